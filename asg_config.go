@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// asgConfigOverride overrides global settings for a single ASG, e.g. to roll stateful node groups more
+// carefully than stateless ones. Settings that are not set are taken from the global configuration.
+type asgConfigOverride struct {
+	BatchSize            *int     `json:"batchSize"`
+	IncreaseMax          *bool    `json:"increaseMax"`
+	Drain                *bool    `json:"drain"`
+	OriginalDesiredOnTag *bool    `json:"originalDesiredOnTag"`
+	TerminationPolicies  []string `json:"terminationPolicies"`
+	NodeWeightAnnotation *string  `json:"nodeWeightAnnotation"`
+}
+
+// parseASGConfig parses the per-ASG overrides, JSON mapping ASG names to their settings, for example
+// {"myasg": {"batchSize": 3, "drain": false}}. Unknown settings are an error, to catch typos.
+func parseASGConfig(config string) (map[string]asgConfigOverride, error) {
+	overrides := map[string]asgConfigOverride{}
+	if config == "" {
+		return overrides, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(config)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&overrides); err != nil {
+		return nil, fmt.Errorf("unable to parse per-ASG configuration: %v", err)
+	}
+	for asg, override := range overrides {
+		if override.BatchSize != nil && *override.BatchSize < 1 {
+			return nil, fmt.Errorf("invalid batch size %d for ASG %s, must be at least 1", *override.BatchSize, asg)
+		}
+	}
+	return overrides, nil
+}
+
+// groupConfigs returns the effective configuration for an ASG: the global configuration, with any
+// overrides for the ASG applied. As with ROLLER_BATCH_SIZE, a batch size sets both the initial surge
+// and the max to terminate at once.
+func groupConfigs(configs Configs, asg string) Configs {
+	override, ok := configs.ASGOverrides[asg]
+	if !ok {
+		return configs
+	}
+	if override.BatchSize != nil {
+		configs.BatchSize = *override.BatchSize
+		configs.InitialSurge = *override.BatchSize
+		configs.MaxTerminate = *override.BatchSize
+	}
+	if override.IncreaseMax != nil {
+		configs.IncreaseMax = *override.IncreaseMax
+	}
+	if override.Drain != nil {
+		configs.Drain = *override.Drain
+	}
+	if override.OriginalDesiredOnTag != nil {
+		configs.OriginalDesiredOnTag = *override.OriginalDesiredOnTag
+	}
+	if override.TerminationPolicies != nil {
+		configs.TerminationPolicies = override.TerminationPolicies
+	}
+	if override.NodeWeightAnnotation != nil {
+		configs.NodeWeightAnnotation = *override.NodeWeightAnnotation
+	}
+	return configs
+}
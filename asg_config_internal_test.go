@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func TestParseASGConfig(t *testing.T) {
+	tests := []struct {
+		desc   string
+		config string
+		asgs   int
+		err    string
+	}{
+		{"empty", "", 0, ""},
+		{"all settings", `{"stateful": {"batchSize": 1, "increaseMax": false, "drain": true, "originalDesiredOnTag": true}}`, 1, ""},
+		{"several ASGs", `{"stateful": {"batchSize": 1}, "stateless": {"batchSize": 5, "drain": false}}`, 2, ""},
+		{"no settings", `{"stateful": {}}`, 1, ""},
+		{"termination policies", `{"stateful": {"terminationPolicies": ["OldestInstance", "Default"]}}`, 1, ""},
+		{"node weight annotation", `{"stateful": {"nodeWeightAnnotation": "example.com/weight"}}`, 1, ""},
+		{"unknown setting", `{"stateful": {"batch": 1}}`, 0, "unable to parse per-ASG configuration"},
+		{"invalid json", `{"stateful": `, 0, "unable to parse per-ASG configuration"},
+		{"wrong type", `{"stateful": {"drain": "no"}}`, 0, "unable to parse per-ASG configuration"},
+		{"invalid batch size", `{"stateful": {"batchSize": 0}}`, 0, "invalid batch size 0 for ASG stateful"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			overrides, err := parseASGConfig(tt.config)
+			switch {
+			case (err == nil && tt.err != "") || (err != nil && tt.err == "") || (err != nil && !strings.HasPrefix(err.Error(), tt.err)):
+				t.Errorf("mismatched errors, actual %v expected %s", err, tt.err)
+			case err == nil && len(overrides) != tt.asgs:
+				t.Errorf("mismatched number of ASGs, actual %d expected %d", len(overrides), tt.asgs)
+			}
+		})
+	}
+}
+
+func TestGroupConfigs(t *testing.T) {
+	overrides, err := parseASGConfig(`{"stateful": {"batchSize": 1, "increaseMax": false, "drain": true, "originalDesiredOnTag": true}, "stateless": {"batchSize": 5, "drain": false}}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	global := Configs{
+		BatchSize:            2,
+		InitialSurge:         2,
+		MaxTerminate:         2,
+		IncreaseMax:          true,
+		Drain:                true,
+		OriginalDesiredOnTag: false,
+		ASGOverrides:         overrides,
+	}
+	tests := []struct {
+		asg                  string
+		batchSize            int
+		increaseMax          bool
+		drain                bool
+		originalDesiredOnTag bool
+	}{
+		{"stateful", 1, false, true, true},
+		{"stateless", 5, true, false, false},
+		// not in the overrides, so the global settings apply
+		{"other", 2, true, true, false},
+	}
+	for _, tt := range tests {
+		configs := groupConfigs(global, tt.asg)
+		switch {
+		case configs.BatchSize != tt.batchSize || configs.InitialSurge != tt.batchSize || configs.MaxTerminate != tt.batchSize:
+			t.Errorf("%s: mismatched batch size, actual %d, initial surge %d, max terminate %d, expected %d", tt.asg, configs.BatchSize, configs.InitialSurge, configs.MaxTerminate, tt.batchSize)
+		case configs.IncreaseMax != tt.increaseMax:
+			t.Errorf("%s: mismatched increase max, actual %v expected %v", tt.asg, configs.IncreaseMax, tt.increaseMax)
+		case configs.Drain != tt.drain:
+			t.Errorf("%s: mismatched drain, actual %v expected %v", tt.asg, configs.Drain, tt.drain)
+		case configs.OriginalDesiredOnTag != tt.originalDesiredOnTag:
+			t.Errorf("%s: mismatched original desired on tag, actual %v expected %v", tt.asg, configs.OriginalDesiredOnTag, tt.originalDesiredOnTag)
+		}
+	}
+	// the global configuration is left as it is
+	if global.BatchSize != 2 || !global.IncreaseMax || !global.Drain {
+		t.Errorf("global configuration changed to %+v", global)
+	}
+}
+
+func TestAdjustASGConfig(t *testing.T) {
+	overrides, err := parseASGConfig(`{"stateless": {"batchSize": 3}, "stateful": {"increaseMax": false}, "deleted": {"batchSize": 2}}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// every group is at its max size, with old instances to roll
+	lcName := "lconfig"
+	oldLcName := "oldlconfig"
+	myHealthy := healthy
+	groups := map[string]*autoscaling.Group{}
+	names := []string{"stateless", "stateful", "other"}
+	for _, n := range names {
+		name := n
+		instances := make([]*autoscaling.Instance, 0)
+		for i := 0; i < 3; i++ {
+			instances = append(instances, &autoscaling.Instance{InstanceId: aws.String(fmt.Sprintf("%s-%d", name, i)), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy})
+		}
+		groups[name] = &autoscaling.Group{
+			AutoScalingGroupName:    &name,
+			DesiredCapacity:         aws.Int64(3),
+			MaxSize:                 aws.Int64(3),
+			LaunchConfigurationName: &lcName,
+			Instances:               instances,
+		}
+	}
+	asgSvc := &mockAsgSvc{groups: groups}
+	state := newRollerState()
+	state.originalDesired = map[string]int64{"stateless": 3, "stateful": 3, "other": 3}
+	configs := Configs{
+		KubernetesEnabled: kubernetesEnabled,
+		ASGS:              names,
+		BatchSize:         1,
+		InitialSurge:      1,
+		MaxTerminate:      1,
+		MaxSurge:          -1,
+		MaxUnavailable:    1,
+		IncreaseMax:       true,
+		ASGOverrides:      overrides,
+	}
+	if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	setDesired := map[string]int64{}
+	for _, c := range asgSvc.counter.filterByName("SetDesiredCapacity") {
+		input := c.params[0].(*autoscaling.SetDesiredCapacityInput)
+		setDesired[*input.AutoScalingGroupName] = *input.DesiredCapacity
+	}
+	updatedMax := map[string]int64{}
+	for _, c := range asgSvc.counter.filterByName("UpdateAutoScalingGroup") {
+		input := c.params[0].(*autoscaling.UpdateAutoScalingGroupInput)
+		updatedMax[*input.AutoScalingGroupName] = *input.MaxSize
+	}
+	terminated := make([]string, 0)
+	for _, c := range asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup") {
+		terminated = append(terminated, *c.params[0].(*autoscaling.TerminateInstanceInAutoScalingGroupInput).InstanceId)
+	}
+	// the stateless group surges by its batch size, the stateful group cannot go above its max size, so
+	// replaces an instance without surging, and the other group has the global settings
+	expectedDesired := map[string]int64{"stateless": 6, "other": 4}
+	if fmt.Sprint(setDesired) != fmt.Sprint(expectedDesired) {
+		t.Errorf("mismatched desired counts, actual %v expected %v", setDesired, expectedDesired)
+	}
+	if fmt.Sprint(updatedMax) != fmt.Sprint(expectedDesired) {
+		t.Errorf("mismatched max sizes, actual %v expected %v", updatedMax, expectedDesired)
+	}
+	if !testStringEq(terminated, []string{"stateful-0"}) {
+		t.Errorf("mismatched terminated instances, actual %v expected %v", terminated, []string{"stateful-0"})
+	}
+}
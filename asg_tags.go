@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// parseASGTags parses the tags to discover ASGs by, each of the form key=value
+func parseASGTags(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	tags := map[string]string{}
+	for _, pair := range pairs {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid tag '%s', must be of the form key=value", pair)
+		}
+		tags[parts[0]] = parts[1]
+	}
+	return tags, nil
+}
+
+// awsDiscoverGroups returns the ASGs that have all of the tags, with the values given, and whose names match
+// the pattern, if any
+func awsDiscoverGroups(svc asgClient, tags map[string]string, pattern *regexp.Regexp) ([]*autoscaling.Group, error) {
+	groups := make([]*autoscaling.Group, 0)
+	input := &autoscaling.DescribeAutoScalingGroupsInput{}
+	for {
+		result, err := svc.DescribeAutoScalingGroups(input)
+		if err != nil {
+			return nil, fmt.Errorf("unable to describe ASGs to discover: %v", err)
+		}
+		for _, group := range result.AutoScalingGroups {
+			if pattern != nil && !pattern.MatchString(aws.StringValue(group.AutoScalingGroupName)) {
+				continue
+			}
+			if groupHasTags(group, tags) {
+				groups = append(groups, group)
+			}
+		}
+		if aws.StringValue(result.NextToken) == "" {
+			return groups, nil
+		}
+		input.NextToken = result.NextToken
+	}
+}
+
+// groupHasTags returns whether the ASG has all of the tags, with the values given
+func groupHasTags(group *autoscaling.Group, tags map[string]string) bool {
+	found := 0
+	for _, tag := range group.Tags {
+		if value, ok := tags[aws.StringValue(tag.Key)]; ok && value == aws.StringValue(tag.Value) {
+			found++
+		}
+	}
+	return found == len(tags)
+}
+
+// describeConfiguredGroups describes the ASGs named in the configs, along with any discovered by tag and
+// name pattern, each only once
+func describeConfiguredGroups(svc asgClient, configs Configs) ([]*autoscaling.Group, error) {
+	asgs := make([]*autoscaling.Group, 0)
+	if len(configs.ASGS) > 0 {
+		named, err := awsDescribeGroups(svc, configs.ASGS)
+		if err != nil {
+			return nil, err
+		}
+		asgs = append(asgs, named...)
+	}
+	if len(configs.ASGTagFilters) == 0 && configs.ASGNamePattern == nil {
+		return asgs, nil
+	}
+	discovered, err := awsDiscoverGroups(svc, configs.ASGTagFilters, configs.ASGNamePattern)
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	for _, asg := range asgs {
+		known[aws.StringValue(asg.AutoScalingGroupName)] = true
+	}
+	for _, asg := range discovered {
+		if !known[aws.StringValue(asg.AutoScalingGroupName)] {
+			asgs = append(asgs, asg)
+		}
+	}
+	return asgs, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func TestParseASGTags(t *testing.T) {
+	tests := []struct {
+		pairs []string
+		tags  map[string]string
+		err   bool
+	}{
+		{nil, nil, false},
+		{[]string{"team=web"}, map[string]string{"team": "web"}, false},
+		{[]string{"team=web", " env=prod"}, map[string]string{"team": "web", "env": "prod"}, false},
+		{[]string{"k8s.io/cluster-autoscaler/enabled=true"}, map[string]string{"k8s.io/cluster-autoscaler/enabled": "true"}, false},
+		{[]string{"empty="}, map[string]string{"empty": ""}, false},
+		{[]string{"team"}, nil, true},
+		{[]string{"=web"}, nil, true},
+	}
+	for i, tt := range tests {
+		tags, err := parseASGTags(tt.pairs)
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("%d: expected error, had none", i)
+		case !tt.err && err != nil:
+			t.Errorf("%d: unexpected error: %v", i, err)
+		case !reflect.DeepEqual(tags, tt.tags):
+			t.Errorf("%d: mismatched tags, actual %v expected %v", i, tags, tt.tags)
+		}
+	}
+}
+
+func TestDescribeConfiguredGroups(t *testing.T) {
+	tag := func(key, value string) *autoscaling.TagDescription {
+		return &autoscaling.TagDescription{Key: aws.String(key), Value: aws.String(value)}
+	}
+	asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+		"web-a":            {AutoScalingGroupName: aws.String("web-a"), Tags: []*autoscaling.TagDescription{tag("team", "web"), tag("env", "prod")}},
+		"web-b":            {AutoScalingGroupName: aws.String("web-b"), Tags: []*autoscaling.TagDescription{tag("env", "prod"), tag("team", "web")}},
+		"web-dev":          {AutoScalingGroupName: aws.String("web-dev"), Tags: []*autoscaling.TagDescription{tag("team", "web"), tag("env", "dev")}},
+		"db":               {AutoScalingGroupName: aws.String("db"), Tags: []*autoscaling.TagDescription{tag("team", "db"), tag("env", "prod")}},
+		"untagged":         {AutoScalingGroupName: aws.String("untagged")},
+		"prod-a-workers":   {AutoScalingGroupName: aws.String("prod-a-workers")},
+		"prod-b-workers":   {AutoScalingGroupName: aws.String("prod-b-workers"), Tags: []*autoscaling.TagDescription{tag("team", "web")}},
+		"prod-a-masters":   {AutoScalingGroupName: aws.String("prod-a-masters")},
+		"dev-prod-workers": {AutoScalingGroupName: aws.String("dev-prod-workers")},
+	}}
+	tests := []struct {
+		desc    string
+		names   []string
+		tags    map[string]string
+		pattern string
+		asgs    []string
+	}{
+		{"names only", []string{"db"}, nil, "", []string{"db"}},
+		{"one tag", nil, map[string]string{"team": "web"}, "", []string{"prod-b-workers", "web-a", "web-b", "web-dev"}},
+		{"all tags must match", nil, map[string]string{"team": "web", "env": "prod"}, "", []string{"web-a", "web-b"}},
+		{"no match", nil, map[string]string{"team": "mobile"}, "", []string{}},
+		{"names and tags", []string{"db", "web-a"}, map[string]string{"team": "web", "env": "prod"}, "", []string{"db", "web-a", "web-b"}},
+		{"pattern", nil, nil, "^prod-.*-workers$", []string{"prod-a-workers", "prod-b-workers"}},
+		{"unanchored pattern", nil, nil, "prod", []string{"dev-prod-workers", "prod-a-masters", "prod-a-workers", "prod-b-workers"}},
+		{"pattern and tags", nil, map[string]string{"team": "web"}, "^prod-.*-workers$", []string{"prod-b-workers"}},
+		{"names and pattern", []string{"db"}, nil, "^web-[ab]$", []string{"db", "web-a", "web-b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			configs := Configs{ASGS: tt.names, ASGTagFilters: tt.tags}
+			if tt.pattern != "" {
+				configs.ASGNamePattern = regexp.MustCompile(tt.pattern)
+			}
+			asgs, err := describeConfiguredGroups(asgSvc, configs)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			names := make([]string, 0)
+			for _, asg := range asgs {
+				names = append(names, *asg.AutoScalingGroupName)
+			}
+			if !testStringEq(names, tt.asgs) {
+				t.Errorf("mismatched ASGs, actual %v expected %v", names, tt.asgs)
+			}
+		})
+	}
+}
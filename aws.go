@@ -1,21 +1,39 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/appconfig"
+	"github.com/aws/aws-sdk-go/service/appconfig/appconfigiface"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
-	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/ec2"
-	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/servicequotas"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"log"
+	"time"
 )
 
-func setAsgDesired(svc autoscalingiface.AutoScalingAPI, asg *autoscaling.Group, count int64, canIncreaseMax, verbose bool) error {
+const ec2TagNameTerminatedBy = "aws-asg-roller/terminated-by"
+
+func setAsgDesired(svc asgClient, asg *autoscaling.Group, count int64, canIncreaseMax, dryRun, verbose bool) error {
 	if count > *asg.MaxSize {
 		if canIncreaseMax {
-			err := setAsgMax(svc, asg, count, verbose)
+			err := setAsgMax(svc, asg, count, dryRun, verbose)
 			if err != nil {
 				return err
 			}
@@ -23,6 +41,10 @@ func setAsgDesired(svc autoscalingiface.AutoScalingAPI, asg *autoscaling.Group,
 			return fmt.Errorf("unable to increase ASG %s desired size to %d as greater than max size %d", *asg.AutoScalingGroupName, count, *asg.MaxSize)
 		}
 	}
+	if dryRun {
+		log.Printf("dry run: would set ASG %s desired count to %d", *asg.AutoScalingGroupName, count)
+		return nil
+	}
 	if verbose {
 		log.Printf("increasing ASG %s desired count to %d", *asg.AutoScalingGroupName, count)
 	}
@@ -53,7 +75,11 @@ func setAsgDesired(svc autoscalingiface.AutoScalingAPI, asg *autoscaling.Group,
 	return nil
 }
 
-func setAsgMax(svc autoscalingiface.AutoScalingAPI, asg *autoscaling.Group, count int64, verbose bool) error {
+func setAsgMax(svc asgClient, asg *autoscaling.Group, count int64, dryRun, verbose bool) error {
+	if dryRun {
+		log.Printf("dry run: would set ASG %s max size to %d", *asg.AutoScalingGroupName, count)
+		return nil
+	}
 	if verbose {
 		log.Printf("increasing ASG %s max size to %d to accommodate desired count", *asg.AutoScalingGroupName, count)
 	}
@@ -65,6 +91,8 @@ func setAsgMax(svc autoscalingiface.AutoScalingAPI, asg *autoscaling.Group, coun
 		errMsg := fmt.Sprintf("unable to increase ASG %s max size to %d", *asg.AutoScalingGroupName, count)
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
+			case autoscaling.ErrCodeLimitExceededFault:
+				return &maxSizeLimitError{asg: *asg.AutoScalingGroupName, max: count, err: aerr}
 			case autoscaling.ErrCodeScalingActivityInProgressFault:
 				return fmt.Errorf("%s - %s %v", errMsg, autoscaling.ErrCodeScalingActivityInProgressFault, aerr.Error())
 			case autoscaling.ErrCodeResourceContentionFault:
@@ -82,17 +110,14 @@ func setAsgMax(svc autoscalingiface.AutoScalingAPI, asg *autoscaling.Group, coun
 	return nil
 }
 
-func awsGetHostname(svc ec2iface.EC2API, id string) (string, error) {
-	hostnames, err := awsGetHostnames(svc, []string{id})
+func awsGetHostname(svc ec2Client, id string) (string, error) {
+	hostnames, err := awsGetHostnames(svc, []string{id}, "")
 	if err != nil {
 		return "", err
 	}
-	if len(hostnames) < 1 {
-		return "", err
-	}
-	return hostnames[0], nil
+	return hostnames[id], nil
 }
-func awsGetLaunchTemplateByID(svc ec2iface.EC2API, id string) (*ec2.LaunchTemplate, error) {
+func awsGetLaunchTemplateByID(svc ec2Client, id string) (*ec2.LaunchTemplate, error) {
 	input := &ec2.DescribeLaunchTemplatesInput{
 		LaunchTemplateIds: []*string{
 			aws.String(id),
@@ -100,7 +125,7 @@ func awsGetLaunchTemplateByID(svc ec2iface.EC2API, id string) (*ec2.LaunchTempla
 	}
 	return awsGetLaunchTemplate(svc, input)
 }
-func awsGetLaunchTemplateByName(svc ec2iface.EC2API, name string) (*ec2.LaunchTemplate, error) {
+func awsGetLaunchTemplateByName(svc ec2Client, name string) (*ec2.LaunchTemplate, error) {
 	input := &ec2.DescribeLaunchTemplatesInput{
 		LaunchTemplateNames: []*string{
 			aws.String(name),
@@ -108,7 +133,7 @@ func awsGetLaunchTemplateByName(svc ec2iface.EC2API, name string) (*ec2.LaunchTe
 	}
 	return awsGetLaunchTemplate(svc, input)
 }
-func awsGetLaunchTemplate(svc ec2iface.EC2API, input *ec2.DescribeLaunchTemplatesInput) (*ec2.LaunchTemplate, error) {
+func awsGetLaunchTemplate(svc ec2Client, input *ec2.DescribeLaunchTemplatesInput) (*ec2.LaunchTemplate, error) {
 	templatesOutput, err := svc.DescribeLaunchTemplates(input)
 	descriptiveMsg := fmt.Sprintf("%v / %v", input.LaunchTemplateIds, input.LaunchTemplateNames)
 	if err != nil {
@@ -119,30 +144,128 @@ func awsGetLaunchTemplate(svc ec2iface.EC2API, input *ec2.DescribeLaunchTemplate
 	}
 	return templatesOutput.LaunchTemplates[0], nil
 }
-func awsGetHostnames(svc ec2iface.EC2API, ids []string) ([]string, error) {
+func awsGetLaunchConfiguration(svc asgClient, name string) (*autoscaling.LaunchConfiguration, error) {
+	input := &autoscaling.DescribeLaunchConfigurationsInput{
+		LaunchConfigurationNames: aws.StringSlice([]string{name}),
+	}
+	lcOutput, err := svc.DescribeLaunchConfigurations(input)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get description for Launch Configuration %s: %v", name, err)
+	}
+	if len(lcOutput.LaunchConfigurations) < 1 {
+		return nil, nil
+	}
+	return lcOutput.LaunchConfigurations[0], nil
+}
+
+// awsGetInstanceContentHashes gets the hash of the contents - AMI, instance type and user data - that each
+// instance was launched with, as calculated by contentHash, so that it can be compared to that of a
+// launch configuration
+func awsGetInstanceContentHashes(svc ec2Client, ids []string) (map[string]string, error) {
+	hashes := map[string]string{}
 	if len(ids) == 0 {
-		return []string{}, nil
+		return hashes, nil
 	}
-	ec2input := &ec2.DescribeInstancesInput{
+	nodesResult, err := svc.DescribeInstances(&ec2.DescribeInstancesInput{
 		InstanceIds: aws.StringSlice(ids),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get description for node %v: %v", ids, err)
+	}
+	for _, r := range nodesResult.Reservations {
+		for _, i := range r.Instances {
+			// user data is only available one instance at a time
+			attr, err := svc.DescribeInstanceAttribute(&ec2.DescribeInstanceAttributeInput{
+				Attribute:  aws.String(ec2.InstanceAttributeNameUserData),
+				InstanceId: i.InstanceId,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("Unable to get user data for node %v: %v", p2v(i.InstanceId), err)
+			}
+			var userData string
+			if attr.UserData != nil {
+				userData = aws.StringValue(attr.UserData.Value)
+			}
+			hashes[*i.InstanceId] = contentHash(aws.StringValue(i.ImageId), aws.StringValue(i.InstanceType), userData)
+		}
+	}
+	return hashes, nil
+}
+
+// awsGetHostnames returns the hostname of each of the instances, by instance ID, as for instanceHostnames
+func awsGetHostnames(svc ec2Client, ids []string, nameTag string) (map[string]string, error) {
+	described, err := awsDescribeInstances(svc, ids, 1)
+	if err != nil {
+		return nil, err
+	}
+	return instanceHostnames(described, nameTag), nil
+}
+
+// describeInstancesBatchSize is how many instances are described in a single call, or set of pages
+const describeInstancesBatchSize = 100
+
+// awsDescribeInstances returns the description of each of the instances, by instance ID. The instances are
+// described in batches, up to concurrency batches at the same time, paging through the descriptions of
+// each batch, which for many instances do not all come in a single response.
+func awsDescribeInstances(svc ec2Client, ids []string, concurrency int) (map[string]*ec2.Instance, error) {
+	described := map[string]*ec2.Instance{}
+	if len(ids) == 0 {
+		return described, nil
+	}
+	batches := make([][]string, 0)
+	for start := 0; start < len(ids); start += describeInstancesBatchSize {
+		end := start + describeInstancesBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batches = append(batches, ids[start:end])
 	}
-	nodesResult, err := svc.DescribeInstances(ec2input)
+	// each batch has its own results, so that they can be merged once all are described
+	results := make([][]*ec2.Instance, len(batches))
+	err := runConcurrently(len(batches), concurrency, func(b int) error {
+		ec2input := &ec2.DescribeInstancesInput{
+			InstanceIds: aws.StringSlice(batches[b]),
+		}
+		return svc.DescribeInstancesPages(ec2input, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+			for _, i := range page.Reservations {
+				results[b] = append(results[b], i.Instances...)
+			}
+			return true
+		})
+	})
 	if err != nil {
 		return nil, fmt.Errorf("Unable to get description for node %v: %v", ids, err)
 	}
-	if len(nodesResult.Reservations) < 1 {
+	for _, instances := range results {
+		for _, i := range instances {
+			described[aws.StringValue(i.InstanceId)] = i
+		}
+	}
+	if len(described) < 1 {
 		return nil, fmt.Errorf("Did not get any reservations for node %v", ids)
 	}
-	hostnames := make([]string, 0)
-	for _, i := range nodesResult.Reservations {
-		for _, j := range i.Instances {
-			hostnames = append(hostnames, *j.PrivateDnsName)
+	return described, nil
+}
+
+// instanceHostnames returns the hostname of each of the described instances, by instance ID. The hostname is
+// the value of the nameTag tag of the instance, if set and the instance has it, else its private DNS name.
+func instanceHostnames(described map[string]*ec2.Instance, nameTag string) map[string]string {
+	hostnames := map[string]string{}
+	for id, i := range described {
+		hostnames[id] = aws.StringValue(i.PrivateDnsName)
+		if nameTag == "" {
+			continue
+		}
+		for _, tag := range i.Tags {
+			if aws.StringValue(tag.Key) == nameTag && aws.StringValue(tag.Value) != "" {
+				hostnames[id] = aws.StringValue(tag.Value)
+			}
 		}
 	}
-	return hostnames, nil
+	return hostnames
 }
 
-func awsDescribeGroups(svc autoscalingiface.AutoScalingAPI, names []string) ([]*autoscaling.Group, error) {
+func awsDescribeGroups(svc asgClient, names []string) ([]*autoscaling.Group, error) {
 	input := &autoscaling.DescribeAutoScalingGroupsInput{
 		AutoScalingGroupNames: aws.StringSlice(names),
 	}
@@ -166,7 +289,11 @@ func awsDescribeGroups(svc autoscalingiface.AutoScalingAPI, names []string) ([]*
 	return result.AutoScalingGroups, nil
 }
 
-func awsTerminateNode(svc autoscalingiface.AutoScalingAPI, id string) error {
+func awsTerminateNode(svc asgClient, id string, dryRun bool) error {
+	if dryRun {
+		log.Printf("dry run: would terminate instance %s", id)
+		return nil
+	}
 	input := &autoscaling.TerminateInstanceInAutoScalingGroupInput{
 		InstanceId:                     aws.String(id),
 		ShouldDecrementDesiredCapacity: aws.Bool(false),
@@ -192,12 +319,190 @@ func awsTerminateNode(svc autoscalingiface.AutoScalingAPI, id string) error {
 	return nil
 }
 
-func awsGetServices() (ec2iface.EC2API, autoscalingiface.AutoScalingAPI, error) {
-	sess, err := session.NewSession()
+// awsBackOutInstance terminates an instance via the ASG and lowers the desired count of the ASG to match,
+// so that it is not replaced
+func awsBackOutInstance(svc asgClient, id string, dryRun bool) error {
+	if dryRun {
+		log.Printf("dry run: would terminate instance %s and decrement desired count", id)
+		return nil
+	}
+	input := &autoscaling.TerminateInstanceInAutoScalingGroupInput{
+		InstanceId:                     aws.String(id),
+		ShouldDecrementDesiredCapacity: aws.Bool(true),
+	}
+
+	_, err := svc.TerminateInstanceInAutoScalingGroup(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case autoscaling.ErrCodeScalingActivityInProgressFault:
+				return fmt.Errorf("Could not back out instance, autoscaling already in progress, will try next loop")
+			case autoscaling.ErrCodeResourceContentionFault:
+				return fmt.Errorf("Could not back out instance, instance in contention, will try next loop")
+			default:
+				return fmt.Errorf("Unknown aws error when backing out instance: %v", aerr.Error())
+			}
+		}
+		return fmt.Errorf("Unknown non-aws error when backing out instance: %v", err.Error())
+	}
+	return nil
+}
+
+// awsTerminateInstances terminates instances directly via EC2, rather than via the ASG, which allows many
+// instances to be terminated in a single call. The ASG sees them terminate and replaces them, without
+// changing its desired count.
+func awsTerminateInstances(svc ec2Client, ids []string) error {
+	input := &ec2.TerminateInstancesInput{
+		InstanceIds: aws.StringSlice(ids),
+	}
+
+	_, err := svc.TerminateInstances(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			return fmt.Errorf("Unknown aws error when terminating old instances: %v", aerr.Error())
+		}
+		return fmt.Errorf("Unknown non-aws error when terminating old instances: %v", err.Error())
+	}
+	return nil
+}
+
+// awsTagTerminated tags instances that are about to be terminated with the time they were terminated by the
+// roller, so that the termination can be traced back to the roller, e.g. in CloudTrail
+func awsTagTerminated(svc ec2Client, ids []string, when time.Time) error {
+	input := &ec2.CreateTagsInput{
+		Resources: aws.StringSlice(ids),
+		Tags: []*ec2.Tag{
+			{
+				Key:   aws.String(ec2TagNameTerminatedBy),
+				Value: aws.String(fmt.Sprintf("aws-asg-roller at %s", when.UTC().Format(time.RFC3339))),
+			},
+		},
+	}
+
+	_, err := svc.CreateTags(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			return fmt.Errorf("Unknown aws error when tagging old instances: %v", aerr.Error())
+		}
+		return fmt.Errorf("Unknown non-aws error when tagging old instances: %v", err.Error())
+	}
+	return nil
+}
+
+// awsUploadRollReport uploads the report of a completed roll to S3 as JSON
+func awsUploadRollReport(svc s3iface.S3API, bucket, key string, report rollReport) error {
+	body, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Unable to create roll report: %v", err)
+	}
+	_, err = svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			return fmt.Errorf("Unknown aws error when uploading roll report: %v", aerr.Error())
+		}
+		return fmt.Errorf("Unknown non-aws error when uploading roll report: %v", err.Error())
+	}
+	return nil
+}
+
+// awsConfig returns the configuration for AWS sessions. An empty region or endpoint leaves it to the SDK
+// to find the region, as from AWS_REGION, and the endpoint for it. A custom endpoint, such as for
+// localstack, is used for every service, so S3 buckets are addressed by path rather than by host.
+func awsConfig(region, endpoint string) *aws.Config {
+	config := aws.NewConfig()
+	if region != "" {
+		config = config.WithRegion(region)
+	}
+	if endpoint != "" {
+		config = config.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+	}
+	return config
+}
+
+// awsNewSession creates an AWS session with the given region and endpoint. If a role ARN is given, the
+// session uses temporary credentials for that role, assumed via STS with the credentials otherwise
+// available, and assumed again shortly before they expire, so that long-running loops keep working.
+func awsNewSession(region, endpoint, roleARN, externalID string) (*session.Session, error) {
+	config := awsConfig(region, endpoint)
+	sess, err := session.NewSession(config)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	if roleARN == "" {
+		return sess, nil
+	}
+	creds := stscreds.NewCredentials(sess, roleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = "aws-asg-roller"
+		p.ExpiryWindow = time.Minute
+		if externalID != "" {
+			p.ExternalID = aws.String(externalID)
+		}
+	})
+	return session.NewSession(config.Copy().WithCredentials(creds))
+}
+
+func awsGetServices(region, endpoint, roleARN, externalID string) (ec2Client, asgClient, s3iface.S3API, sqsiface.SQSAPI, cloudwatchiface.CloudWatchAPI, error) {
+	sess, err := awsNewSession(region, endpoint, roleARN, externalID)
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
 	}
 	asgSvc := autoscaling.New(sess)
 	ec2svc := ec2.New(sess)
-	return ec2svc, asgSvc, nil
+	s3Svc := s3.New(sess)
+	sqsSvc := sqs.New(sess)
+	cloudWatchSvc := cloudwatch.New(sess)
+	return ec2svc, asgSvc, s3Svc, sqsSvc, cloudWatchSvc, nil
+}
+
+func awsGetLoadBalancerHealth(region, endpoint, roleARN, externalID string) (loadBalancerHealth, error) {
+	sess, err := awsNewSession(region, endpoint, roleARN, externalID)
+	if err != nil {
+		return nil, err
+	}
+	return &awsLoadBalancerHealth{elbSvc: elb.New(sess), elbv2Svc: elbv2.New(sess)}, nil
+}
+
+func awsGetAppConfigService(region, endpoint, roleARN, externalID string) (appconfigiface.AppConfigAPI, error) {
+	sess, err := awsNewSession(region, endpoint, roleARN, externalID)
+	if err != nil {
+		return nil, err
+	}
+	return appconfig.New(sess), nil
+}
+
+func awsGetSSMService(region, endpoint, roleARN, externalID string) (ssmClient, error) {
+	sess, err := awsNewSession(region, endpoint, roleARN, externalID)
+	if err != nil {
+		return nil, err
+	}
+	return ssm.New(sess), nil
+}
+
+func awsGetDynamoDBService(region, endpoint, roleARN, externalID string) (dynamoClient, error) {
+	sess, err := awsNewSession(region, endpoint, roleARN, externalID)
+	if err != nil {
+		return nil, err
+	}
+	return dynamodb.New(sess), nil
+}
+
+func awsGetCapacityQuota(ec2Svc ec2Client, region, endpoint, roleARN, externalID string) (capacityQuota, error) {
+	sess, err := awsNewSession(region, endpoint, roleARN, externalID)
+	if err != nil {
+		return nil, err
+	}
+	return &awsCapacityQuota{quotasSvc: servicequotas.New(sess), ec2Svc: ec2Svc}, nil
+}
+
+func awsGetSTSService(region, endpoint, roleARN, externalID string) (stsClient, error) {
+	sess, err := awsNewSession(region, endpoint, roleARN, externalID)
+	if err != nil {
+		return nil, err
+	}
+	return sts.New(sess), nil
 }
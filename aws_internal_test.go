@@ -1,9 +1,19 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -11,6 +21,8 @@ import (
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 )
 
 func testASGEq(a, b []*autoscaling.Group) bool {
@@ -53,12 +65,30 @@ var validLaunchTemplates = map[string]*ec2.LaunchTemplate{
 		LatestVersionNumber:  aws.Int64(40),
 		DefaultVersionNumber: aws.Int64(30),
 	},
+	"lt3": {
+		LaunchTemplateId:     aws.String("lt-0003"),
+		LaunchTemplateName:   aws.String("lt3"),
+		LatestVersionNumber:  aws.Int64(7),
+		DefaultVersionNumber: aws.Int64(5),
+	},
+	// freshly created, described without version numbers
+	"lt4": {
+		LaunchTemplateName: aws.String("lt4"),
+	},
 }
 
 type mockEc2Svc struct {
 	ec2iface.EC2API
 	autodescribe bool
+	err          error
 	counter      funcCounter
+	// instances to describe, by ID, and their user data
+	instances map[string]*ec2.Instance
+	userData  map[string]string
+	// AMI ID of each launch template version, by version
+	templateImages map[string]string
+	// number of each launch template version, by version, e.g. `$Latest`
+	templateVersions map[string]int64
 }
 
 func (m *mockEc2Svc) DescribeInstances(in *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
@@ -69,6 +99,10 @@ func (m *mockEc2Svc) DescribeInstances(in *ec2.DescribeInstancesInput) (*ec2.Des
 	}
 	instances := make([]*ec2.Instance, 0)
 	for _, i := range in.InstanceIds {
+		if instance, ok := m.instances[*i]; ok {
+			instances = append(instances, instance)
+			continue
+		}
 		if name, ok := hostMap[*i]; ok {
 			instances = append(instances, &ec2.Instance{
 				InstanceId:     i,
@@ -96,6 +130,25 @@ func (m *mockEc2Svc) DescribeInstances(in *ec2.DescribeInstancesInput) (*ec2.Des
 	return ret, nil
 }
 
+// DescribeInstancesPages returns each instance on a page of its own, to exercise paging
+func (m *mockEc2Svc) DescribeInstancesPages(in *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool) error {
+	m.counter.add("DescribeInstancesPages", in)
+	out, err := m.DescribeInstances(in)
+	if err != nil {
+		return err
+	}
+	instances := out.Reservations[0].Instances
+	for i, instance := range instances {
+		page := &ec2.DescribeInstancesOutput{
+			Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{instance}}},
+		}
+		if !fn(page, i == len(instances)-1) {
+			break
+		}
+	}
+	return nil
+}
+
 func (m *mockEc2Svc) DescribeLaunchTemplates(in *ec2.DescribeLaunchTemplatesInput) (*ec2.DescribeLaunchTemplatesOutput, error) {
 	m.counter.add("DescribeLaunchTemplates:", in)
 	templates := make([]*ec2.LaunchTemplate, 0)
@@ -119,11 +172,89 @@ func (m *mockEc2Svc) DescribeLaunchTemplates(in *ec2.DescribeLaunchTemplatesInpu
 	return ret, nil
 }
 
-type mockAsgSvc struct {
-	autoscalingiface.AutoScalingAPI
+func (m *mockEc2Svc) DescribeLaunchTemplateVersions(in *ec2.DescribeLaunchTemplateVersionsInput) (*ec2.DescribeLaunchTemplateVersionsOutput, error) {
+	m.counter.add("DescribeLaunchTemplateVersions", in)
+	versions := make([]*ec2.LaunchTemplateVersion, 0)
+	for _, v := range in.Versions {
+		if image, ok := m.templateImages[*v]; ok {
+			versions = append(versions, &ec2.LaunchTemplateVersion{
+				LaunchTemplateId:   in.LaunchTemplateId,
+				LaunchTemplateName: in.LaunchTemplateName,
+				LaunchTemplateData: &ec2.ResponseLaunchTemplateData{ImageId: aws.String(image)},
+			})
+		}
+		if number, ok := m.templateVersions[*v]; ok {
+			versions = append(versions, &ec2.LaunchTemplateVersion{
+				LaunchTemplateId:   in.LaunchTemplateId,
+				LaunchTemplateName: in.LaunchTemplateName,
+				VersionNumber:      aws.Int64(number),
+				DefaultVersion:     aws.Bool(*v == "$Default"),
+			})
+		}
+	}
+	return &ec2.DescribeLaunchTemplateVersionsOutput{LaunchTemplateVersions: versions}, m.err
+}
+
+func (m *mockEc2Svc) TerminateInstances(in *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+	m.counter.add("TerminateInstances", in)
+	return &ec2.TerminateInstancesOutput{}, m.err
+}
+
+func (m *mockEc2Svc) DescribeInstanceAttribute(in *ec2.DescribeInstanceAttributeInput) (*ec2.DescribeInstanceAttributeOutput, error) {
+	m.counter.add("DescribeInstanceAttribute", in)
+	return &ec2.DescribeInstanceAttributeOutput{
+		InstanceId: in.InstanceId,
+		UserData:   &ec2.AttributeValue{Value: aws.String(m.userData[*in.InstanceId])},
+	}, m.err
+}
+
+func (m *mockEc2Svc) CreateTags(in *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	m.counter.add("CreateTags", in)
+	return &ec2.CreateTagsOutput{}, m.err
+}
+
+type mockS3Svc struct {
+	s3iface.S3API
 	err     error
 	counter funcCounter
-	groups  map[string]*autoscaling.Group
+	// body of each object put, by key
+	objects map[string][]byte
+}
+
+func (m *mockS3Svc) PutObject(in *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	m.counter.add("PutObject", in)
+	if m.err != nil {
+		return nil, m.err
+	}
+	body, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	if m.objects == nil {
+		m.objects = map[string][]byte{}
+	}
+	m.objects[*in.Key] = body
+	return &s3.PutObjectOutput{}, nil
+}
+
+type mockAsgSvc struct {
+	autoscalingiface.AutoScalingAPI
+	err                  error
+	counter              funcCounter
+	groups               map[string]*autoscaling.Group
+	launchConfigurations map[string]*autoscaling.LaunchConfiguration
+	lifecycleHooks       []*autoscaling.LifecycleHook
+	// errors returned by successive calls to CreateOrUpdateTags, before err
+	tagErrs []error
+	// error returned by UpdateAutoScalingGroup, if set, rather than err
+	updateErr error
+	// scaling activities of each group, by name
+	activities map[string][]*autoscaling.Activity
+	// instance refreshes of each group, newest first, by name
+	instanceRefreshes map[string][]*autoscaling.InstanceRefresh
+	// instances in the warm pool of each group, by name, described in pages of warmPoolPageSize, if set
+	warmPools        map[string][]*autoscaling.Instance
+	warmPoolPageSize int
 }
 
 func (m *mockAsgSvc) TerminateInstanceInAutoScalingGroup(in *autoscaling.TerminateInstanceInAutoScalingGroupInput) (*autoscaling.TerminateInstanceInAutoScalingGroupOutput, error) {
@@ -131,9 +262,59 @@ func (m *mockAsgSvc) TerminateInstanceInAutoScalingGroup(in *autoscaling.Termina
 	ret := &autoscaling.TerminateInstanceInAutoScalingGroupOutput{}
 	return ret, m.err
 }
+func (m *mockAsgSvc) ExitStandby(in *autoscaling.ExitStandbyInput) (*autoscaling.ExitStandbyOutput, error) {
+	m.counter.add("ExitStandby", in)
+	return &autoscaling.ExitStandbyOutput{}, m.err
+}
+func (m *mockAsgSvc) DescribeLifecycleHooks(in *autoscaling.DescribeLifecycleHooksInput) (*autoscaling.DescribeLifecycleHooksOutput, error) {
+	m.counter.add("DescribeLifecycleHooks", in)
+	return &autoscaling.DescribeLifecycleHooksOutput{LifecycleHooks: m.lifecycleHooks}, m.err
+}
+func (m *mockAsgSvc) DescribeScalingActivities(in *autoscaling.DescribeScalingActivitiesInput) (*autoscaling.DescribeScalingActivitiesOutput, error) {
+	m.counter.add("DescribeScalingActivities", in)
+	return &autoscaling.DescribeScalingActivitiesOutput{Activities: m.activities[aws.StringValue(in.AutoScalingGroupName)]}, m.err
+}
+func (m *mockAsgSvc) DescribeInstanceRefreshes(in *autoscaling.DescribeInstanceRefreshesInput) (*autoscaling.DescribeInstanceRefreshesOutput, error) {
+	m.counter.add("DescribeInstanceRefreshes", in)
+	return &autoscaling.DescribeInstanceRefreshesOutput{InstanceRefreshes: m.instanceRefreshes[aws.StringValue(in.AutoScalingGroupName)]}, m.err
+}
+func (m *mockAsgSvc) DescribeWarmPool(in *autoscaling.DescribeWarmPoolInput) (*autoscaling.DescribeWarmPoolOutput, error) {
+	m.counter.add("DescribeWarmPool", in)
+	if m.err != nil {
+		return nil, m.err
+	}
+	instances := m.warmPools[aws.StringValue(in.AutoScalingGroupName)]
+	start, _ := strconv.Atoi(aws.StringValue(in.NextToken))
+	end := len(instances)
+	if m.warmPoolPageSize > 0 && start+m.warmPoolPageSize < end {
+		end = start + m.warmPoolPageSize
+	}
+	out := &autoscaling.DescribeWarmPoolOutput{Instances: instances[start:end]}
+	if end < len(instances) {
+		out.NextToken = aws.String(strconv.Itoa(end))
+	}
+	return out, nil
+}
+func (m *mockAsgSvc) StartInstanceRefresh(in *autoscaling.StartInstanceRefreshInput) (*autoscaling.StartInstanceRefreshOutput, error) {
+	m.counter.add("StartInstanceRefresh", in)
+	return &autoscaling.StartInstanceRefreshOutput{InstanceRefreshId: aws.String("refresh1")}, m.err
+}
+func (m *mockAsgSvc) CompleteLifecycleAction(in *autoscaling.CompleteLifecycleActionInput) (*autoscaling.CompleteLifecycleActionOutput, error) {
+	m.counter.add("CompleteLifecycleAction", in)
+	return &autoscaling.CompleteLifecycleActionOutput{}, m.err
+}
 func (m *mockAsgSvc) DescribeAutoScalingGroups(in *autoscaling.DescribeAutoScalingGroupsInput) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
 	m.counter.add("DescribeAutoScalingGroups", in)
 	groups := make([]*autoscaling.Group, 0)
+	// without names, all of the groups are described, in order of name
+	if len(in.AutoScalingGroupNames) == 0 {
+		names := make([]string, 0, len(m.groups))
+		for name := range m.groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		in = &autoscaling.DescribeAutoScalingGroupsInput{AutoScalingGroupNames: aws.StringSlice(names)}
+	}
 	for _, n := range in.AutoScalingGroupNames {
 		if group, ok := m.groups[*n]; ok {
 			groups = append(groups, group)
@@ -143,6 +324,18 @@ func (m *mockAsgSvc) DescribeAutoScalingGroups(in *autoscaling.DescribeAutoScali
 		AutoScalingGroups: groups,
 	}, m.err
 }
+func (m *mockAsgSvc) DescribeLaunchConfigurations(in *autoscaling.DescribeLaunchConfigurationsInput) (*autoscaling.DescribeLaunchConfigurationsOutput, error) {
+	m.counter.add("DescribeLaunchConfigurations", in)
+	lcs := make([]*autoscaling.LaunchConfiguration, 0)
+	for _, n := range in.LaunchConfigurationNames {
+		if lc, ok := m.launchConfigurations[*n]; ok {
+			lcs = append(lcs, lc)
+		}
+	}
+	return &autoscaling.DescribeLaunchConfigurationsOutput{
+		LaunchConfigurations: lcs,
+	}, m.err
+}
 func (m *mockAsgSvc) SetDesiredCapacity(in *autoscaling.SetDesiredCapacityInput) (*autoscaling.SetDesiredCapacityOutput, error) {
 	m.counter.add("SetDesiredCapacity", in)
 	ret := &autoscaling.SetDesiredCapacityOutput{}
@@ -151,6 +344,9 @@ func (m *mockAsgSvc) SetDesiredCapacity(in *autoscaling.SetDesiredCapacityInput)
 func (m *mockAsgSvc) UpdateAutoScalingGroup(in *autoscaling.UpdateAutoScalingGroupInput) (*autoscaling.UpdateAutoScalingGroupOutput, error) {
 	m.counter.add("UpdateAutoScalingGroup", in)
 	ret := &autoscaling.UpdateAutoScalingGroupOutput{}
+	if m.updateErr != nil {
+		return ret, m.updateErr
+	}
 	return ret, m.err
 }
 func (m *mockAsgSvc) DescribeTags(in *autoscaling.DescribeTagsInput) (*autoscaling.DescribeTagsOutput, error) {
@@ -164,27 +360,91 @@ func (m *mockAsgSvc) DescribeTags(in *autoscaling.DescribeTagsInput) (*autoscali
 func (m *mockAsgSvc) CreateOrUpdateTags(in *autoscaling.CreateOrUpdateTagsInput) (*autoscaling.CreateOrUpdateTagsOutput, error) {
 	m.counter.add("CreateOrUpdateTags", in)
 	ret := &autoscaling.CreateOrUpdateTagsOutput{}
+	if len(m.tagErrs) > 0 {
+		err := m.tagErrs[0]
+		m.tagErrs = m.tagErrs[1:]
+		return ret, err
+	}
+	return ret, m.err
+}
+func (m *mockAsgSvc) DeleteTags(in *autoscaling.DeleteTagsInput) (*autoscaling.DeleteTagsOutput, error) {
+	m.counter.add("DeleteTags", in)
+	ret := &autoscaling.DeleteTagsOutput{}
 	return ret, m.err
 }
 
+func TestAwsDescribeInstancesConcurrent(t *testing.T) {
+	// run with -race to catch unsafe access to the results
+	ids := make([]string, 0)
+	for i := 0; i < 350; i++ {
+		ids = append(ids, fmt.Sprintf("i-%d", i))
+	}
+	for _, concurrency := range []int{1, 4, 10} {
+		svc := &mockEc2Svc{autodescribe: true}
+		described, err := awsDescribeInstances(svc, ids, concurrency)
+		if err != nil {
+			t.Fatalf("concurrency %d: unexpected error: %v", concurrency, err)
+		}
+		if len(described) != len(ids) {
+			t.Errorf("concurrency %d: mismatched number of instances, actual %d expected %d", concurrency, len(described), len(ids))
+		}
+		for _, id := range ids {
+			if hostname := aws.StringValue(described[id].PrivateDnsName); hostname != "host"+id {
+				t.Errorf("concurrency %d: mismatched hostname for %s, actual %s", concurrency, id, hostname)
+			}
+		}
+		// described in batches
+		if calls := len(svc.counter.filterByName("DescribeInstancesPages")); calls != 4 {
+			t.Errorf("concurrency %d: mismatched describe calls, actual %d expected 4", concurrency, calls)
+		}
+	}
+	// an error describing any batch is an error
+	if _, err := awsDescribeInstances(&mockEc2Svc{err: fmt.Errorf("failed")}, ids, 4); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
 func TestAwsGetHostnames(t *testing.T) {
+	// some instances have their node name set on a tag
+	instances := map[string]*ec2.Instance{
+		"tagged": {
+			InstanceId:     aws.String("tagged"),
+			PrivateDnsName: aws.String("ip-10-0-0-1.ec2.internal"),
+			Tags:           []*ec2.Tag{{Key: aws.String("KubernetesNodeName"), Value: aws.String("worker-1")}},
+		},
+		"emptytag": {
+			InstanceId:     aws.String("emptytag"),
+			PrivateDnsName: aws.String("ip-10-0-0-2.ec2.internal"),
+			Tags:           []*ec2.Tag{{Key: aws.String("KubernetesNodeName"), Value: aws.String("")}},
+		},
+		"othertag": {
+			InstanceId:     aws.String("othertag"),
+			PrivateDnsName: aws.String("ip-10-0-0-3.ec2.internal"),
+			Tags:           []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String("worker-3")}},
+		},
+	}
 	tests := []struct {
 		ids       []string
-		hostnames []string
+		nameTag   string
+		hostnames map[string]string
 		err       error
 	}{
-		{[]string{"12345", "67890"}, []string{"host12345", "host67890"}, nil},
-		{[]string{"67890"}, []string{"host67890"}, nil},
-		{[]string{"notexist"}, nil, fmt.Errorf("Unable to get description")},
+		{[]string{"12345", "67890"}, "", map[string]string{"12345": "host12345", "67890": "host67890"}, nil},
+		{[]string{"67890", "12345"}, "", map[string]string{"12345": "host12345", "67890": "host67890"}, nil},
+		{[]string{"67890"}, "", map[string]string{"67890": "host67890"}, nil},
+		{[]string{}, "", map[string]string{}, nil},
+		{[]string{"notexist"}, "", nil, fmt.Errorf("Unable to get description")},
+		{[]string{"tagged", "othertag"}, "", map[string]string{"tagged": "ip-10-0-0-1.ec2.internal", "othertag": "ip-10-0-0-3.ec2.internal"}, nil},
+		{[]string{"tagged", "emptytag", "othertag", "12345"}, "KubernetesNodeName", map[string]string{"tagged": "worker-1", "emptytag": "ip-10-0-0-2.ec2.internal", "othertag": "ip-10-0-0-3.ec2.internal", "12345": "host12345"}, nil},
 	}
 	for _, tt := range tests {
-		hostnames, err := awsGetHostnames(&mockEc2Svc{}, tt.ids)
+		hostnames, err := awsGetHostnames(&mockEc2Svc{instances: instances}, tt.ids, tt.nameTag)
 		switch {
 		case (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
 			t.Errorf("Mismatched error, actual then expected")
 			t.Logf("%v", err)
 			t.Logf("%v", tt.err)
-		case !testStringEq(hostnames, tt.hostnames):
+		case !reflect.DeepEqual(hostnames, tt.hostnames):
 			t.Errorf("Mismatched results, actual then expected")
 			t.Logf("%v", hostnames)
 			t.Logf("%v", tt.hostnames)
@@ -216,15 +476,48 @@ func TestAwsGetHostname(t *testing.T) {
 }
 
 func TestAwsGetServices(t *testing.T) {
-	ec2, asg, err := awsGetServices()
-	if err != nil {
-		t.Fatalf("Unexpected err %v", err)
-	}
-	if ec2 == nil {
-		t.Fatalf("ec2 unexpectedly nil")
+	tests := []struct {
+		region   string
+		endpoint string
+		roleARN  string
+	}{
+		{"", "", ""},
+		{"us-gov-west-1", "", ""},
+		{"us-east-1", "http://localhost:4566", ""},
+		{"us-east-1", "", "arn:aws:iam::123456789012:role/roller"},
 	}
-	if asg == nil {
-		t.Fatalf("asg unexpectedly nil")
+	for _, tt := range tests {
+		ec2Svc, asgSvc, s3Svc, sqsSvc, cloudWatchSvc, err := awsGetServices(tt.region, tt.endpoint, tt.roleARN, "")
+		if err != nil {
+			t.Fatalf("Unexpected err %v", err)
+		}
+		if ec2Svc == nil {
+			t.Fatalf("ec2 unexpectedly nil")
+		}
+		if asgSvc == nil {
+			t.Fatalf("asg unexpectedly nil")
+		}
+		if s3Svc == nil {
+			t.Fatalf("s3 unexpectedly nil")
+		}
+		if sqsSvc == nil {
+			t.Fatalf("sqs unexpectedly nil")
+		}
+		if cloudWatchSvc == nil {
+			t.Fatalf("cloudwatch unexpectedly nil")
+		}
+		asgClient := asgSvc.(*autoscaling.AutoScaling)
+		if tt.region != "" && aws.StringValue(asgClient.Config.Region) != tt.region {
+			t.Errorf("region %s: mismatched region %s", tt.region, aws.StringValue(asgClient.Config.Region))
+		}
+		if tt.endpoint != "" {
+			if asgClient.Endpoint != tt.endpoint || ec2Svc.(*ec2.EC2).Endpoint != tt.endpoint || s3Svc.(*s3.S3).Endpoint != tt.endpoint {
+				t.Errorf("endpoint %s: mismatched endpoints %s %s %s", tt.endpoint, asgClient.Endpoint, ec2Svc.(*ec2.EC2).Endpoint, s3Svc.(*s3.S3).Endpoint)
+			}
+			if !aws.BoolValue(s3Svc.(*s3.S3).Config.S3ForcePathStyle) {
+				t.Errorf("endpoint %s: expected S3 path style", tt.endpoint)
+			}
+		}
 	}
 }
 
@@ -233,21 +526,176 @@ func TestAwsTerminateNode(t *testing.T) {
 	tests := []struct {
 		awserr error
 		err    error
+		dryRun bool
 	}{
-		{awserr.New(autoscaling.ErrCodeScalingActivityInProgressFault, "", nil), fmt.Errorf("Could not terminate instance, autoscaling already in progress")},
-		{awserr.New(autoscaling.ErrCodeResourceContentionFault, "", nil), fmt.Errorf("Could not terminate instance, instance in contention")},
-		{awserr.New("test it new", "", nil), fmt.Errorf("Unknown aws error when terminating old instance")},
-		{fmt.Errorf("test it new"), fmt.Errorf("Unknown non-aws error when terminating old instance")},
+		{awserr.New(autoscaling.ErrCodeScalingActivityInProgressFault, "", nil), fmt.Errorf("Could not terminate instance, autoscaling already in progress"), false},
+		{awserr.New(autoscaling.ErrCodeResourceContentionFault, "", nil), fmt.Errorf("Could not terminate instance, instance in contention"), false},
+		{awserr.New("test it new", "", nil), fmt.Errorf("Unknown aws error when terminating old instance"), false},
+		{fmt.Errorf("test it new"), fmt.Errorf("Unknown non-aws error when terminating old instance"), false},
+		{fmt.Errorf("test it new"), nil, true},
 	}
 	for i, tt := range tests {
-		err := awsTerminateNode(&mockAsgSvc{
+		svc := &mockAsgSvc{
 			err: tt.awserr,
-		}, id)
+		}
+		err := awsTerminateNode(svc, id, tt.dryRun)
 		if (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())) {
 			t.Errorf("%d: mismatched errors, actual then expected", i)
 			t.Logf("%v", err)
 			t.Logf("%v", tt.err)
 		}
+		if calls := svc.counter.filterByName("TerminateInstanceInAutoScalingGroup"); tt.dryRun && len(calls) != 0 {
+			t.Errorf("%d: expected no terminate calls in dry run, had %d", i, len(calls))
+		}
+	}
+}
+func TestAwsTerminateInstances(t *testing.T) {
+	ids := []string{"12345", "67890"}
+	tests := []struct {
+		awserr error
+		err    error
+	}{
+		{nil, nil},
+		{awserr.New("test it new", "", nil), fmt.Errorf("Unknown aws error when terminating old instances")},
+		{fmt.Errorf("test it new"), fmt.Errorf("Unknown non-aws error when terminating old instances")},
+	}
+	for i, tt := range tests {
+		svc := &mockEc2Svc{
+			err: tt.awserr,
+		}
+		err := awsTerminateInstances(svc, ids)
+		if (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())) {
+			t.Errorf("%d: mismatched errors, actual then expected", i)
+			t.Logf("%v", err)
+			t.Logf("%v", tt.err)
+		}
+		calls := svc.counter.filterByName("TerminateInstances")
+		if len(calls) != 1 || !testStringEq(aws.StringValueSlice(calls[0].params[0].(*ec2.TerminateInstancesInput).InstanceIds), ids) {
+			t.Errorf("%d: expected a single call to terminate %v", i, ids)
+		}
+	}
+}
+func TestAwsGetLaunchConfiguration(t *testing.T) {
+	lc := &autoscaling.LaunchConfiguration{LaunchConfigurationName: aws.String("lc"), ImageId: aws.String("ami-1")}
+	tests := []struct {
+		name   string
+		awserr error
+		lc     *autoscaling.LaunchConfiguration
+		err    error
+	}{
+		{"lc", nil, lc, nil},
+		{"notexist", nil, nil, nil},
+		{"lc", fmt.Errorf("failed"), nil, fmt.Errorf("Unable to get description for Launch Configuration lc")},
+	}
+	for i, tt := range tests {
+		svc := &mockAsgSvc{
+			err:                  tt.awserr,
+			launchConfigurations: map[string]*autoscaling.LaunchConfiguration{"lc": lc},
+		}
+		result, err := awsGetLaunchConfiguration(svc, tt.name)
+		if (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())) {
+			t.Errorf("%d: mismatched errors, actual then expected", i)
+			t.Logf("%v", err)
+			t.Logf("%v", tt.err)
+		}
+		if err == nil && result != tt.lc {
+			t.Errorf("%d: mismatched launch configuration, actual %v expected %v", i, result, tt.lc)
+		}
+	}
+}
+func TestAwsGetInstanceContentHashes(t *testing.T) {
+	svc := &mockEc2Svc{
+		instances: map[string]*ec2.Instance{
+			"1": {InstanceId: aws.String("1"), ImageId: aws.String("ami-1"), InstanceType: aws.String("m5.large")},
+			"2": {InstanceId: aws.String("2"), ImageId: aws.String("ami-2"), InstanceType: aws.String("m5.large")},
+		},
+		userData: map[string]string{"1": "dXNlcmRhdGE=", "2": "b3RoZXI="},
+	}
+	hashes, err := awsGetInstanceContentHashes(svc, []string{"1", "2"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]string{
+		"1": contentHash("ami-1", "m5.large", "dXNlcmRhdGE="),
+		"2": contentHash("ami-2", "m5.large", "b3RoZXI="),
+	}
+	for id, hash := range expected {
+		if hashes[id] != hash {
+			t.Errorf("%s: mismatched hash, actual %s expected %s", id, hashes[id], hash)
+		}
+	}
+	if calls := svc.counter.filterByName("DescribeInstanceAttribute"); len(calls) != 2 {
+		t.Errorf("expected 2 DescribeInstanceAttribute calls, had %d", len(calls))
+	}
+}
+func TestAwsTagTerminated(t *testing.T) {
+	ids := []string{"12345", "67890"}
+	when := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		awserr error
+		err    error
+	}{
+		{nil, nil},
+		{awserr.New("test it new", "", nil), fmt.Errorf("Unknown aws error when tagging old instances")},
+		{fmt.Errorf("test it new"), fmt.Errorf("Unknown non-aws error when tagging old instances")},
+	}
+	for i, tt := range tests {
+		svc := &mockEc2Svc{
+			err: tt.awserr,
+		}
+		err := awsTagTerminated(svc, ids, when)
+		if (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())) {
+			t.Errorf("%d: mismatched errors, actual then expected", i)
+			t.Logf("%v", err)
+			t.Logf("%v", tt.err)
+		}
+		calls := svc.counter.filterByName("CreateTags")
+		if len(calls) != 1 {
+			t.Fatalf("%d: expected a single call to tag %v", i, ids)
+		}
+		input := calls[0].params[0].(*ec2.CreateTagsInput)
+		if !testStringEq(aws.StringValueSlice(input.Resources), ids) {
+			t.Errorf("%d: mismatched tagged instances, actual %v expected %v", i, aws.StringValueSlice(input.Resources), ids)
+		}
+		if len(input.Tags) != 1 || *input.Tags[0].Key != ec2TagNameTerminatedBy || *input.Tags[0].Value != "aws-asg-roller at 2020-01-02T03:04:05Z" {
+			t.Errorf("%d: mismatched tags %v", i, input.Tags)
+		}
+	}
+}
+func TestAwsUploadRollReport(t *testing.T) {
+	report := rollReport{Validation: "passed", ASGs: []asgRollResult{{Name: "myasg", Duration: "1m0s"}}}
+	tests := []struct {
+		awserr error
+		err    error
+	}{
+		{nil, nil},
+		{awserr.New("test it new", "", nil), fmt.Errorf("Unknown aws error when uploading roll report")},
+		{fmt.Errorf("test it new"), fmt.Errorf("Unknown non-aws error when uploading roll report")},
+	}
+	for i, tt := range tests {
+		svc := &mockS3Svc{
+			err: tt.awserr,
+		}
+		err := awsUploadRollReport(svc, "mybucket", "my/key.json", report)
+		if (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())) {
+			t.Errorf("%d: mismatched errors, actual then expected", i)
+			t.Logf("%v", err)
+			t.Logf("%v", tt.err)
+		}
+		calls := svc.counter.filterByName("PutObject")
+		if len(calls) != 1 || *calls[0].params[0].(*s3.PutObjectInput).Bucket != "mybucket" {
+			t.Fatalf("%d: expected a single call to put to mybucket", i)
+		}
+		if tt.err != nil {
+			continue
+		}
+		var uploaded rollReport
+		if err := json.Unmarshal(svc.objects["my/key.json"], &uploaded); err != nil {
+			t.Fatalf("%d: unable to parse uploaded report: %v", i, err)
+		}
+		if uploaded.Validation != "passed" || len(uploaded.ASGs) != 1 || uploaded.ASGs[0].Name != "myasg" {
+			t.Errorf("%d: mismatched uploaded report %+v", i, uploaded)
+		}
 	}
 }
 func TestAwsDescribeGroups(t *testing.T) {
@@ -310,24 +758,31 @@ func TestAwsSetAsgDesired(t *testing.T) {
 		setErr         error
 		err            error
 		verbose        bool
+		dryRun         bool
 	}{
-		{3, 3, true, nil, nil, false},
-		{2, 2, true, nil, nil, false},
-		{15, 15, true, awserr.New(autoscaling.ErrCodeResourceContentionFault, "", nil), fmt.Errorf("unable to increase ASG mygroup desired count to 15 - ResourceContention"), false},
-		{1, 1, true, awserr.New("testabc", "", nil), fmt.Errorf("unable to increase ASG mygroup desired count to 1 - unexpected and unknown AWS error"), false},
-		{25, 25, true, fmt.Errorf("testabc"), fmt.Errorf("unable to increase ASG mygroup desired count to 25 - unexpected and unknown non-AWS error"), false},
-		{31, 30, false, nil, fmt.Errorf("unable to increase ASG mygroup desired size to 31 as greater than max size 30"), false},
-		{31, 30, true, nil, nil, false},
+		{3, 3, true, nil, nil, false, false},
+		{2, 2, true, nil, nil, false, false},
+		{15, 15, true, awserr.New(autoscaling.ErrCodeResourceContentionFault, "", nil), fmt.Errorf("unable to increase ASG mygroup desired count to 15 - ResourceContention"), false, false},
+		{1, 1, true, awserr.New("testabc", "", nil), fmt.Errorf("unable to increase ASG mygroup desired count to 1 - unexpected and unknown AWS error"), false, false},
+		{25, 25, true, fmt.Errorf("testabc"), fmt.Errorf("unable to increase ASG mygroup desired count to 25 - unexpected and unknown non-AWS error"), false, false},
+		{31, 30, false, nil, fmt.Errorf("unable to increase ASG mygroup desired size to 31 as greater than max size 30"), false, false},
+		{31, 30, true, nil, nil, false, false},
+		{25, 25, true, fmt.Errorf("testabc"), nil, false, true},
+		{31, 30, true, fmt.Errorf("testabc"), nil, false, true},
+		{31, 30, false, nil, fmt.Errorf("unable to increase ASG mygroup desired size to 31 as greater than max size 30"), false, true},
 	}
 	for i, tt := range tests {
 		asg := &autoscaling.Group{
 			AutoScalingGroupName: &groupName,
 			MaxSize:              &tt.max,
 		}
-		err := setAsgDesired(&mockAsgSvc{
+		svc := &mockAsgSvc{
 			err: tt.setErr,
-		}, asg, tt.desired, tt.canIncreaseMax, tt.verbose)
+		}
+		err := setAsgDesired(svc, asg, tt.desired, tt.canIncreaseMax, tt.dryRun, tt.verbose)
 		switch {
+		case tt.dryRun && len(svc.counter.filterByName("SetDesiredCapacity"))+len(svc.counter.filterByName("UpdateAutoScalingGroup")) != 0:
+			t.Errorf("%d: expected no calls in dry run", i)
 		case (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
 			t.Errorf("%d: Mismatched error, actual then expected", i)
 			t.Logf("%v", err)
@@ -348,6 +803,7 @@ func TestAwsSetAsgMax(t *testing.T) {
 		{2, nil, nil, false},
 		{15, awserr.New(autoscaling.ErrCodeResourceContentionFault, "", nil), fmt.Errorf("unable to increase ASG mygroup max size to 15 - ResourceContention"), false},
 		{1, awserr.New("testabc", "", nil), fmt.Errorf("unable to increase ASG mygroup max size to 1 - unexpected and unknown AWS error: testabc"), false},
+		{4, awserr.New(autoscaling.ErrCodeLimitExceededFault, "", nil), fmt.Errorf("unable to increase ASG mygroup max size to 4, as it is at the account or service limit"), false},
 		{25, fmt.Errorf("testabc"), fmt.Errorf("unable to increase ASG mygroup max size to 25 - unexpected and unknown non-AWS error: testabc"), false},
 	}
 	for i, tt := range tests {
@@ -356,7 +812,7 @@ func TestAwsSetAsgMax(t *testing.T) {
 		}
 		err := setAsgMax(&mockAsgSvc{
 			err: tt.setErr,
-		}, asg, tt.max, tt.verbose)
+		}, asg, tt.max, false, tt.verbose)
 		switch {
 		case (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
 			t.Errorf("%d: Mismatched error, actual then expected", i)
@@ -406,3 +862,47 @@ func TestAwsGetLaunchTemplate(t *testing.T) {
 func testCompareLaunchTemplate(t1, t2 *ec2.LaunchTemplate) bool {
 	return t1.LaunchTemplateName == t2.LaunchTemplateName && t1.LaunchTemplateId == t2.LaunchTemplateId && t1.DefaultVersionNumber == t2.DefaultVersionNumber && t1.LatestVersionNumber == t2.LatestVersionNumber
 }
+
+func TestAwsNewSessionAssumeRole(t *testing.T) {
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("unable to parse request: %v", err)
+		}
+		form = r.PostForm
+		fmt.Fprint(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><AssumeRoleResult><Credentials>
+<AccessKeyId>ASSUMEDKEY</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>token</SessionToken>
+<Expiration>2099-01-01T00:00:00Z</Expiration></Credentials></AssumeRoleResult></AssumeRoleResponse>`)
+	}))
+	defer server.Close()
+	os.Setenv("AWS_ACCESS_KEY_ID", "BASEKEY")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	tests := []struct {
+		roleARN    string
+		externalID string
+		key        string
+	}{
+		{"", "", "BASEKEY"},
+		{"arn:aws:iam::123456789012:role/roller", "", "ASSUMEDKEY"},
+		{"arn:aws:iam::123456789012:role/roller", "external", "ASSUMEDKEY"},
+	}
+	for _, tt := range tests {
+		form = nil
+		sess, err := awsNewSession("us-east-1", server.URL, tt.roleARN, tt.externalID)
+		if err != nil {
+			t.Fatalf("Unexpected err %v", err)
+		}
+		creds, err := sess.Config.Credentials.Get()
+		switch {
+		case err != nil:
+			t.Errorf("role '%s': unexpected error getting credentials: %v", tt.roleARN, err)
+		case creds.AccessKeyID != tt.key:
+			t.Errorf("role '%s': mismatched access key, actual %s expected %s", tt.roleARN, creds.AccessKeyID, tt.key)
+		case tt.roleARN != "" && (form.Get("RoleArn") != tt.roleARN || form.Get("ExternalId") != tt.externalID):
+			t.Errorf("role '%s': mismatched assume role request %v", tt.roleARN, form)
+		}
+	}
+}
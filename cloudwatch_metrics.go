@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+)
+
+const (
+	cloudWatchMetricOldInstances = "OldInstances"
+	cloudWatchMetricNewInstances = "NewInstances"
+	cloudWatchMetricTerminations = "Terminations"
+	cloudWatchDimensionASG       = "AutoScalingGroupName"
+)
+
+// the most metric data that can be put to CloudWatch in a single call
+const cloudWatchMaxDatums = 20
+
+// publishCloudWatchMetrics puts the numbers of old and new instances of each ASG at the end of a loop, and the
+// number of instances terminated in it, as custom metrics in the namespace, with the name of the ASG as
+// a dimension, so that rolls can be followed on CloudWatch dashboards
+func publishCloudWatchMetrics(svc cloudwatchiface.CloudWatchAPI, namespace string, statuses []RollStatus, now time.Time) error {
+	datums := make([]*cloudwatch.MetricDatum, 0, 3*len(statuses))
+	for _, status := range statuses {
+		dimensions := []*cloudwatch.Dimension{
+			{Name: aws.String(cloudWatchDimensionASG), Value: aws.String(status.ASG)},
+		}
+		for _, metric := range []struct {
+			name  string
+			value int
+		}{
+			{cloudWatchMetricOldInstances, status.OldInstances},
+			{cloudWatchMetricNewInstances, status.NewInstances},
+			{cloudWatchMetricTerminations, len(status.Terminated)},
+		} {
+			datums = append(datums, &cloudwatch.MetricDatum{
+				MetricName: aws.String(metric.name),
+				Dimensions: dimensions,
+				Timestamp:  aws.Time(now),
+				Unit:       aws.String(cloudwatch.StandardUnitCount),
+				Value:      aws.Float64(float64(metric.value)),
+			})
+		}
+	}
+	for start := 0; start < len(datums); start += cloudWatchMaxDatums {
+		end := start + cloudWatchMaxDatums
+		if end > len(datums) {
+			end = len(datums)
+		}
+		_, err := svc.PutMetricData(&cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(namespace),
+			MetricData: datums[start:end],
+		})
+		if err != nil {
+			return fmt.Errorf("unable to put metrics to CloudWatch namespace %s: %v", namespace, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+)
+
+type mockCloudWatchSvc struct {
+	cloudwatchiface.CloudWatchAPI
+	counter funcCounter
+	err     error
+}
+
+func (m *mockCloudWatchSvc) PutMetricData(in *cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error) {
+	m.counter.add("PutMetricData", in)
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+func TestPublishCloudWatchMetrics(t *testing.T) {
+	now := time.Now()
+	svc := &mockCloudWatchSvc{}
+	statuses := []RollStatus{
+		{ASG: "asg1", OldInstances: 2, NewInstances: 1, Terminated: []string{"1"}},
+		{ASG: "asg2", OldInstances: 0, NewInstances: 3},
+	}
+	if err := publishCloudWatchMetrics(svc, "roller", statuses, now); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	calls := svc.counter.filterByName("PutMetricData")
+	if len(calls) != 1 {
+		t.Fatalf("expected 1 PutMetricData call, had %d", len(calls))
+	}
+	in := calls[0].params[0].(*cloudwatch.PutMetricDataInput)
+	if *in.Namespace != "roller" {
+		t.Errorf("mismatched namespace, actual %s expected roller", *in.Namespace)
+	}
+	expected := map[string]float64{
+		"asg1/OldInstances": 2, "asg1/NewInstances": 1, "asg1/Terminations": 1,
+		"asg2/OldInstances": 0, "asg2/NewInstances": 3, "asg2/Terminations": 0,
+	}
+	if len(in.MetricData) != len(expected) {
+		t.Errorf("mismatched number of metrics, actual %d expected %d", len(in.MetricData), len(expected))
+	}
+	for _, datum := range in.MetricData {
+		if len(datum.Dimensions) != 1 || *datum.Dimensions[0].Name != "AutoScalingGroupName" {
+			t.Errorf("%s: mismatched dimensions %v", *datum.MetricName, datum.Dimensions)
+			continue
+		}
+		key := *datum.Dimensions[0].Value + "/" + *datum.MetricName
+		value, ok := expected[key]
+		switch {
+		case !ok:
+			t.Errorf("unexpected metric %s", key)
+		case *datum.Value != value:
+			t.Errorf("%s: mismatched value, actual %v expected %v", key, *datum.Value, value)
+		case !datum.Timestamp.Equal(now) || *datum.Unit != cloudwatch.StandardUnitCount:
+			t.Errorf("%s: mismatched timestamp %v or unit %s", key, *datum.Timestamp, *datum.Unit)
+		}
+	}
+
+	// many ASGs are published in several calls
+	svc = &mockCloudWatchSvc{}
+	statuses = make([]RollStatus, 0)
+	for i := 0; i < 10; i++ {
+		statuses = append(statuses, RollStatus{ASG: fmt.Sprintf("asg%d", i)})
+	}
+	if err := publishCloudWatchMetrics(svc, "roller", statuses, now); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls := svc.counter.filterByName("PutMetricData"); len(calls) != 2 {
+		t.Errorf("expected 2 PutMetricData calls for 30 metrics, had %d", len(calls))
+	}
+
+	svc = &mockCloudWatchSvc{err: fmt.Errorf("throttled")}
+	if err := publishCloudWatchMetrics(svc, "roller", statuses, now); err == nil {
+		t.Errorf("expected error, had none")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// asgRollResult is the result of rolling a single ASG
+type asgRollResult struct {
+	Name     string    `json:"name"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Duration string    `json:"duration"`
+}
+
+// rollReport is a machine-readable report of a completed roll, for pipelines that gate on it
+type rollReport struct {
+	Completed time.Time       `json:"completed"`
+	ASGs      []asgRollResult `json:"asgs"`
+	// passed, failed or skipped if there is no post-roll validation
+	Validation      string `json:"validation"`
+	ValidationError string `json:"validationError,omitempty"`
+}
+
+func newRollReport(results []asgRollResult, validated bool, validationErr error) rollReport {
+	report := rollReport{
+		Completed:  time.Now().UTC(),
+		ASGs:       make([]asgRollResult, 0),
+		Validation: "skipped",
+	}
+	for _, r := range results {
+		r.Duration = r.Finished.Sub(r.Started).String()
+		report.ASGs = append(report.ASGs, r)
+	}
+	switch {
+	case validated && validationErr != nil:
+		report.Validation = "failed"
+		report.ValidationError = validationErr.Error()
+	case validated:
+		report.Validation = "passed"
+	}
+	return report
+}
+
+// completeRoll does everything that is needed once a roll has completed, if one has since it was last
+// called: runs the post-roll validation, if any, and uploads the completion report, if so configured
+func completeRoll(configs Configs, validator postRollValidator, s3Svc s3iface.S3API, state *rollerState) error {
+	if !state.takeRollCompleted() {
+		return nil
+	}
+	validationErr := validateRoll(configs, validator)
+	results := state.takeFinished()
+	if configs.ReportS3Bucket != "" {
+		report := newRollReport(results, validator != nil, validationErr)
+		if err := awsUploadRollReport(s3Svc, configs.ReportS3Bucket, configs.ReportS3Key, report); err != nil {
+			return fmt.Errorf("error uploading roll report: %v", err)
+		}
+		log.Printf("uploaded roll report to s3://%s/%s", configs.ReportS3Bucket, configs.ReportS3Key)
+	}
+	return validationErr
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNewRollReport(t *testing.T) {
+	started := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	results := []asgRollResult{
+		{Name: "asg1", Started: started, Finished: started.Add(10 * time.Minute)},
+		{Name: "asg2", Started: started, Finished: started.Add(90 * time.Second)},
+	}
+	tests := []struct {
+		validated       bool
+		validationErr   error
+		validation      string
+		validationError string
+	}{
+		{false, nil, "skipped", ""},
+		{true, nil, "passed", ""},
+		{true, fmt.Errorf("smoke tests failed"), "failed", "smoke tests failed"},
+	}
+	for i, tt := range tests {
+		report := newRollReport(results, tt.validated, tt.validationErr)
+		if report.Validation != tt.validation || report.ValidationError != tt.validationError {
+			t.Errorf("%d: mismatched validation, actual %s '%s' expected %s '%s'", i, report.Validation, report.ValidationError, tt.validation, tt.validationError)
+		}
+		if len(report.ASGs) != 2 || report.ASGs[0].Duration != "10m0s" || report.ASGs[1].Duration != "1m30s" {
+			t.Errorf("%d: mismatched ASG results %+v", i, report.ASGs)
+		}
+	}
+}
+
+func TestCompleteRoll(t *testing.T) {
+	tests := []struct {
+		desc       string
+		completed  bool
+		bucket     string
+		validator  *testValidator
+		uploaded   bool
+		validation string
+		err        bool
+	}{
+		{"not completed", false, "mybucket", nil, false, "", false},
+		{"no report", true, "", nil, false, "", false},
+		{"report without validation", true, "mybucket", nil, true, "skipped", false},
+		{"report with validation passed", true, "mybucket", &testValidator{}, true, "passed", false},
+		{"report with validation failed", true, "mybucket", &testValidator{err: fmt.Errorf("failed")}, true, "failed", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			configs := Configs{ASGS: []string{"asg1", "asg2"}, ReportS3Bucket: tt.bucket, ReportS3Key: "report.json"}
+			// asg1 has rolled and finished, asg2 never needed to roll
+			state := newRollerState()
+			state.setRolling("asg1", true)
+			state.setRolling("asg1", false)
+			if tt.completed {
+				state.setRollCompleted()
+			}
+			var validator postRollValidator
+			if tt.validator != nil {
+				validator = tt.validator
+			}
+			s3Svc := &mockS3Svc{}
+			err := completeRoll(configs, validator, s3Svc, state)
+			if (err != nil) != tt.err {
+				t.Errorf("mismatched error, actual %v expected error %v", err, tt.err)
+			}
+			body, ok := s3Svc.objects["report.json"]
+			if ok != tt.uploaded {
+				t.Fatalf("mismatched upload, actual %v expected %v", ok, tt.uploaded)
+			}
+			if !tt.uploaded {
+				return
+			}
+			var report rollReport
+			if err := json.Unmarshal(body, &report); err != nil {
+				t.Fatalf("unable to parse uploaded report: %v", err)
+			}
+			if report.Validation != tt.validation {
+				t.Errorf("mismatched validation, actual %s expected %s", report.Validation, tt.validation)
+			}
+			if len(report.ASGs) != 1 || report.ASGs[0].Name != "asg1" || report.ASGs[0].Duration == "" {
+				t.Errorf("mismatched ASG results %+v", report.ASGs)
+			}
+			// the completion is handled only once
+			if err := completeRoll(configs, validator, s3Svc, state); err != nil || len(s3Svc.counter.filterByName("PutObject")) != 1 {
+				t.Errorf("expected completion to be handled only once")
+			}
+		})
+	}
+}
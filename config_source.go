@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/appconfig"
+	"github.com/aws/aws-sdk-go/service/appconfig/appconfigiface"
+)
+
+// configSource is a source of roll configuration, other than the environment, that can change while the
+// roller is running. Settings from the source override those read from the environment.
+type configSource interface {
+	// apply overrides settings in configs with those from the source
+	apply(configs *Configs) error
+}
+
+// appConfigSettings are the roll settings that can be read from AWS AppConfig. Any setting that is not
+// present in the configuration leaves the value from the environment unchanged.
+type appConfigSettings struct {
+	Interval       *string `json:"interval"`
+	MaxUnavailable *int    `json:"maxUnavailable"`
+	Paused         *bool   `json:"paused"`
+}
+
+// appConfigSource reads roll settings from an AWS AppConfig configuration profile, fetching them again
+// at most once every refresh interval
+type appConfigSource struct {
+	svc           appconfigiface.AppConfigAPI
+	application   string
+	environment   string
+	configuration string
+	clientID      string
+	refresh       time.Duration
+	// version of the configuration last received, so that AppConfig only sends it again when it changes
+	version   string
+	settings  appConfigSettings
+	lastFetch time.Time
+}
+
+func newAppConfigSource(svc appconfigiface.AppConfigAPI, configs Configs) *appConfigSource {
+	return &appConfigSource{
+		svc:           svc,
+		application:   configs.AppConfigApplication,
+		environment:   configs.AppConfigEnvironment,
+		configuration: configs.AppConfigConfiguration,
+		clientID:      configs.AppConfigClientID,
+		refresh:       configs.AppConfigRefresh,
+	}
+}
+
+// apply overrides settings in configs with the latest settings from AppConfig. If they cannot be fetched,
+// the last settings successfully fetched are applied, and the error is returned.
+func (s *appConfigSource) apply(configs *Configs) error {
+	var err error
+	if s.lastFetch.IsZero() || time.Since(s.lastFetch) >= s.refresh {
+		err = s.fetch()
+	}
+	if s.settings.Interval != nil {
+		interval, parseErr := time.ParseDuration(*s.settings.Interval)
+		if parseErr != nil {
+			return fmt.Errorf("invalid interval '%s' from AppConfig: %v", *s.settings.Interval, parseErr)
+		}
+		configs.Interval = interval
+	}
+	if s.settings.MaxUnavailable != nil {
+		configs.MaxTerminate = *s.settings.MaxUnavailable
+	}
+	if s.settings.Paused != nil {
+		configs.Paused = *s.settings.Paused
+	}
+	return err
+}
+
+// fetch gets the settings from AppConfig, keeping the previous settings if they have not changed
+func (s *appConfigSource) fetch() error {
+	input := &appconfig.GetConfigurationInput{
+		Application:   aws.String(s.application),
+		Environment:   aws.String(s.environment),
+		Configuration: aws.String(s.configuration),
+		ClientId:      aws.String(s.clientID),
+	}
+	if s.version != "" {
+		input.ClientConfigurationVersion = aws.String(s.version)
+	}
+	out, err := s.svc.GetConfiguration(input)
+	if err != nil {
+		return fmt.Errorf("unable to get configuration from AppConfig: %v", err)
+	}
+	s.lastFetch = time.Now()
+	// AppConfig returns no content when the configuration has not changed since the version we have
+	if len(out.Content) == 0 {
+		return nil
+	}
+	var settings appConfigSettings
+	if err := json.Unmarshal(out.Content, &settings); err != nil {
+		return fmt.Errorf("unable to parse configuration from AppConfig: %v", err)
+	}
+	s.settings = settings
+	s.version = aws.StringValue(out.ConfigurationVersion)
+	log.Printf("read configuration version %s from AppConfig", s.version)
+	return nil
+}
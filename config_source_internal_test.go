@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/appconfig"
+	"github.com/aws/aws-sdk-go/service/appconfig/appconfigiface"
+)
+
+type mockAppConfigSvc struct {
+	appconfigiface.AppConfigAPI
+	counter funcCounter
+	// content returned by each successive call, empty for unchanged
+	contents []string
+	err      error
+}
+
+func (m *mockAppConfigSvc) GetConfiguration(in *appconfig.GetConfigurationInput) (*appconfig.GetConfigurationOutput, error) {
+	m.counter.add("GetConfiguration", in)
+	if m.err != nil {
+		return nil, m.err
+	}
+	call := len(m.counter.filterByName("GetConfiguration"))
+	content := m.contents[call-1]
+	return &appconfig.GetConfigurationOutput{
+		Content:              []byte(content),
+		ConfigurationVersion: aws.String(fmt.Sprintf("%d", call)),
+	}, nil
+}
+
+func TestAppConfigSourceApply(t *testing.T) {
+	base := Configs{
+		Interval:     30 * time.Second,
+		MaxTerminate: 1,
+	}
+	tests := []struct {
+		desc     string
+		contents []string
+		err      error
+		interval time.Duration
+		max      int
+		paused   bool
+		applyErr string
+	}{
+		{"all settings", []string{`{"interval": "10s", "maxUnavailable": 3, "paused": true}`}, nil, 10 * time.Second, 3, true, ""},
+		{"some settings", []string{`{"maxUnavailable": 2}`}, nil, 30 * time.Second, 2, false, ""},
+		{"no settings", []string{`{}`}, nil, 30 * time.Second, 1, false, ""},
+		{"unchanged keeps previous", []string{`{"maxUnavailable": 2}`, ""}, nil, 30 * time.Second, 2, false, ""},
+		{"changed", []string{`{"maxUnavailable": 2}`, `{"paused": true}`}, nil, 30 * time.Second, 1, true, ""},
+		{"invalid json", []string{`{"maxUnavailable":`}, nil, 30 * time.Second, 1, false, "unable to parse configuration from AppConfig"},
+		{"invalid interval", []string{`{"interval": "10"}`}, nil, 30 * time.Second, 1, false, "invalid interval '10' from AppConfig"},
+		{"error", nil, fmt.Errorf("failed"), 30 * time.Second, 1, false, "unable to get configuration from AppConfig"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			svc := &mockAppConfigSvc{contents: tt.contents, err: tt.err}
+			source := newAppConfigSource(svc, Configs{AppConfigApplication: "app", AppConfigEnvironment: "env", AppConfigConfiguration: "conf", AppConfigClientID: "client"})
+			var (
+				configs Configs
+				err     error
+			)
+			// apply once per response, starting from the environment config each time, as the main loop does
+			for i := 0; i < len(tt.contents) || i == 0; i++ {
+				configs = base
+				err = source.apply(&configs)
+			}
+			switch {
+			case (err == nil && tt.applyErr != "") || (err != nil && tt.applyErr == "") || (err != nil && !strings.HasPrefix(err.Error(), tt.applyErr)):
+				t.Errorf("mismatched errors, actual %v expected %s", err, tt.applyErr)
+			case configs.Interval != tt.interval:
+				t.Errorf("mismatched interval, actual %v expected %v", configs.Interval, tt.interval)
+			case configs.MaxTerminate != tt.max:
+				t.Errorf("mismatched max terminate, actual %d expected %d", configs.MaxTerminate, tt.max)
+			case configs.Paused != tt.paused:
+				t.Errorf("mismatched paused, actual %v expected %v", configs.Paused, tt.paused)
+			}
+			calls := svc.counter.filterByName("GetConfiguration")
+			if len(calls) > 1 {
+				input := calls[1].params[0].(*appconfig.GetConfigurationInput)
+				if aws.StringValue(input.ClientConfigurationVersion) != "1" {
+					t.Errorf("expected second call to send version 1, sent %s", aws.StringValue(input.ClientConfigurationVersion))
+				}
+			}
+		})
+	}
+}
+
+func TestAppConfigSourceRefresh(t *testing.T) {
+	tests := []struct {
+		refresh time.Duration
+		calls   int
+	}{
+		{0, 3},
+		{time.Hour, 1},
+	}
+	for _, tt := range tests {
+		svc := &mockAppConfigSvc{contents: []string{`{"paused": true}`, "", ""}}
+		source := newAppConfigSource(svc, Configs{AppConfigRefresh: tt.refresh})
+		for i := 0; i < 3; i++ {
+			configs := Configs{}
+			if err := source.apply(&configs); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !configs.Paused {
+				t.Errorf("refresh %v: expected paused on apply %d", tt.refresh, i)
+			}
+		}
+		if calls := len(svc.counter.filterByName("GetConfiguration")); calls != tt.calls {
+			t.Errorf("refresh %v: mismatched calls, actual %d expected %d", tt.refresh, calls, tt.calls)
+		}
+	}
+}
@@ -1,18 +1,137 @@
 package main
 
-import "time"
+import (
+	"regexp"
+	"time"
+)
 
 // Configs struct deals with env configuration
 type Configs struct {
-	Interval             time.Duration `env:"ROLLER_INTERVAL" envDefault:"30s"`
-	CheckDelay           int           `env:"ROLLER_CHECK_DELAY" envDefault:"30"`
-	Drain                bool          `env:"ROLLER_DRAIN" envDefault:"true"`
-	DrainForce           bool          `env:"ROLLER_DRAIN_FORCE" envDefault:"true"`
-	IncreaseMax          bool          `env:"ROLLER_CAN_INCREASE_MAX" envDefault:"false"`
-	IgnoreDaemonSets     bool          `env:"ROLLER_IGNORE_DAEMONSETS" envDefault:"true"`
-	DeleteLocalData      bool          `env:"ROLLER_DELETE_LOCAL_DATA" envDefault:"false"`
-	OriginalDesiredOnTag bool          `env:"ROLLER_ORIGINAL_DESIRED_ON_TAG" envDefault:"false"`
-	ASGS                 []string      `env:"ROLLER_ASG,required" envSeparator:","`
-	KubernetesEnabled    bool          `env:"ROLLER_KUBERNETES" envDefault:"true"`
-	Verbose              bool          `env:"ROLLER_VERBOSE" envDefault:"false"`
+	Interval               time.Duration `env:"ROLLER_INTERVAL" envDefault:"30s"`
+	IdleInterval           time.Duration `env:"ROLLER_IDLE_INTERVAL" envDefault:"0s"`
+	ActiveInterval         time.Duration `env:"ROLLER_ACTIVE_INTERVAL" envDefault:"0s"`
+	IntervalJitter         string        `env:"ROLLER_INTERVAL_JITTER"`
+	MinLoopSleep           time.Duration `env:"ROLLER_MIN_LOOP_SLEEP" envDefault:"1s"`
+	AdjustTimeout          time.Duration `env:"ROLLER_ADJUST_TIMEOUT" envDefault:"0s"`
+	CheckDelay             int           `env:"ROLLER_CHECK_DELAY" envDefault:"30"`
+	Drain                  bool          `env:"ROLLER_DRAIN" envDefault:"true"`
+	DrainForce             bool          `env:"ROLLER_DRAIN_FORCE" envDefault:"true"`
+	DrainMethod            string        `env:"ROLLER_DRAIN_METHOD" envDefault:"library"`
+	NodePoolLabel          string        `env:"ROLLER_NODE_POOL_LABEL"`
+	MaxDrainsPerPool       int           `env:"ROLLER_MAX_DRAINS_PER_POOL" envDefault:"0"`
+	DrainTimeout           time.Duration `env:"ROLLER_DRAIN_TIMEOUT" envDefault:"0s"`
+	DrainGracePeriod       int           `env:"ROLLER_DRAIN_GRACE_PERIOD" envDefault:"-1"`
+	VerifyDrain            bool          `env:"ROLLER_VERIFY_DRAIN" envDefault:"false"`
+	WaitForAutoscaler      bool          `env:"ROLLER_WAIT_FOR_AUTOSCALER" envDefault:"false"`
+	DrainFailureLimit      int           `env:"ROLLER_DRAIN_FAILURE_LIMIT" envDefault:"0"`
+	DrainFailureAction     string        `env:"ROLLER_DRAIN_FAILURE_ACTION" envDefault:"force"`
+	PostDrainSleep         time.Duration `env:"ROLLER_POST_DRAIN_SLEEP" envDefault:"0s"`
+	IncreaseMax            bool          `env:"ROLLER_CAN_INCREASE_MAX" envDefault:"false"`
+	MaxLimitAction         string        `env:"ROLLER_MAX_LIMIT_ACTION" envDefault:"abort"`
+	RestoreMax             bool          `env:"ROLLER_RESTORE_MAX" envDefault:"false"`
+	IgnoreDaemonSets       bool          `env:"ROLLER_IGNORE_DAEMONSETS" envDefault:"true"`
+	DeleteLocalData        bool          `env:"ROLLER_DELETE_LOCAL_DATA" envDefault:"false"`
+	OrderByPodCount        bool          `env:"ROLLER_ORDER_BY_POD_COUNT" envDefault:"false"`
+	TerminateOrder         string        `env:"ROLLER_TERMINATE_ORDER" envDefault:"oldest"`
+	TerminateSpotFirst     bool          `env:"ROLLER_TERMINATE_SPOT_FIRST" envDefault:"false"`
+	NodeWeightAnnotation   string        `env:"ROLLER_NODE_WEIGHT_ANNOTATION"`
+	TerminationPolicies    []string      `env:"ROLLER_TERMINATION_POLICIES" envSeparator:","`
+	NodeNameTag            string        `env:"ROLLER_NODE_NAME_TAG"`
+	ReadyLabel             string        `env:"ROLLER_READY_LABEL"`
+	ReadyDaemonSets        []string      `env:"ROLLER_READY_DAEMONSETS" envSeparator:","`
+	MatchNodesByInstanceID bool          `env:"ROLLER_MATCH_NODES_BY_INSTANCE_ID" envDefault:"false"`
+	OriginalDesiredOnTag   bool          `env:"ROLLER_ORIGINAL_DESIRED_ON_TAG" envDefault:"false"`
+	DuplicateDesiredTags   string        `env:"ROLLER_DUPLICATE_ORIGINAL_DESIRED_TAGS" envDefault:"max"`
+	TagBatchSize           int           `env:"ROLLER_TAG_BATCH_SIZE" envDefault:"20"`
+	StateBackend           string        `env:"ROLLER_STATE_BACKEND" envDefault:"tag"`
+	StateSSMPrefix         string        `env:"ROLLER_STATE_SSM_PREFIX" envDefault:"/aws-asg-roller/original-desired"`
+	StateDynamoDBTable     string        `env:"ROLLER_STATE_DYNAMODB_TABLE"`
+	PersistRollState       bool          `env:"ROLLER_PERSIST_ROLL_STATE" envDefault:"false"`
+	RefreshOriginalDesired bool          `env:"ROLLER_REFRESH_ORIGINAL_DESIRED" envDefault:"false"`
+	ASGS                   []string      `env:"ROLLER_ASG" envSeparator:","`
+	ASGTags                []string      `env:"ROLLER_ASG_TAGS" envSeparator:","`
+	ASGPattern             string        `env:"ROLLER_ASG_PATTERN"`
+	ASGConfig              string        `env:"ROLLER_ASG_CONFIG"`
+	CompareLaunchConfigs   bool          `env:"ROLLER_COMPARE_LAUNCH_CONFIG_CONTENTS" envDefault:"false"`
+	RequireIMDSv2          bool          `env:"ROLLER_REQUIRE_IMDSV2" envDefault:"false"`
+	CompareAMI             bool          `env:"ROLLER_COMPARE_AMI" envDefault:"false"`
+	MissingLTVersions      string        `env:"ROLLER_MISSING_TEMPLATE_VERSIONS" envDefault:"old"`
+	IncludeStandby         bool          `env:"ROLLER_INCLUDE_STANDBY" envDefault:"false"`
+	SkipTag                string        `env:"ROLLER_SKIP_TAG" envDefault:"aws-asg-roller/skip"`
+	CompleteLifecycleHooks bool          `env:"ROLLER_COMPLETE_LIFECYCLE_HOOKS" envDefault:"false"`
+	SkipWithoutLaunch      bool          `env:"ROLLER_SKIP_WITHOUT_LAUNCH_CONFIG" envDefault:"false"`
+	MissingASGError        bool          `env:"ROLLER_MISSING_ASG_ERROR" envDefault:"false"`
+	StrictASG              bool          `env:"ROLLER_STRICT_ASG" envDefault:"false"`
+	KubernetesEnabled      bool          `env:"ROLLER_KUBERNETES" envDefault:"true"`
+	KubernetesRequired     bool          `env:"ROLLER_KUBERNETES_REQUIRED" envDefault:"false"`
+	Verbose                bool          `env:"ROLLER_VERBOSE" envDefault:"false"`
+	DescribeConcurrency    int           `env:"ROLLER_DESCRIBE_CONCURRENCY" envDefault:"1"`
+	TemplateConcurrency    int           `env:"ROLLER_TEMPLATE_CONCURRENCY" envDefault:"0"`
+	Concurrency            int           `env:"ROLLER_CONCURRENCY" envDefault:"1"`
+	LookupConcurrency      int           `env:"ROLLER_LOOKUP_CONCURRENCY" envDefault:"1"`
+	BatchSize              int           `env:"ROLLER_BATCH_SIZE" envDefault:"1"`
+	MaxTerminate           int           `env:"ROLLER_MAX_TERMINATE" envDefault:"1"`
+	InitialSurge           int           `env:"ROLLER_INITIAL_SURGE" envDefault:"1"`
+	Strategy               string        `env:"ROLLER_STRATEGY" envDefault:"surge"`
+	MaxSurgeSetting        string        `env:"ROLLER_MAX_SURGE" envDefault:"-1"`
+	MaxUnavailable         int           `env:"ROLLER_MAX_UNAVAILABLE" envDefault:"-1"`
+	SkipZeroDesired        bool          `env:"ROLLER_SKIP_ZERO_DESIRED" envDefault:"false"`
+	SkipDuringActivities   bool          `env:"ROLLER_SKIP_DURING_ACTIVITIES" envDefault:"true"`
+	PostRollCooldown       time.Duration `env:"ROLLER_POST_ROLL_COOLDOWN" envDefault:"0s"`
+	TerminateCooldown      time.Duration `env:"ROLLER_TERMINATE_COOLDOWN" envDefault:"0s"`
+	MaxRollingASGs         int           `env:"ROLLER_MAX_ROLLING_ASGS" envDefault:"0"`
+	InstanceRefresh        bool          `env:"ROLLER_USE_INSTANCE_REFRESH" envDefault:"false"`
+	RefreshMinHealthy      int           `env:"ROLLER_INSTANCE_REFRESH_MIN_HEALTHY" envDefault:"90"`
+	IncludeWarmPool        bool          `env:"ROLLER_INCLUDE_WARM_POOL" envDefault:"false"`
+	TerminateViaEC2        bool          `env:"ROLLER_TERMINATE_VIA_EC2" envDefault:"false"`
+	TagTerminated          bool          `env:"ROLLER_TAG_TERMINATED" envDefault:"false"`
+	TerminateDedupWindow   time.Duration `env:"ROLLER_TERMINATE_DEDUP_WINDOW" envDefault:"0s"`
+	LoadBalancerHealth     bool          `env:"ROLLER_LOAD_BALANCER_HEALTH" envDefault:"false"`
+	WaitForELB             bool          `env:"ROLLER_WAIT_FOR_ELB" envDefault:"false"`
+	VerifyReplacement      bool          `env:"ROLLER_VERIFY_REPLACEMENT" envDefault:"false"`
+	ReplacementTimeout     time.Duration `env:"ROLLER_REPLACEMENT_TIMEOUT" envDefault:"0s"`
+	PendingTimeout         time.Duration `env:"ROLLER_PENDING_TIMEOUT" envDefault:"0s"`
+	UnhealthyTimeout       time.Duration `env:"ROLLER_UNHEALTHY_TIMEOUT" envDefault:"0s"`
+	HealthGracePeriod      time.Duration `env:"ROLLER_HEALTH_GRACE_PERIOD" envDefault:"0s"`
+	CheckQuota             bool          `env:"ROLLER_CHECK_QUOTA" envDefault:"false"`
+	Paused                 bool          `env:"ROLLER_PAUSED" envDefault:"false"`
+	DryRun                 bool          `env:"ROLLER_DRY_RUN" envDefault:"false"`
+	LogPlan                bool          `env:"ROLLER_LOG_PLAN" envDefault:"false"`
+	ValidatePlan           bool          `env:"ROLLER_VALIDATE_PLAN" envDefault:"false"`
+	SlackWebhookURL        string        `env:"ROLLER_SLACK_WEBHOOK_URL"`
+	SQSQueueURL            string        `env:"ROLLER_SQS_QUEUE_URL"`
+	PostRollWebhook        string        `env:"ROLLER_POST_ROLL_WEBHOOK"`
+	PostRollCommand        string        `env:"ROLLER_POST_ROLL_COMMAND"`
+	PostRollTimeout        time.Duration `env:"ROLLER_POST_ROLL_TIMEOUT" envDefault:"5m"`
+	ReportS3Bucket         string        `env:"ROLLER_REPORT_S3_BUCKET"`
+	ReportS3Key            string        `env:"ROLLER_REPORT_S3_KEY" envDefault:"aws-asg-roller/report.json"`
+	MetricsAddress         string        `env:"ROLLER_METRICS_ADDRESS" envDefault:":9090"`
+	CloudWatchMetrics      bool          `env:"ROLLER_CLOUDWATCH_METRICS" envDefault:"false"`
+	CloudWatchNamespace    string        `env:"ROLLER_CW_NAMESPACE" envDefault:"ASGRoller"`
+	DecisionsNDJSON        bool          `env:"ROLLER_DECISIONS_NDJSON" envDefault:"false"`
+	ShutdownSummary        bool          `env:"ROLLER_SHUTDOWN_SUMMARY" envDefault:"false"`
+	HealthAddress          string        `env:"ROLLER_HEALTH_ADDRESS" envDefault:":8080"`
+	ReadyMaxFailures       int           `env:"ROLLER_READY_MAX_FAILURES" envDefault:"3"`
+	AWSRegion              string        `env:"ROLLER_AWS_REGION"`
+	AWSEndpoint            string        `env:"ROLLER_AWS_ENDPOINT"`
+	AssumeRoleARN          string        `env:"ROLLER_ASSUME_ROLE_ARN"`
+	AssumeRoleExternalID   string        `env:"ROLLER_ASSUME_ROLE_EXTERNAL_ID"`
+	CredentialsTimeout     time.Duration `env:"ROLLER_CREDENTIALS_TIMEOUT" envDefault:"0s"`
+	AppConfigApplication   string        `env:"ROLLER_APPCONFIG_APPLICATION"`
+	AppConfigEnvironment   string        `env:"ROLLER_APPCONFIG_ENVIRONMENT"`
+	AppConfigConfiguration string        `env:"ROLLER_APPCONFIG_CONFIGURATION"`
+	AppConfigClientID      string        `env:"ROLLER_APPCONFIG_CLIENT_ID" envDefault:"aws-asg-roller"`
+	AppConfigRefresh       time.Duration `env:"ROLLER_APPCONFIG_REFRESH" envDefault:"5m"`
+
+	// max surge, parsed from MaxSurgeSetting, as a number of instances, or a percentage of the original
+	// desired count, if set
+	MaxSurge        int
+	MaxSurgePercent int
+
+	// per-ASG overrides, parsed from ASGConfig
+	ASGOverrides map[string]asgConfigOverride
+	// tags to discover ASGs by, parsed from ASGTags
+	ASGTagFilters map[string]string
+	// pattern to discover ASGs by name, compiled from ASGPattern
+	ASGNamePattern *regexp.Regexp
 }
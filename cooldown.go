@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+const asgTagNameLastRollFinished = "aws-asg-roller/LastRollFinished"
+
+// recordRollFinished records when an ASG finished rolling as a tag on the ASG, so that its post-roll
+// cooldown is kept in the case of the process terminating. In a dry run the tag is left alone.
+func recordRollFinished(state *rollerState, asg *autoscaling.Group, asgSvc asgClient, dryRun, verbose bool) error {
+	asgName := *asg.AutoScalingGroupName
+	finished, ok := state.getLastFinished(asgName)
+	if !ok {
+		return nil
+	}
+	if dryRun {
+		log.Printf("dry run: would record roll finished at %v in tag '%s' on ASG: %s", finished, asgTagNameLastRollFinished, asgName)
+		return nil
+	}
+	_, err := asgSvc.CreateOrUpdateTags(&autoscaling.CreateOrUpdateTagsInput{
+		Tags: []*autoscaling.Tag{
+			{
+				Key:               aws.String(asgTagNameLastRollFinished),
+				PropagateAtLaunch: aws.Bool(false),
+				ResourceId:        aws.String(asgName),
+				ResourceType:      aws.String("auto-scaling-group"),
+				Value:             aws.String(finished.UTC().Format(time.RFC3339)),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to set tag '%s' for ASG %s: %v", asgTagNameLastRollFinished, asgName, err)
+	}
+	if verbose {
+		log.Printf("recorded roll finished at %v in tag on ASG: %s", finished, asgName)
+	}
+	return nil
+}
+
+// cooldownRemaining returns how much is left of the post-roll cooldown of an ASG, during which it is not
+// rolled again, or 0 if there is none left. When the ASG last finished rolling is taken from the state,
+// or else from the tag on the ASG.
+func cooldownRemaining(state *rollerState, asg *autoscaling.Group, cooldown time.Duration, now time.Time) (time.Duration, error) {
+	if cooldown <= 0 {
+		return 0, nil
+	}
+	asgName := *asg.AutoScalingGroupName
+	finished, ok := state.getLastFinished(asgName)
+	if !ok {
+		for _, tag := range asg.Tags {
+			if aws.StringValue(tag.Key) != asgTagNameLastRollFinished {
+				continue
+			}
+			tagFinished, err := time.Parse(time.RFC3339, aws.StringValue(tag.Value))
+			if err != nil {
+				return 0, fmt.Errorf("unable to read tag '%s' for ASG %s: %v", asgTagNameLastRollFinished, asgName, err)
+			}
+			state.setLastFinished(asgName, tagFinished)
+			finished, ok = tagFinished, true
+		}
+	}
+	if !ok {
+		return 0, nil
+	}
+	if remaining := finished.Add(cooldown).Sub(now); remaining > 0 {
+		return remaining, nil
+	}
+	return 0, nil
+}
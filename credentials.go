@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// how long to wait between attempts to get valid AWS credentials at startup
+const credentialsRetryInterval = 5 * time.Second
+
+// waitForCredentials waits until AWS credentials are valid, checking by identifying the caller, for up to
+// the timeout. When running with a role for a service account, or assuming a role, credentials may not be
+// available yet when the process starts, and the first loop would otherwise fail.
+func waitForCredentials(stsSvc stsClient, timeout time.Duration) error {
+	var waited time.Duration
+	for {
+		out, err := stsSvc.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+		if err == nil {
+			log.Printf("using AWS credentials for %s", aws.StringValue(out.Arn))
+			return nil
+		}
+		if waited+credentialsRetryInterval > timeout {
+			return fmt.Errorf("no valid AWS credentials within %v: %v", timeout, err)
+		}
+		log.Printf("AWS credentials not valid yet, retrying in %v: %v", credentialsRetryInterval, err)
+		sleep(credentialsRetryInterval)
+		waited += credentialsRetryInterval
+	}
+}
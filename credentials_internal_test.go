@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// mockStsSvc fails to identify the caller a number of times before succeeding
+type mockStsSvc struct {
+	failures int
+	calls    int
+}
+
+func (m *mockStsSvc) GetCallerIdentity(in *sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error) {
+	m.calls++
+	if m.calls <= m.failures {
+		return nil, fmt.Errorf("NoCredentialProviders: no valid providers in chain")
+	}
+	return &sts.GetCallerIdentityOutput{Arn: aws.String("arn:aws:sts::123456789012:assumed-role/roller/session")}, nil
+}
+
+func TestWaitForCredentials(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		timeout  time.Duration
+		calls    int
+		slept    time.Duration
+		err      bool
+	}{
+		{"valid at once", 0, 30 * time.Second, 1, 0, false},
+		{"valid after retries", 2, 30 * time.Second, 3, 2 * credentialsRetryInterval, false},
+		{"valid just in time", 2, 2 * credentialsRetryInterval, 3, 2 * credentialsRetryInterval, false},
+		{"never valid", 100, 30 * time.Second, 7, 6 * credentialsRetryInterval, true},
+		{"timeout shorter than retry", 1, time.Second, 1, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var slept time.Duration
+			sleep = func(d time.Duration) {
+				slept += d
+			}
+			defer func() { sleep = time.Sleep }()
+			svc := &mockStsSvc{failures: tt.failures}
+			err := waitForCredentials(svc, tt.timeout)
+			switch {
+			case err == nil && tt.err:
+				t.Errorf("no error, expected one")
+			case err != nil && !tt.err:
+				t.Errorf("unexpected error: %v", err)
+			}
+			if svc.calls != tt.calls {
+				t.Errorf("called %d times instead of %d", svc.calls, tt.calls)
+			}
+			if slept != tt.slept {
+				t.Errorf("slept %v instead of %v", slept, tt.slept)
+			}
+		})
+	}
+}
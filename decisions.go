@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// phases of an ASG in a loop, as written to the decisions output
+const (
+	decisionPhaseDone        = "done"
+	decisionPhaseSurging     = "surging"
+	decisionPhaseTerminating = "terminating"
+	decisionPhaseWaiting     = "waiting"
+)
+
+// decision is what the roller decided to do to an ASG in a loop, written as a line of JSON
+type decision struct {
+	ASG           string   `json:"asg"`
+	Phase         string   `json:"phase"`
+	DesiredBefore int64    `json:"desiredBefore"`
+	DesiredAfter  int64    `json:"desiredAfter"`
+	Terminations  []string `json:"terminations"`
+}
+
+// decisionPhase returns the phase of the ASG in the loop: done if it has no old instances left, terminating
+// if old instances were terminated, surging if desired was raised, otherwise waiting, e.g. for new nodes
+// to be ready
+func decisionPhase(status RollStatus) string {
+	switch {
+	case status.Done:
+		return decisionPhaseDone
+	case len(status.Terminated) > 0:
+		return decisionPhaseTerminating
+	case status.Desired > status.DesiredBefore:
+		return decisionPhaseSurging
+	default:
+		return decisionPhaseWaiting
+	}
+}
+
+// writeDecisions writes the decisions of a loop as newline-delimited JSON, a line for each ASG, so that they
+// can be piped to other tools, apart from the logs
+func writeDecisions(w io.Writer, statuses []RollStatus) error {
+	encoder := json.NewEncoder(w)
+	for _, status := range statuses {
+		terminations := status.Terminated
+		if terminations == nil {
+			terminations = []string{}
+		}
+		err := encoder.Encode(decision{
+			ASG:           status.ASG,
+			Phase:         decisionPhase(status),
+			DesiredBefore: status.DesiredBefore,
+			DesiredAfter:  status.Desired,
+			Terminations:  terminations,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
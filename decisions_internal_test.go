@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func TestWriteDecisions(t *testing.T) {
+	statuses := []RollStatus{
+		{ASG: "surging", OldInstances: 2, DesiredBefore: 2, Desired: 3, Terminated: []string{}},
+		{ASG: "terminating", OldInstances: 2, NewInstances: 1, DesiredBefore: 3, Desired: 3, Terminated: []string{"1"}},
+		{ASG: "waiting", OldInstances: 1, NewInstances: 1, DesiredBefore: 3, Desired: 3},
+		{ASG: "done", NewInstances: 2, DesiredBefore: 3, Desired: 2, Terminated: []string{}, Done: true},
+	}
+	var buf bytes.Buffer
+	if err := writeDecisions(&buf, statuses); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(statuses) {
+		t.Fatalf("expected %d lines, one per ASG, had %d: %q", len(statuses), len(lines), buf.String())
+	}
+	expected := []map[string]interface{}{
+		{"asg": "surging", "phase": "surging", "desiredBefore": 2.0, "desiredAfter": 3.0, "terminations": []interface{}{}},
+		{"asg": "terminating", "phase": "terminating", "desiredBefore": 3.0, "desiredAfter": 3.0, "terminations": []interface{}{"1"}},
+		{"asg": "waiting", "phase": "waiting", "desiredBefore": 3.0, "desiredAfter": 3.0, "terminations": []interface{}{}},
+		{"asg": "done", "phase": "done", "desiredBefore": 3.0, "desiredAfter": 2.0, "terminations": []interface{}{}},
+	}
+	for i, line := range lines {
+		var actual map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &actual); err != nil {
+			t.Errorf("line %d: invalid JSON %q: %v", i, line, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, expected[i]) {
+			t.Errorf("line %d: mismatched decision, actual %v expected %v", i, actual, expected[i])
+		}
+	}
+}
+
+func TestAdjustDecisions(t *testing.T) {
+	// a loop writes a line for each ASG it adjusted
+	asgs := []string{"asg1", "asg2"}
+	asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{}}
+	for _, name := range asgs {
+		asgSvc.groups[name] = &autoscaling.Group{
+			AutoScalingGroupName:    aws.String(name),
+			DesiredCapacity:         aws.Int64(2),
+			MaxSize:                 aws.Int64(3),
+			LaunchConfigurationName: aws.String("lconfig"),
+			Instances: []*autoscaling.Instance{
+				{InstanceId: aws.String(name + "-1"), LaunchConfigurationName: aws.String("oldlconfig"), HealthStatus: aws.String(healthy)},
+				{InstanceId: aws.String(name + "-2"), LaunchConfigurationName: aws.String("oldlconfig"), HealthStatus: aws.String(healthy)},
+			},
+		}
+	}
+	configs := Configs{KubernetesEnabled: kubernetesEnabled, ASGS: asgs, MaxSurge: 1, MaxTerminate: 1}
+	statuses, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, newRollerState())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := writeDecisions(&buf, statuses); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(asgs) {
+		t.Fatalf("expected %d lines, had %q", len(asgs), buf.String())
+	}
+	for i, line := range lines {
+		var actual decision
+		if err := json.Unmarshal([]byte(line), &actual); err != nil {
+			t.Fatalf("line %d: invalid JSON %q: %v", i, line, err)
+		}
+		expected := decision{ASG: asgs[i], Phase: decisionPhaseSurging, DesiredBefore: 2, DesiredAfter: 3, Terminations: []string{}}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("line %d: mismatched decision, actual %+v expected %+v", i, actual, expected)
+		}
+	}
+}
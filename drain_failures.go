@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// what to do with a node that failed to drain as many times as allowed
+const (
+	// drain the node with force, removing pods that draining otherwise would not, e.g. ones not managed by a
+	// controller
+	drainFailureActionForce = "force"
+	// terminate the node without draining it
+	drainFailureActionTerminate = "terminate"
+	// leave the node as it is, and roll the rest of the group
+	drainFailureActionSkip = "skip"
+	// stop rolling the group
+	drainFailureActionAbort = "abort"
+)
+
+// drainFailedInstance returns the ID of the instance that failed to drain, if the error is a drain failure
+func drainFailedInstance(err error) (string, bool) {
+	switch e := err.(type) {
+	case *drainTimeoutError:
+		return e.id, e.id != ""
+	case *drainError:
+		return e.id, e.id != ""
+	}
+	return "", false
+}
+
+// escalateDrainFailures applies the action to the old instances of an ASG that failed to drain at least
+// limit times, so that a node that never drains does not stall the roll forever. It returns the old
+// instances to consider for termination, whether to drain them, whether to force the drain, and whether to
+// roll the group at all.
+func escalateDrainFailures(state *rollerState, asg *autoscaling.Group, oldInstances []*autoscaling.Instance, drain, drainForce bool, limit int, action string) ([]*autoscaling.Instance, bool, bool, bool) {
+	asgName := *asg.AutoScalingGroupName
+	failed := state.failedToDrain(asgName, asg.Instances, limit)
+	escalated := make([]*autoscaling.Instance, 0)
+	rest := make([]*autoscaling.Instance, 0)
+	for _, i := range oldInstances {
+		if failed[*i.InstanceId] {
+			escalated = append(escalated, i)
+		} else {
+			rest = append(rest, i)
+		}
+	}
+	if len(escalated) == 0 {
+		return oldInstances, drain, drainForce, true
+	}
+	ids := mapInstancesIds(escalated)
+	switch action {
+	case drainFailureActionAbort:
+		log.Printf("[%s] ERROR: nodes %v failed to drain %d times, not rolling the group - skipping\n", asgName, ids, limit)
+		return nil, drain, drainForce, false
+	case drainFailureActionSkip:
+		if len(rest) == 0 {
+			// with no other old instances to roll, the group would otherwise appear done
+			log.Printf("[%s] ERROR: nodes %v failed to drain %d times, and are the only old instances left - skipping\n", asgName, ids, limit)
+			return nil, drain, drainForce, false
+		}
+		log.Printf("[%s] WARNING: nodes %v failed to drain %d times, leaving them and rolling the rest\n", asgName, ids, limit)
+		return rest, drain, drainForce, true
+	case drainFailureActionTerminate:
+		log.Printf("[%s] WARNING: nodes %v failed to drain %d times, terminating them without draining\n", asgName, ids, limit)
+		return escalated, false, drainForce, true
+	default:
+		log.Printf("[%s] WARNING: nodes %v failed to drain %d times, draining them with force\n", asgName, ids, limit)
+		return escalated, drain, true, true
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func TestAdjustDrainFailures(t *testing.T) {
+	tests := []struct {
+		desc       string
+		limit      int
+		action     string
+		drained    []bool
+		forced     bool
+		terminated []string
+	}{
+		// without a limit, the node is drained again as before, and terminated once it drains
+		{"no limit", 0, drainFailureActionForce, []bool{true}, false, []string{"1"}},
+		{"force", 2, drainFailureActionForce, []bool{true}, true, []string{"1"}},
+		{"terminate", 2, drainFailureActionTerminate, []bool{false}, false, []string{"1"}},
+		{"skip", 2, drainFailureActionSkip, []bool{true}, false, []string{"2"}},
+		{"abort", 2, drainFailureActionAbort, []bool{}, false, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// part way through a roll, with new instances ready to replace old ones
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			instances := make([]*autoscaling.Instance, 0)
+			for _, id := range []string{"1", "2"} {
+				instances = append(instances, &autoscaling.Instance{InstanceId: aws.String(id), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy})
+			}
+			for _, id := range []string{"new1", "new2"} {
+				instances = append(instances, &autoscaling.Instance{InstanceId: aws.String(id), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy})
+			}
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(3),
+					MaxSize:                 aws.Int64(3),
+					LaunchConfigurationName: &lcName,
+					Instances:               instances,
+				},
+			}}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 2}
+			state.setRolling(name, true)
+			configs := Configs{
+				KubernetesEnabled:  kubernetesEnabled,
+				ASGS:               []string{name},
+				Drain:              true,
+				DrainForce:         false,
+				MaxTerminate:       1,
+				DrainFailureLimit:  tt.limit,
+				DrainFailureAction: tt.action,
+			}
+			// a pod on the first old node never evicts
+			handler := &testReadyHandler{terminateError: &drainError{hostname: "host1", id: "1", err: fmt.Errorf("pod will not evict")}}
+			for i := 0; i < 2; i++ {
+				if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, handler, nil, nil, nil, state); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if len(asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup")) != 0 {
+				t.Fatalf("unexpected termination before the drain failure limit")
+			}
+
+			// once the limit is reached, the configured escalation kicks in
+			handler.terminateError = nil
+			handler.counter = funcCounter{}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, handler, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			drained := make([]bool, 0)
+			forced := false
+			for _, c := range handler.counter.filterByName("prepareTermination") {
+				drained = append(drained, c.params[2].(bool))
+				forced = forced || c.params[3].(bool)
+			}
+			terminated := make([]string, 0)
+			for _, c := range asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup") {
+				terminated = append(terminated, *c.params[0].(*autoscaling.TerminateInstanceInAutoScalingGroupInput).InstanceId)
+			}
+			if len(drained) != len(tt.drained) || (len(drained) > 0 && drained[0] != tt.drained[0]) {
+				t.Errorf("mismatched drains, actual %v expected %v", drained, tt.drained)
+			}
+			if forced != tt.forced {
+				t.Errorf("mismatched force of the drain, actual %v expected %v", forced, tt.forced)
+			}
+			if !testStringEq(terminated, tt.terminated) {
+				t.Errorf("mismatched terminated instances, actual %v expected %v", terminated, tt.terminated)
+			}
+		})
+	}
+}
+
+func TestFailedToDrain(t *testing.T) {
+	state := newRollerState()
+	for i := 0; i < 3; i++ {
+		state.addDrainFailure("myasg", "1")
+	}
+	state.addDrainFailure("myasg", "2")
+	state.addDrainFailure("myasg", "gone")
+	instances := []*autoscaling.Instance{{InstanceId: aws.String("1")}, {InstanceId: aws.String("2")}}
+	failed := state.failedToDrain("myasg", instances, 2)
+	if len(failed) != 1 || !failed["1"] {
+		t.Errorf("mismatched failed instances, actual %v expected [1]", failed)
+	}
+	// instances that left the ASG are forgotten
+	if failures := state.addDrainFailure("myasg", "gone"); failures != 1 {
+		t.Errorf("mismatched failures for instance that left, actual %d expected 1", failures)
+	}
+}
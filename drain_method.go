@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	drainer "github.com/openshift/kubernetes-drain"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ways to drain a node
+const (
+	// the drain library, the default
+	drainMethodLibrary = "library"
+	// cordon the node and evict its pods with the eviction API, respecting PodDisruptionBudgets
+	drainMethodEvict = "evict"
+	// cordon the node and delete its pods, ignoring PodDisruptionBudgets, for clusters where neither the
+	// library nor eviction work
+	drainMethodDelete = "delete"
+)
+
+// the version of the eviction API that replaces policy/v1beta1, served from Kubernetes 1.22
+const evictionVersionV1 = "v1"
+
+// how long to wait between checks that evicted or deleted pods are gone, and between attempts to evict a
+// pod that a PodDisruptionBudget does not allow to be evicted yet
+var drainPollInterval = 5 * time.Second
+
+// nodeDrainer drains a node of its pods, so that the implementation can be swapped, e.g. when the drain
+// library does not work with the API of the cluster. Draining stops when the context is done, if the
+// implementation can be interrupted.
+type nodeDrainer interface {
+	drainNode(ctx context.Context, node *corev1.Node, force bool) error
+}
+
+// newNodeDrainer returns the drainer for the method, the drain library if it is not set. Pods removed are
+// given gracePeriod seconds to stop, or their own termination grace period if it is negative.
+func newNodeDrainer(method string, clientset kubernetes.Interface, ignoreDaemonSets, deleteLocalData bool, gracePeriod int) nodeDrainer {
+	switch method {
+	case drainMethodEvict, drainMethodDelete:
+		return &podDrainer{clientset: clientset, ignoreDaemonSets: ignoreDaemonSets, deleteLocalData: deleteLocalData, gracePeriod: gracePeriod, evict: method == drainMethodEvict}
+	default:
+		return &libraryDrainer{clientset: clientset, ignoreDaemonSets: ignoreDaemonSets, deleteLocalData: deleteLocalData, gracePeriod: gracePeriod}
+	}
+}
+
+// libraryDrainer drains nodes with the drain library
+type libraryDrainer struct {
+	clientset        kubernetes.Interface
+	ignoreDaemonSets bool
+	deleteLocalData  bool
+	// seconds pods are given to stop, -1 for their own termination grace period
+	gracePeriod int
+}
+
+// drainNode drains the node with the drain library, which cannot be interrupted, so ignores the context
+func (d *libraryDrainer) drainNode(ctx context.Context, node *corev1.Node, force bool) error {
+	return drainer.Drain(d.clientset, []*corev1.Node{node}, &drainer.DrainOptions{
+		IgnoreDaemonsets:   d.ignoreDaemonSets,
+		GracePeriodSeconds: d.gracePeriod,
+		Force:              force,
+		DeleteLocalData:    d.deleteLocalData,
+	})
+}
+
+// podDrainer drains nodes directly with the clientset: it cordons the node, then evicts or deletes each
+// of the pods draining removes, and waits for them to be gone
+type podDrainer struct {
+	clientset        kubernetes.Interface
+	ignoreDaemonSets bool
+	deleteLocalData  bool
+	// seconds pods are given to stop, negative for their own termination grace period
+	gracePeriod int
+	// evict the pods with the eviction API, rather than deleting them
+	evict bool
+}
+
+func (d *podDrainer) drainNode(ctx context.Context, node *corev1.Node, force bool) error {
+	var evictVersion string
+	if d.evict {
+		version, err := d.evictionVersion()
+		if err != nil {
+			return err
+		}
+		evictVersion = version
+	}
+	if err := d.cordon(node); err != nil {
+		return err
+	}
+	pods, err := d.podsToRemove(node, force)
+	if err != nil {
+		return err
+	}
+	for _, p := range pods {
+		if err := d.remove(ctx, p, evictVersion); err != nil {
+			return err
+		}
+	}
+	for _, p := range pods {
+		if err := d.waitForRemoval(ctx, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evictionVersion returns the version of the eviction API to evict pods with: policy/v1 if the cluster serves
+// it, or else policy/v1beta1, which older clusters serve, and newer ones no longer do
+func (d *podDrainer) evictionVersion() (string, error) {
+	groups, err := d.clientset.Discovery().ServerGroups()
+	if err != nil {
+		return "", fmt.Errorf("unable to check which eviction API the cluster serves: %v", err)
+	}
+	for _, group := range groups.Groups {
+		if group.Name != policyv1beta1.GroupName {
+			continue
+		}
+		for _, version := range group.Versions {
+			if version.Version == evictionVersionV1 {
+				return evictionVersionV1, nil
+			}
+		}
+	}
+	return policyv1beta1.SchemeGroupVersion.Version, nil
+}
+
+// cordon marks the node unschedulable, so that the pods removed are not scheduled back onto it
+func (d *podDrainer) cordon(node *corev1.Node) error {
+	current, err := d.clientset.CoreV1().Nodes().Get(node.ObjectMeta.Name, v1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to get node %s to cordon it: %v", node.ObjectMeta.Name, err)
+	}
+	if current.Spec.Unschedulable {
+		return nil
+	}
+	current.Spec.Unschedulable = true
+	if _, err := d.clientset.CoreV1().Nodes().Update(current); err != nil {
+		return fmt.Errorf("unable to cordon node %s: %v", node.ObjectMeta.Name, err)
+	}
+	return nil
+}
+
+// podsToRemove returns the pods on the node that draining removes. As with the drain library, it is an
+// error if there are DaemonSet pods, unless they are ignored, pods that are not managed by a controller,
+// unless forced, or pods with local data, unless it may be deleted. Nothing is removed in that case.
+func (d *podDrainer) podsToRemove(node *corev1.Node, force bool) ([]corev1.Pod, error) {
+	pods, err := d.clientset.CoreV1().Pods(v1.NamespaceAll).List(v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get pods on node %s: %v", node.ObjectMeta.Name, err)
+	}
+	remove := make([]corev1.Pod, 0)
+	problems := make([]string, 0)
+	for _, p := range pods.Items {
+		if p.Spec.NodeName != node.ObjectMeta.Name {
+			continue
+		}
+		name := fmt.Sprintf("%s/%s", p.ObjectMeta.Namespace, p.ObjectMeta.Name)
+		controller := v1.GetControllerOf(&p)
+		switch {
+		case controller != nil && controller.Kind == "DaemonSet" && !d.ignoreDaemonSets:
+			problems = append(problems, fmt.Sprintf("DaemonSet-managed pod %s", name))
+			continue
+		case !drainablePod(&p):
+			continue
+		case controller == nil && !force:
+			problems = append(problems, fmt.Sprintf("pod %s not managed by a controller", name))
+			continue
+		case hasLocalData(&p) && !d.deleteLocalData:
+			problems = append(problems, fmt.Sprintf("pod %s with local storage", name))
+			continue
+		}
+		remove = append(remove, p)
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("cannot drain node %s: %s", node.ObjectMeta.Name, strings.Join(problems, ", "))
+	}
+	return remove, nil
+}
+
+// hasLocalData reports if the pod has an emptyDir volume, whose data is lost when the pod is removed
+func hasLocalData(p *corev1.Pod) bool {
+	for _, volume := range p.Spec.Volumes {
+		if volume.EmptyDir != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// remove evicts the pod with the eviction API of the version, or deletes it if the version is empty.
+// Evicting a pod that a PodDisruptionBudget does not yet allow to be disrupted is retried until it is
+// allowed, or the context is done. A pod that is already gone is removed.
+func (d *podDrainer) remove(ctx context.Context, p corev1.Pod, evictVersion string) error {
+	pods := d.clientset.CoreV1().Pods(p.ObjectMeta.Namespace)
+	eviction := &policyv1beta1.Eviction{
+		ObjectMeta:    v1.ObjectMeta{Name: p.ObjectMeta.Name, Namespace: p.ObjectMeta.Namespace},
+		DeleteOptions: d.deleteOptions(),
+	}
+	for {
+		var err error
+		switch evictVersion {
+		case "":
+			err = pods.Delete(p.ObjectMeta.Name, d.deleteOptions())
+		case evictionVersionV1:
+			err = d.evictV1(eviction)
+		default:
+			err = pods.Evict(eviction)
+		}
+		switch {
+		case err == nil || apierrors.IsNotFound(err):
+			return nil
+		case evictVersion != "" && apierrors.IsTooManyRequests(err):
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("gave up evicting pod %s/%s, which its disruption budget does not allow: %v", p.ObjectMeta.Namespace, p.ObjectMeta.Name, ctx.Err())
+			case <-time.After(drainPollInterval):
+			}
+		default:
+			return fmt.Errorf("unable to remove pod %s/%s: %v", p.ObjectMeta.Namespace, p.ObjectMeta.Name, err)
+		}
+	}
+}
+
+// evictV1 evicts a pod with the policy/v1 eviction API. The pinned client-go only has the policy/v1beta1
+// Eviction type, whose fields are the same, so the eviction is posted as policy/v1 directly.
+func (d *podDrainer) evictV1(eviction *policyv1beta1.Eviction) error {
+	v1Eviction := eviction.DeepCopy()
+	v1Eviction.TypeMeta = v1.TypeMeta{APIVersion: policyv1beta1.GroupName + "/" + evictionVersionV1, Kind: "Eviction"}
+	body, err := json.Marshal(v1Eviction)
+	if err != nil {
+		return err
+	}
+	return d.clientset.CoreV1().RESTClient().Post().
+		Namespace(eviction.ObjectMeta.Namespace).
+		Resource("pods").
+		Name(eviction.ObjectMeta.Name).
+		SubResource("eviction").
+		Body(body).
+		Do().
+		Error()
+}
+
+// deleteOptions are the options to remove pods with, which leave the pods their own termination grace period
+// unless the drainer has one
+func (d *podDrainer) deleteOptions() *v1.DeleteOptions {
+	options := &v1.DeleteOptions{}
+	if d.gracePeriod >= 0 {
+		gracePeriod := int64(d.gracePeriod)
+		options.GracePeriodSeconds = &gracePeriod
+	}
+	return options
+}
+
+// waitForRemoval waits for the pod to be gone, or replaced by another pod of the same name, or for the
+// context to be done
+func (d *podDrainer) waitForRemoval(ctx context.Context, p corev1.Pod) error {
+	for {
+		current, err := d.clientset.CoreV1().Pods(p.ObjectMeta.Namespace).Get(p.ObjectMeta.Name, v1.GetOptions{})
+		switch {
+		case apierrors.IsNotFound(err):
+			return nil
+		case err != nil:
+			return fmt.Errorf("unable to check pod %s/%s is gone: %v", p.ObjectMeta.Namespace, p.ObjectMeta.Name, err)
+		case current.ObjectMeta.UID != p.ObjectMeta.UID:
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up waiting for pod %s/%s to be gone: %v", p.ObjectMeta.Namespace, p.ObjectMeta.Name, ctx.Err())
+		case <-time.After(drainPollInterval):
+		}
+	}
+}
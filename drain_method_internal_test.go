@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newEvictionClientset returns a fake clientset with the objects, on which evicting a pod removes it, as the
+// eviction API does, refusing the first refusals evictions as a PodDisruptionBudget would, and records the
+// pods evicted. The fake clientset of the pinned client-go does not expose the tracker of its objects, so it
+// is given one of its own to remove them from.
+func newEvictionClientset(refusals int, evicted *[]string, objects ...runtime.Object) *fake.Clientset {
+	tracker := k8stesting.NewObjectTracker(scheme.Scheme, scheme.Codecs.UniversalDecoder())
+	for _, o := range objects {
+		if err := tracker.Add(o); err != nil {
+			panic(err)
+		}
+	}
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("*", "*", k8stesting.ObjectReaction(tracker))
+	clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		eviction := action.(k8stesting.CreateAction).GetObject().(*policyv1beta1.Eviction)
+		if refusals > 0 {
+			refusals--
+			return true, nil, apierrors.NewTooManyRequests("disruption budget", 1)
+		}
+		*evicted = append(*evicted, eviction.ObjectMeta.Name)
+		gvr := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+		return true, nil, tracker.Delete(gvr, eviction.ObjectMeta.Namespace, eviction.ObjectMeta.Name)
+	})
+	return clientset
+}
+
+func TestPodDrainer(t *testing.T) {
+	tests := []struct {
+		desc     string
+		method   string
+		refusals int
+		removed  []string
+	}{
+		{"evict", drainMethodEvict, 0, []string{"a1", "s1"}},
+		{"evict retried after disruption budget", drainMethodEvict, 2, []string{"a1", "s1"}},
+		{"delete", drainMethodDelete, 0, []string{"a1", "s1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			defer func(interval time.Duration) { drainPollInterval = interval }(drainPollInterval)
+			drainPollInterval = time.Millisecond
+			mirror := testPod("m1", "ip-10-0-0-1.ec2.internal", "", corev1.PodRunning)
+			mirror.ObjectMeta.Annotations = map[string]string{mirrorPodAnnotation: "abc"}
+			evicted := make([]string, 0)
+			clientset := newEvictionClientset(tt.refusals, &evicted,
+				testNode("ip-10-0-0-1.ec2.internal", "", "", true),
+				testPod("a1", "ip-10-0-0-1.ec2.internal", "ReplicaSet", corev1.PodRunning),
+				testPod("s1", "ip-10-0-0-1.ec2.internal", "StatefulSet", corev1.PodRunning),
+				testPod("d1", "ip-10-0-0-1.ec2.internal", "DaemonSet", corev1.PodRunning),
+				testPod("j1", "ip-10-0-0-1.ec2.internal", "Job", corev1.PodSucceeded),
+				testPod("b1", "ip-10-0-0-2.ec2.internal", "ReplicaSet", corev1.PodRunning),
+				mirror,
+			)
+			drainer := newNodeDrainer(tt.method, clientset, true, false, -1)
+			if err := drainer.drainNode(context.Background(), testNode("ip-10-0-0-1.ec2.internal", "", "", true), false); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			node, err := clientset.CoreV1().Nodes().Get("ip-10-0-0-1.ec2.internal", v1.GetOptions{})
+			if err != nil || !node.Spec.Unschedulable {
+				t.Errorf("expected node to be cordoned, error %v", err)
+			}
+			pods, err := clientset.CoreV1().Pods(v1.NamespaceAll).List(v1.ListOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error listing pods: %v", err)
+			}
+			left := map[string]bool{}
+			for _, p := range pods.Items {
+				left[p.ObjectMeta.Name] = true
+			}
+			for _, name := range tt.removed {
+				if left[name] {
+					t.Errorf("pod %s not removed", name)
+				}
+			}
+			for _, name := range []string{"d1", "j1", "b1", "m1"} {
+				if !left[name] {
+					t.Errorf("pod %s unexpectedly removed", name)
+				}
+			}
+			if tt.method == drainMethodEvict && !testStringEq(evicted, tt.removed) {
+				t.Errorf("mismatched evicted pods, actual %v expected %v", evicted, tt.removed)
+			}
+			if tt.method == drainMethodDelete && len(evicted) != 0 {
+				t.Errorf("unexpected evictions %v when deleting", evicted)
+			}
+		})
+	}
+}
+
+func TestPodDrainerRefuses(t *testing.T) {
+	withLocalData := testPod("l1", "ip-10-0-0-1.ec2.internal", "ReplicaSet", corev1.PodRunning)
+	withLocalData.Spec.Volumes = []corev1.Volume{{Name: "scratch", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}}
+	tests := []struct {
+		desc             string
+		pod              *corev1.Pod
+		ignoreDaemonSets bool
+		deleteLocalData  bool
+		force            bool
+		err              bool
+	}{
+		{"unmanaged pod", testPod("u1", "ip-10-0-0-1.ec2.internal", "", corev1.PodRunning), true, false, false, true},
+		{"unmanaged pod forced", testPod("u1", "ip-10-0-0-1.ec2.internal", "", corev1.PodRunning), true, false, true, false},
+		{"DaemonSet pod", testPod("d1", "ip-10-0-0-1.ec2.internal", "DaemonSet", corev1.PodRunning), false, false, false, true},
+		{"DaemonSet pod ignored", testPod("d1", "ip-10-0-0-1.ec2.internal", "DaemonSet", corev1.PodRunning), true, false, false, false},
+		{"local data", withLocalData, true, false, false, true},
+		{"local data deleted", withLocalData, true, true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			evicted := make([]string, 0)
+			clientset := newEvictionClientset(0, &evicted,
+				testNode("ip-10-0-0-1.ec2.internal", "", "", true),
+				testPod("a1", "ip-10-0-0-1.ec2.internal", "ReplicaSet", corev1.PodRunning),
+				tt.pod.DeepCopy(),
+			)
+			drainer := newNodeDrainer(drainMethodEvict, clientset, tt.ignoreDaemonSets, tt.deleteLocalData, -1)
+			err := drainer.drainNode(context.Background(), testNode("ip-10-0-0-1.ec2.internal", "", "", true), tt.force)
+			switch {
+			case tt.err && err == nil:
+				t.Errorf("expected error, had none")
+			case !tt.err && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.err && len(evicted) != 0:
+				// nothing is removed from a node that cannot be drained
+				t.Errorf("unexpected evictions %v", evicted)
+			}
+		})
+	}
+}
+
+func TestPodDrainerGivesUp(t *testing.T) {
+	// a disruption budget that never allows the eviction is waited on no longer than the context allows,
+	// however long the wait between attempts
+	defer func(interval time.Duration) { drainPollInterval = interval }(drainPollInterval)
+	drainPollInterval = time.Minute
+	evicted := make([]string, 0)
+	clientset := newEvictionClientset(1000, &evicted,
+		testNode("ip-10-0-0-1.ec2.internal", "", "", true),
+		testPod("a1", "ip-10-0-0-1.ec2.internal", "ReplicaSet", corev1.PodRunning),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := newNodeDrainer(drainMethodEvict, clientset, true, false, -1).drainNode(ctx, testNode("ip-10-0-0-1.ec2.internal", "", "", true), false)
+	if err == nil {
+		t.Fatalf("expected error, had none")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("gave up after %v, expected at the timeout", elapsed)
+	}
+	if len(evicted) != 0 {
+		t.Errorf("unexpected evictions %v", evicted)
+	}
+}
+
+// policyV1Server is an API server that serves the policy/v1 eviction API, and no other, which refuses the
+// first refusals evictions as a PodDisruptionBudget would, and records the pods evicted and the API version
+// of each eviction
+type policyV1Server struct {
+	refusals int
+	evicted  []string
+	versions []string
+}
+
+func (s *policyV1Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api":
+		json.NewEncoder(w).Encode(v1.APIVersions{Versions: []string{"v1"}})
+	case r.Method == http.MethodGet && r.URL.Path == "/apis":
+		policy := v1.GroupVersionForDiscovery{GroupVersion: "policy/v1", Version: "v1"}
+		json.NewEncoder(w).Encode(v1.APIGroupList{Groups: []v1.APIGroup{{Name: "policy", Versions: []v1.GroupVersionForDiscovery{policy}, PreferredVersion: policy}}})
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/eviction"):
+		var eviction policyv1beta1.Eviction
+		if err := json.NewDecoder(r.Body).Decode(&eviction); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.versions = append(s.versions, eviction.TypeMeta.APIVersion)
+		if s.refusals > 0 {
+			s.refusals--
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(apierrors.NewTooManyRequests("disruption budget", 1).ErrStatus)
+			return
+		}
+		s.evicted = append(s.evicted, eviction.ObjectMeta.Name)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(v1.Status{Status: v1.StatusSuccess})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(apierrors.NewNotFound(schema.GroupResource{}, r.URL.Path).ErrStatus)
+	}
+}
+
+func TestPodDrainerEvictV1(t *testing.T) {
+	defer func(interval time.Duration) { drainPollInterval = interval }(drainPollInterval)
+	drainPollInterval = time.Millisecond
+	server := &policyV1Server{refusals: 2}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: httpServer.URL})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	drainer := &podDrainer{clientset: clientset, gracePeriod: -1, evict: true}
+	version, err := drainer.evictionVersion()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if version != "v1" {
+		t.Fatalf("mismatched eviction version, actual %s expected v1", version)
+	}
+	pod := testPod("a1", "ip-10-0-0-1.ec2.internal", "ReplicaSet", corev1.PodRunning)
+	if err := drainer.remove(context.Background(), *pod, version); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !testStringEq(server.evicted, []string{"a1"}) {
+		t.Errorf("mismatched evicted pods, actual %v expected [a1]", server.evicted)
+	}
+	// retried after the disruption budget, always at policy/v1
+	if !testStringEq(server.versions, []string{"policy/v1", "policy/v1", "policy/v1"}) {
+		t.Errorf("mismatched eviction versions, actual %v", server.versions)
+	}
+
+	// clusters that do not serve policy/v1 are evicted from at policy/v1beta1
+	version, err = newNodeDrainer(drainMethodEvict, fake.NewSimpleClientset(), true, false, -1).(*podDrainer).evictionVersion()
+	if err != nil || version != "v1beta1" {
+		t.Errorf("mismatched eviction version without policy/v1, actual %s expected v1beta1, error %v", version, err)
+	}
+}
+
+func TestKubernetesPrepareTerminationDrainMethod(t *testing.T) {
+	evicted := make([]string, 0)
+	clientset := newEvictionClientset(0, &evicted,
+		testNode("ip-10-0-0-1.ec2.internal", "", "", true),
+		testPod("a1", "ip-10-0-0-1.ec2.internal", "ReplicaSet", corev1.PodRunning),
+	)
+	k := &kubernetesReadiness{clientset: clientset, drainer: newNodeDrainer(drainMethodEvict, clientset, true, false, -1)}
+	if err := k.prepareTermination([]string{"ip-10-0-0-1.ec2.internal"}, []string{"i-a"}, true, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !testStringEq(evicted, []string{"a1"}) {
+		t.Errorf("mismatched evicted pods, actual %v expected [a1]", evicted)
+	}
+}
+
+func TestDrainGracePeriod(t *testing.T) {
+	thirty := int64(30)
+	tests := []struct {
+		desc        string
+		gracePeriod int
+		expected    *int64
+	}{
+		{"own grace period", -1, nil},
+		{"capped", 30, &thirty},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// the drain library is given the grace period as is
+			clientset := fake.NewSimpleClientset()
+			library, ok := newNodeDrainer(drainMethodLibrary, clientset, true, false, tt.gracePeriod).(*libraryDrainer)
+			if !ok || library.gracePeriod != tt.gracePeriod {
+				t.Errorf("mismatched library grace period, actual %+v expected %d", library, tt.gracePeriod)
+			}
+
+			// pods evicted are given it with the eviction
+			var options *v1.DeleteOptions
+			evicted := make([]string, 0)
+			clientset = newEvictionClientset(0, &evicted,
+				testNode("ip-10-0-0-1.ec2.internal", "", "", true),
+				testPod("a1", "ip-10-0-0-1.ec2.internal", "ReplicaSet", corev1.PodRunning),
+			)
+			clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if eviction, ok := action.(k8stesting.CreateAction).GetObject().(*policyv1beta1.Eviction); ok {
+					options = eviction.DeleteOptions
+				}
+				return false, nil, nil
+			})
+			k := &kubernetesReadiness{clientset: clientset, drainer: newNodeDrainer(drainMethodEvict, clientset, true, false, tt.gracePeriod)}
+			if err := k.prepareTermination([]string{"ip-10-0-0-1.ec2.internal"}, []string{"i-a"}, true, false); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !testStringEq(evicted, []string{"a1"}) {
+				t.Fatalf("mismatched evicted pods, actual %v expected [a1]", evicted)
+			}
+			if options == nil {
+				t.Fatalf("no delete options with the eviction")
+			}
+			switch {
+			case tt.expected == nil && options.GracePeriodSeconds != nil:
+				t.Errorf("unexpected grace period %d", *options.GracePeriodSeconds)
+			case tt.expected != nil && (options.GracePeriodSeconds == nil || *options.GracePeriodSeconds != *tt.expected):
+				t.Errorf("mismatched grace period, actual %v expected %d", options.GracePeriodSeconds, *tt.expected)
+			}
+		})
+	}
+}
+
+// recordingDrainer records the nodes it is asked to drain, and whether it is asked to force it
+type recordingDrainer struct {
+	drained []string
+	forced  []bool
+}
+
+func (r *recordingDrainer) drainNode(ctx context.Context, node *corev1.Node, force bool) error {
+	r.drained = append(r.drained, node.ObjectMeta.Name)
+	r.forced = append(r.forced, force)
+	return nil
+}
+
+func TestKubernetesPrepareTerminationDrainOptions(t *testing.T) {
+	tests := []struct {
+		desc    string
+		drain   bool
+		force   bool
+		drained []string
+		forced  []bool
+	}{
+		{"drain forced", true, true, []string{"ip-10-0-0-1.ec2.internal"}, []bool{true}},
+		{"drain not forced", true, false, []string{"ip-10-0-0-1.ec2.internal"}, []bool{false}},
+		{"no drain", false, true, []string{}, []bool{}},
+		{"no drain not forced", false, false, []string{}, []bool{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(testNode("ip-10-0-0-1.ec2.internal", "", "", true))
+			drainer := &recordingDrainer{drained: []string{}, forced: []bool{}}
+			k := &kubernetesReadiness{clientset: clientset, drainer: drainer}
+			if err := k.prepareTermination([]string{"ip-10-0-0-1.ec2.internal"}, []string{"i-a"}, tt.drain, tt.force); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !testStringEq(drainer.drained, tt.drained) {
+				t.Errorf("mismatched drained nodes, actual %v expected %v", drainer.drained, tt.drained)
+			}
+			if fmt.Sprint(drainer.forced) != fmt.Sprint(tt.forced) {
+				t.Errorf("mismatched force, actual %v expected %v", drainer.forced, tt.forced)
+			}
+		})
+	}
+}
@@ -3,7 +3,7 @@ module github.com/deitch/aws-asg-roller
 go 1.12
 
 require (
-	github.com/aws/aws-sdk-go v1.21.8
+	github.com/aws/aws-sdk-go v1.40.0
 	github.com/caarlos0/env/v6 v6.6.0
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/go-log/log v0.2.0 // indirect
@@ -20,7 +20,6 @@ require (
 	github.com/spf13/pflag v1.0.3 // indirect
 	github.com/stretchr/testify v1.7.0
 	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550 // indirect
-	golang.org/x/net v0.0.0-20200226121028-0de0cce0169b // indirect
 	golang.org/x/oauth2 v0.0.0-20170412232759-a6bd8cefa181 // indirect
 	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e // indirect
 	golang.org/x/time v0.0.0-20161028155119-f51c12702a4d // indirect
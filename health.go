@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthStatus is the health of the loop, for liveness and readiness probes. It is safe for concurrent
+// use, as long as it is accessed only via its methods.
+type healthStatus struct {
+	mu sync.Mutex
+	// how many loops in a row may fail before the roller is no longer ready
+	maxFailures int
+	// set while a loop is adjusting the ASGs
+	adjusting bool
+	// when the last loop finished, and how long until the next one is expected to start
+	lastFinished time.Time
+	interval     time.Duration
+	// whether any loop has succeeded, and how many have failed in a row since
+	succeeded bool
+	failures  int
+	// used in place of time.Now, for tests
+	now func() time.Time
+}
+
+func newHealthStatus(maxFailures int) *healthStatus {
+	return &healthStatus{maxFailures: maxFailures, now: time.Now}
+}
+
+// loopStarted records that a loop started adjusting the ASGs
+func (h *healthStatus) loopStarted() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.adjusting = true
+}
+
+// loopFinished records the result of a loop, and how long until the next one
+func (h *healthStatus) loopFinished(err error, interval time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.adjusting = false
+	h.lastFinished = h.now()
+	h.interval = interval
+	if err != nil {
+		h.failures++
+		return
+	}
+	h.succeeded = true
+	h.failures = 0
+}
+
+// live reports whether the loop is running: either it is adjusting the ASGs, or it is waiting for the next
+// loop, which is not overdue by more than the interval. Until the first loop finishes, it is live.
+func (h *healthStatus) live() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.adjusting || h.lastFinished.IsZero() {
+		return nil
+	}
+	if since := h.now().Sub(h.lastFinished); since > 2*h.interval {
+		return fmt.Errorf("last loop finished %v ago, expected one every %v", since.Round(time.Second), h.interval)
+	}
+	return nil
+}
+
+// ready reports whether a loop has succeeded, and no more than the maximum number of loops in a row
+// have failed since
+func (h *healthStatus) ready() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case !h.succeeded:
+		return fmt.Errorf("no loop has succeeded yet")
+	case h.failures > h.maxFailures:
+		return fmt.Errorf("last %d loops failed", h.failures)
+	}
+	return nil
+}
+
+// handler returns a handler that responds 200 if check passes, else 503
+func (h *healthStatus) handler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// serveHealth serves the liveness probe at /healthz and the readiness probe at /readyz on the address,
+// until the server fails
+func serveHealth(address string, health *healthStatus) {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", health.handler(health.live))
+	mux.Handle("/readyz", health.handler(health.ready))
+	log.Printf("serving health checks on %s/healthz and %s/readyz", address, address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		log.Printf("Error serving health checks: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthStatus(t *testing.T) {
+	failed := fmt.Errorf("failed")
+	tests := []struct {
+		desc string
+		// results of the loops so far, and whether the last one still is adjusting
+		results   []error
+		adjusting bool
+		since     time.Duration
+		live      int
+		ready     int
+	}{
+		{"starting", nil, false, 0, http.StatusOK, http.StatusServiceUnavailable},
+		{"first loop adjusting", nil, true, 0, http.StatusOK, http.StatusServiceUnavailable},
+		{"first loop failed", []error{failed}, false, 0, http.StatusOK, http.StatusServiceUnavailable},
+		{"succeeded", []error{nil}, false, 0, http.StatusOK, http.StatusOK},
+		{"failures up to max", []error{nil, failed, failed, failed}, false, 0, http.StatusOK, http.StatusOK},
+		{"failures over max", []error{nil, failed, failed, failed, failed}, false, 0, http.StatusOK, http.StatusServiceUnavailable},
+		{"succeeded after failures", []error{nil, failed, failed, failed, failed, nil}, false, 0, http.StatusOK, http.StatusOK},
+		{"waiting for next loop", []error{nil}, false, 45 * time.Second, http.StatusOK, http.StatusOK},
+		{"next loop overdue", []error{nil}, false, 2 * time.Minute, http.StatusServiceUnavailable, http.StatusOK},
+		{"adjusting for long", []error{nil}, true, 2 * time.Minute, http.StatusOK, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			now := time.Now()
+			health := newHealthStatus(3)
+			health.now = func() time.Time { return now }
+			for _, err := range tt.results {
+				health.loopStarted()
+				health.loopFinished(err, 30*time.Second)
+			}
+			if tt.adjusting {
+				health.loopStarted()
+			}
+			now = now.Add(tt.since)
+			for _, check := range []struct {
+				name    string
+				handler http.HandlerFunc
+				status  int
+			}{
+				{"healthz", health.handler(health.live), tt.live},
+				{"readyz", health.handler(health.ready), tt.ready},
+			} {
+				rec := httptest.NewRecorder()
+				check.handler(rec, httptest.NewRequest("GET", "/"+check.name, nil))
+				if rec.Code != check.status {
+					t.Errorf("%s: mismatched status, actual %d expected %d: %s", check.name, rec.Code, check.status, rec.Body.String())
+				}
+			}
+		})
+	}
+}
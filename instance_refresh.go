@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// refreshInstances leaves rolling the ASG to its own instance refresh, rather than surging and terminating
+// old instances. It starts a refresh that keeps at least minHealthyPercent of the desired capacity healthy,
+// unless one is already under way, whose progress it logs instead. A refresh that ended while the ASG still
+// has old instances, e.g. because it failed, or the launch template changed again since, is followed by
+// another. It returns the status of the refresh under way, empty if none was started in a dry run.
+func refreshInstances(svc asgClient, asg *autoscaling.Group, minHealthyPercent int, dryRun bool) (string, error) {
+	name := aws.StringValue(asg.AutoScalingGroupName)
+	out, err := svc.DescribeInstanceRefreshes(&autoscaling.DescribeInstanceRefreshesInput{
+		AutoScalingGroupName: asg.AutoScalingGroupName,
+		MaxRecords:           aws.Int64(1),
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to describe instance refreshes of ASG %s: %v", name, err)
+	}
+	// refreshes are listed newest first
+	if len(out.InstanceRefreshes) > 0 {
+		refresh := out.InstanceRefreshes[0]
+		id, status := aws.StringValue(refresh.InstanceRefreshId), aws.StringValue(refresh.Status)
+		switch status {
+		case autoscaling.InstanceRefreshStatusPending, autoscaling.InstanceRefreshStatusInProgress, autoscaling.InstanceRefreshStatusCancelling:
+			log.Printf("[%s] instance refresh %s is %s, %d%% complete, %d instances left to update\n", name, id, status, aws.Int64Value(refresh.PercentageComplete), aws.Int64Value(refresh.InstancesToUpdate))
+			return status, nil
+		case autoscaling.InstanceRefreshStatusFailed, autoscaling.InstanceRefreshStatusCancelled:
+			log.Printf("[%s] WARNING: instance refresh %s is %s: %s\n", name, id, status, aws.StringValue(refresh.StatusReason))
+		}
+	}
+	if dryRun {
+		log.Printf("dry run: would start an instance refresh of ASG %s, keeping %d%% healthy", name, minHealthyPercent)
+		return "", nil
+	}
+	started, err := svc.StartInstanceRefresh(&autoscaling.StartInstanceRefreshInput{
+		AutoScalingGroupName: asg.AutoScalingGroupName,
+		Strategy:             aws.String(autoscaling.RefreshStrategyRolling),
+		Preferences: &autoscaling.RefreshPreferences{
+			MinHealthyPercentage: aws.Int64(int64(minHealthyPercent)),
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to start instance refresh of ASG %s: %v", name, err)
+	}
+	log.Printf("[%s] started instance refresh %s\n", name, aws.StringValue(started.InstanceRefreshId))
+	return autoscaling.InstanceRefreshStatusPending, nil
+}
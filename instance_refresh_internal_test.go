@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func TestRefreshInstances(t *testing.T) {
+	refresh := func(status string) []*autoscaling.InstanceRefresh {
+		return []*autoscaling.InstanceRefresh{{InstanceRefreshId: aws.String("refresh0"), Status: aws.String(status)}}
+	}
+	tests := []struct {
+		desc      string
+		refreshes []*autoscaling.InstanceRefresh
+		dryRun    bool
+		err       error
+		status    string
+		started   bool
+		fails     bool
+	}{
+		{"none yet", nil, false, nil, autoscaling.InstanceRefreshStatusPending, true, false},
+		{"in progress", refresh(autoscaling.InstanceRefreshStatusInProgress), false, nil, autoscaling.InstanceRefreshStatusInProgress, false, false},
+		{"pending", refresh(autoscaling.InstanceRefreshStatusPending), false, nil, autoscaling.InstanceRefreshStatusPending, false, false},
+		{"failed", refresh(autoscaling.InstanceRefreshStatusFailed), false, nil, autoscaling.InstanceRefreshStatusPending, true, false},
+		{"successful but still old instances", refresh(autoscaling.InstanceRefreshStatusSuccessful), false, nil, autoscaling.InstanceRefreshStatusPending, true, false},
+		{"dry run", nil, true, nil, "", false, false},
+		{"error", nil, false, fmt.Errorf("unavailable"), "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			name := "myasg"
+			asgSvc := &mockAsgSvc{err: tt.err, instanceRefreshes: map[string][]*autoscaling.InstanceRefresh{name: tt.refreshes}}
+			status, err := refreshInstances(asgSvc, &autoscaling.Group{AutoScalingGroupName: aws.String(name)}, 75, tt.dryRun)
+			switch {
+			case err != nil && !tt.fails:
+				t.Fatalf("unexpected error: %v", err)
+			case err == nil && tt.fails:
+				t.Fatalf("expected error, had none")
+			}
+			if status != tt.status {
+				t.Errorf("mismatched status, actual %q expected %q", status, tt.status)
+			}
+			starts := asgSvc.counter.filterByName("StartInstanceRefresh")
+			if started := len(starts) > 0; started != tt.started {
+				t.Fatalf("mismatched started, actual %v expected %v", started, tt.started)
+			}
+			if tt.started {
+				in := starts[0].params[0].(*autoscaling.StartInstanceRefreshInput)
+				if aws.StringValue(in.AutoScalingGroupName) != name || aws.Int64Value(in.Preferences.MinHealthyPercentage) != 75 {
+					t.Errorf("mismatched refresh started for ASG %s with min healthy %d", aws.StringValue(in.AutoScalingGroupName), aws.Int64Value(in.Preferences.MinHealthyPercentage))
+				}
+			}
+		})
+	}
+}
+
+func TestAdjustInstanceRefresh(t *testing.T) {
+	name := "myasg"
+	lcName := "lconfig"
+	oldLcName := "oldlconfig"
+	myHealthy := healthy
+	asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+		name: {
+			AutoScalingGroupName:    &name,
+			DesiredCapacity:         aws.Int64(2),
+			MaxSize:                 aws.Int64(2),
+			LaunchConfigurationName: &lcName,
+			Instances: []*autoscaling.Instance{
+				{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+				{InstanceId: aws.String("2"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+			},
+		},
+	}}
+	state := newRollerState()
+	configs := Configs{
+		KubernetesEnabled: kubernetesEnabled,
+		ASGS:              []string{name},
+		InitialSurge:      1,
+		MaxTerminate:      1,
+		MaxSurge:          -1,
+		MaxUnavailable:    -1,
+		InstanceRefresh:   true,
+		RefreshMinHealthy: 90,
+	}
+	statuses, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(statuses) != 1 || statuses[0].InstanceRefresh != autoscaling.InstanceRefreshStatusPending {
+		t.Errorf("mismatched statuses, actual %v expected an instance refresh %s", statuses, autoscaling.InstanceRefreshStatusPending)
+	}
+	if !state.isRolling(name) {
+		t.Errorf("expected ASG to be rolling")
+	}
+	if starts := asgSvc.counter.filterByName("StartInstanceRefresh"); len(starts) != 1 {
+		t.Errorf("mismatched instance refreshes started, actual %d expected 1", len(starts))
+	}
+	// the roller itself neither surges nor terminates
+	for _, call := range []string{"SetDesiredCapacity", "UpdateAutoScalingGroup", "TerminateInstanceInAutoScalingGroup"} {
+		if calls := asgSvc.counter.filterByName(call); len(calls) != 0 {
+			t.Errorf("unexpected %s calls %d", call, len(calls))
+		}
+	}
+
+	// once the refresh is under way, it is only monitored
+	asgSvc.instanceRefreshes = map[string][]*autoscaling.InstanceRefresh{
+		name: {{InstanceRefreshId: aws.String("refresh1"), Status: aws.String(autoscaling.InstanceRefreshStatusInProgress), PercentageComplete: aws.Int64(50)}},
+	}
+	statuses, err = adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(statuses) != 1 || statuses[0].InstanceRefresh != autoscaling.InstanceRefreshStatusInProgress {
+		t.Errorf("mismatched statuses, actual %v expected an instance refresh %s", statuses, autoscaling.InstanceRefreshStatusInProgress)
+	}
+	if starts := asgSvc.counter.filterByName("StartInstanceRefresh"); len(starts) != 1 {
+		t.Errorf("mismatched instance refreshes started, actual %d expected 1", len(starts))
+	}
+}
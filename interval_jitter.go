@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// used only to randomize the loop interval by the jitter
+var jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// jitterInterval returns the interval moved by up to the jitter either way, so that rollers started at the
+// same time do not all call AWS at the same time. The jitter is either a percentage of the interval, e.g.
+// `10%`, or a duration, e.g. `5s`; random, from 0 up to 1, picks how far the interval is moved, with 0.5
+// leaving it as it is. The interval is never moved below zero.
+func jitterInterval(interval time.Duration, jitter string, random float64) (time.Duration, error) {
+	if jitter == "" {
+		return interval, nil
+	}
+	var spread time.Duration
+	if strings.HasSuffix(jitter, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(jitter, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return 0, fmt.Errorf("invalid jitter percentage '%s', must be from 0%% to 100%%", jitter)
+		}
+		spread = time.Duration(float64(interval) * percent / 100)
+	} else {
+		var err error
+		if spread, err = time.ParseDuration(jitter); err != nil || spread < 0 {
+			return 0, fmt.Errorf("invalid jitter '%s', must be a percentage or a duration", jitter)
+		}
+	}
+	jittered := interval + time.Duration((2*random-1)*float64(spread))
+	if jittered < 0 {
+		return 0, nil
+	}
+	return jittered, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJitterInterval(t *testing.T) {
+	tests := []struct {
+		desc     string
+		interval time.Duration
+		jitter   string
+		random   float64
+		expected time.Duration
+		err      bool
+	}{
+		{"no jitter", 30 * time.Second, "", 0, 30 * time.Second, false},
+		{"percentage lowest", 30 * time.Second, "10%", 0, 27 * time.Second, false},
+		{"percentage middle", 30 * time.Second, "10%", 0.5, 30 * time.Second, false},
+		{"percentage highest", 30 * time.Second, "10%", 1, 33 * time.Second, false},
+		{"percentage fraction", 40 * time.Second, "2.5%", 0.75, 40*time.Second + 500*time.Millisecond, false},
+		{"duration lowest", 30 * time.Second, "5s", 0, 25 * time.Second, false},
+		{"duration highest", 30 * time.Second, "5s", 1, 35 * time.Second, false},
+		{"never below zero", 3 * time.Second, "5s", 0, 0, false},
+		{"percentage too large", 30 * time.Second, "150%", 0.5, 0, true},
+		{"negative percentage", 30 * time.Second, "-10%", 0.5, 0, true},
+		{"invalid percentage", 30 * time.Second, "abc%", 0.5, 0, true},
+		{"negative duration", 30 * time.Second, "-5s", 0.5, 0, true},
+		{"invalid duration", 30 * time.Second, "five", 0.5, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			jittered, err := jitterInterval(tt.interval, tt.jitter, tt.random)
+			switch {
+			case err != nil && !tt.err:
+				t.Errorf("unexpected error: %v", err)
+			case err == nil && tt.err:
+				t.Errorf("no error, expected one")
+			case jittered != tt.expected:
+				t.Errorf("mismatched interval, actual %v expected %v", jittered, tt.expected)
+			}
+		})
+	}
+	// random from the jitter source stays within the jitter
+	for i := 0; i < 100; i++ {
+		jittered, err := jitterInterval(30*time.Second, "10%", jitterRand.Float64())
+		if err != nil || jittered < 27*time.Second || jittered > 33*time.Second {
+			t.Fatalf("interval %v, error %v, outside of 27s to 33s", jittered, err)
+		}
+	}
+}
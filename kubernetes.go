@@ -1,25 +1,79 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
-	drainer "github.com/openshift/kubernetes-drain"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-const clusterAutoscalerScaleDownDisabledFlag = "cluster-autoscaler.kubernetes.io/scale-down-disabled"
+const (
+	clusterAutoscalerScaleDownDisabledFlag = "cluster-autoscaler.kubernetes.io/scale-down-disabled"
+	nodeInstanceIDLabel                    = "node.kubernetes.io/instance-id"
+	mirrorPodAnnotation                    = "kubernetes.io/config.mirror"
+	// taint the cluster-autoscaler puts on a node it is about to remove
+	clusterAutoscalerToBeDeletedTaint = "ToBeDeletedByClusterAutoscaler"
+)
 
 type kubernetesReadiness struct {
-	clientset        *kubernetes.Clientset
+	clientset        kubernetes.Interface
 	ignoreDaemonSets bool
 	deleteLocalData  bool
+	// also match nodes to instances by instance ID, for nodes whose names do not match the private DNS name
+	matchInstanceID bool
+	// drainTimeout is how long to wait for a node to drain, 0 for no limit
+	drainTimeout time.Duration
+	// verifyDrain checks that no pods other than those draining leaves are left on a drained node
+	verifyDrain bool
+	// drainer drains the nodes, the drain library if not set
+	drainer nodeDrainer
+	// drainGracePeriod is the seconds pods are given to stop when draining, -1 for their own termination grace
+	// period
+	drainGracePeriod int
+	// lookupConcurrency is how many nodes to look up at the same time
+	lookupConcurrency int
+	// readyKey is a label or annotation that new nodes must also have, with the value readyValue, to be
+	// ready, e.g. as set by a controller once the node is ready for the application; empty for none
+	readyKey   string
+	readyValue string
+	// readyDaemonSets are the DaemonSets, as namespace/name, that must have a pod running on new nodes for
+	// them to be ready, e.g. for networking
+	readyDaemonSets []string
+}
+
+// drainTimeoutError is returned when draining a node does not complete within the drain timeout, e.g.
+// because a pod cannot be evicted, so that callers can tell it apart from other errors
+type drainTimeoutError struct {
+	asg      string
+	hostname string
+	id       string
+	timeout  time.Duration
+}
+
+func (e *drainTimeoutError) Error() string {
+	return fmt.Sprintf("[%s] draining kubernetes node %s did not complete within %v", e.asg, e.hostname, e.timeout)
+}
+
+// drainError is returned when draining a node fails, so that callers can tell which node failed
+type drainError struct {
+	asg      string
+	hostname string
+	id       string
+	err      error
+}
+
+func (e *drainError) Error() string {
+	return fmt.Sprintf("[%s] unable to drain kubernetes node %s: %v", e.asg, e.hostname, e.err)
 }
 
 func (k *kubernetesReadiness) getUnreadyCount(hostnames []string, ids []string) (int, error) {
@@ -27,6 +81,10 @@ func (k *kubernetesReadiness) getUnreadyCount(hostnames []string, ids []string)
 	for _, h := range hostnames {
 		hostHash[h] = true
 	}
+	idHash := map[string]bool{}
+	for _, id := range ids {
+		idHash[id] = true
+	}
 	/*
 		in AWS, the `name` of the node *always* is the internal private DNS name
 		you can get a node by name by doing Nodes().Get(name)
@@ -38,25 +96,112 @@ func (k *kubernetesReadiness) getUnreadyCount(hostnames []string, ids []string)
 		We _should_ be able to just filter on kubernetes.io/hostname label, but this label *does*
 		respect --hostname-override, which we do not know if it is set or not. Oops.
 		This, for now, we are stuck doing multiple Get(), one for each hostname, or doing a List() of all nodes
+
+		Some distributions do name the node after the --hostname-override, in which case the name does not match
+		the private DNS name at all. For those, optionally fall back to matching on the instance ID.
 	*/
 	nodes, err := k.clientset.CoreV1().Nodes().List(v1.ListOptions{})
 	if err != nil {
 		return 0, fmt.Errorf("Unexpected error getting nodes for cluster: %v", err)
 	}
+	var running map[string]map[string]bool
+	if len(k.readyDaemonSets) > 0 {
+		if running, err = k.runningDaemonSets(); err != nil {
+			return 0, err
+		}
+	}
 	unReadyCount := 0
 	for _, n := range nodes.Items {
 		// first make sure that this is one of the new nodes we care about
-		if _, ok := hostHash[n.ObjectMeta.Name]; !ok {
+		if !hostHash[n.ObjectMeta.Name] && !(k.matchInstanceID && idHash[nodeInstanceID(&n)]) {
 			continue
 		}
 		// next check its status
-		conditions := n.Status.Conditions
-		if conditions[len(conditions)-1].Type != corev1.NodeReady {
+		if !nodeReady(&n) || !k.customReady(&n) {
 			unReadyCount++
+			continue
+		}
+		for _, ds := range k.readyDaemonSets {
+			if !running[n.ObjectMeta.Name][ds] {
+				log.Printf("Node %s is ready, but DaemonSet %s has no pod running on it yet", n.ObjectMeta.Name, ds)
+				unReadyCount++
+				break
+			}
 		}
 	}
 	return unReadyCount, nil
 }
+
+// runningDaemonSets returns the DaemonSets, as namespace/name, that have a pod running on each node, by
+// node name
+func (k *kubernetesReadiness) runningDaemonSets() (map[string]map[string]bool, error) {
+	pods, err := k.clientset.CoreV1().Pods(v1.NamespaceAll).List(v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Unexpected error getting pods for cluster: %v", err)
+	}
+	running := map[string]map[string]bool{}
+	for _, p := range pods.Items {
+		controller := v1.GetControllerOf(&p)
+		if controller == nil || controller.Kind != "DaemonSet" || p.Status.Phase != corev1.PodRunning {
+			continue
+		}
+		if running[p.Spec.NodeName] == nil {
+			running[p.Spec.NodeName] = map[string]bool{}
+		}
+		running[p.Spec.NodeName][fmt.Sprintf("%s/%s", p.ObjectMeta.Namespace, controller.Name)] = true
+	}
+	return running, nil
+}
+
+// parseReadyDaemonSets checks that each DaemonSet that must be running on new nodes is given as
+// namespace/name
+func parseReadyDaemonSets(daemonSets []string) ([]string, error) {
+	parsed := make([]string, 0, len(daemonSets))
+	for _, ds := range daemonSets {
+		ds = strings.TrimSpace(ds)
+		if ds == "" {
+			continue
+		}
+		parts := strings.Split(ds, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid DaemonSet '%s', must be namespace/name", ds)
+		}
+		parsed = append(parsed, ds)
+	}
+	return parsed, nil
+}
+
+// nodeReady reports if the node has a NodeReady condition that is true. The conditions are in no
+// particular order, and a node without the condition is not ready.
+func nodeReady(node *corev1.Node) bool {
+	for _, c := range node.Status.Conditions {
+		if c.Type == corev1.NodeReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// customReady reports if the node has the custom ready label or annotation, if one is required
+func (k *kubernetesReadiness) customReady(node *corev1.Node) bool {
+	if k.readyKey == "" {
+		return true
+	}
+	if value, ok := node.ObjectMeta.Labels[k.readyKey]; ok {
+		return value == k.readyValue
+	}
+	return node.ObjectMeta.Annotations[k.readyKey] == k.readyValue
+}
+
+// parseReadyLabel splits a custom ready label of the form `key=value` into its key and value. The value
+// is `true` if there is none.
+func parseReadyLabel(label string) (string, string) {
+	parts := strings.SplitN(label, "=", 2)
+	if len(parts) == 1 {
+		return parts[0], "true"
+	}
+	return parts[0], parts[1]
+}
 func (k *kubernetesReadiness) prepareTermination(hostnames []string, ids []string, drain, drainForce bool) error {
 	// get the node reference - first need the hostname
 	var (
@@ -69,25 +214,186 @@ func (k *kubernetesReadiness) prepareTermination(hostnames []string, ids []strin
 		return nil
 	}
 
-	for _, h := range hostnames {
-		node, err = k.clientset.CoreV1().Nodes().Get(h, v1.GetOptions{})
+	for i, h := range hostnames {
+		node, err = k.getNode(h, ids[i])
 		if err != nil {
 			return fmt.Errorf("Unexpected error getting kubernetes node %s: %v", h, err)
 		}
 		// set options and drain nodes
-		err = drainer.Drain(k.clientset, []*corev1.Node{node}, &drainer.DrainOptions{
-			IgnoreDaemonsets:   k.ignoreDaemonSets,
-			GracePeriodSeconds: -1,
-			Force:              drainForce,
-			DeleteLocalData:    k.deleteLocalData,
-		})
+		err = k.drain(node, drainForce)
+		if timeoutErr, ok := err.(*drainTimeoutError); ok {
+			timeoutErr.id = ids[i]
+			return timeoutErr
+		}
 		if err != nil {
-			return fmt.Errorf("Unexpected error draining kubernetes node %s: %v", h, err)
+			return &drainError{hostname: h, id: ids[i], err: err}
+		}
+		// the drain library can report success while pods are still on the node
+		if k.verifyDrain {
+			remaining, err := k.remainingPods(node)
+			if err != nil {
+				return fmt.Errorf("Unexpected error verifying drain of kubernetes node %s: %v", h, err)
+			}
+			if len(remaining) > 0 {
+				return &drainError{hostname: h, id: ids[i], err: fmt.Errorf("pods %s still on node after draining", strings.Join(remaining, ", "))}
+			}
 		}
 	}
 	return nil
 }
 
+// remainingPods returns the namespaced names of the pods on the node that draining it should have removed
+func (k *kubernetesReadiness) remainingPods(node *corev1.Node) ([]string, error) {
+	pods, err := k.clientset.CoreV1().Pods(v1.NamespaceAll).List(v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Unexpected error getting pods for cluster: %v", err)
+	}
+	remaining := make([]string, 0)
+	for _, p := range pods.Items {
+		if p.Spec.NodeName == node.ObjectMeta.Name && drainablePod(&p) {
+			remaining = append(remaining, fmt.Sprintf("%s/%s", p.ObjectMeta.Namespace, p.ObjectMeta.Name))
+		}
+	}
+	return remaining, nil
+}
+
+// drainablePod reports if draining a node removes the pod: finished pods, DaemonSet pods and mirror pods
+// are left where they are
+func drainablePod(p *corev1.Pod) bool {
+	if p.Status.Phase == corev1.PodSucceeded || p.Status.Phase == corev1.PodFailed {
+		return false
+	}
+	if controller := v1.GetControllerOf(p); controller != nil && controller.Kind == "DaemonSet" {
+		return false
+	}
+	_, mirror := p.ObjectMeta.Annotations[mirrorPodAnnotation]
+	return !mirror
+}
+
+func (k *kubernetesReadiness) getPodCounts(hostnames []string, ids []string) (map[string]int, error) {
+	// the node name is needed to find pods, and might not be the hostname
+	nodes, err := k.getNodes(hostnames, ids)
+	if err != nil {
+		return nil, err
+	}
+	nodeIDs := map[string]string{}
+	for i, node := range nodes {
+		nodeIDs[node.ObjectMeta.Name] = ids[i]
+	}
+	pods, err := k.clientset.CoreV1().Pods(v1.NamespaceAll).List(v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Unexpected error getting pods for cluster: %v", err)
+	}
+	counts := map[string]int{}
+	for _, id := range ids {
+		counts[id] = 0
+	}
+	for _, p := range pods.Items {
+		id, ok := nodeIDs[p.Spec.NodeName]
+		if !ok {
+			continue
+		}
+		// pods draining does not remove are not disrupted by it
+		if !drainablePod(&p) {
+			continue
+		}
+		counts[id]++
+	}
+	return counts, nil
+}
+
+// getNodeLabels returns the value of the label on the node for each instance, by instance ID
+func (k *kubernetesReadiness) getNodeLabels(hostnames []string, ids []string, label string) (map[string]string, error) {
+	nodes, err := k.getNodes(hostnames, ids)
+	if err != nil {
+		return nil, err
+	}
+	labels := map[string]string{}
+	for i, node := range nodes {
+		labels[ids[i]] = node.ObjectMeta.Labels[label]
+	}
+	return labels, nil
+}
+
+// getNodeAnnotations returns the value of the annotation on the node for each instance, by instance ID
+func (k *kubernetesReadiness) getNodeAnnotations(hostnames []string, ids []string, annotation string) (map[string]string, error) {
+	nodes, err := k.getNodes(hostnames, ids)
+	if err != nil {
+		return nil, err
+	}
+	annotations := map[string]string{}
+	for i, node := range nodes {
+		annotations[ids[i]] = node.ObjectMeta.Annotations[annotation]
+	}
+	return annotations, nil
+}
+
+// getScalingDownNodes returns the names of the nodes the cluster-autoscaler has tainted to remove them
+func (k *kubernetesReadiness) getScalingDownNodes() ([]string, error) {
+	nodes, err := k.clientset.CoreV1().Nodes().List(v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Unexpected error getting nodes for cluster: %v", err)
+	}
+	scalingDown := make([]string, 0)
+	for _, n := range nodes.Items {
+		for _, taint := range n.Spec.Taints {
+			if taint.Key == clusterAutoscalerToBeDeletedTaint {
+				scalingDown = append(scalingDown, n.ObjectMeta.Name)
+				break
+			}
+		}
+	}
+	return scalingDown, nil
+}
+
+// getNodes gets the node for each instance, in the same order as the hostnames and IDs, looking up to
+// lookupConcurrency of them at the same time
+func (k *kubernetesReadiness) getNodes(hostnames []string, ids []string) ([]*corev1.Node, error) {
+	nodes := make([]*corev1.Node, len(hostnames))
+	err := runConcurrently(len(hostnames), k.lookupConcurrency, func(i int) error {
+		node, err := k.getNode(hostnames[i], ids[i])
+		if err != nil {
+			return fmt.Errorf("Unexpected error getting kubernetes node %s: %v", hostnames[i], err)
+		}
+		nodes[i] = node
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// getNode gets the node for an instance by its hostname, falling back to its instance ID if so configured
+func (k *kubernetesReadiness) getNode(hostname, id string) (*corev1.Node, error) {
+	node, err := k.clientset.CoreV1().Nodes().Get(hostname, v1.GetOptions{})
+	if err == nil || !k.matchInstanceID || !apierrors.IsNotFound(err) {
+		return node, err
+	}
+	nodes, listErr := k.clientset.CoreV1().Nodes().List(v1.ListOptions{})
+	if listErr != nil {
+		return nil, listErr
+	}
+	for i := range nodes.Items {
+		if nodeInstanceID(&nodes.Items[i]) == id {
+			return &nodes.Items[i], nil
+		}
+	}
+	return nil, err
+}
+
+// nodeInstanceID returns the ID of the EC2 instance for a node, from its instance ID label if it has one,
+// else from its provider ID, which looks like aws:///us-east-1a/i-0123456789abcdef0
+func nodeInstanceID(node *corev1.Node) string {
+	if id, ok := node.ObjectMeta.Labels[nodeInstanceIDLabel]; ok {
+		return id
+	}
+	if providerID := node.Spec.ProviderID; strings.HasPrefix(providerID, "aws://") {
+		return providerID[strings.LastIndex(providerID, "/")+1:]
+	}
+	return ""
+}
+
 func kubeGetClientset(kubernetesEnabled bool) (*kubernetes.Clientset, error) {
 	// if it is *explicitly* set to false, then do nothing
 	if !kubernetesEnabled {
@@ -128,7 +434,7 @@ func getKubeOutOfCluster() (*rest.Config, error) {
 	// use the current context in kubeconfig
 	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
 	return config, nil
 }
@@ -140,21 +446,63 @@ func homeDir() string {
 	return os.Getenv("USERPROFILE") // windows
 }
 
-func kubeGetReadinessHandler(kubernetesEnabled, ignoreDaemonSets, deleteLocalData bool) (readiness, error) {
+// drain drains a node, giving up if it does not complete within the drain timeout. A drain that is given
+// up on is cancelled, and stops once the drainer notices, or is abandoned if it cannot be interrupted, as
+// with the drain library.
+func (k *kubernetesReadiness) drain(node *corev1.Node, drainForce bool) error {
+	nodeDrainer := k.drainer
+	if nodeDrainer == nil {
+		nodeDrainer = newNodeDrainer(drainMethodLibrary, k.clientset, k.ignoreDaemonSets, k.deleteLocalData, k.drainGracePeriod)
+	}
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if k.drainTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), k.drainTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	// stop the drain once it is given up on, and release the timer once it finishes
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- nodeDrainer.drainNode(ctx, node, drainForce)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return &drainTimeoutError{hostname: node.ObjectMeta.Name, timeout: k.drainTimeout}
+	}
+}
+
+func kubeGetReadinessHandler(kubernetesEnabled, ignoreDaemonSets, deleteLocalData, matchInstanceID, verifyDrain bool, drainTimeout time.Duration, drainMethod string, drainGracePeriod int, lookupConcurrency int, readyLabel string, readyDaemonSets []string) (readiness, error) {
+	// without a connection there is no handler, which checkReadinessHandler warns about, or fails on if kubernetes
+	// is required
 	clientset, err := kubeGetClientset(kubernetesEnabled)
 	if err != nil {
-		log.Fatalf("Error getting kubernetes connection: %v", err)
+		log.Printf("Error getting kubernetes connection: %v", err)
+		return nil, nil
 	}
 	if clientset == nil {
 		return nil, nil
 	}
-	return &kubernetesReadiness{clientset: clientset, ignoreDaemonSets: ignoreDaemonSets, deleteLocalData: deleteLocalData}, nil
+	k := &kubernetesReadiness{clientset: clientset, ignoreDaemonSets: ignoreDaemonSets, deleteLocalData: deleteLocalData, matchInstanceID: matchInstanceID, drainTimeout: drainTimeout, verifyDrain: verifyDrain, drainGracePeriod: drainGracePeriod, lookupConcurrency: lookupConcurrency}
+	k.drainer = newNodeDrainer(drainMethod, clientset, ignoreDaemonSets, deleteLocalData, drainGracePeriod)
+	if readyLabel != "" {
+		k.readyKey, k.readyValue = parseReadyLabel(readyLabel)
+	}
+	if k.readyDaemonSets, err = parseReadyDaemonSets(readyDaemonSets); err != nil {
+		return nil, err
+	}
+	return k, nil
 }
 
 // setScaleDownDisabledAnnotation set the "cluster-autoscaler.kubernetes.io/scale-down-disabled" annotation
 // on the list of nodes if required. Returns a list of 151 where the annotation
-// is applied.
-func setScaleDownDisabledAnnotation(kubernetesEnabled bool, hostnames []string) ([]string, error) {
+// is applied. In a dry run the nodes are left as they are.
+func setScaleDownDisabledAnnotation(kubernetesEnabled bool, hostnames []string, dryRun bool) ([]string, error) {
 	// get the node reference - first need the hostname
 	var (
 		node      *corev1.Node
@@ -177,6 +525,13 @@ func setScaleDownDisabledAnnotation(kubernetesEnabled bool, hostnames []string)
 		}
 		annotations := node.GetAnnotations()
 		if value := annotations[key]; value != "true" {
+			if dryRun {
+				log.Printf("dry run: would set annotation %s on node %s", key, h)
+				continue
+			}
+			if annotations == nil {
+				annotations = map[string]string{}
+			}
 			annotations[key] = "true"
 			node.SetAnnotations(annotations)
 			_, err := nodes.Update(node)
@@ -188,7 +543,7 @@ func setScaleDownDisabledAnnotation(kubernetesEnabled bool, hostnames []string)
 	}
 	return annotated, nil
 }
-func removeScaleDownDisabledAnnotation(kubernetesEnabled bool, hostnames []string) error {
+func removeScaleDownDisabledAnnotation(kubernetesEnabled bool, hostnames []string, dryRun bool) error {
 	// get the node reference - first need the hostname
 	var (
 		node *corev1.Node
@@ -210,6 +565,10 @@ func removeScaleDownDisabledAnnotation(kubernetesEnabled bool, hostnames []strin
 		}
 		annotations := node.GetAnnotations()
 		if _, ok := annotations[key]; ok {
+			if dryRun {
+				log.Printf("dry run: would remove annotation %s from node %s", key, h)
+				continue
+			}
 			delete(annotations, key)
 			node.SetAnnotations(annotations)
 			_, err := nodes.Update(node)
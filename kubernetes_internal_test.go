@@ -0,0 +1,620 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testNode(name, instanceIDLabel, providerID string, ready bool) *corev1.Node {
+	condition := corev1.NodeReady
+	if !ready {
+		condition = corev1.NodeMemoryPressure
+	}
+	node := &corev1.Node{
+		ObjectMeta: v1.ObjectMeta{Name: name, Labels: map[string]string{}},
+		Spec:       corev1.NodeSpec{ProviderID: providerID},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{{Type: condition, Status: corev1.ConditionTrue}},
+		},
+	}
+	if instanceIDLabel != "" {
+		node.ObjectMeta.Labels[nodeInstanceIDLabel] = instanceIDLabel
+	}
+	return node
+}
+
+func TestNodeInstanceID(t *testing.T) {
+	tests := []struct {
+		label      string
+		providerID string
+		id         string
+	}{
+		{"i-1", "", "i-1"},
+		{"", "aws:///us-east-1a/i-2", "i-2"},
+		{"i-1", "aws:///us-east-1a/i-2", "i-1"},
+		{"", "gce://project/zone/i-2", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		if id := nodeInstanceID(testNode("node", tt.label, tt.providerID, true)); id != tt.id {
+			t.Errorf("label %s provider ID %s: mismatched ID, actual %s expected %s", tt.label, tt.providerID, id, tt.id)
+		}
+	}
+}
+
+func TestKubernetesGetUnreadyCount(t *testing.T) {
+	// node names differ from the private DNS names, as with --hostname-override
+	nodes := []*corev1.Node{
+		testNode("custom-a", "i-a", "", true),
+		testNode("custom-b", "", "aws:///us-east-1a/i-b", false),
+		testNode("ip-10-0-0-3.ec2.internal", "", "", false),
+	}
+	tests := []struct {
+		desc            string
+		hostnames       []string
+		ids             []string
+		matchInstanceID bool
+		unready         int
+	}{
+		{"match by name", []string{"ip-10-0-0-3.ec2.internal"}, []string{"i-c"}, false, 1},
+		{"overridden names not matched", []string{"ip-10-0-0-1.ec2.internal", "ip-10-0-0-2.ec2.internal"}, []string{"i-a", "i-b"}, false, 0},
+		{"overridden names matched by ID", []string{"ip-10-0-0-1.ec2.internal", "ip-10-0-0-2.ec2.internal"}, []string{"i-a", "i-b"}, true, 1},
+		{"ready matched by label", []string{"ip-10-0-0-1.ec2.internal"}, []string{"i-a"}, true, 0},
+		{"name and ID", []string{"ip-10-0-0-2.ec2.internal", "ip-10-0-0-3.ec2.internal"}, []string{"i-b", "i-c"}, true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			for _, n := range nodes {
+				if _, err := clientset.CoreV1().Nodes().Create(n); err != nil {
+					t.Fatalf("unable to create node: %v", err)
+				}
+			}
+			k := &kubernetesReadiness{clientset: clientset, matchInstanceID: tt.matchInstanceID}
+			unready, err := k.getUnreadyCount(tt.hostnames, tt.ids)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if unready != tt.unready {
+				t.Errorf("mismatched unready count, actual %d expected %d", unready, tt.unready)
+			}
+		})
+	}
+}
+
+func TestNodeReady(t *testing.T) {
+	tests := []struct {
+		desc       string
+		conditions []corev1.NodeCondition
+		ready      bool
+	}{
+		{"ready last", []corev1.NodeCondition{
+			{Type: corev1.NodeMemoryPressure, Status: corev1.ConditionFalse},
+			{Type: corev1.NodeReady, Status: corev1.ConditionTrue},
+		}, true},
+		{"ready first", []corev1.NodeCondition{
+			{Type: corev1.NodeReady, Status: corev1.ConditionTrue},
+			{Type: corev1.NodeMemoryPressure, Status: corev1.ConditionFalse},
+			{Type: corev1.NodeDiskPressure, Status: corev1.ConditionFalse},
+		}, true},
+		{"not ready first", []corev1.NodeCondition{
+			{Type: corev1.NodeReady, Status: corev1.ConditionFalse},
+			{Type: corev1.NodeMemoryPressure, Status: corev1.ConditionFalse},
+		}, false},
+		{"unknown", []corev1.NodeCondition{
+			{Type: corev1.NodeMemoryPressure, Status: corev1.ConditionFalse},
+			{Type: corev1.NodeReady, Status: corev1.ConditionUnknown},
+		}, false},
+		{"no ready condition", []corev1.NodeCondition{
+			{Type: corev1.NodeMemoryPressure, Status: corev1.ConditionFalse},
+		}, false},
+		{"no conditions", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			node := &corev1.Node{Status: corev1.NodeStatus{Conditions: tt.conditions}}
+			if ready := nodeReady(node); ready != tt.ready {
+				t.Errorf("mismatched ready, actual %v expected %v", ready, tt.ready)
+			}
+		})
+	}
+}
+
+func TestKubernetesGetUnreadyCountReadyLabel(t *testing.T) {
+	tests := []struct {
+		desc        string
+		readyLabel  string
+		labels      map[string]string
+		annotations map[string]string
+		unready     int
+	}{
+		{"no ready label", "", nil, nil, 0},
+		{"label missing", "myapp/ready=true", nil, nil, 1},
+		{"label not ready", "myapp/ready=true", map[string]string{"myapp/ready": "false"}, nil, 1},
+		{"label ready", "myapp/ready=true", map[string]string{"myapp/ready": "true"}, nil, 0},
+		{"annotation ready", "myapp/ready=true", nil, map[string]string{"myapp/ready": "true"}, 0},
+		{"value defaults to true", "myapp/ready", map[string]string{"myapp/ready": "true"}, nil, 0},
+		{"custom value", "myapp/state=serving", map[string]string{"myapp/state": "serving"}, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			node := testNode("ip-10-0-0-1.ec2.internal", "", "", true)
+			for k, v := range tt.labels {
+				node.ObjectMeta.Labels[k] = v
+			}
+			node.ObjectMeta.Annotations = tt.annotations
+			clientset := fake.NewSimpleClientset(node)
+			k := &kubernetesReadiness{clientset: clientset}
+			if tt.readyLabel != "" {
+				k.readyKey, k.readyValue = parseReadyLabel(tt.readyLabel)
+			}
+			unready, err := k.getUnreadyCount([]string{"ip-10-0-0-1.ec2.internal"}, []string{"i-1"})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if unready != tt.unready {
+				t.Errorf("mismatched unready count, actual %d expected %d", unready, tt.unready)
+			}
+		})
+	}
+	// the controller marks the node ready later
+	node := testNode("ip-10-0-0-1.ec2.internal", "", "", true)
+	clientset := fake.NewSimpleClientset(node)
+	k := &kubernetesReadiness{clientset: clientset, readyKey: "myapp/ready", readyValue: "true"}
+	if unready, _ := k.getUnreadyCount([]string{"ip-10-0-0-1.ec2.internal"}, nil); unready != 1 {
+		t.Errorf("mismatched unready count before label set, actual %d expected 1", unready)
+	}
+	node.ObjectMeta.Labels["myapp/ready"] = "true"
+	if _, err := clientset.CoreV1().Nodes().Update(node); err != nil {
+		t.Fatalf("unable to update node: %v", err)
+	}
+	if unready, _ := k.getUnreadyCount([]string{"ip-10-0-0-1.ec2.internal"}, nil); unready != 0 {
+		t.Errorf("mismatched unready count after label set, actual %d expected 0", unready)
+	}
+}
+
+func TestKubernetesGetUnreadyCountReadyDaemonSets(t *testing.T) {
+	// a pod of the given DaemonSet in kube-system, with the given phase, on the given node
+	dsPod := func(name, node, controllerKind, owner string, phase corev1.PodPhase) *corev1.Pod {
+		pod := testPod(name, node, controllerKind, phase)
+		pod.ObjectMeta.Namespace = "kube-system"
+		pod.ObjectMeta.OwnerReferences[0].Name = owner
+		return pod
+	}
+	newNode := "ip-10-0-0-1.ec2.internal"
+	tests := []struct {
+		desc       string
+		daemonSets []string
+		pods       []*corev1.Pod
+		unready    int
+	}{
+		{"none required", nil, []*corev1.Pod{dsPod("aws-node-a", newNode, "DaemonSet", "aws-node", corev1.PodPending)}, 0},
+		{"pod pending", []string{"kube-system/aws-node"}, []*corev1.Pod{dsPod("aws-node-a", newNode, "DaemonSet", "aws-node", corev1.PodPending)}, 1},
+		{"pod running", []string{"kube-system/aws-node"}, []*corev1.Pod{dsPod("aws-node-a", newNode, "DaemonSet", "aws-node", corev1.PodRunning)}, 0},
+		{"no pod", []string{"kube-system/aws-node"}, nil, 1},
+		{"pod on another node", []string{"kube-system/aws-node"}, []*corev1.Pod{dsPod("aws-node-b", "ip-10-0-0-2.ec2.internal", "DaemonSet", "aws-node", corev1.PodRunning)}, 1},
+		{"pod in another namespace", []string{"default/aws-node"}, []*corev1.Pod{dsPod("aws-node-a", newNode, "DaemonSet", "aws-node", corev1.PodRunning)}, 1},
+		{"pod not of a DaemonSet", []string{"kube-system/aws-node"}, []*corev1.Pod{dsPod("aws-node-a", newNode, "ReplicaSet", "aws-node", corev1.PodRunning)}, 1},
+		{"one of two running", []string{"kube-system/aws-node", "kube-system/kube-proxy"}, []*corev1.Pod{
+			dsPod("aws-node-a", newNode, "DaemonSet", "aws-node", corev1.PodRunning),
+			dsPod("kube-proxy-a", newNode, "DaemonSet", "kube-proxy", corev1.PodPending),
+		}, 1},
+		{"both running", []string{"kube-system/aws-node", "kube-system/kube-proxy"}, []*corev1.Pod{
+			dsPod("aws-node-a", newNode, "DaemonSet", "aws-node", corev1.PodRunning),
+			dsPod("kube-proxy-a", newNode, "DaemonSet", "kube-proxy", corev1.PodRunning),
+		}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			objects := []runtime.Object{testNode(newNode, "", "", true)}
+			for _, p := range tt.pods {
+				objects = append(objects, p)
+			}
+			clientset := fake.NewSimpleClientset(objects...)
+			k := &kubernetesReadiness{clientset: clientset, readyDaemonSets: tt.daemonSets}
+			unready, err := k.getUnreadyCount([]string{newNode}, []string{"i-1"})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if unready != tt.unready {
+				t.Errorf("mismatched unready count, actual %d expected %d", unready, tt.unready)
+			}
+		})
+	}
+}
+
+func TestParseReadyDaemonSets(t *testing.T) {
+	tests := []struct {
+		daemonSets []string
+		parsed     []string
+		err        bool
+	}{
+		{nil, []string{}, false},
+		{[]string{"kube-system/aws-node"}, []string{"kube-system/aws-node"}, false},
+		{[]string{"kube-system/aws-node", " kube-system/kube-proxy "}, []string{"kube-system/aws-node", "kube-system/kube-proxy"}, false},
+		{[]string{"aws-node"}, nil, true},
+		{[]string{"kube-system/"}, nil, true},
+		{[]string{"a/b/c"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.daemonSets, ","), func(t *testing.T) {
+			parsed, err := parseReadyDaemonSets(tt.daemonSets)
+			switch {
+			case err != nil && !tt.err:
+				t.Errorf("unexpected error: %v", err)
+			case err == nil && tt.err:
+				t.Errorf("no error, expected one")
+			case !testStringEq(parsed, tt.parsed):
+				t.Errorf("mismatched DaemonSets, actual %v expected %v", parsed, tt.parsed)
+			}
+		})
+	}
+}
+
+func TestKubernetesGetScalingDownNodes(t *testing.T) {
+	removing := testNode("ip-10-0-0-2.ec2.internal", "", "", true)
+	removing.Spec.Taints = []corev1.Taint{{Key: clusterAutoscalerToBeDeletedTaint, Value: "1600000000", Effect: corev1.TaintEffectNoSchedule}}
+	candidate := testNode("ip-10-0-0-3.ec2.internal", "", "", true)
+	candidate.Spec.Taints = []corev1.Taint{{Key: "DeletionCandidateOfClusterAutoscaler", Value: "1600000000", Effect: corev1.TaintEffectPreferNoSchedule}}
+	clientset := fake.NewSimpleClientset(testNode("ip-10-0-0-1.ec2.internal", "", "", true), removing, candidate)
+	k := &kubernetesReadiness{clientset: clientset}
+	scalingDown, err := k.getScalingDownNodes()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !testStringEq(scalingDown, []string{"ip-10-0-0-2.ec2.internal"}) {
+		t.Errorf("mismatched nodes scaling down, actual %v expected %v", scalingDown, []string{"ip-10-0-0-2.ec2.internal"})
+	}
+}
+
+func TestKubernetesGetNode(t *testing.T) {
+	tests := []struct {
+		desc            string
+		hostname        string
+		id              string
+		matchInstanceID bool
+		node            string
+		err             bool
+	}{
+		{"by name", "ip-10-0-0-3.ec2.internal", "i-c", false, "ip-10-0-0-3.ec2.internal", false},
+		{"overridden name not found", "ip-10-0-0-1.ec2.internal", "i-a", false, "", true},
+		{"overridden name found by label", "ip-10-0-0-1.ec2.internal", "i-a", true, "custom-a", false},
+		{"overridden name found by provider ID", "ip-10-0-0-2.ec2.internal", "i-b", true, "custom-b", false},
+		{"unknown ID", "ip-10-0-0-4.ec2.internal", "i-d", true, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(
+				testNode("custom-a", "i-a", "", true),
+				testNode("custom-b", "", "aws:///us-east-1a/i-b", true),
+				testNode("ip-10-0-0-3.ec2.internal", "", "", true),
+			)
+			k := &kubernetesReadiness{clientset: clientset, matchInstanceID: tt.matchInstanceID}
+			node, err := k.getNode(tt.hostname, tt.id)
+			switch {
+			case tt.err && err == nil:
+				t.Errorf("expected error, found node %s", node.ObjectMeta.Name)
+			case !tt.err && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case !tt.err && node.ObjectMeta.Name != tt.node:
+				t.Errorf("mismatched node, actual %s expected %s", node.ObjectMeta.Name, tt.node)
+			}
+		})
+	}
+}
+
+func testPod(name, node, controllerKind string, phase corev1.PodPhase) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       corev1.PodSpec{NodeName: node},
+		Status:     corev1.PodStatus{Phase: phase},
+	}
+	if controllerKind != "" {
+		controller := true
+		pod.ObjectMeta.OwnerReferences = []v1.OwnerReference{{Kind: controllerKind, Name: "owner", Controller: &controller}}
+	}
+	return pod
+}
+
+func TestKubernetesGetPodCounts(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		testNode("ip-10-0-0-1.ec2.internal", "", "", true),
+		testNode("ip-10-0-0-2.ec2.internal", "", "", true),
+		testNode("custom-c", "i-c", "", true),
+		testPod("a1", "ip-10-0-0-1.ec2.internal", "ReplicaSet", corev1.PodRunning),
+		testPod("a2", "ip-10-0-0-1.ec2.internal", "", corev1.PodRunning),
+		testPod("a3", "ip-10-0-0-1.ec2.internal", "DaemonSet", corev1.PodRunning),
+		testPod("b1", "ip-10-0-0-2.ec2.internal", "DaemonSet", corev1.PodRunning),
+		testPod("b2", "ip-10-0-0-2.ec2.internal", "Job", corev1.PodSucceeded),
+		testPod("c1", "custom-c", "ReplicaSet", corev1.PodRunning),
+		testPod("c2", "custom-c", "StatefulSet", corev1.PodPending),
+		testPod("c3", "custom-c", "ReplicaSet", corev1.PodRunning),
+		testPod("d1", "ip-10-0-0-4.ec2.internal", "ReplicaSet", corev1.PodRunning),
+	)
+	k := &kubernetesReadiness{clientset: clientset, matchInstanceID: true}
+	counts, err := k.getPodCounts([]string{"ip-10-0-0-1.ec2.internal", "ip-10-0-0-2.ec2.internal", "ip-10-0-0-3.ec2.internal"}, []string{"i-a", "i-b", "i-c"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]int{"i-a": 2, "i-b": 0, "i-c": 3}
+	if len(counts) != len(expected) {
+		t.Errorf("mismatched counts, actual %v expected %v", counts, expected)
+	}
+	for id, count := range expected {
+		if counts[id] != count {
+			t.Errorf("%s: mismatched pod count, actual %d expected %d", id, counts[id], count)
+		}
+	}
+	// a node that cannot be found is an error
+	if _, err := k.getPodCounts([]string{"ip-10-0-0-4.ec2.internal"}, []string{"i-d"}); err == nil {
+		t.Errorf("expected error for unknown node")
+	}
+}
+
+func TestKubernetesGetNodeLabels(t *testing.T) {
+	poolA := testNode("ip-10-0-0-1.ec2.internal", "", "", true)
+	poolA.ObjectMeta.Labels["pool"] = "a"
+	poolB := testNode("custom-b", "i-b", "", true)
+	poolB.ObjectMeta.Labels["pool"] = "b"
+	clientset := fake.NewSimpleClientset(poolA, poolB, testNode("ip-10-0-0-3.ec2.internal", "", "", true))
+	k := &kubernetesReadiness{clientset: clientset, matchInstanceID: true}
+	labels, err := k.getNodeLabels([]string{"ip-10-0-0-1.ec2.internal", "ip-10-0-0-2.ec2.internal", "ip-10-0-0-3.ec2.internal"}, []string{"i-a", "i-b", "i-c"}, "pool")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]string{"i-a": "a", "i-b": "b", "i-c": ""}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Errorf("mismatched labels, actual %v expected %v", labels, expected)
+	}
+	// a node that cannot be found is an error
+	if _, err := k.getNodeLabels([]string{"ip-10-0-0-4.ec2.internal"}, []string{"i-d"}, "pool"); err == nil {
+		t.Errorf("expected error for unknown node")
+	}
+}
+
+func TestKubernetesGetNodeAnnotations(t *testing.T) {
+	light := testNode("ip-10-0-0-1.ec2.internal", "", "", true)
+	light.ObjectMeta.Annotations = map[string]string{"example.com/weight": "1"}
+	heavy := testNode("custom-b", "i-b", "", true)
+	heavy.ObjectMeta.Annotations = map[string]string{"example.com/weight": "10"}
+	clientset := fake.NewSimpleClientset(light, heavy, testNode("ip-10-0-0-3.ec2.internal", "", "", true))
+	k := &kubernetesReadiness{clientset: clientset, matchInstanceID: true}
+	annotations, err := k.getNodeAnnotations([]string{"ip-10-0-0-1.ec2.internal", "ip-10-0-0-2.ec2.internal", "ip-10-0-0-3.ec2.internal"}, []string{"i-a", "i-b", "i-c"}, "example.com/weight")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]string{"i-a": "1", "i-b": "10", "i-c": ""}
+	if !reflect.DeepEqual(annotations, expected) {
+		t.Errorf("mismatched annotations, actual %v expected %v", annotations, expected)
+	}
+	// a node that cannot be found is an error
+	if _, err := k.getNodeAnnotations([]string{"ip-10-0-0-4.ec2.internal"}, []string{"i-d"}, "example.com/weight"); err == nil {
+		t.Errorf("expected error for unknown node")
+	}
+}
+
+func TestKubernetesGetNodesConcurrent(t *testing.T) {
+	// run with -race to catch unsafe access to the results
+	clientset := fake.NewSimpleClientset()
+	hostnames := make([]string, 0)
+	ids := make([]string, 0)
+	for i := 0; i < 50; i++ {
+		hostname := fmt.Sprintf("ip-10-0-0-%d.ec2.internal", i)
+		id := fmt.Sprintf("i-%d", i)
+		// every other node is named after something other than its hostname, so is found by instance ID
+		name := hostname
+		if i%2 == 1 {
+			name = fmt.Sprintf("custom-%d", i)
+		}
+		node := testNode(name, id, "", true)
+		node.ObjectMeta.Labels["pool"] = id
+		if _, err := clientset.CoreV1().Nodes().Create(node); err != nil {
+			t.Fatalf("unable to create node: %v", err)
+		}
+		hostnames = append(hostnames, hostname)
+		ids = append(ids, id)
+	}
+	for _, concurrency := range []int{1, 4, 10} {
+		k := &kubernetesReadiness{clientset: clientset, matchInstanceID: true, lookupConcurrency: concurrency}
+		labels, err := k.getNodeLabels(hostnames, ids, "pool")
+		if err != nil {
+			t.Fatalf("concurrency %d: unexpected error: %v", concurrency, err)
+		}
+		for _, id := range ids {
+			if labels[id] != id {
+				t.Errorf("concurrency %d: mismatched node for %s, found node labeled %s", concurrency, id, labels[id])
+			}
+		}
+		if _, err := k.getNodeLabels(append(hostnames, "ip-10-0-1-0.ec2.internal"), append(ids, "i-unknown"), "pool"); err == nil {
+			t.Errorf("concurrency %d: expected error for unknown node", concurrency)
+		}
+	}
+}
+
+func TestKubernetesPrepareTerminationTimeout(t *testing.T) {
+	tests := []struct {
+		desc    string
+		stuck   bool
+		timeout time.Duration
+		err     bool
+	}{
+		{"drained", false, time.Second, false},
+		{"drained without timeout", false, 0, false},
+		{"stuck pod times out", true, 100 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(
+				testNode("ip-10-0-0-1.ec2.internal", "", "", true),
+				testPod("a1", "ip-10-0-0-1.ec2.internal", "ReplicaSet", corev1.PodRunning),
+			)
+			// a pod that cannot be removed, e.g. because of a finalizer, never completes deletion
+			stuck := make(chan struct{})
+			defer close(stuck)
+			if tt.stuck {
+				clientset.PrependReactor("delete", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					<-stuck
+					return true, nil, nil
+				})
+			}
+			k := &kubernetesReadiness{clientset: clientset, drainTimeout: tt.timeout}
+			err := k.prepareTermination([]string{"ip-10-0-0-1.ec2.internal"}, []string{"i-a"}, true, true)
+			timeoutErr, isTimeout := err.(*drainTimeoutError)
+			switch {
+			case !tt.err && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.err && !isTimeout:
+				t.Errorf("expected drain timeout error, had %v", err)
+			case tt.err && timeoutErr.hostname != "ip-10-0-0-1.ec2.internal":
+				t.Errorf("mismatched hostname in timeout error %s", timeoutErr.hostname)
+			case tt.err && timeoutErr.id != "i-a":
+				t.Errorf("mismatched instance ID in timeout error %s", timeoutErr.id)
+			}
+		})
+	}
+}
+
+func TestKubernetesPrepareTerminationVerifyDrain(t *testing.T) {
+	tests := []struct {
+		desc      string
+		verify    bool
+		lingering bool
+		err       bool
+	}{
+		{"not verified", false, true, false},
+		{"verified drained", true, false, false},
+		{"verified lingering pod", true, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			mirror := testPod("m1", "ip-10-0-0-1.ec2.internal", "", corev1.PodRunning)
+			mirror.ObjectMeta.Annotations = map[string]string{mirrorPodAnnotation: "abc"}
+			clientset := fake.NewSimpleClientset(
+				testNode("ip-10-0-0-1.ec2.internal", "", "", true),
+				testPod("a1", "ip-10-0-0-1.ec2.internal", "ReplicaSet", corev1.PodRunning),
+				testPod("d1", "ip-10-0-0-1.ec2.internal", "DaemonSet", corev1.PodRunning),
+				mirror,
+			)
+			if tt.lingering {
+				// the drain deletes the pod, and sees it gone, but it is still listed on the node
+				clientset.PrependReactor("delete", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, nil
+				})
+				clientset.PrependReactor("get", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, apierrors.NewNotFound(schema.GroupResource{Resource: "pods"}, action.(k8stesting.GetAction).GetName())
+				})
+			}
+			k := &kubernetesReadiness{clientset: clientset, ignoreDaemonSets: true, verifyDrain: tt.verify}
+			err := k.prepareTermination([]string{"ip-10-0-0-1.ec2.internal"}, []string{"i-a"}, true, true)
+			drainErr, isDrainErr := err.(*drainError)
+			switch {
+			case !tt.err && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.err && !isDrainErr:
+				t.Errorf("expected drain error, had %v", err)
+			case tt.err && drainErr.id != "i-a":
+				t.Errorf("mismatched instance ID in drain error %s", drainErr.id)
+			case tt.err && !strings.Contains(err.Error(), "default/a1"):
+				t.Errorf("drain error does not name the lingering pod: %v", err)
+			}
+		})
+	}
+}
+
+// nodeServer is a fake kubernetes API server with a single node, which records the updates to it
+type nodeServer struct {
+	node    *corev1.Node
+	updates int
+}
+
+func (s *nodeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/v1/nodes/"+s.node.ObjectMeta.Name {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodPut {
+		s.updates++
+		node := &corev1.Node{}
+		if err := json.NewDecoder(r.Body).Decode(node); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.node = node
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.node)
+}
+
+func TestScaleDownDisabledAnnotation(t *testing.T) {
+	server := &nodeServer{node: testNode("ip-10-0-0-1.ec2.internal", "", "", true)}
+	server.node.TypeMeta = v1.TypeMeta{Kind: "Node", APIVersion: "v1"}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	// connect out of cluster, with a kubeconfig for the fake server
+	dir, err := ioutil.TempDir("", "roller-kube")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	kubeconfig := filepath.Join(dir, "config")
+	config := fmt.Sprintf("apiVersion: v1\nkind: Config\nclusters:\n- name: test\n  cluster:\n    server: %s\ncontexts:\n- name: test\n  context:\n    cluster: test\ncurrent-context: test\n", httpServer.URL)
+	if err := ioutil.WriteFile(kubeconfig, []byte(config), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for env, value := range map[string]string{"KUBERNETES_SERVICE_HOST": "", "KUBECONFIG": kubeconfig} {
+		if old, ok := os.LookupEnv(env); ok {
+			defer os.Setenv(env, old)
+		} else {
+			defer os.Unsetenv(env)
+		}
+		os.Setenv(env, value)
+	}
+	hostnames := []string{"ip-10-0-0-1.ec2.internal"}
+
+	// a dry run leaves the node as it is
+	annotated, err := setScaleDownDisabledAnnotation(true, hostnames, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(annotated) != 0 || server.updates != 0 {
+		t.Errorf("expected no annotation in dry run, had %v with %d updates", annotated, server.updates)
+	}
+	annotated, err = setScaleDownDisabledAnnotation(true, hostnames, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !testStringEq(annotated, hostnames) || server.node.ObjectMeta.Annotations[clusterAutoscalerScaleDownDisabledFlag] != "true" {
+		t.Errorf("expected node annotated, had %v with annotations %v", annotated, server.node.ObjectMeta.Annotations)
+	}
+
+	updates := server.updates
+	if err := removeScaleDownDisabledAnnotation(true, hostnames, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if server.updates != updates {
+		t.Errorf("expected no annotation removed in dry run, had %d updates", server.updates-updates)
+	}
+	if err := removeScaleDownDisabledAnnotation(true, hostnames, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := server.node.ObjectMeta.Annotations[clusterAutoscalerScaleDownDisabledFlag]; ok {
+		t.Errorf("expected annotation removed, had annotations %v", server.node.ObjectMeta.Annotations)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// launchTemplateCache caches the launch templates described during a single loop, by ID or name, so that
+// each is described at most once per loop, however many ASGs use it. It is safe for concurrent use. A nil
+// cache describes every launch template asked for.
+type launchTemplateCache struct {
+	mu        sync.Mutex
+	templates map[string]*cachedLaunchTemplate
+}
+
+// cachedLaunchTemplate is the result of describing a launch template, once
+type cachedLaunchTemplate struct {
+	once     sync.Once
+	template *ec2.LaunchTemplate
+	err      error
+}
+
+func newLaunchTemplateCache() *launchTemplateCache {
+	return &launchTemplateCache{templates: map[string]*cachedLaunchTemplate{}}
+}
+
+// byID returns the launch template with the ID, describing it if it has not been yet
+func (c *launchTemplateCache) byID(svc ec2Client, id string) (*ec2.LaunchTemplate, error) {
+	return c.get("id:"+id, func() (*ec2.LaunchTemplate, error) { return awsGetLaunchTemplateByID(svc, id) })
+}
+
+// byName returns the launch template with the name, describing it if it has not been yet
+func (c *launchTemplateCache) byName(svc ec2Client, name string) (*ec2.LaunchTemplate, error) {
+	return c.get("name:"+name, func() (*ec2.LaunchTemplate, error) { return awsGetLaunchTemplateByName(svc, name) })
+}
+
+func (c *launchTemplateCache) get(key string, describe func() (*ec2.LaunchTemplate, error)) (*ec2.LaunchTemplate, error) {
+	if c == nil {
+		return describe()
+	}
+	c.mu.Lock()
+	cached, ok := c.templates[key]
+	if !ok {
+		cached = &cachedLaunchTemplate{}
+		c.templates[key] = cached
+	}
+	c.mu.Unlock()
+	// lookups of the same template at the same time wait for the one describing it
+	cached.once.Do(func() {
+		cached.template, cached.err = describe()
+	})
+	return cached.template, cached.err
+}
+
+// prefetch describes the launch templates of all of the ASGs up front, up to concurrency of them at the
+// same time, rather than each as the first ASG using it is grouped. Errors are cached along with the
+// templates, and returned when an ASG using the template is grouped.
+func (c *launchTemplateCache) prefetch(svc ec2Client, asgs []*autoscaling.Group, concurrency int) {
+	lookups := make([]func(), 0)
+	seen := map[string]bool{}
+	for _, asg := range asgs {
+		lt := targetLaunchTemplate(asg)
+		switch {
+		case lt == nil:
+		case lt.LaunchTemplateId != nil && *lt.LaunchTemplateId != "":
+			id := *lt.LaunchTemplateId
+			if !seen["id:"+id] {
+				seen["id:"+id] = true
+				lookups = append(lookups, func() { _, _ = c.byID(svc, id) })
+			}
+		case lt.LaunchTemplateName != nil && *lt.LaunchTemplateName != "":
+			name := *lt.LaunchTemplateName
+			if !seen["name:"+name] {
+				seen["name:"+name] = true
+				lookups = append(lookups, func() { _, _ = c.byName(svc, name) })
+			}
+		}
+	}
+	_ = runConcurrently(len(lookups), concurrency, func(i int) error {
+		lookups[i]()
+		return nil
+	})
+}
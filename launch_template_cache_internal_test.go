@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func TestAdjustLaunchTemplateCache(t *testing.T) {
+	tests := []struct {
+		desc                string
+		concurrency         int
+		templateConcurrency int
+	}{
+		{"serial", 1, 0},
+		{"concurrent", 2, 0},
+		{"prefetched", 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// two groups use the same launch template, each with an instance of an old version
+			groups := map[string]*autoscaling.Group{}
+			names := []string{"myasg", "anotherasg"}
+			for _, name := range names {
+				groups[name] = &autoscaling.Group{
+					AutoScalingGroupName: aws.String(name),
+					DesiredCapacity:      aws.Int64(1),
+					MaxSize:              aws.Int64(2),
+					LaunchTemplate:       &autoscaling.LaunchTemplateSpecification{LaunchTemplateId: aws.String("12345"), Version: aws.String("$Latest")},
+					Instances: []*autoscaling.Instance{
+						{
+							InstanceId:     aws.String(fmt.Sprintf("%s-1", name)),
+							HealthStatus:   aws.String(healthy),
+							LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateId: aws.String("12345"), Version: aws.String("64")},
+						},
+					},
+				}
+			}
+			ec2Svc := &mockEc2Svc{autodescribe: true}
+			asgSvc := &mockAsgSvc{groups: groups}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{"myasg": 1, "anotherasg": 1}
+			configs := Configs{
+				KubernetesEnabled:   kubernetesEnabled,
+				ASGS:                names,
+				DescribeConcurrency: tt.concurrency,
+				TemplateConcurrency: tt.templateConcurrency,
+			}
+			if _, err := adjust(configs, ec2Svc, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if calls := ec2Svc.counter.filterByName("DescribeLaunchTemplates:"); len(calls) != 1 {
+				t.Errorf("expected 1 DescribeLaunchTemplates call, had %d", len(calls))
+			}
+			// both groups still are found to need updates
+			if calls := asgSvc.counter.filterByName("SetDesiredCapacity"); len(calls) != 2 {
+				t.Errorf("expected 2 SetDesiredCapacity calls, had %d", len(calls))
+			}
+
+			// the cache lasts only for a single loop
+			if _, err := adjust(configs, ec2Svc, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if calls := ec2Svc.counter.filterByName("DescribeLaunchTemplates:"); len(calls) != 2 {
+				t.Errorf("expected 2 DescribeLaunchTemplates calls after second loop, had %d", len(calls))
+			}
+		})
+	}
+}
+
+func TestLaunchTemplateCachePrefetch(t *testing.T) {
+	asgs := []*autoscaling.Group{
+		{AutoScalingGroupName: aws.String("a"), LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateId: aws.String("12345")}},
+		{AutoScalingGroupName: aws.String("b"), LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateId: aws.String("12345")}},
+		{AutoScalingGroupName: aws.String("c"), LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: aws.String("lt1")}},
+		{AutoScalingGroupName: aws.String("d"), MixedInstancesPolicy: &autoscaling.MixedInstancesPolicy{
+			LaunchTemplate: &autoscaling.LaunchTemplate{LaunchTemplateSpecification: &autoscaling.LaunchTemplateSpecification{LaunchTemplateId: aws.String("67890")}},
+		}},
+		{AutoScalingGroupName: aws.String("e"), LaunchConfigurationName: aws.String("lconfig")},
+	}
+	ec2Svc := &mockEc2Svc{}
+	templates := newLaunchTemplateCache()
+	templates.prefetch(ec2Svc, asgs, 2)
+	if calls := ec2Svc.counter.filterByName("DescribeLaunchTemplates:"); len(calls) != 3 {
+		t.Errorf("expected 3 DescribeLaunchTemplates calls, had %d", len(calls))
+	}
+	// the prefetched templates are reused
+	for _, id := range []string{"12345", "67890"} {
+		if template, err := templates.byID(ec2Svc, id); err != nil || aws.StringValue(template.LaunchTemplateId) != id {
+			t.Errorf("mismatched template for ID %s, actual %v, error %v", id, template, err)
+		}
+	}
+	if template, err := templates.byName(ec2Svc, "lt1"); err != nil || aws.StringValue(template.LaunchTemplateName) != "lt1" {
+		t.Errorf("mismatched template for name lt1, actual %v, error %v", template, err)
+	}
+	if calls := ec2Svc.counter.filterByName("DescribeLaunchTemplates:"); len(calls) != 3 {
+		t.Errorf("expected no more DescribeLaunchTemplates calls after prefetching, had %d", len(calls))
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// prefix of the AMI ID of a launch template that refers to an SSM parameter for it
+const ssmParameterImagePrefix = "resolve:ssm:"
+
+// requireTemplateImage moves new instances that were not launched from the AMI of the target launch template
+// version to the old instances, so that they are replaced. With a version such as `$Latest`, the AMI can
+// change without a new version, e.g. when the template refers to an SSM parameter for it, which comparing
+// template versions does not catch. ASGs that use launch configurations are left as they are.
+func requireTemplateImage(asg *autoscaling.Group, oldInstances, newInstances []*autoscaling.Instance, ec2Svc ec2Client, ssmSvc ssmClient, verbose bool) ([]*autoscaling.Instance, []*autoscaling.Instance, error) {
+	targetLt := asg.LaunchTemplate
+	if targetLt == nil && asg.MixedInstancesPolicy != nil && asg.MixedInstancesPolicy.LaunchTemplate != nil {
+		targetLt = asg.MixedInstancesPolicy.LaunchTemplate.LaunchTemplateSpecification
+	}
+	if targetLt == nil || len(newInstances) == 0 {
+		return oldInstances, newInstances, nil
+	}
+	image, err := awsGetLaunchTemplateImage(ec2Svc, ssmSvc, targetLt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("[%v] error retrieving AMI of launch template: %v", p2v(asg.AutoScalingGroupName), err)
+	}
+	if image == "" {
+		return oldInstances, newInstances, nil
+	}
+	described, err := awsDescribeInstances(ec2Svc, mapInstancesIds(newInstances), 1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("[%v] error retrieving AMIs of instances: %v", p2v(asg.AutoScalingGroupName), err)
+	}
+	current := make([]*autoscaling.Instance, 0)
+	for _, i := range newInstances {
+		instance, ok := described[*i.InstanceId]
+		if !ok || aws.StringValue(instance.ImageId) == image {
+			current = append(current, i)
+			continue
+		}
+		if verbose {
+			log.Printf("[%v] adding %v to list of old instances because its AMI %v is not that of the launch template %v", p2v(asg.AutoScalingGroupName), p2v(i.InstanceId), p2v(instance.ImageId), image)
+		}
+		oldInstances = append(oldInstances, i)
+	}
+	return oldInstances, current, nil
+}
+
+// awsGetLaunchTemplateImage returns the AMI ID of the version of the launch template, resolving the SSM
+// parameter it refers to for it, if any. It returns an empty ID if the version does not set an AMI.
+func awsGetLaunchTemplateImage(ec2Svc ec2Client, ssmSvc ssmClient, lt *autoscaling.LaunchTemplateSpecification) (string, error) {
+	version := aws.StringValue(lt.Version)
+	if version == "" {
+		version = "$Default"
+	}
+	input := &ec2.DescribeLaunchTemplateVersionsInput{
+		Versions: aws.StringSlice([]string{version}),
+	}
+	if aws.StringValue(lt.LaunchTemplateId) != "" {
+		input.LaunchTemplateId = lt.LaunchTemplateId
+	} else {
+		input.LaunchTemplateName = lt.LaunchTemplateName
+	}
+	out, err := ec2Svc.DescribeLaunchTemplateVersions(input)
+	if err != nil {
+		return "", fmt.Errorf("Unable to get version %s of Launch Template %v / %v: %v", version, p2v(lt.LaunchTemplateId), p2v(lt.LaunchTemplateName), err)
+	}
+	if len(out.LaunchTemplateVersions) < 1 || out.LaunchTemplateVersions[0].LaunchTemplateData == nil {
+		return "", fmt.Errorf("Version %s of Launch Template %v / %v not found", version, p2v(lt.LaunchTemplateId), p2v(lt.LaunchTemplateName))
+	}
+	image := aws.StringValue(out.LaunchTemplateVersions[0].LaunchTemplateData.ImageId)
+	if !strings.HasPrefix(image, ssmParameterImagePrefix) {
+		return image, nil
+	}
+	parameter := strings.TrimPrefix(image, ssmParameterImagePrefix)
+	if ssmSvc == nil {
+		return "", fmt.Errorf("Unable to resolve SSM parameter %s for AMI without an SSM client", parameter)
+	}
+	param, err := ssmSvc.GetParameter(&ssm.GetParameterInput{Name: aws.String(parameter)})
+	if err != nil {
+		return "", fmt.Errorf("Unable to resolve SSM parameter %s for AMI: %v", parameter, err)
+	}
+	if param.Parameter == nil {
+		return "", fmt.Errorf("SSM parameter %s for AMI not found", parameter)
+	}
+	return aws.StringValue(param.Parameter.Value), nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+type mockSsmSvc struct {
+	counter    funcCounter
+	parameters map[string]string
+}
+
+func (m *mockSsmSvc) GetParameter(in *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	m.counter.add("GetParameter", in)
+	value, ok := m.parameters[*in.Name]
+	if !ok {
+		return nil, awserr.New(ssm.ErrCodeParameterNotFound, fmt.Sprintf("parameter %s not found", *in.Name), nil)
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Name: in.Name, Value: aws.String(value)}}, nil
+}
+
+func (m *mockSsmSvc) PutParameter(in *ssm.PutParameterInput) (*ssm.PutParameterOutput, error) {
+	m.counter.add("PutParameter", in)
+	if m.parameters == nil {
+		m.parameters = map[string]string{}
+	}
+	m.parameters[*in.Name] = *in.Value
+	return &ssm.PutParameterOutput{}, nil
+}
+
+func TestRequireTemplateImage(t *testing.T) {
+	tests := []struct {
+		desc    string
+		version string
+		images  map[string]string
+		params  map[string]string
+		old     []string
+		new     []string
+		err     bool
+	}{
+		{"all on template AMI", "$Latest", map[string]string{"$Latest": "ami-new"}, nil, []string{"old1"}, []string{"1", "2"}, false},
+		{"AMI changed", "$Latest", map[string]string{"$Latest": "ami-newer"}, nil, []string{"old1", "1", "2"}, []string{}, false},
+		{"default version", "", map[string]string{"$Default": "ami-new", "$Latest": "ami-newer"}, nil, []string{"old1"}, []string{"1", "2"}, false},
+		{"SSM parameter", "$Latest", map[string]string{"$Latest": "resolve:ssm:/golden/ami"}, map[string]string{"/golden/ami": "ami-new"}, []string{"old1"}, []string{"1", "2"}, false},
+		{"SSM parameter updated", "$Latest", map[string]string{"$Latest": "resolve:ssm:/golden/ami"}, map[string]string{"/golden/ami": "ami-newer"}, []string{"old1", "1", "2"}, []string{}, false},
+		{"SSM parameter missing", "$Latest", map[string]string{"$Latest": "resolve:ssm:/golden/ami"}, map[string]string{}, nil, nil, true},
+		{"version missing", "$Latest", map[string]string{}, nil, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			instances := map[string]*ec2.Instance{
+				"1": {InstanceId: aws.String("1"), ImageId: aws.String("ami-new")},
+				"2": {InstanceId: aws.String("2"), ImageId: aws.String("ami-new")},
+			}
+			asg := &autoscaling.Group{
+				AutoScalingGroupName: aws.String("myasg"),
+				LaunchTemplate:       &autoscaling.LaunchTemplateSpecification{LaunchTemplateId: aws.String("12345"), Version: aws.String(tt.version)},
+			}
+			if tt.version == "" {
+				asg.LaunchTemplate.Version = nil
+			}
+			oldInstances := []*autoscaling.Instance{{InstanceId: aws.String("old1")}}
+			newInstances := []*autoscaling.Instance{{InstanceId: aws.String("1")}, {InstanceId: aws.String("2")}}
+			ec2Svc := &mockEc2Svc{instances: instances, templateImages: tt.images}
+			oldInstances, newInstances, err := requireTemplateImage(asg, oldInstances, newInstances, ec2Svc, &mockSsmSvc{parameters: tt.params}, false)
+			if (err != nil) != tt.err {
+				t.Fatalf("mismatched error, actual %v expected error %v", err, tt.err)
+			}
+			if tt.err {
+				return
+			}
+			if old := mapInstancesIds(oldInstances); !testStringEq(old, tt.old) {
+				t.Errorf("mismatched old instances, actual %v expected %v", old, tt.old)
+			}
+			if newIDs := mapInstancesIds(newInstances); !testStringEq(newIDs, tt.new) {
+				t.Errorf("mismatched new instances, actual %v expected %v", newIDs, tt.new)
+			}
+		})
+	}
+}
+
+func TestAdjustCompareAMI(t *testing.T) {
+	tests := []struct {
+		desc       string
+		compare    bool
+		setDesired []int64
+	}{
+		{"not compared", false, []int64{}},
+		{"compared", true, []int64{3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// every instance is on the latest template version, but the SSM parameter for the AMI moved on
+			name := "myasg"
+			myHealthy := healthy
+			lt := &autoscaling.LaunchTemplateSpecification{LaunchTemplateId: aws.String("12345"), Version: aws.String("$Latest")}
+			ec2Instances := map[string]*ec2.Instance{
+				"1": {InstanceId: aws.String("1"), PrivateDnsName: aws.String("host1"), ImageId: aws.String("ami-old")},
+				"2": {InstanceId: aws.String("2"), PrivateDnsName: aws.String("host2"), ImageId: aws.String("ami-old")},
+			}
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName: &name,
+					DesiredCapacity:      aws.Int64(2),
+					MaxSize:              aws.Int64(4),
+					LaunchTemplate:       lt,
+					Instances: []*autoscaling.Instance{
+						{InstanceId: aws.String("1"), LaunchTemplate: lt, HealthStatus: &myHealthy},
+						{InstanceId: aws.String("2"), LaunchTemplate: lt, HealthStatus: &myHealthy},
+					},
+				},
+			}}
+			ec2Svc := &mockEc2Svc{instances: ec2Instances, templateImages: map[string]string{"$Latest": "resolve:ssm:/golden/ami"}}
+			ssmSvc := &mockSsmSvc{parameters: map[string]string{"/golden/ami": "ami-new"}}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 2}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				InitialSurge:      1,
+				MaxTerminate:      1,
+				MaxSurge:          -1,
+				MaxUnavailable:    -1,
+				CompareAMI:        tt.compare,
+			}
+			if _, err := adjust(configs, ec2Svc, asgSvc, ssmSvc, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			setDesired := make([]int64, 0)
+			for _, c := range asgSvc.counter.filterByName("SetDesiredCapacity") {
+				setDesired = append(setDesired, *c.params[0].(*autoscaling.SetDesiredCapacityInput).DesiredCapacity)
+			}
+			if fmt.Sprint(setDesired) != fmt.Sprint(tt.setDesired) {
+				t.Errorf("mismatched desired counts, actual %v expected %v", setDesired, tt.setDesired)
+			}
+		})
+	}
+}
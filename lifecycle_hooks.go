@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+const (
+	// transition of lifecycle hooks that hold instances in Terminating:Wait
+	lifecycleTransitionTerminating = "autoscaling:EC2_INSTANCE_TERMINATING"
+	// result to complete a lifecycle action with, to let the instance terminate
+	lifecycleActionContinue = "CONTINUE"
+)
+
+// terminatingInstances returns the instances that are on their way out of the ASG, including those held
+// in Terminating:Wait by a termination lifecycle hook. They are still in the ASG until they have left it.
+func terminatingInstances(instances []*autoscaling.Instance) []*autoscaling.Instance {
+	terminating := make([]*autoscaling.Instance, 0)
+	for _, i := range instances {
+		if strings.HasPrefix(aws.StringValue(i.LifecycleState), autoscaling.LifecycleStateTerminating) {
+			terminating = append(terminating, i)
+		}
+	}
+	return terminating
+}
+
+// waitingInstances returns the IDs of the instances held in Terminating:Wait by a termination lifecycle hook
+func waitingInstances(instances []*autoscaling.Instance) []string {
+	waiting := make([]string, 0)
+	for _, i := range instances {
+		if aws.StringValue(i.LifecycleState) == autoscaling.LifecycleStateTerminatingWait {
+			waiting = append(waiting, *i.InstanceId)
+		}
+	}
+	return waiting
+}
+
+// awsCompleteLifecycleHooks completes the actions of every termination lifecycle hook of the ASG for the
+// instances, so that they terminate rather than waiting for the hooks to time out
+func awsCompleteLifecycleHooks(svc asgClient, asg *autoscaling.Group, ids []string, dryRun bool) error {
+	out, err := svc.DescribeLifecycleHooks(&autoscaling.DescribeLifecycleHooksInput{
+		AutoScalingGroupName: asg.AutoScalingGroupName,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to describe lifecycle hooks of ASG %s: %v", *asg.AutoScalingGroupName, err)
+	}
+	for _, hook := range out.LifecycleHooks {
+		if aws.StringValue(hook.LifecycleTransition) != lifecycleTransitionTerminating {
+			continue
+		}
+		for _, id := range ids {
+			if dryRun {
+				log.Printf("dry run: would complete lifecycle hook %s of ASG %s for instance %s", *hook.LifecycleHookName, *asg.AutoScalingGroupName, id)
+				continue
+			}
+			_, err := svc.CompleteLifecycleAction(&autoscaling.CompleteLifecycleActionInput{
+				AutoScalingGroupName:  asg.AutoScalingGroupName,
+				LifecycleHookName:     hook.LifecycleHookName,
+				InstanceId:            aws.String(id),
+				LifecycleActionResult: aws.String(lifecycleActionContinue),
+			})
+			if err != nil {
+				return fmt.Errorf("unable to complete lifecycle hook %s of ASG %s for instance %s: %v", *hook.LifecycleHookName, *asg.AutoScalingGroupName, id, err)
+			}
+		}
+	}
+	return nil
+}
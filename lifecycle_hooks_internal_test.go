@@ -0,0 +1,117 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func TestCalculateAdjustmentTerminating(t *testing.T) {
+	// original desired is 2, surged by 1, with old instance 2 in the given state
+	tests := []struct {
+		state           string
+		targetTerminate []string
+	}{
+		{autoscaling.LifecycleStateInService, []string{"1"}},
+		{autoscaling.LifecycleStateTerminating, nil},
+		{autoscaling.LifecycleStateTerminatingWait, nil},
+		{autoscaling.LifecycleStateTerminatingProceed, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.state, func(t *testing.T) {
+			myHealthy := healthy
+			inService := aws.String(autoscaling.LifecycleStateInService)
+			oldInstances := []*autoscaling.Instance{
+				{InstanceId: aws.String("1"), HealthStatus: &myHealthy, LifecycleState: inService},
+				{InstanceId: aws.String("2"), HealthStatus: &myHealthy, LifecycleState: aws.String(tt.state)},
+			}
+			newInstances := []*autoscaling.Instance{
+				{InstanceId: aws.String("3"), HealthStatus: &myHealthy, LifecycleState: inService},
+				{InstanceId: aws.String("4"), HealthStatus: &myHealthy, LifecycleState: inService},
+			}
+			asg := &autoscaling.Group{
+				AutoScalingGroupName: aws.String("myasg"),
+				DesiredCapacity:      aws.Int64(3),
+				Instances:            append(append([]*autoscaling.Instance{}, oldInstances...), newInstances...),
+			}
+			desired, terminate, err := calculateAdjustment(false, asg, oldInstances, newInstances, map[string]string{}, nil, nil, nil, 2, 1, rollLimits{1, 0}, 0, false, false, false, false, true, true)
+			switch {
+			case err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case desired != 3:
+				t.Errorf("mismatched desired, actual %d expected %d", desired, 3)
+			case !testStringEq(terminate, tt.targetTerminate):
+				t.Errorf("mismatched terminate IDs, actual %v expected %v", terminate, tt.targetTerminate)
+			}
+		})
+	}
+}
+
+func TestAdjustCompleteLifecycleHooks(t *testing.T) {
+	tests := []struct {
+		desc      string
+		complete  bool
+		completed []string
+	}{
+		{"waiting", false, []string{}},
+		{"completing", true, []string{"termhook:1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// part way through a roll, with an old instance held by a termination lifecycle hook
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			asgSvc := &mockAsgSvc{
+				groups: map[string]*autoscaling.Group{
+					name: {
+						AutoScalingGroupName:    &name,
+						DesiredCapacity:         aws.Int64(3),
+						MaxSize:                 aws.Int64(4),
+						LaunchConfigurationName: &lcName,
+						Instances: []*autoscaling.Instance{
+							{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy, LifecycleState: aws.String(autoscaling.LifecycleStateTerminatingWait)},
+							{InstanceId: aws.String("2"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy, LifecycleState: aws.String(autoscaling.LifecycleStateInService)},
+							{InstanceId: aws.String("3"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy, LifecycleState: aws.String(autoscaling.LifecycleStateInService)},
+							{InstanceId: aws.String("4"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy, LifecycleState: aws.String(autoscaling.LifecycleStateInService)},
+						},
+					},
+				},
+				lifecycleHooks: []*autoscaling.LifecycleHook{
+					{LifecycleHookName: aws.String("launchhook"), LifecycleTransition: aws.String("autoscaling:EC2_INSTANCE_LAUNCHING")},
+					{LifecycleHookName: aws.String("termhook"), LifecycleTransition: aws.String(lifecycleTransitionTerminating)},
+				},
+			}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 2}
+			state.setRolling(name, true)
+			configs := Configs{
+				KubernetesEnabled:      kubernetesEnabled,
+				ASGS:                   []string{name},
+				InitialSurge:           1,
+				MaxTerminate:           1,
+				MaxSurge:               -1,
+				MaxUnavailable:         -1,
+				CompleteLifecycleHooks: tt.complete,
+			}
+			_, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			completed := make([]string, 0)
+			for _, c := range asgSvc.counter.filterByName("CompleteLifecycleAction") {
+				in := c.params[0].(*autoscaling.CompleteLifecycleActionInput)
+				completed = append(completed, *in.LifecycleHookName+":"+*in.InstanceId)
+			}
+			if !testStringEq(completed, tt.completed) {
+				t.Errorf("mismatched lifecycle actions completed, actual %v expected %v", completed, tt.completed)
+			}
+			// the other old instance is not terminated until the one terminating has left the ASG
+			if terminated := asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup"); len(terminated) != 0 {
+				t.Errorf("terminated %d instances while one was still terminating", len(terminated))
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+const (
+	asgTagNameMaxSurge       = "aws-asg-roller/MaxSurge"
+	asgTagNameMaxUnavailable = "aws-asg-roller/MaxUnavailable"
+)
+
+// how to roll an ASG when neither max surge nor max unavailable are set
+const (
+	// surge above the original desired count before terminating old instances
+	strategySurge = "surge"
+	// terminate old instances first, going below the original desired count, and let the ASG replace them
+	strategyMaxUnavailable = "maxUnavailable"
+)
+
+// rollLimits are how far above and below its original desired count an ASG may go while it is rolled,
+// much as for the rolling update of a kubernetes Deployment
+type rollLimits struct {
+	// maxSurge is how many instances above the original desired count the ASG may go
+	maxSurge int
+	// maxUnavailable is how many fewer healthy instances than the original desired count there may be
+	maxUnavailable int
+}
+
+// parseMaxSurge parses a max surge, either a number of instances, or a percentage of the original desired
+// count, e.g. `25%`. It returns the number, or -1 and the percentage.
+func parseMaxSurge(value string) (int, int, error) {
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+		if err != nil || percent < 0 {
+			return 0, 0, fmt.Errorf("invalid percentage '%s'", value)
+		}
+		if percent == 0 {
+			return 0, 0, nil
+		}
+		return -1, percent, nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid number '%s'", value)
+	}
+	return count, 0, nil
+}
+
+// percentOfDesired returns the number of instances that a percentage of the original desired count is,
+// rounded up, as for the maxSurge of a kubernetes Deployment
+func percentOfDesired(percent int, originalDesired int64) int {
+	return int((originalDesired*int64(percent) + 99) / 100)
+}
+
+// getRollLimits returns the limits for rolling an ASG. Tags on the ASG override the configured limits.
+// A max surge may be a percentage of the original desired count, which caps how far the ASG grows.
+// If neither max surge nor max unavailable are set at all, with the surge strategy the ASG surges by the
+// initial surge, but by no more than can be terminated at once, and keeps all of its original desired count
+// healthy; with the max unavailable strategy, it does not surge, and up to as many instances as can be
+// terminated at once may be unavailable.
+func getRollLimits(asg *autoscaling.Group, configs Configs, originalDesired int64) (rollLimits, error) {
+	maxSurge, maxUnavailable := configs.MaxSurge, configs.MaxUnavailable
+	if configs.MaxSurgePercent > 0 {
+		maxSurge = percentOfDesired(configs.MaxSurgePercent, originalDesired)
+	}
+	for _, tag := range asg.Tags {
+		var (
+			target *int
+			value  int
+			err    error
+		)
+		switch aws.StringValue(tag.Key) {
+		case asgTagNameMaxSurge:
+			target = &maxSurge
+			var percent int
+			if value, percent, err = parseMaxSurge(aws.StringValue(tag.Value)); percent > 0 {
+				value = percentOfDesired(percent, originalDesired)
+			}
+		case asgTagNameMaxUnavailable:
+			target = &maxUnavailable
+			value, err = strconv.Atoi(aws.StringValue(tag.Value))
+		default:
+			continue
+		}
+		if err != nil || value < 0 {
+			return rollLimits{}, fmt.Errorf("invalid value '%s' for tag '%s' on ASG %s", aws.StringValue(tag.Value), aws.StringValue(tag.Key), aws.StringValue(asg.AutoScalingGroupName))
+		}
+		*target = value
+	}
+	limits := rollLimits{maxSurge: maxSurge, maxUnavailable: maxUnavailable}
+	if configs.Strategy == strategyMaxUnavailable {
+		if maxSurge < 0 {
+			limits.maxSurge = 0
+		}
+		if maxUnavailable < 0 {
+			limits.maxUnavailable = configs.MaxTerminate
+			if limits.maxUnavailable < 1 {
+				limits.maxUnavailable = 1
+			}
+		}
+	}
+	if limits.maxSurge < 0 {
+		limits.maxSurge = configs.InitialSurge
+		if maxTerminate := configs.MaxTerminate; limits.maxSurge > maxTerminate {
+			limits.maxSurge = maxTerminate
+		}
+	}
+	if limits.maxUnavailable < 0 {
+		limits.maxUnavailable = 0
+	}
+	// without surging nor going below the original desired count, an ASG can never be rolled
+	if limits.maxSurge < 1 && limits.maxUnavailable < 1 {
+		limits.maxSurge = 1
+	}
+	return limits, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elb/elbiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+)
+
+// state of an instance healthy in a classic load balancer
+const elbInstanceInService = "InService"
+
+// loadBalancerHealth checks the health of instances directly with the load balancers of their ASG, rather
+// than relying on the health status the ASG reports for them, which may be stale
+type loadBalancerHealth interface {
+	// getUnhealthyCount returns how many of the instances are not healthy in every classic load balancer
+	// and target group of the ASG
+	getUnhealthyCount(asg *autoscaling.Group, ids []string) (int, error)
+}
+
+type awsLoadBalancerHealth struct {
+	elbSvc   elbiface.ELBAPI
+	elbv2Svc elbv2iface.ELBV2API
+}
+
+func (a *awsLoadBalancerHealth) getUnhealthyCount(asg *autoscaling.Group, ids []string) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	unhealthy := map[string]bool{}
+	for _, name := range asg.LoadBalancerNames {
+		instances := make([]*elb.Instance, 0, len(ids))
+		for _, id := range ids {
+			instances = append(instances, &elb.Instance{InstanceId: aws.String(id)})
+		}
+		out, err := a.elbSvc.DescribeInstanceHealth(&elb.DescribeInstanceHealthInput{
+			LoadBalancerName: name,
+			Instances:        instances,
+		})
+		if err != nil {
+			return 0, fmt.Errorf("unable to describe instance health in load balancer %s: %v", aws.StringValue(name), err)
+		}
+		healthy := map[string]bool{}
+		for _, state := range out.InstanceStates {
+			if aws.StringValue(state.State) == elbInstanceInService {
+				healthy[aws.StringValue(state.InstanceId)] = true
+			}
+		}
+		markUnhealthy(unhealthy, ids, healthy)
+	}
+	for _, arn := range asg.TargetGroupARNs {
+		targets := make([]*elbv2.TargetDescription, 0, len(ids))
+		for _, id := range ids {
+			targets = append(targets, &elbv2.TargetDescription{Id: aws.String(id)})
+		}
+		out, err := a.elbv2Svc.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{
+			TargetGroupArn: arn,
+			Targets:        targets,
+		})
+		if err != nil {
+			return 0, fmt.Errorf("unable to describe target health in target group %s: %v", aws.StringValue(arn), err)
+		}
+		healthy := map[string]bool{}
+		for _, description := range out.TargetHealthDescriptions {
+			if description.Target != nil && description.TargetHealth != nil && aws.StringValue(description.TargetHealth.State) == elbv2.TargetHealthStateEnumHealthy {
+				healthy[aws.StringValue(description.Target.Id)] = true
+			}
+		}
+		markUnhealthy(unhealthy, ids, healthy)
+	}
+	return len(unhealthy), nil
+}
+
+// markUnhealthy marks each of the instances that is not healthy as unhealthy, including those that the
+// load balancer did not report at all
+func markUnhealthy(unhealthy map[string]bool, ids []string, healthy map[string]bool) {
+	for _, id := range ids {
+		if !healthy[id] {
+			unhealthy[id] = true
+		}
+	}
+}
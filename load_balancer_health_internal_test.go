@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elb/elbiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+)
+
+type mockElbSvc struct {
+	elbiface.ELBAPI
+	err error
+	// state of each instance, by load balancer and instance ID
+	states map[string]map[string]string
+}
+
+func (m *mockElbSvc) DescribeInstanceHealth(in *elb.DescribeInstanceHealthInput) (*elb.DescribeInstanceHealthOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	out := &elb.DescribeInstanceHealthOutput{}
+	for _, i := range in.Instances {
+		if state, ok := m.states[*in.LoadBalancerName][*i.InstanceId]; ok {
+			out.InstanceStates = append(out.InstanceStates, &elb.InstanceState{InstanceId: i.InstanceId, State: aws.String(state)})
+		}
+	}
+	return out, nil
+}
+
+type mockElbv2Svc struct {
+	elbv2iface.ELBV2API
+	err error
+	// state of each target, by target group ARN and instance ID
+	states map[string]map[string]string
+}
+
+func (m *mockElbv2Svc) DescribeTargetHealth(in *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	out := &elbv2.DescribeTargetHealthOutput{}
+	for _, t := range in.Targets {
+		if state, ok := m.states[*in.TargetGroupArn][*t.Id]; ok {
+			out.TargetHealthDescriptions = append(out.TargetHealthDescriptions, &elbv2.TargetHealthDescription{
+				Target:       &elbv2.TargetDescription{Id: t.Id},
+				TargetHealth: &elbv2.TargetHealth{State: aws.String(state)},
+			})
+		}
+	}
+	return out, nil
+}
+
+func TestLoadBalancerHealthGetUnhealthyCount(t *testing.T) {
+	tests := []struct {
+		desc         string
+		elbStates    map[string]map[string]string
+		targetStates map[string]map[string]string
+		err          error
+		unhealthy    int
+	}{
+		{"all healthy",
+			map[string]map[string]string{"lb": {"1": "InService", "2": "InService"}},
+			map[string]map[string]string{"tg": {"1": "healthy", "2": "healthy"}},
+			nil, 0},
+		{"out of service in load balancer",
+			map[string]map[string]string{"lb": {"1": "OutOfService", "2": "InService"}},
+			map[string]map[string]string{"tg": {"1": "healthy", "2": "healthy"}},
+			nil, 1},
+		{"unhealthy in target group",
+			map[string]map[string]string{"lb": {"1": "InService", "2": "InService"}},
+			map[string]map[string]string{"tg": {"1": "healthy", "2": "initial"}},
+			nil, 1},
+		{"unhealthy in both",
+			map[string]map[string]string{"lb": {"1": "OutOfService", "2": "InService"}},
+			map[string]map[string]string{"tg": {"1": "unhealthy", "2": "draining"}},
+			nil, 2},
+		{"not registered",
+			map[string]map[string]string{"lb": {"1": "InService"}},
+			map[string]map[string]string{"tg": {"1": "healthy"}},
+			nil, 1},
+		{"error", nil, nil, fmt.Errorf("error"), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			lbHealth := &awsLoadBalancerHealth{
+				elbSvc:   &mockElbSvc{err: tt.err, states: tt.elbStates},
+				elbv2Svc: &mockElbv2Svc{err: tt.err, states: tt.targetStates},
+			}
+			asg := &autoscaling.Group{
+				AutoScalingGroupName: aws.String("myasg"),
+				LoadBalancerNames:    []*string{aws.String("lb")},
+				TargetGroupARNs:      []*string{aws.String("tg")},
+			}
+			unhealthy, err := lbHealth.getUnhealthyCount(asg, []string{"1", "2"})
+			switch {
+			case (err == nil) != (tt.err == nil):
+				t.Errorf("mismatched error, actual %v expected %v", err, tt.err)
+			case unhealthy != tt.unhealthy:
+				t.Errorf("mismatched unhealthy count, actual %d expected %d", unhealthy, tt.unhealthy)
+			}
+		})
+	}
+}
+
+func TestCalculateAdjustmentLoadBalancerHealth(t *testing.T) {
+	tests := []struct {
+		desc      string
+		lbHealth  loadBalancerHealth
+		terminate []string
+		err       bool
+	}{
+		{"no load balancer health", nil, []string{"1"}, false},
+		{"new instances healthy", &awsLoadBalancerHealth{
+			elbSvc:   &mockElbSvc{states: map[string]map[string]string{"lb": {"2": "InService"}}},
+			elbv2Svc: &mockElbv2Svc{},
+		}, []string{"1"}, false},
+		{"new instances unhealthy", &awsLoadBalancerHealth{
+			elbSvc:   &mockElbSvc{states: map[string]map[string]string{"lb": {"2": "OutOfService"}}},
+			elbv2Svc: &mockElbv2Svc{},
+		}, nil, false},
+		{"error", &awsLoadBalancerHealth{
+			elbSvc:   &mockElbSvc{err: fmt.Errorf("error")},
+			elbv2Svc: &mockElbv2Svc{},
+		}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// the ASG reports the new instance as healthy, whatever its load balancer says
+			old := &autoscaling.Instance{InstanceId: aws.String("1"), HealthStatus: aws.String(healthy)}
+			newInstance := &autoscaling.Instance{InstanceId: aws.String("2"), HealthStatus: aws.String(healthy)}
+			asg := &autoscaling.Group{
+				AutoScalingGroupName: aws.String("myasg"),
+				DesiredCapacity:      aws.Int64(2),
+				MaxSize:              aws.Int64(2),
+				HealthCheckType:      aws.String("ELB"),
+				LoadBalancerNames:    []*string{aws.String("lb")},
+				Instances:            []*autoscaling.Instance{old, newInstance},
+			}
+			desired, terminate, err := calculateAdjustment(false, asg, []*autoscaling.Instance{old}, []*autoscaling.Instance{newInstance}, map[string]string{}, nil, tt.lbHealth, nil, 1, 1, rollLimits{maxSurge: 1}, 0, false, false, false, false, true, true)
+			switch {
+			case (err != nil) != tt.err:
+				t.Errorf("mismatched error, actual %v expected error %v", err, tt.err)
+			case desired != 2:
+				t.Errorf("mismatched desired, actual %d expected 2", desired)
+			case !testStringEq(terminate, tt.terminate):
+				t.Errorf("mismatched terminate IDs, actual %v expected %v", terminate, tt.terminate)
+			}
+		})
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
-	"strings"
+	"os/signal"
+	"regexp"
+	"syscall"
 	"time"
 
 	env "github.com/caarlos0/env/v6"
@@ -13,49 +16,332 @@ func main() {
 	configs := getConfigs()
 
 	// get a kube connection
-	readinessHandler, err := kubeGetReadinessHandler(configs.KubernetesEnabled, configs.IgnoreDaemonSets, configs.DeleteLocalData)
+	readinessHandler, err := getReadinessHandler(configs)
 	if err != nil {
 		log.Fatalf("Error getting kubernetes readiness handler when required: %v", err)
 	}
 
 	// get the AWS sessions
-	ec2Svc, asgSvc, err := awsGetServices()
+	ec2Svc, asgSvc, s3Svc, sqsSvc, cloudWatchSvc, err := awsGetServices(configs.AWSRegion, configs.AWSEndpoint, configs.AssumeRoleARN, configs.AssumeRoleExternalID)
 	if err != nil {
 		log.Fatalf("Unable to create an AWS session: %v", err)
 	}
+	// optionally wait for credentials to become available before the first loop
+	if configs.CredentialsTimeout > 0 {
+		stsSvc, err := awsGetSTSService(configs.AWSRegion, configs.AWSEndpoint, configs.AssumeRoleARN, configs.AssumeRoleExternalID)
+		if err != nil {
+			log.Fatalf("Unable to create an AWS session for STS: %v", err)
+		}
+		if err := waitForCredentials(stsSvc, configs.CredentialsTimeout); err != nil {
+			log.Fatalf("Unable to get AWS credentials: %v", err)
+		}
+	}
+
+	// catch typos in the ASG names before the first loop
+	if err := checkGroupsExist(configs, asgSvc); err != nil {
+		log.Fatalf("Error checking configured ASGs: %v", err)
+	}
+
+	// optionally read roll settings from AppConfig as well as the environment
+	var source configSource
+	if configs.AppConfigApplication != "" {
+		appConfigSvc, err := awsGetAppConfigService(configs.AWSRegion, configs.AWSEndpoint, configs.AssumeRoleARN, configs.AssumeRoleExternalID)
+		if err != nil {
+			log.Fatalf("Unable to create an AWS session for AppConfig: %v", err)
+		}
+		source = newAppConfigSource(appConfigSvc, configs)
+	}
+
+	// optionally resolve the SSM parameters launch templates refer to for their AMIs, or record state in SSM
+	var ssmSvc ssmClient
+	if configs.CompareAMI || configs.StateBackend == stateBackendSSM {
+		ssmSvc, err = awsGetSSMService(configs.AWSRegion, configs.AWSEndpoint, configs.AssumeRoleARN, configs.AssumeRoleExternalID)
+		if err != nil {
+			log.Fatalf("Unable to create an AWS session for SSM: %v", err)
+		}
+	}
+
+	// optionally record the original desired values somewhere other than the tags on the ASGs
+	var store stateStore
+	switch configs.StateBackend {
+	case stateBackendSSM:
+		store = &ssmStateStore{ssmSvc: ssmSvc, prefix: configs.StateSSMPrefix}
+	case stateBackendDynamoDB:
+		dynamoSvc, err := awsGetDynamoDBService(configs.AWSRegion, configs.AWSEndpoint, configs.AssumeRoleARN, configs.AssumeRoleExternalID)
+		if err != nil {
+			log.Fatalf("Unable to create an AWS session for DynamoDB: %v", err)
+		}
+		store = &dynamoStateStore{svc: dynamoSvc, table: configs.StateDynamoDBTable}
+	}
+
+	// optionally check the health of new instances with their load balancers
+	var lbHealth loadBalancerHealth
+	if configs.LoadBalancerHealth {
+		lbHealth, err = awsGetLoadBalancerHealth(configs.AWSRegion, configs.AWSEndpoint, configs.AssumeRoleARN, configs.AssumeRoleExternalID)
+		if err != nil {
+			log.Fatalf("Unable to create an AWS session for load balancers: %v", err)
+		}
+	}
+
+	// optionally check the headroom under the instance quota before surging
+	var quota capacityQuota
+	if configs.CheckQuota {
+		quota, err = awsGetCapacityQuota(ec2Svc, configs.AWSRegion, configs.AWSEndpoint, configs.AssumeRoleARN, configs.AssumeRoleExternalID)
+		if err != nil {
+			log.Fatalf("Unable to create an AWS session for service quotas: %v", err)
+		}
+	}
+
+	// optionally validate once every ASG has been rolled
+	validator := getPostRollValidator(configs)
+
+	// serve metrics alongside the loop
+	if configs.MetricsAddress != "" {
+		go serveMetrics(configs.MetricsAddress)
+	}
+
+	// serve health checks for the loop
+	health := newHealthStatus(configs.ReadyMaxFailures)
+	if configs.HealthAddress != "" {
+		go serveHealth(configs.HealthAddress, health)
+	}
+
+	// optionally notify of roll events
+	notifier := getRollNotifier(configs, sqsSvc)
+
+	// to keep track of original target sizes and other state during rolling updates
+	state := newRollerState()
 
-	// to keep track of original target sizes during rolling updates
-	originalDesired := map[string]int64{}
+	// optionally log what was left mid-roll on shutdown
+	if configs.ShutdownSummary {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		go handleShutdown(signals, state, os.Exit)
+	}
 
 	// infinite loop
 	for {
-		err := adjust(
-			configs.KubernetesEnabled, configs.ASGS, ec2Svc, asgSvc,
-			readinessHandler, originalDesired, configs.OriginalDesiredOnTag,
-			configs.IncreaseMax, configs.Verbose, configs.Drain, configs.DrainForce,
-		)
+		loopConfigs := configs
+		if source != nil {
+			if err := source.apply(&loopConfigs); err != nil {
+				log.Printf("Error reading configuration: %v", err)
+			}
+		}
+		health.loopStarted()
+		statuses, err := adjustWithTimeout(loopConfigs.AdjustTimeout, loopConfigs, ec2Svc, asgSvc, ssmSvc, store, readinessHandler, lbHealth, quota, notifier, state)
 		if err != nil {
 			log.Printf("Error adjusting AutoScaling Groups: %v", err)
 		}
+		for _, status := range statuses {
+			log.Printf("%v\n", status)
+		}
+		if loopConfigs.DecisionsNDJSON {
+			if err := writeDecisions(os.Stdout, statuses); err != nil {
+				log.Printf("Error writing decisions: %v", err)
+			}
+		}
+		if loopConfigs.CloudWatchMetrics {
+			// failing to publish metrics does not affect rolling
+			if err := publishCloudWatchMetrics(cloudWatchSvc, loopConfigs.CloudWatchNamespace, statuses, time.Now()); err != nil {
+				log.Printf("Error publishing CloudWatch metrics: %v", err)
+			}
+		}
+		if err := completeRoll(loopConfigs, validator, s3Svc, state); err != nil {
+			log.Printf("Error completing roll: %v", err)
+		}
 		// delay with each loop
-		log.Printf("Sleeping %v\n", configs.Interval)
-		time.Sleep(configs.Interval)
+		interval := loopInterval(loopConfigs, state)
+		health.loopFinished(err, interval)
+		log.Printf("Sleeping %v\n", interval)
+		time.Sleep(interval)
 	}
 }
 
-func getConfigs() (configs Configs) {
-	// Compat helper
-	val, ok := os.LookupEnv("ROLLER_CHECK_DELAY")
-	if ok {
-		// Use value from check delay to set an interval
-		if !strings.HasSuffix(val, "s") {
-			os.Setenv("ROLLER_INTERVAL", val+"s")
+// getReadinessHandler returns the kubernetes readiness handler, nil if kubernetes is disabled, or if there is
+// no connection to it and it is not required
+func getReadinessHandler(configs Configs) (readiness, error) {
+	readinessHandler, err := kubeGetReadinessHandler(configs.KubernetesEnabled, configs.IgnoreDaemonSets, configs.DeleteLocalData, configs.MatchNodesByInstanceID, configs.VerifyDrain, configs.DrainTimeout, configs.DrainMethod, configs.DrainGracePeriod, configs.LookupConcurrency, configs.ReadyLabel, configs.ReadyDaemonSets)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkReadinessHandler(configs, readinessHandler); err != nil {
+		return nil, err
+	}
+	return readinessHandler, nil
+}
+
+// checkReadinessHandler checks that there is a readiness handler if kubernetes is enabled. If there is not,
+// it is an error if kubernetes is required, else a warning.
+func checkReadinessHandler(configs Configs, readinessHandler readiness) error {
+	if !configs.KubernetesEnabled || readinessHandler != nil {
+		return nil
+	}
+	if configs.KubernetesRequired {
+		return fmt.Errorf("kubernetes is enabled and required, but there is no connection to it")
+	}
+	log.Printf("WARNING: kubernetes is enabled, but there is no connection to it, so nodes will be checked only for EC2 health, and will not be drained")
+	return nil
+}
+
+// checkGroupsExist checks that each of the configured ASGs exists, as AWS silently leaves out any that do
+// not, e.g. due to a typo in the name, which would otherwise never be rolled. Each one missing is warned of,
+// and it is an error if the ASGs are required to exist.
+func checkGroupsExist(configs Configs, asgSvc asgClient) error {
+	if len(configs.ASGS) == 0 {
+		return nil
+	}
+	asgs, err := awsDescribeGroups(asgSvc, configs.ASGS)
+	if err != nil {
+		if configs.StrictASG {
+			return err
+		}
+		log.Printf("WARNING: unable to check that the configured ASGs exist: %v", err)
+		return nil
+	}
+	missing := missingGroups(configs.ASGS, asgs)
+	for _, name := range missing {
+		log.Printf("[%s] WARNING: configured ASG does not exist, check ROLLER_ASG for typos", name)
+	}
+	if len(missing) > 0 && configs.StrictASG {
+		return fmt.Errorf("configured ASGs do not exist: %v", missing)
+	}
+	return nil
+}
+
+// loopInterval returns how long to wait before the next loop, depending on whether any ASG was rolling
+// in the last one. If no interval is set for that phase, the general interval is used, moved randomly by up
+// to the jitter, if any. It is never less than the minimum loop sleep, so that the loop cannot spin, e.g. on
+// errors, with a zero interval.
+func loopInterval(configs Configs, state *rollerState) time.Duration {
+	interval := configs.Interval
+	if state.anyRolling() {
+		if configs.ActiveInterval > 0 {
+			interval = configs.ActiveInterval
 		}
+	} else if configs.IdleInterval > 0 {
+		interval = configs.IdleInterval
 	}
+	// the jitter is checked at startup
+	if jittered, err := jitterInterval(interval, configs.IntervalJitter, jitterRand.Float64()); err == nil {
+		interval = jittered
+	}
+	if interval < configs.MinLoopSleep {
+		return configs.MinLoopSleep
+	}
+	return interval
+}
 
+func getConfigs() (configs Configs) {
 	if err := env.Parse(&configs); err != nil {
 		log.Panicf("unexpected error while initializing the config: %v", err)
 	}
 
+	// Compat helper: the deprecated check delay is used for the interval only if the interval is not set
+	intervalSet := os.Getenv("ROLLER_INTERVAL") != ""
+	checkDelaySet := os.Getenv("ROLLER_CHECK_DELAY") != ""
+	switch {
+	case intervalSet && checkDelaySet:
+		log.Printf("both ROLLER_INTERVAL and deprecated ROLLER_CHECK_DELAY are set, using ROLLER_INTERVAL of %v", configs.Interval)
+	case checkDelaySet:
+		configs.Interval = time.Duration(configs.CheckDelay) * time.Second
+		log.Printf("using deprecated ROLLER_CHECK_DELAY for an interval of %v, use ROLLER_INTERVAL instead", configs.Interval)
+	}
+
+	// the batch size is a shorthand for both the initial surge and the max to terminate at once, unless
+	// either of those is set explicitly
+	if configs.BatchSize > 1 {
+		if os.Getenv("ROLLER_INITIAL_SURGE") == "" {
+			configs.InitialSurge = configs.BatchSize
+		}
+		if os.Getenv("ROLLER_MAX_TERMINATE") == "" {
+			configs.MaxTerminate = configs.BatchSize
+		}
+	}
+
+	maxSurge, maxSurgePercent, err := parseMaxSurge(configs.MaxSurgeSetting)
+	if err != nil {
+		log.Panicf("invalid ROLLER_MAX_SURGE: %v", err)
+	}
+	configs.MaxSurge, configs.MaxSurgePercent = maxSurge, maxSurgePercent
+
+	// waiting for the load balancers is the same as checking the health of new instances with them
+	if configs.WaitForELB {
+		configs.LoadBalancerHealth = true
+	}
+
+	tags, err := parseASGTags(configs.ASGTags)
+	if err != nil {
+		log.Panicf("invalid ROLLER_ASG_TAGS: %v", err)
+	}
+	configs.ASGTagFilters = tags
+	if configs.ASGPattern != "" {
+		pattern, err := regexp.Compile(configs.ASGPattern)
+		if err != nil {
+			log.Panicf("invalid ROLLER_ASG_PATTERN: %v", err)
+		}
+		configs.ASGNamePattern = pattern
+	}
+	if len(configs.ASGS) == 0 && len(tags) == 0 && configs.ASGNamePattern == nil {
+		log.Panicf("ROLLER_ASG is required, unless ASGs are discovered by ROLLER_ASG_TAGS or ROLLER_ASG_PATTERN")
+	}
+
+	overrides, err := parseASGConfig(configs.ASGConfig)
+	if err != nil {
+		log.Panicf("invalid ROLLER_ASG_CONFIG: %v", err)
+	}
+	configs.ASGOverrides = overrides
+
+	switch configs.DuplicateDesiredTags {
+	case duplicateDesiredTagsMax, duplicateDesiredTagsMin, duplicateDesiredTagsError:
+	default:
+		log.Panicf("invalid ROLLER_DUPLICATE_ORIGINAL_DESIRED_TAGS '%s', must be one of %s, %s or %s", configs.DuplicateDesiredTags, duplicateDesiredTagsMax, duplicateDesiredTagsMin, duplicateDesiredTagsError)
+	}
+	switch configs.StateBackend {
+	case stateBackendTag, stateBackendSSM:
+	case stateBackendDynamoDB:
+		if configs.StateDynamoDBTable == "" {
+			log.Panicf("ROLLER_STATE_DYNAMODB_TABLE is required when ROLLER_STATE_BACKEND is %s", stateBackendDynamoDB)
+		}
+	default:
+		log.Panicf("invalid ROLLER_STATE_BACKEND '%s', must be one of %s, %s or %s", configs.StateBackend, stateBackendTag, stateBackendSSM, stateBackendDynamoDB)
+	}
+	switch configs.DrainFailureAction {
+	case drainFailureActionForce, drainFailureActionTerminate, drainFailureActionSkip, drainFailureActionAbort:
+	default:
+		log.Panicf("invalid ROLLER_DRAIN_FAILURE_ACTION '%s', must be one of %s, %s, %s or %s", configs.DrainFailureAction, drainFailureActionForce, drainFailureActionTerminate, drainFailureActionSkip, drainFailureActionAbort)
+	}
+	switch configs.DrainMethod {
+	case drainMethodLibrary, drainMethodEvict, drainMethodDelete:
+	default:
+		log.Panicf("invalid ROLLER_DRAIN_METHOD '%s', must be one of %s, %s or %s", configs.DrainMethod, drainMethodLibrary, drainMethodEvict, drainMethodDelete)
+	}
+	if configs.DrainGracePeriod < -1 {
+		log.Panicf("invalid ROLLER_DRAIN_GRACE_PERIOD %d, must be -1 or more", configs.DrainGracePeriod)
+	}
+	if configs.RefreshMinHealthy < 0 || configs.RefreshMinHealthy > 100 {
+		log.Panicf("invalid ROLLER_INSTANCE_REFRESH_MIN_HEALTHY %d, must be from 0 to 100", configs.RefreshMinHealthy)
+	}
+	switch configs.Strategy {
+	case strategySurge, strategyMaxUnavailable:
+	default:
+		log.Panicf("invalid ROLLER_STRATEGY '%s', must be one of %s or %s", configs.Strategy, strategySurge, strategyMaxUnavailable)
+	}
+	switch configs.MaxLimitAction {
+	case maxLimitActionAbort, maxLimitActionReplace:
+	default:
+		log.Panicf("invalid ROLLER_MAX_LIMIT_ACTION '%s', must be one of %s or %s", configs.MaxLimitAction, maxLimitActionAbort, maxLimitActionReplace)
+	}
+	switch configs.MissingLTVersions {
+	case missingTemplateVersionsOld, missingTemplateVersionsSkip, missingTemplateVersionsResolve:
+	default:
+		log.Panicf("invalid ROLLER_MISSING_TEMPLATE_VERSIONS '%s', must be one of %s, %s or %s", configs.MissingLTVersions, missingTemplateVersionsOld, missingTemplateVersionsSkip, missingTemplateVersionsResolve)
+	}
+	if _, err := jitterInterval(configs.Interval, configs.IntervalJitter, 0); err != nil {
+		log.Panicf("invalid ROLLER_INTERVAL_JITTER: %v", err)
+	}
+	if !validTerminateOrder(configs.TerminateOrder) {
+		log.Panicf("invalid ROLLER_TERMINATE_ORDER '%s', must be one of %s, %s or %s", configs.TerminateOrder, terminateOrderOldest, terminateOrderNewest, terminateOrderRandom)
+	}
+
 	return configs
 }
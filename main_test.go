@@ -1,11 +1,16 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -26,19 +31,60 @@ func TestGetConfigs(t *testing.T) {
 		envValue    string
 		shouldError bool
 	}{
-		// check delay gets translated to interval
+		// check delay gets translated to interval only if interval is not set, see TestGetConfigsInterval
 		{"ROLLER_CHECK_DELAY", "should return default", "Interval", time.Duration(30 * time.Second), "", false},
-		{"ROLLER_CHECK_DELAY", "should return override", "Interval", time.Duration(17 * time.Second), "17", false},
+		{"ROLLER_CHECK_DELAY", "should not override interval", "Interval", time.Duration(30 * time.Second), "17", false},
 		{"ROLLER_CHECK_DELAY", "should fail due to wrong type", "CheckDelay", 0, "17s", true},
 		{"ROLLER_CHECK_DELAY", "should error if override invalid", "CheckDelay", 0, "fake", true},
 		{"ROLLER_INTERVAL", "should return default", "Interval", time.Duration(30 * time.Second), "", false},
 		{"ROLLER_INTERVAL", "should fail due to wrong type", "Interval", 0, "17", true},
 		{"ROLLER_INTERVAL", "should return override", "Interval", time.Duration(17 * time.Second), "17s", false},
 		{"ROLLER_INTERVAL", "should error if override invalid", "Interval", 0, "fake", true},
+		{"ROLLER_IDLE_INTERVAL", "should return default", "IdleInterval", time.Duration(0), "", false},
+		{"ROLLER_IDLE_INTERVAL", "should return override", "IdleInterval", time.Duration(5 * time.Minute), "5m", false},
+		{"ROLLER_ACTIVE_INTERVAL", "should return default", "ActiveInterval", time.Duration(0), "", false},
+		{"ROLLER_ACTIVE_INTERVAL", "should return override", "ActiveInterval", time.Duration(10 * time.Second), "10s", false},
+		{"ROLLER_MIN_LOOP_SLEEP", "should return default", "MinLoopSleep", time.Duration(time.Second), "", false},
+		{"ROLLER_MIN_LOOP_SLEEP", "should return override", "MinLoopSleep", time.Duration(5 * time.Second), "5s", false},
 		{"ROLLER_ASG", "should error on empty", "ASGS", 0, "", true},
+		{"ROLLER_ASG_TAGS", "should parse tags", "ASGTagFilters", map[string]string{"team": "web", "env": "prod"}, "team=web,env=prod", false},
+		{"ROLLER_ASG_TAGS", "should error if tag invalid", "ASGTagFilters", nil, "team", true},
+		{"ROLLER_ASG_PATTERN", "should compile pattern", "ASGPattern", "^prod-.*-workers$", "^prod-.*-workers$", false},
+		{"ROLLER_ASG_PATTERN", "should error if pattern invalid", "ASGPattern", nil, "^prod-(", true},
 		{"ROLLER_ASG", "should work with single value", "ASGS", []string{"grp1"}, "grp1", false},
 		{"ROLLER_ASG", "should work with multiple values", "ASGS", []string{"grp1", "grp2"}, "grp1,grp2", false},
 		{"ROLLER_ASG", "should work with multiple values with space after comma", "ASGS", []string{"grp1", " grp2"}, "grp1, grp2", false},
+		{"ROLLER_DUPLICATE_ORIGINAL_DESIRED_TAGS", "should return default", "DuplicateDesiredTags", "max", "", false},
+		{"ROLLER_DUPLICATE_ORIGINAL_DESIRED_TAGS", "should return override", "DuplicateDesiredTags", "error", "error", false},
+		{"ROLLER_DUPLICATE_ORIGINAL_DESIRED_TAGS", "should error if override invalid", "DuplicateDesiredTags", "", "first", true},
+		{"ROLLER_STATE_BACKEND", "should return default", "StateBackend", "tag", "", false},
+		{"ROLLER_STATE_BACKEND", "should return override without original desired on tag", "StateBackend", "ssm", "ssm", false},
+		{"ROLLER_STATE_BACKEND", "should error if override invalid", "StateBackend", "", "file", true},
+		{"ROLLER_ASG_CONFIG", "should parse overrides", "ASGOverrides", map[string]asgConfigOverride{"grp1": {Drain: aws.Bool(false)}}, `{"grp1": {"drain": false}}`, false},
+		{"ROLLER_ASG_CONFIG", "should error if override invalid", "ASGOverrides", nil, `{"grp1": {"drian": false}}`, true},
+		{"ROLLER_WAIT_FOR_ELB", "should return default", "LoadBalancerHealth", false, "", false},
+		{"ROLLER_WAIT_FOR_ELB", "should enable load balancer health", "LoadBalancerHealth", true, "true", false},
+		{"ROLLER_MAX_SURGE", "should return default", "MaxSurge", -1, "", false},
+		{"ROLLER_MAX_SURGE", "should return override", "MaxSurge", 2, "2", false},
+		{"ROLLER_MAX_SURGE", "should return percentage", "MaxSurgePercent", 25, "25%", false},
+		{"ROLLER_MAX_SURGE", "should not be a number with percentage", "MaxSurge", -1, "25%", false},
+		{"ROLLER_MAX_SURGE", "should error if override invalid", "MaxSurge", 0, "many", true},
+		{"ROLLER_TERMINATE_ORDER", "should return default", "TerminateOrder", "oldest", "", false},
+		{"ROLLER_TERMINATE_ORDER", "should return override", "TerminateOrder", "random", "random", false},
+		{"ROLLER_TERMINATE_ORDER", "should error if override invalid", "TerminateOrder", "", "first", true},
+		{"ROLLER_DRAIN_METHOD", "should return default", "DrainMethod", "library", "", false},
+		{"ROLLER_DRAIN_METHOD", "should return override", "DrainMethod", "evict", "evict", false},
+		{"ROLLER_DRAIN_METHOD", "should error if override invalid", "DrainMethod", "", "kubectl", true},
+		{"ROLLER_DRAIN_GRACE_PERIOD", "should return default", "DrainGracePeriod", -1, "", false},
+		{"ROLLER_DRAIN_GRACE_PERIOD", "should return override", "DrainGracePeriod", 30, "30", false},
+		{"ROLLER_DRAIN_GRACE_PERIOD", "should error if override invalid", "DrainGracePeriod", 0, "-5", true},
+		{"ROLLER_USE_INSTANCE_REFRESH", "should return default", "InstanceRefresh", false, "", false},
+		{"ROLLER_USE_INSTANCE_REFRESH", "should return override", "InstanceRefresh", true, "true", false},
+		{"ROLLER_INSTANCE_REFRESH_MIN_HEALTHY", "should return default", "RefreshMinHealthy", 90, "", false},
+		{"ROLLER_INSTANCE_REFRESH_MIN_HEALTHY", "should return override", "RefreshMinHealthy", 50, "50", false},
+		{"ROLLER_INSTANCE_REFRESH_MIN_HEALTHY", "should error if override invalid", "RefreshMinHealthy", 0, "120", true},
+		{"ROLLER_INCLUDE_WARM_POOL", "should return default", "IncludeWarmPool", false, "", false},
+		{"ROLLER_INCLUDE_WARM_POOL", "should return override", "IncludeWarmPool", true, "true", false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.env+":"+tt.name, func(t *testing.T) {
@@ -63,3 +109,191 @@ func TestGetConfigs(t *testing.T) {
 		})
 	}
 }
+
+func TestGetConfigsInterval(t *testing.T) {
+	tests := []struct {
+		name       string
+		interval   string
+		checkDelay string
+		want       time.Duration
+	}{
+		{"neither set", "", "", 30 * time.Second},
+		{"only interval set", "17s", "", 17 * time.Second},
+		{"only check delay set", "", "17", 17 * time.Second},
+		{"both set with same value", "17s", "17", 17 * time.Second},
+		{"both set with conflicting values", "17s", "45", 17 * time.Second},
+		{"both set with conflicting values in minutes", "2m", "17", 2 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setBaseEnvs()
+			os.Unsetenv("ROLLER_INTERVAL")
+			if tt.interval != "" {
+				os.Setenv("ROLLER_INTERVAL", tt.interval)
+			}
+			if tt.checkDelay != "" {
+				os.Setenv("ROLLER_CHECK_DELAY", tt.checkDelay)
+			}
+			assert.Equal(t, tt.want, getConfigs().Interval)
+		})
+	}
+}
+
+func TestGetConfigsBatchSize(t *testing.T) {
+	tests := []struct {
+		name         string
+		batchSize    string
+		initialSurge string
+		maxTerminate string
+		wantSurge    int
+		wantMax      int
+	}{
+		{"not set", "", "", "", 1, 1},
+		{"batch size only", "5", "", "", 5, 5},
+		{"initial surge set", "5", "2", "", 2, 5},
+		{"max terminate set", "5", "", "3", 5, 3},
+		{"both set", "5", "2", "3", 2, 3},
+		{"batch size of one", "1", "", "3", 1, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setBaseEnvs()
+			for k, v := range map[string]string{"ROLLER_BATCH_SIZE": tt.batchSize, "ROLLER_INITIAL_SURGE": tt.initialSurge, "ROLLER_MAX_TERMINATE": tt.maxTerminate} {
+				os.Unsetenv(k)
+				if v != "" {
+					os.Setenv(k, v)
+				}
+			}
+			configs := getConfigs()
+			assert.Equal(t, tt.wantSurge, configs.InitialSurge)
+			assert.Equal(t, tt.wantMax, configs.MaxTerminate)
+		})
+	}
+}
+
+func TestLoopInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		idle     time.Duration
+		active   time.Duration
+		minSleep time.Duration
+		rolling  bool
+		expected time.Duration
+	}{
+		{"idle with no overrides", 30 * time.Second, 0, 0, 0, false, 30 * time.Second},
+		{"active with no overrides", 30 * time.Second, 0, 0, 0, true, 30 * time.Second},
+		{"idle with overrides", 30 * time.Second, 5 * time.Minute, 10 * time.Second, 0, false, 5 * time.Minute},
+		{"active with overrides", 30 * time.Second, 5 * time.Minute, 10 * time.Second, 0, true, 10 * time.Second},
+		{"idle with only active override", 30 * time.Second, 0, 10 * time.Second, 0, false, 30 * time.Second},
+		{"active with only idle override", 30 * time.Second, 5 * time.Minute, 0, 0, true, 30 * time.Second},
+		{"above min sleep", 30 * time.Second, 0, 0, time.Second, false, 30 * time.Second},
+		{"zero interval with min sleep", 0, 0, 0, time.Second, false, time.Second},
+		{"active below min sleep", 30 * time.Second, 0, 100 * time.Millisecond, time.Second, true, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configs := Configs{Interval: tt.interval, IdleInterval: tt.idle, ActiveInterval: tt.active, MinLoopSleep: tt.minSleep}
+			state := newRollerState()
+			state.setRolling("myasg", tt.rolling)
+			assert.Equal(t, tt.expected, loopInterval(configs, state))
+		})
+	}
+}
+
+func TestCheckReadinessHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		enabled     bool
+		required    bool
+		handler     readiness
+		shouldError bool
+	}{
+		{"kubernetes disabled", false, true, nil, false},
+		{"kubernetes enabled with handler", true, true, &testReadyHandler{}, false},
+		{"kubernetes enabled without handler", true, false, nil, false},
+		{"kubernetes required without handler", true, true, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configs := Configs{KubernetesEnabled: tt.enabled, KubernetesRequired: tt.required}
+			err := checkReadinessHandler(configs, tt.handler)
+			if tt.shouldError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestGetReadinessHandlerNoConnection(t *testing.T) {
+	// neither in a cluster nor with a kubeconfig, so there is no connection to kubernetes
+	dir, err := ioutil.TempDir("", "roller-kube")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for env, value := range map[string]string{"KUBERNETES_SERVICE_HOST": "", "KUBECONFIG": filepath.Join(dir, "config")} {
+		if old, ok := os.LookupEnv(env); ok {
+			defer os.Setenv(env, old)
+		} else {
+			defer os.Unsetenv(env)
+		}
+		os.Setenv(env, value)
+	}
+	tests := []struct {
+		name        string
+		enabled     bool
+		required    bool
+		shouldError bool
+	}{
+		{"kubernetes disabled", false, true, false},
+		{"kubernetes enabled", true, false, false},
+		{"kubernetes required", true, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configs := Configs{KubernetesEnabled: tt.enabled, KubernetesRequired: tt.required}
+			handler, err := getReadinessHandler(configs)
+			if tt.shouldError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Nil(t, handler)
+		})
+	}
+}
+
+func TestCheckGroupsExist(t *testing.T) {
+	tests := []struct {
+		name        string
+		asgs        []string
+		strict      bool
+		err         error
+		shouldError bool
+	}{
+		{"all exist", []string{"grp1", "grp2"}, true, nil, false},
+		{"missing", []string{"grp1", "gpr2"}, false, nil, false},
+		{"missing strict", []string{"grp1", "gpr2"}, true, nil, true},
+		{"missing with space strict", []string{"grp1", " grp2"}, true, nil, true},
+		{"describe error", []string{"grp1"}, false, fmt.Errorf("unavailable"), false},
+		{"describe error strict", []string{"grp1"}, true, fmt.Errorf("unavailable"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			asgSvc := &mockAsgSvc{
+				err: tt.err,
+				groups: map[string]*autoscaling.Group{
+					"grp1": {AutoScalingGroupName: aws.String("grp1")},
+					"grp2": {AutoScalingGroupName: aws.String("grp2")},
+				},
+			}
+			err := checkGroupsExist(Configs{ASGS: tt.asgs, StrictASG: tt.strict}, asgSvc)
+			if tt.shouldError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
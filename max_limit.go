@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// what to do when the max size of an ASG cannot be raised to surge it, as it is at the account limit
+const (
+	// stop rolling the group
+	maxLimitActionAbort = "abort"
+	// roll the group without surging, replacing old instances in place
+	maxLimitActionReplace = "replace"
+)
+
+// maxSizeLimitError is returned when the max size of an ASG cannot be raised as it is at the account or
+// service limit
+type maxSizeLimitError struct {
+	asg string
+	max int64
+	err error
+}
+
+func (e *maxSizeLimitError) Error() string {
+	return fmt.Sprintf("unable to increase ASG %s max size to %d, as it is at the account or service limit: %v", e.asg, e.max, e.err)
+}
+
+// isMaxSizeLimit returns whether the error is from being unable to raise the max size of an ASG due to a limit
+func isMaxSizeLimit(err error) bool {
+	_, ok := err.(*maxSizeLimitError)
+	return ok
+}
+
+// replaceInPlace changes the roll limits of an ASG whose max size could not be raised due to a limit, so
+// that it is rolled within its max size, without surging beyond it: old instances are terminated, and
+// replaced by the ASG, one at a time unless more are allowed to be unavailable
+func replaceInPlace(asg *autoscaling.Group, limits rollLimits) rollLimits {
+	log.Printf("[%v] max size is at the limit, replacing instances in place without surging\n", p2v(asg.AutoScalingGroupName))
+	if limits.maxUnavailable < 1 {
+		limits.maxUnavailable = 1
+	}
+	return limits
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func TestAdjustMaxLimit(t *testing.T) {
+	tests := []struct {
+		desc       string
+		action     string
+		err        bool
+		terminated int
+	}{
+		{"abort", maxLimitActionAbort, true, 0},
+		{"replace in place", maxLimitActionReplace, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// the ASG is at its max size, which cannot be raised to surge it
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			asgSvc := &mockAsgSvc{
+				groups: map[string]*autoscaling.Group{
+					name: {
+						AutoScalingGroupName:    &name,
+						DesiredCapacity:         aws.Int64(2),
+						MaxSize:                 aws.Int64(2),
+						LaunchConfigurationName: &lcName,
+						Instances: []*autoscaling.Instance{
+							{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy, LifecycleState: aws.String(autoscaling.LifecycleStateInService)},
+							{InstanceId: aws.String("2"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy, LifecycleState: aws.String(autoscaling.LifecycleStateInService)},
+						},
+					},
+				},
+				updateErr: awserr.New(autoscaling.ErrCodeLimitExceededFault, "max size limit", nil),
+			}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 2}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				IncreaseMax:       true,
+				MaxLimitAction:    tt.action,
+				InitialSurge:      1,
+				MaxTerminate:      1,
+				MaxSurge:          -1,
+				MaxUnavailable:    -1,
+			}
+			// the first loop tries to surge, and the second acts on the result
+			_, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state)
+			switch {
+			case tt.err && (err == nil || !strings.Contains(err.Error(), "account or service limit")):
+				t.Errorf("expected limit error, had %v", err)
+			case !tt.err && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			}
+			if state.isMaxAtLimit(name) != !tt.err {
+				t.Errorf("mismatched max at limit, actual %v expected %v", state.isMaxAtLimit(name), !tt.err)
+			}
+			if !tt.err {
+				if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if calls := asgSvc.counter.filterByName("SetDesiredCapacity"); len(calls) != 0 {
+				t.Errorf("expected desired not to be set, had %d calls", len(calls))
+			}
+			if calls := asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup"); len(calls) != tt.terminated {
+				t.Errorf("mismatched terminations, actual %d expected %d", len(calls), tt.terminated)
+			}
+		})
+	}
+}
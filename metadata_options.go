@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// requireIMDSv2 moves new instances that do not enforce IMDSv2, i.e. that allow instance metadata to be
+// read without a session token, to the old instances, so that they are replaced. This catches instances
+// that drifted from the metadata options of the launch template, which comparing launch configurations
+// or template versions does not.
+// The metadata options of launch templates cannot be read with the version of the AWS SDK in use, so the
+// instances are checked against IMDSv2 enforcement directly.
+func requireIMDSv2(asg *autoscaling.Group, oldInstances, newInstances []*autoscaling.Instance, ec2Svc ec2Client, verbose bool) ([]*autoscaling.Instance, []*autoscaling.Instance, error) {
+	if len(newInstances) == 0 {
+		return oldInstances, newInstances, nil
+	}
+	described, err := awsDescribeInstances(ec2Svc, mapInstancesIds(newInstances), 1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("[%v] error retrieving metadata options of instances: %v", p2v(asg.AutoScalingGroupName), err)
+	}
+	enforced := make([]*autoscaling.Instance, 0)
+	for _, i := range newInstances {
+		instance, ok := described[*i.InstanceId]
+		if !ok || imdsv2Enforced(instance.MetadataOptions) {
+			enforced = append(enforced, i)
+			continue
+		}
+		if verbose {
+			log.Printf("[%v] adding %v to list of old instances because it does not enforce IMDSv2", p2v(asg.AutoScalingGroupName), p2v(i.InstanceId))
+		}
+		oldInstances = append(oldInstances, i)
+	}
+	return oldInstances, enforced, nil
+}
+
+// imdsv2Enforced reports if the metadata options allow instance metadata to be read only with a session
+// token, or not at all
+func imdsv2Enforced(options *ec2.InstanceMetadataOptionsResponse) bool {
+	if options == nil {
+		return false
+	}
+	return aws.StringValue(options.HttpTokens) == ec2.HttpTokensStateRequired || aws.StringValue(options.HttpEndpoint) == ec2.InstanceMetadataEndpointStateDisabled
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics are the metrics of the roller, served for Prometheus to scrape
+var metrics = newRollerMetrics()
+
+// rollerMetrics are the metrics of the roller. They are safe for concurrent use, as long as they are
+// accessed only via their methods.
+type rollerMetrics struct {
+	mu sync.Mutex
+	// by ASG name
+	oldInstances map[string]int
+	newInstances map[string]int
+	desired      map[string]int64
+	terminations int
+	loopDuration time.Duration
+}
+
+func newRollerMetrics() *rollerMetrics {
+	return &rollerMetrics{
+		oldInstances: map[string]int{},
+		newInstances: map[string]int{},
+		desired:      map[string]int64{},
+	}
+}
+
+// setGroup records the numbers of old and new instances, and the desired count, of an ASG
+func (m *rollerMetrics) setGroup(asg string, oldInstances, newInstances int, desired int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.oldInstances[asg] = oldInstances
+	m.newInstances[asg] = newInstances
+	m.desired[asg] = desired
+}
+
+// addTerminations counts instances terminated
+func (m *rollerMetrics) addTerminations(count int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.terminations += count
+}
+
+// setLoopDuration records how long the last loop took
+func (m *rollerMetrics) setLoopDuration(duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loopDuration = duration
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format
+func (m *rollerMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+func (m *rollerMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	writeGroupMetric(w, "asg_roller_old_instances", "Number of instances in the ASG that are not on the latest launch configuration or template.", m.oldInstances)
+	writeGroupMetric(w, "asg_roller_new_instances", "Number of instances in the ASG that are on the latest launch configuration or template.", m.newInstances)
+	desired := map[string]int{}
+	for asg, d := range m.desired {
+		desired[asg] = int(d)
+	}
+	writeGroupMetric(w, "asg_roller_desired", "Desired count of the ASG.", desired)
+	fmt.Fprintf(w, "# HELP asg_roller_terminations_total Number of instances terminated by the roller.\n")
+	fmt.Fprintf(w, "# TYPE asg_roller_terminations_total counter\n")
+	fmt.Fprintf(w, "asg_roller_terminations_total %d\n", m.terminations)
+	fmt.Fprintf(w, "# HELP asg_roller_loop_duration_seconds How long the last loop took to adjust the ASGs.\n")
+	fmt.Fprintf(w, "# TYPE asg_roller_loop_duration_seconds gauge\n")
+	fmt.Fprintf(w, "asg_roller_loop_duration_seconds %g\n", m.loopDuration.Seconds())
+}
+
+// writeGroupMetric writes a gauge with a value for each ASG, in order of ASG name
+func writeGroupMetric(w io.Writer, name, help string, values map[string]int) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+	asgs := make([]string, 0, len(values))
+	for asg := range values {
+		asgs = append(asgs, asg)
+	}
+	sort.Strings(asgs)
+	for _, asg := range asgs {
+		fmt.Fprintf(w, "%s{asg=\"%s\"} %d\n", name, labelEscaper.Replace(asg), values[asg])
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// serveMetrics serves the metrics at /metrics on the address, until the server fails
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	log.Printf("serving metrics on %s/metrics", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		log.Printf("Error serving metrics: %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func TestRollerMetricsServeHTTP(t *testing.T) {
+	m := newRollerMetrics()
+	m.setGroup("asg2", 1, 3, 4)
+	m.setGroup("asg1", 2, 0, 2)
+	m.addTerminations(2)
+	m.addTerminations(1)
+	m.setLoopDuration(1500 * time.Millisecond)
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if contentType := rec.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain") {
+		t.Errorf("mismatched content type %s", contentType)
+	}
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE asg_roller_old_instances gauge",
+		`asg_roller_old_instances{asg="asg1"} 2`,
+		`asg_roller_old_instances{asg="asg2"} 1`,
+		`asg_roller_new_instances{asg="asg1"} 0`,
+		`asg_roller_new_instances{asg="asg2"} 3`,
+		`asg_roller_desired{asg="asg1"} 2`,
+		`asg_roller_desired{asg="asg2"} 4`,
+		"# TYPE asg_roller_terminations_total counter",
+		"asg_roller_terminations_total 3",
+		"# TYPE asg_roller_loop_duration_seconds gauge",
+		"asg_roller_loop_duration_seconds 1.5",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing line %q in metrics:\n%s", line, body)
+		}
+	}
+	// groups are in order of name
+	if strings.Index(body, `asg_roller_old_instances{asg="asg1"}`) > strings.Index(body, `asg_roller_old_instances{asg="asg2"}`) {
+		t.Errorf("groups out of order in metrics:\n%s", body)
+	}
+}
+
+func TestAdjustMetrics(t *testing.T) {
+	metrics = newRollerMetrics()
+	// part way through a roll, with a new instance ready to replace an old one
+	name := "myasg"
+	lcName := "lconfig"
+	oldLcName := "oldlconfig"
+	myHealthy := healthy
+	asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+		name: {
+			AutoScalingGroupName:    &name,
+			DesiredCapacity:         aws.Int64(3),
+			MaxSize:                 aws.Int64(3),
+			LaunchConfigurationName: &lcName,
+			Instances: []*autoscaling.Instance{
+				{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+				{InstanceId: aws.String("2"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+				{InstanceId: aws.String("3"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+			},
+		},
+	}}
+	state := newRollerState()
+	state.originalDesired = map[string]int64{name: 2}
+	configs := Configs{
+		KubernetesEnabled: kubernetesEnabled,
+		ASGS:              []string{name},
+		MaxTerminate:      1,
+	}
+	if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if old := metrics.oldInstances[name]; old != 2 {
+		t.Errorf("mismatched old instances, actual %d expected 2", old)
+	}
+	if newCount := metrics.newInstances[name]; newCount != 1 {
+		t.Errorf("mismatched new instances, actual %d expected 1", newCount)
+	}
+	if desired := metrics.desired[name]; desired != 3 {
+		t.Errorf("mismatched desired, actual %d expected 3", desired)
+	}
+	if metrics.terminations != 1 {
+		t.Errorf("mismatched terminations, actual %d expected 1", metrics.terminations)
+	}
+	if metrics.loopDuration <= 0 {
+		t.Errorf("expected loop duration to be recorded")
+	}
+}
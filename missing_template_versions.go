@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// what to do with an ASG whose launch template is described without a default or latest version number
+const (
+	// treat instances on `$Default` or `$Latest` as not on the target version, i.e. old
+	missingTemplateVersionsOld = "old"
+	// leave the ASG alone until the template has both version numbers
+	missingTemplateVersionsSkip = "skip"
+	// resolve `$Default` and `$Latest` to concrete version numbers by describing those versions
+	missingTemplateVersionsResolve = "resolve"
+)
+
+// missingTemplateVersionsError is returned when grouping the instances of an ASG whose launch template
+// has no default or latest version number, so that callers can skip just that ASG
+type missingTemplateVersionsError struct {
+	name string
+	id   string
+}
+
+func (e *missingTemplateVersionsError) Error() string {
+	return fmt.Sprintf("launch template name %s, id %s has no default or latest version number", e.name, e.id)
+}
+
+// awsResolveTemplateVersions returns a copy of the launch template with its default and latest version
+// numbers, found by describing the `$Default` and `$Latest` versions of it. The template itself may be
+// shared by other ASGs, so is left as it is.
+func awsResolveTemplateVersions(svc ec2Client, template *ec2.LaunchTemplate) (*ec2.LaunchTemplate, error) {
+	input := &ec2.DescribeLaunchTemplateVersionsInput{
+		Versions: aws.StringSlice([]string{"$Default", "$Latest"}),
+	}
+	if aws.StringValue(template.LaunchTemplateId) != "" {
+		input.LaunchTemplateId = template.LaunchTemplateId
+	} else {
+		input.LaunchTemplateName = template.LaunchTemplateName
+	}
+	out, err := svc.DescribeLaunchTemplateVersions(input)
+	if err != nil {
+		return nil, fmt.Errorf("unable to describe default and latest versions: %v", err)
+	}
+	resolved := *template
+	for _, v := range out.LaunchTemplateVersions {
+		if v.VersionNumber == nil {
+			continue
+		}
+		// the default version may be the latest too, in which case it is described only once
+		if aws.BoolValue(v.DefaultVersion) {
+			resolved.DefaultVersionNumber = v.VersionNumber
+		}
+		if resolved.LatestVersionNumber == nil || *v.VersionNumber > *resolved.LatestVersionNumber {
+			resolved.LatestVersionNumber = v.VersionNumber
+		}
+	}
+	if resolved.DefaultVersionNumber == nil || resolved.LatestVersionNumber == nil {
+		return nil, fmt.Errorf("default or latest version not found")
+	}
+	return &resolved, nil
+}
+
+// skipUndescribed returns the descriptions of the groups that were described, leaving out those that
+// were skipped
+func skipUndescribed(descriptions []*groupDescription) []*groupDescription {
+	described := make([]*groupDescription, 0, len(descriptions))
+	for _, d := range descriptions {
+		if d != nil {
+			described = append(described, d)
+		}
+	}
+	return described
+}
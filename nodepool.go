@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// nodePoolDrains caps how many nodes of each node pool, identified by the value of a node label, are
+// drained in a single loop, across all ASGs, so that one pool is not drained all at once while
+// another is untouched. Nodes without the label are not capped. It is safe for concurrent use.
+type nodePoolDrains struct {
+	mu     sync.Mutex
+	label  string
+	max    int
+	drains map[string]int
+}
+
+func newNodePoolDrains(label string, max int) *nodePoolDrains {
+	return &nodePoolDrains{
+		label:  label,
+		max:    max,
+		drains: map[string]int{},
+	}
+}
+
+// take picks up to count of the instances, in order, to drain without going over the cap of any pool,
+// and counts them as drained. pools is the node pool of each instance, by ID.
+func (n *nodePoolDrains) take(instances []*autoscaling.Instance, pools map[string]string, count int) []*autoscaling.Instance {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	taken := make([]*autoscaling.Instance, 0)
+	for _, i := range instances {
+		if len(taken) >= count {
+			break
+		}
+		pool := pools[*i.InstanceId]
+		if pool != "" && n.drains[pool] >= n.max {
+			continue
+		}
+		if pool != "" {
+			n.drains[pool]++
+		}
+		taken = append(taken, i)
+	}
+	return taken
+}
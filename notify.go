@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// kinds of roll events
+const (
+	rollEventStarted    = "started"
+	rollEventTerminated = "terminated"
+	rollEventFinished   = "finished"
+	rollEventBackedOut  = "backed out"
+	rollEventFailed     = "failed"
+	rollEventDeferred   = "deferred"
+)
+
+// how many times to retry sending a roll event to SQS, and how long to wait between attempts. They are
+// kept short, as notifying should not hold up the roll.
+const sqsSendRetries = 2
+
+var sqsRetryDelay = 500 * time.Millisecond
+
+// rollEvent is something that happened while rolling an ASG: it started or finished rolling, the roller
+// terminated some of its old instances, backed out new instances stuck pending, failed to roll it in a loop,
+// or deferred surging it
+type rollEvent struct {
+	kind string
+	asg  string
+	// numbers of old and new instances in the ASG when the event happened
+	oldInstances int
+	newInstances int
+	// IDs of the instances terminated, for terminated and backed out events
+	terminated []string
+	// why rolling the ASG failed or was deferred, for failed and deferred events
+	err error
+}
+
+// message returns a message describing the event
+func (e rollEvent) message() string {
+	counts := fmt.Sprintf("%d old instances, %d new instances", e.oldInstances, e.newInstances)
+	switch e.kind {
+	case rollEventTerminated:
+		return fmt.Sprintf("[%s] terminated instances %s (%s)", e.asg, strings.Join(e.terminated, ", "), counts)
+	case rollEventBackedOut:
+		return fmt.Sprintf("[%s] backed out surge, terminated instances %s stuck pending (%s)", e.asg, strings.Join(e.terminated, ", "), counts)
+	case rollEventFailed:
+		return fmt.Sprintf("[%s] roll failed: %v (%s)", e.asg, e.err, counts)
+	case rollEventDeferred:
+		return fmt.Sprintf("[%s] roll deferred: %v (%s)", e.asg, e.err, counts)
+	default:
+		return fmt.Sprintf("[%s] roll %s (%s)", e.asg, e.kind, counts)
+	}
+}
+
+// rollNotifier notifies, e.g. operators, of events while rolling ASGs
+type rollNotifier interface {
+	notify(event rollEvent) error
+}
+
+// slackNotifier notifies of roll events by posting messages to a Slack incoming webhook
+type slackNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (s *slackNotifier) notify(event rollEvent) error {
+	body, err := json.Marshal(map[string]string{"text": event.message()})
+	if err != nil {
+		return fmt.Errorf("unable to create Slack message: %v", err)
+	}
+	res, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error posting to Slack: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("Slack returned status %s", res.Status)
+	}
+	return nil
+}
+
+// sqsMessage is the body of a roll event sent to SQS
+type sqsMessage struct {
+	Type       string `json:"type"`
+	ASG        string `json:"asg"`
+	InstanceID string `json:"instanceId,omitempty"`
+	Timestamp  string `json:"timestamp"`
+	Message    string `json:"message"`
+}
+
+// sqsNotifier notifies of roll events by sending them as JSON messages to an SQS queue, for processing
+// elsewhere. Events for terminated instances are sent as a message per instance.
+type sqsNotifier struct {
+	svc      sqsiface.SQSAPI
+	queueURL string
+}
+
+func (s *sqsNotifier) notify(event rollEvent) error {
+	ids := event.terminated
+	if len(ids) == 0 {
+		ids = []string{""}
+	}
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	for _, id := range ids {
+		body, err := json.Marshal(sqsMessage{Type: event.kind, ASG: event.asg, InstanceID: id, Timestamp: timestamp, Message: event.message()})
+		if err != nil {
+			return fmt.Errorf("unable to create SQS message: %v", err)
+		}
+		if err := s.send(string(body)); err != nil {
+			return fmt.Errorf("error sending to SQS queue %s: %v", s.queueURL, err)
+		}
+	}
+	return nil
+}
+
+// send sends a message to the queue, retrying up to sqsSendRetries times on failure
+func (s *sqsNotifier) send(body string) error {
+	for attempt := 0; ; attempt++ {
+		_, err := s.svc.SendMessage(&sqs.SendMessageInput{
+			QueueUrl:    aws.String(s.queueURL),
+			MessageBody: aws.String(body),
+		})
+		if err == nil || attempt >= sqsSendRetries {
+			return err
+		}
+		log.Printf("error sending to SQS queue %s, retrying in %v: %v", s.queueURL, sqsRetryDelay, err)
+		sleep(sqsRetryDelay)
+	}
+}
+
+// multiNotifier notifies of roll events with each of several notifiers
+type multiNotifier []rollNotifier
+
+func (m multiNotifier) notify(event rollEvent) error {
+	errs := make([]string, 0)
+	for _, n := range m {
+		if err := n.notify(event); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// getRollNotifier returns the notifiers configured, if any. The SQS client is used only if a queue is set.
+func getRollNotifier(configs Configs, sqsSvc sqsiface.SQSAPI) rollNotifier {
+	notifiers := make(multiNotifier, 0)
+	if configs.SlackWebhookURL != "" {
+		notifiers = append(notifiers, &slackNotifier{url: configs.SlackWebhookURL, client: &http.Client{Timeout: 10 * time.Second}})
+	}
+	if configs.SQSQueueURL != "" && sqsSvc != nil {
+		notifiers = append(notifiers, &sqsNotifier{svc: sqsSvc, queueURL: configs.SQSQueueURL})
+	}
+	switch len(notifiers) {
+	case 0:
+		return nil
+	case 1:
+		return notifiers[0]
+	default:
+		return notifiers
+	}
+}
+
+// notifyRoll notifies of a roll event, if there is a notifier. Notifications only keep people informed, so
+// failing to send one should not hold up the roll.
+func notifyRoll(notifier rollNotifier, event rollEvent) {
+	if notifier == nil {
+		return
+	}
+	if err := notifier.notify(event); err != nil {
+		log.Printf("[%s] Unable to notify of roll event: %v\n", event.asg, err)
+	}
+}
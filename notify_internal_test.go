@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+type mockNotifier struct {
+	events []rollEvent
+}
+
+func (m *mockNotifier) notify(event rollEvent) error {
+	m.events = append(m.events, event)
+	return nil
+}
+
+type mockSqsSvc struct {
+	sqsiface.SQSAPI
+	counter funcCounter
+	// errors returned by successive calls to SendMessage
+	errs []error
+}
+
+func (m *mockSqsSvc) SendMessage(in *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	m.counter.add("SendMessage", in)
+	if len(m.errs) > 0 {
+		err := m.errs[0]
+		m.errs = m.errs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func TestSQSNotifier(t *testing.T) {
+	tests := []struct {
+		desc      string
+		event     rollEvent
+		errs      []error
+		instances []string
+		sends     int
+		err       bool
+	}{
+		{"started", rollEvent{kind: rollEventStarted, asg: "myasg", oldInstances: 3}, nil, []string{""}, 1, false},
+		{"terminated", rollEvent{kind: rollEventTerminated, asg: "myasg", oldInstances: 3, newInstances: 2, terminated: []string{"1", "2"}}, nil, []string{"1", "2"}, 2, false},
+		{"retried", rollEvent{kind: rollEventFinished, asg: "myasg", newInstances: 3}, []error{fmt.Errorf("throttled")}, []string{""}, 2, false},
+		{"failed", rollEvent{kind: rollEventFinished, asg: "myasg", newInstances: 3}, []error{fmt.Errorf("a"), fmt.Errorf("b"), fmt.Errorf("c")}, nil, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			sleep = func(d time.Duration) {}
+			defer func() { sleep = time.Sleep }()
+			svc := &mockSqsSvc{errs: tt.errs}
+			notifier := &sqsNotifier{svc: svc, queueURL: "https://queue"}
+			err := notifier.notify(tt.event)
+			switch {
+			case err != nil && !tt.err:
+				t.Errorf("unexpected error: %v", err)
+			case err == nil && tt.err:
+				t.Errorf("expected error, got none")
+			}
+			sends := svc.counter.filterByName("SendMessage")
+			if len(sends) != tt.sends {
+				t.Fatalf("mismatched SendMessage calls, actual %d expected %d", len(sends), tt.sends)
+			}
+			if tt.err {
+				return
+			}
+			// only the successful sends, which are the last for each instance
+			sends = sends[len(sends)-len(tt.instances):]
+			for i, c := range sends {
+				in := c.params[0].(*sqs.SendMessageInput)
+				if *in.QueueUrl != "https://queue" {
+					t.Errorf("mismatched queue %s", *in.QueueUrl)
+				}
+				var msg sqsMessage
+				if err := json.Unmarshal([]byte(*in.MessageBody), &msg); err != nil {
+					t.Fatalf("unable to decode message: %v", err)
+				}
+				if msg.Type != tt.event.kind || msg.ASG != "myasg" || msg.InstanceID != tt.instances[i] || msg.Message != tt.event.message() {
+					t.Errorf("mismatched message %+v", msg)
+				}
+				if _, err := time.Parse(time.RFC3339, msg.Timestamp); err != nil {
+					t.Errorf("invalid timestamp %s: %v", msg.Timestamp, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSlackNotifier(t *testing.T) {
+	tests := []struct {
+		desc    string
+		event   rollEvent
+		status  int
+		message string
+		err     bool
+	}{
+		{"started", rollEvent{kind: rollEventStarted, asg: "myasg", oldInstances: 3, newInstances: 0}, http.StatusOK, "[myasg] roll started (3 old instances, 0 new instances)", false},
+		{"terminated", rollEvent{kind: rollEventTerminated, asg: "myasg", oldInstances: 3, newInstances: 2, terminated: []string{"1", "2"}}, http.StatusOK, "[myasg] terminated instances 1, 2 (3 old instances, 2 new instances)", false},
+		{"finished", rollEvent{kind: rollEventFinished, asg: "myasg", oldInstances: 0, newInstances: 3}, http.StatusOK, "[myasg] roll finished (0 old instances, 3 new instances)", false},
+		{"failed", rollEvent{kind: rollEventFailed, asg: "myasg", oldInstances: 2, newInstances: 1, err: fmt.Errorf("max size too low")}, http.StatusOK, "[myasg] roll failed: max size too low (2 old instances, 1 new instances)", false},
+		{"deferred", rollEvent{kind: rollEventDeferred, asg: "myasg", oldInstances: 2, newInstances: 0, err: fmt.Errorf("no headroom")}, http.StatusOK, "[myasg] roll deferred: no headroom (2 old instances, 0 new instances)", false},
+		{"error status", rollEvent{kind: rollEventFinished, asg: "myasg", oldInstances: 0, newInstances: 3}, http.StatusForbidden, "[myasg] roll finished (0 old instances, 3 new instances)", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var payload map[string]string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost {
+					t.Errorf("unexpected method %s", r.Method)
+				}
+				if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+					t.Errorf("unable to decode payload: %v", err)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+			notifier := getRollNotifier(Configs{SlackWebhookURL: server.URL}, nil)
+			err := notifier.notify(tt.event)
+			switch {
+			case err != nil && !tt.err:
+				t.Errorf("unexpected error: %v", err)
+			case err == nil && tt.err:
+				t.Errorf("expected error, got none")
+			}
+			if payload["text"] != tt.message {
+				t.Errorf("mismatched message, actual %q expected %q", payload["text"], tt.message)
+			}
+		})
+	}
+}
+
+func TestGetRollNotifier(t *testing.T) {
+	if notifier := getRollNotifier(Configs{}, &mockSqsSvc{}); notifier != nil {
+		t.Errorf("unexpected notifier without webhook URL or queue: %v", notifier)
+	}
+	if notifier, ok := getRollNotifier(Configs{SQSQueueURL: "https://queue"}, &mockSqsSvc{}).(*sqsNotifier); !ok || notifier.queueURL != "https://queue" {
+		t.Errorf("expected SQS notifier, had %v", notifier)
+	}
+	if notifiers, ok := getRollNotifier(Configs{SlackWebhookURL: "https://hook", SQSQueueURL: "https://queue"}, &mockSqsSvc{}).(multiNotifier); !ok || len(notifiers) != 2 {
+		t.Errorf("expected both notifiers, had %v", notifiers)
+	}
+	// notifying without a notifier does nothing
+	notifyRoll(nil, rollEvent{kind: rollEventStarted, asg: "myasg"})
+}
+
+func TestAdjustNotify(t *testing.T) {
+	tests := []struct {
+		desc    string
+		old     int
+		new     int
+		desired int64
+		rolling bool
+		events  []rollEvent
+	}{
+		{"starting", 2, 0, 2, false, []rollEvent{
+			{kind: rollEventStarted, asg: "myasg", oldInstances: 2, newInstances: 0},
+		}},
+		{"terminating", 2, 1, 3, true, []rollEvent{
+			{kind: rollEventTerminated, asg: "myasg", oldInstances: 2, newInstances: 1, terminated: []string{"old0"}},
+		}},
+		{"finished", 0, 2, 2, true, []rollEvent{
+			{kind: rollEventFinished, asg: "myasg", oldInstances: 0, newInstances: 2},
+		}},
+		{"nothing to do", 0, 2, 2, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			instances := make([]*autoscaling.Instance, 0)
+			for i := 0; i < tt.old; i++ {
+				instances = append(instances, &autoscaling.Instance{InstanceId: aws.String(fmt.Sprintf("old%d", i)), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy})
+			}
+			for i := 0; i < tt.new; i++ {
+				instances = append(instances, &autoscaling.Instance{InstanceId: aws.String(fmt.Sprintf("new%d", i)), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy})
+			}
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(tt.desired),
+					MaxSize:                 aws.Int64(3),
+					LaunchConfigurationName: &lcName,
+					Instances:               instances,
+				},
+			}}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 2}
+			if tt.rolling {
+				state.setRolling(name, true)
+			}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				IncreaseMax:       true,
+			}
+			notifier := &mockNotifier{}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, notifier, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(notifier.events, tt.events) {
+				t.Errorf("mismatched events, actual %+v expected %+v", notifier.events, tt.events)
+			}
+		})
+	}
+}
+
+func TestAdjustNotifyFailed(t *testing.T) {
+	// the max size of "bad" is below its desired count, and cannot be increased, so only it fails
+	lcName := "lconfig"
+	oldLcName := "oldlconfig"
+	myHealthy := healthy
+	groups := map[string]*autoscaling.Group{}
+	for name, max := range map[string]int64{"good": 3, "bad": 1} {
+		groups[name] = &autoscaling.Group{
+			AutoScalingGroupName:    aws.String(name),
+			DesiredCapacity:         aws.Int64(2),
+			MaxSize:                 aws.Int64(max),
+			LaunchConfigurationName: &lcName,
+			Instances: []*autoscaling.Instance{
+				{InstanceId: aws.String(name + "0"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+				{InstanceId: aws.String(name + "1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+			},
+		}
+	}
+	asgSvc := &mockAsgSvc{groups: groups}
+	state := newRollerState()
+	state.originalDesired = map[string]int64{"good": 2, "bad": 2}
+	configs := Configs{
+		KubernetesEnabled: kubernetesEnabled,
+		ASGS:              []string{"good", "bad"},
+		InitialSurge:      1,
+		MaxTerminate:      1,
+		MaxSurge:          -1,
+		MaxUnavailable:    -1,
+	}
+	notifier := &mockNotifier{}
+	if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, notifier, state); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	failed := make([]string, 0)
+	for _, e := range notifier.events {
+		if e.kind != rollEventFailed {
+			continue
+		}
+		if e.err == nil {
+			t.Errorf("[%s] failed event without error", e.asg)
+		}
+		failed = append(failed, e.asg)
+	}
+	if !testStringEq(failed, []string{"bad"}) {
+		t.Errorf("mismatched failed ASGs, actual %v expected [bad]", failed)
+	}
+	// the other group carries on
+	setDesired := asgSvc.counter.filterByName("SetDesiredCapacity")
+	if len(setDesired) != 1 || *setDesired[0].params[0].(*autoscaling.SetDesiredCapacityInput).AutoScalingGroupName != "good" {
+		t.Errorf("expected desired set only for good, actual %d calls", len(setDesired))
+	}
+}
@@ -3,51 +3,124 @@ package main
 import (
 	"fmt"
 	"log"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
-	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 )
 
 const asgTagNameOriginalDesired = "aws-asg-roller/OriginalDesired"
 
+// how many times to retry writing tags when the call fails due to contention
+const tagRetries = 5
+
+// how long to wait before first retrying writing tags, doubled with each further retry
+var tagRetryDelay = time.Second
+
+// ways to pick the original desired value when there is more than one tag for it, which should not happen,
+// but can after manual edits
+const (
+	duplicateDesiredTagsMax   = "max"
+	duplicateDesiredTagsMin   = "min"
+	duplicateDesiredTagsError = "error"
+)
+
 // Populates the original desired values for each ASG, based on the current 'desired' value if unkonwn.
-// The original desired value is recorded as a tag on the respective ASG. Subsequent runs attempt to
-// read the value of the tag to preserve state in the case of the process terminating.
-func populateOriginalDesired(originalDesired map[string]int64, asgs []*autoscaling.Group, asgSvc autoscalingiface.AutoScalingAPI, storeOriginalDesiredOnTag bool, verbose bool) error {
-	for _, asg := range asgs {
-		asgName := *asg.AutoScalingGroupName
-		if storeOriginalDesiredOnTag {
-			tagOriginalDesired, err := getOriginalDesiredTag(asgSvc, asgName, verbose)
-			if err != nil {
-				return err
-			}
-			if tagOriginalDesired >= 0 {
-				originalDesired[asgName] = tagOriginalDesired
-				continue
-			}
+// The original desired value is recorded in the store, by default as a tag on the respective ASG.
+// Subsequent runs attempt to read the value from the store to preserve state in the case of the process
+// terminating. Whether to store the value can be set for each ASG.
+// Up to configs.DescribeConcurrency ASGs are populated at the same time. The values to record are written
+// once all of the ASGs are populated, e.g. for tags in batches of up to configs.TagBatchSize, rather than
+// one call per ASG, to avoid contention when there are many ASGs.
+func populateOriginalDesired(state *rollerState, asgs []*autoscaling.Group, store stateStore, configs Configs) error {
+	var mu sync.Mutex
+	tags := map[string]int64{}
+	err := runConcurrently(len(asgs), configs.DescribeConcurrency, func(i int) error {
+		storeOriginalDesiredOnTag := storesOriginalDesired(groupConfigs(configs, *asgs[i].AutoScalingGroupName))
+		tag, err := populateGroupOriginalDesired(state, asgs[i], store, storeOriginalDesiredOnTag, configs.DuplicateDesiredTags, configs.Verbose)
+		if err != nil || tag < 0 {
+			return err
 		}
-		// guess based on the current value
-		originalDesired[asgName] = *asg.DesiredCapacity
-		if verbose {
-			log.Printf("guessed desired value of %d from current desired on ASG: %s", *asg.DesiredCapacity, asgName)
+		mu.Lock()
+		defer mu.Unlock()
+		tags[*asgs[i].AutoScalingGroupName] = tag
+		return nil
+	})
+	if err != nil || len(tags) == 0 {
+		return err
+	}
+	return store.setOriginalDesired(tags, configs.DryRun, configs.Verbose)
+}
+
+// storesOriginalDesired reports if the original desired values are to be recorded in the store. They always
+// are with a backend other than tags, which is only used for them, and otherwise if set to be kept on tags.
+func storesOriginalDesired(configs Configs) bool {
+	return configs.OriginalDesiredOnTag || configs.StateBackend == stateBackendSSM || configs.StateBackend == stateBackendDynamoDB
+}
+
+// populateGroupOriginalDesired populates the original desired value for a single ASG. It returns the value
+// to record in the store for the ASG, or -1 if it does not need to be written.
+func populateGroupOriginalDesired(state *rollerState, asg *autoscaling.Group, store stateStore, storeOriginalDesiredOnTag bool, duplicateTags string, verbose bool) (int64, error) {
+	asgName := *asg.AutoScalingGroupName
+	if storeOriginalDesiredOnTag {
+		tagOriginalDesired, duplicated, err := store.getOriginalDesired(asgName, duplicateTags, verbose)
+		if err != nil {
+			return -1, err
 		}
-		if storeOriginalDesiredOnTag {
-			err := setOriginalDesiredTag(asgSvc, asgName, asg, verbose)
-			if err != nil {
-				return err
+		if tagOriginalDesired >= 0 {
+			state.setOriginalDesired(asgName, tagOriginalDesired)
+			if duplicated {
+				// replace the duplicates with the single value picked
+				return tagOriginalDesired, nil
 			}
+			return -1, nil
 		}
 	}
+	// already known from a previous run. The current value is no guess for it part way through a roll, as it
+	// includes the surge; changes made while the ASG is steady are picked up once its instances are grouped.
+	if _, ok := state.getOriginalDesired(asgName); ok {
+		return -1, nil
+	}
+	// guess based on the current value
+	state.setOriginalDesired(asgName, *asg.DesiredCapacity)
+	if verbose {
+		log.Printf("guessed desired value of %d from current desired on ASG: %s", *asg.DesiredCapacity, asgName)
+	}
+	if storeOriginalDesiredOnTag {
+		return *asg.DesiredCapacity, nil
+	}
+	return -1, nil
+}
+
+// updateOriginalDesired replaces the original desired value for an ASG with its current desired value.
+// It is used when desired was changed legitimately, e.g. by an operator, while no roll was in progress,
+// so that the roller does not return the ASG to the stale value. If storing the value, the store is
+// updated as well.
+func updateOriginalDesired(state *rollerState, asg *autoscaling.Group, store stateStore, storeOriginalDesiredOnTag, dryRun, verbose bool) error {
+	asgName := *asg.AutoScalingGroupName
+	previous, _ := state.getOriginalDesired(asgName)
+	log.Printf("[%s] desired changed from %d to %d while not rolling, updating original desired", asgName, previous, *asg.DesiredCapacity)
+	if storeOriginalDesiredOnTag {
+		if err := store.setOriginalDesired(map[string]int64{asgName: *asg.DesiredCapacity}, dryRun, verbose); err != nil {
+			return err
+		}
+	}
+	state.setOriginalDesired(asgName, *asg.DesiredCapacity)
 	return nil
 }
 
-// attempt to read the original desired value from the ASG tag
+// attempt to read the original desired value from the ASG tag. If there is more than one tag for it,
+// the value is picked as set by duplicateTags, with a warning.
 // returns
 //   the original desired value from the tag, if present, otherwise -1
+//   whether there was more than one tag
 //   error
-func getOriginalDesiredTag(asgSvc autoscalingiface.AutoScalingAPI, asgName string, verbose bool) (int64, error) {
+func getOriginalDesiredTag(asgSvc asgClient, asgName string, duplicateTags string, verbose bool) (int64, bool, error) {
 	tags, err := asgSvc.DescribeTags(&autoscaling.DescribeTagsInput{
 		Filters: []*autoscaling.Filter{
 			{
@@ -61,38 +134,100 @@ func getOriginalDesiredTag(asgSvc autoscalingiface.AutoScalingAPI, asgName strin
 		},
 	})
 	if err != nil {
-		return -1, fmt.Errorf("unable to read tag '%s' for ASG %s: %v", asgTagNameOriginalDesired, asgName, err)
+		return -1, false, fmt.Errorf("unable to read tag '%s' for ASG %s: %v", asgTagNameOriginalDesired, asgName, err)
+	}
+	values := make([]int64, 0)
+	for _, tag := range tags.Tags {
+		if aws.StringValue(tag.Key) != asgTagNameOriginalDesired {
+			continue
+		}
+		value, err := strconv.ParseInt(aws.StringValue(tag.Value), 10, 64)
+		if err != nil {
+			return -1, false, fmt.Errorf("unable to read tag '%s' for ASG %s: %v", asgTagNameOriginalDesired, asgName, err)
+		}
+		values = append(values, value)
+	}
+	if len(values) == 0 {
+		return -1, false, nil
 	}
-	if len(tags.Tags) == 1 {
-		if tagOriginalDesired, err := strconv.ParseInt(aws.StringValue(tags.Tags[0].Value), 10, 64); err == nil {
-			if verbose {
-				log.Printf("read original desired of %d from tag on ASG: %s", tagOriginalDesired, asgName)
+	tagOriginalDesired := values[0]
+	if len(values) > 1 {
+		if duplicateTags == duplicateDesiredTagsError {
+			return -1, false, fmt.Errorf("found %d tags '%s' for ASG %s, with values %v", len(values), asgTagNameOriginalDesired, asgName, values)
+		}
+		for _, value := range values[1:] {
+			if (duplicateTags == duplicateDesiredTagsMin && value < tagOriginalDesired) || (duplicateTags != duplicateDesiredTagsMin && value > tagOriginalDesired) {
+				tagOriginalDesired = value
 			}
-			return tagOriginalDesired, nil
 		}
-		return -1, fmt.Errorf("unable to read tag '%s' for ASG %s: %v", asgTagNameOriginalDesired, asgName, err)
+		log.Printf("[%s] WARNING: found %d tags '%s', with values %v, using %s value %d", asgName, len(values), asgTagNameOriginalDesired, values, duplicateTags, tagOriginalDesired)
 	}
-	return -1, nil
+	if verbose {
+		log.Printf("read original desired of %d from tag on ASG: %s", tagOriginalDesired, asgName)
+	}
+	return tagOriginalDesired, len(values) > 1, nil
 }
 
-// record original desired value on a tag, in case of process restart
-func setOriginalDesiredTag(asgSvc autoscalingiface.AutoScalingAPI, asgName string, asg *autoscaling.Group, verbose bool) error {
-	_, err := asgSvc.CreateOrUpdateTags(&autoscaling.CreateOrUpdateTagsInput{
-		Tags: []*autoscaling.Tag{
-			{
+// setOriginalDesiredTags records the original desired values of several ASGs, by name, on their tags, with
+// up to batchSize tags in each call, in order of name. Calls that fail due to contention are retried.
+func setOriginalDesiredTags(asgSvc asgClient, desired map[string]int64, batchSize int, dryRun, verbose bool) error {
+	if dryRun {
+		for _, name := range sortedStoreNames(desired) {
+			log.Printf("dry run: would record desired value of %d in tag on ASG: %s", desired[name], name)
+		}
+		return nil
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	names := make([]string, 0, len(desired))
+	for name := range desired {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for start := 0; start < len(names); start += batchSize {
+		end := start + batchSize
+		if end > len(names) {
+			end = len(names)
+		}
+		batch := names[start:end]
+		tags := make([]*autoscaling.Tag, 0, len(batch))
+		for _, name := range batch {
+			tags = append(tags, &autoscaling.Tag{
 				Key:               aws.String(asgTagNameOriginalDesired),
 				PropagateAtLaunch: aws.Bool(false),
-				ResourceId:        aws.String(asgName),
+				ResourceId:        aws.String(name),
 				ResourceType:      aws.String("auto-scaling-group"),
-				Value:             aws.String(strconv.FormatInt(*asg.DesiredCapacity, 10)),
-			},
-		},
-	})
-	if err != nil {
-		return fmt.Errorf("unable to set tag '%s' for ASG %s: %v", asgTagNameOriginalDesired, asgName, err)
-	}
-	if verbose {
-		log.Printf("recorded desired value of %d in tag on ASG: %s", *asg.DesiredCapacity, asgName)
+				Value:             aws.String(strconv.FormatInt(desired[name], 10)),
+			})
+		}
+		if err := createOrUpdateTagsWithRetry(asgSvc, tags); err != nil {
+			return fmt.Errorf("unable to set tag '%s' for ASGs %s: %v", asgTagNameOriginalDesired, strings.Join(batch, ", "), err)
+		}
+		if verbose {
+			for _, name := range batch {
+				log.Printf("recorded desired value of %d in tag on ASG: %s", desired[name], name)
+			}
+		}
 	}
 	return nil
 }
+
+// createOrUpdateTagsWithRetry creates or updates tags, retrying with increasing delays, starting at
+// tagRetryDelay, for as long as the call fails due to contention, up to tagRetries times
+func createOrUpdateTagsWithRetry(asgSvc asgClient, tags []*autoscaling.Tag) error {
+	delay := tagRetryDelay
+	for attempt := 0; ; attempt++ {
+		_, err := asgSvc.CreateOrUpdateTags(&autoscaling.CreateOrUpdateTagsInput{Tags: tags})
+		if err == nil {
+			return nil
+		}
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != autoscaling.ErrCodeResourceContentionFault || attempt >= tagRetries {
+			return err
+		}
+		log.Printf("contention setting tags, retrying in %v: %v", delay, err)
+		sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+const (
+	stateBackendTag      = "tag"
+	stateBackendSSM      = "ssm"
+	stateBackendDynamoDB = "dynamodb"
+
+	// the attributes of the items in the DynamoDB table, keyed by the name of the ASG
+	dynamoDBKeyASG              = "asg"
+	dynamoDBAttrOriginalDesired = "originalDesired"
+)
+
+// stateStore records the original desired values of ASGs, so that they survive the process restarting
+type stateStore interface {
+	// getOriginalDesired returns the recorded original desired value of the ASG, or -1 if there is none,
+	// and whether several values were found, resolved according to duplicates
+	getOriginalDesired(asgName, duplicates string, verbose bool) (int64, bool, error)
+	// setOriginalDesired records the original desired values of several ASGs, by name, unless in a dry run
+	setOriginalDesired(desired map[string]int64, dryRun, verbose bool) error
+}
+
+// tagStateStore records the original desired values on a tag on each ASG, the default
+type tagStateStore struct {
+	asgSvc    asgClient
+	batchSize int
+}
+
+func (s *tagStateStore) getOriginalDesired(asgName, duplicates string, verbose bool) (int64, bool, error) {
+	return getOriginalDesiredTag(s.asgSvc, asgName, duplicates, verbose)
+}
+
+func (s *tagStateStore) setOriginalDesired(desired map[string]int64, dryRun, verbose bool) error {
+	return setOriginalDesiredTags(s.asgSvc, desired, s.batchSize, dryRun, verbose)
+}
+
+// ssmStateStore records the original desired values in an SSM parameter per ASG, under the prefix
+type ssmStateStore struct {
+	ssmSvc ssmClient
+	prefix string
+}
+
+func (s *ssmStateStore) parameterName(asgName string) string {
+	return path.Join("/", s.prefix, asgName)
+}
+
+func (s *ssmStateStore) getOriginalDesired(asgName, duplicates string, verbose bool) (int64, bool, error) {
+	name := s.parameterName(asgName)
+	out, err := s.ssmSvc.GetParameter(&ssm.GetParameterInput{Name: aws.String(name)})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeParameterNotFound {
+			return -1, false, nil
+		}
+		return -1, false, fmt.Errorf("unable to read SSM parameter %s for ASG %s: %v", name, asgName, err)
+	}
+	if out.Parameter == nil || out.Parameter.Value == nil {
+		return -1, false, nil
+	}
+	desired, err := strconv.ParseInt(*out.Parameter.Value, 10, 64)
+	if err != nil {
+		return -1, false, fmt.Errorf("invalid value in SSM parameter %s for ASG %s: %v", name, asgName, err)
+	}
+	if verbose {
+		log.Printf("read original desired of %d from SSM parameter %s for ASG: %s", desired, name, asgName)
+	}
+	return desired, false, nil
+}
+
+func (s *ssmStateStore) setOriginalDesired(desired map[string]int64, dryRun, verbose bool) error {
+	for _, asgName := range sortedStoreNames(desired) {
+		name := s.parameterName(asgName)
+		if dryRun {
+			log.Printf("dry run: would record desired value of %d in SSM parameter %s for ASG: %s", desired[asgName], name, asgName)
+			continue
+		}
+		_, err := s.ssmSvc.PutParameter(&ssm.PutParameterInput{
+			Name:      aws.String(name),
+			Overwrite: aws.Bool(true),
+			Type:      aws.String(ssm.ParameterTypeString),
+			Value:     aws.String(strconv.FormatInt(desired[asgName], 10)),
+		})
+		if err != nil {
+			return fmt.Errorf("unable to set SSM parameter %s for ASG %s: %v", name, asgName, err)
+		}
+		if verbose {
+			log.Printf("recorded desired value of %d in SSM parameter %s for ASG: %s", desired[asgName], name, asgName)
+		}
+	}
+	return nil
+}
+
+// dynamoStateStore records the original desired values in a DynamoDB table, with an item per ASG keyed
+// by its name
+type dynamoStateStore struct {
+	svc   dynamoClient
+	table string
+}
+
+func (s *dynamoStateStore) getOriginalDesired(asgName, duplicates string, verbose bool) (int64, bool, error) {
+	out, err := s.svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamoDBKeyASG: {S: aws.String(asgName)},
+		},
+	})
+	if err != nil {
+		return -1, false, fmt.Errorf("unable to read DynamoDB table %s for ASG %s: %v", s.table, asgName, err)
+	}
+	attr, ok := out.Item[dynamoDBAttrOriginalDesired]
+	if !ok || attr.N == nil {
+		return -1, false, nil
+	}
+	desired, err := strconv.ParseInt(*attr.N, 10, 64)
+	if err != nil {
+		return -1, false, fmt.Errorf("invalid value in DynamoDB table %s for ASG %s: %v", s.table, asgName, err)
+	}
+	if verbose {
+		log.Printf("read original desired of %d from DynamoDB table %s for ASG: %s", desired, s.table, asgName)
+	}
+	return desired, false, nil
+}
+
+func (s *dynamoStateStore) setOriginalDesired(desired map[string]int64, dryRun, verbose bool) error {
+	for _, asgName := range sortedStoreNames(desired) {
+		if dryRun {
+			log.Printf("dry run: would record desired value of %d in DynamoDB table %s for ASG: %s", desired[asgName], s.table, asgName)
+			continue
+		}
+		_, err := s.svc.PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String(s.table),
+			Item: map[string]*dynamodb.AttributeValue{
+				dynamoDBKeyASG:              {S: aws.String(asgName)},
+				dynamoDBAttrOriginalDesired: {N: aws.String(strconv.FormatInt(desired[asgName], 10))},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("unable to write DynamoDB table %s for ASG %s: %v", s.table, asgName, err)
+		}
+		if verbose {
+			log.Printf("recorded desired value of %d in DynamoDB table %s for ASG: %s", desired[asgName], s.table, asgName)
+		}
+	}
+	return nil
+}
+
+// sortedStoreNames returns the names of the ASGs to record, in order, so that writes are predictable
+func sortedStoreNames(desired map[string]int64) []string {
+	names := make([]string, 0, len(desired))
+	for name := range desired {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
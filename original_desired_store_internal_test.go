@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// mockStateStore records the original desired values in memory
+type mockStateStore struct {
+	desired map[string]int64
+	sets    int
+}
+
+func (m *mockStateStore) getOriginalDesired(asgName, duplicates string, verbose bool) (int64, bool, error) {
+	if desired, ok := m.desired[asgName]; ok {
+		return desired, false, nil
+	}
+	return -1, false, nil
+}
+
+func (m *mockStateStore) setOriginalDesired(desired map[string]int64, dryRun, verbose bool) error {
+	if m.desired == nil {
+		m.desired = map[string]int64{}
+	}
+	for name, value := range desired {
+		m.desired[name] = value
+	}
+	m.sets++
+	return nil
+}
+
+type mockDynamoSvc struct {
+	counter funcCounter
+	err     error
+	// the original desired value in each item, by ASG name
+	items map[string]string
+}
+
+func (m *mockDynamoSvc) GetItem(in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	m.counter.add("GetItem", in)
+	if m.err != nil {
+		return nil, m.err
+	}
+	name := *in.Key[dynamoDBKeyASG].S
+	value, ok := m.items[name]
+	if !ok {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+		dynamoDBKeyASG:              {S: aws.String(name)},
+		dynamoDBAttrOriginalDesired: {N: aws.String(value)},
+	}}, nil
+}
+
+func (m *mockDynamoSvc) PutItem(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	m.counter.add("PutItem", in)
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.items == nil {
+		m.items = map[string]string{}
+	}
+	m.items[*in.Item[dynamoDBKeyASG].S] = *in.Item[dynamoDBAttrOriginalDesired].N
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func TestSSMStateStore(t *testing.T) {
+	ssmSvc := &mockSsmSvc{parameters: map[string]string{"/roller/asg1": "3", "/roller/bad": "three"}}
+	store := &ssmStateStore{ssmSvc: ssmSvc, prefix: "/roller"}
+	tests := []struct {
+		name     string
+		expected int64
+		err      bool
+	}{
+		{"asg1", 3, false},
+		{"asg2", -1, false},
+		{"bad", -1, true},
+	}
+	for _, tt := range tests {
+		desired, _, err := store.getOriginalDesired(tt.name, duplicateDesiredTagsMax, false)
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("%s: expected error, had none", tt.name)
+		case !tt.err && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		case desired != tt.expected:
+			t.Errorf("%s: mismatched original desired, actual %d expected %d", tt.name, desired, tt.expected)
+		}
+	}
+	if err := store.setOriginalDesired(map[string]int64{"asg2": 5, "asg1": 4}, false, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	puts := ssmSvc.counter.filterByName("PutParameter")
+	if len(puts) != 2 || *puts[0].params[0].(*ssm.PutParameterInput).Name != "/roller/asg1" || !*puts[0].params[0].(*ssm.PutParameterInput).Overwrite {
+		t.Fatalf("expected 2 PutParameter calls overwriting in order of name, had %v", puts)
+	}
+	if ssmSvc.parameters["/roller/asg1"] != "4" || ssmSvc.parameters["/roller/asg2"] != "5" {
+		t.Errorf("mismatched parameters %v", ssmSvc.parameters)
+	}
+}
+
+func TestDynamoStateStore(t *testing.T) {
+	svc := &mockDynamoSvc{items: map[string]string{"asg1": "3"}}
+	store := &dynamoStateStore{svc: svc, table: "roller"}
+	if desired, _, err := store.getOriginalDesired("asg1", duplicateDesiredTagsMax, false); err != nil || desired != 3 {
+		t.Errorf("mismatched original desired for asg1, actual %d (error %v) expected 3", desired, err)
+	}
+	if desired, _, err := store.getOriginalDesired("asg2", duplicateDesiredTagsMax, false); err != nil || desired != -1 {
+		t.Errorf("mismatched original desired for asg2, actual %d (error %v) expected -1", desired, err)
+	}
+	gets := svc.counter.filterByName("GetItem")
+	if in := gets[0].params[0].(*dynamodb.GetItemInput); *in.TableName != "roller" || !*in.ConsistentRead {
+		t.Errorf("expected consistent read from table roller, had %v", in)
+	}
+	if err := store.setOriginalDesired(map[string]int64{"asg2": 5}, false, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if svc.items["asg2"] != "5" {
+		t.Errorf("mismatched items %v", svc.items)
+	}
+
+	svc.err = fmt.Errorf("unavailable")
+	if _, _, err := store.getOriginalDesired("asg1", duplicateDesiredTagsMax, false); err == nil {
+		t.Errorf("expected error reading, had none")
+	}
+	if err := store.setOriginalDesired(map[string]int64{"asg1": 4}, false, false); err == nil {
+		t.Errorf("expected error writing, had none")
+	}
+}
+
+func TestAdjustStateStore(t *testing.T) {
+	tests := []struct {
+		desc     string
+		stored   map[string]int64
+		expected int64
+		sets     int
+	}{
+		{"recorded in store", map[string]int64{"myasg": 2}, 2, 0},
+		{"not recorded", nil, 3, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			name := "myasg"
+			lcName := "lconfig"
+			myHealthy := healthy
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(3),
+					MaxSize:                 aws.Int64(4),
+					LaunchConfigurationName: &lcName,
+					Instances: []*autoscaling.Instance{
+						{InstanceId: aws.String("1"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+					},
+				},
+			}}
+			store := &mockStateStore{desired: tt.stored}
+			state := newRollerState()
+			// a backend other than tags stores the values without them being set to be kept on tags
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				StateBackend:      stateBackendSSM,
+			}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, store, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if actual := state.originalDesired[name]; actual != tt.expected {
+				t.Errorf("mismatched original desired, actual %d expected %d", actual, tt.expected)
+			}
+			if store.sets != tt.sets {
+				t.Errorf("mismatched writes to the store, actual %d expected %d", store.sets, tt.sets)
+			}
+			// the tags on the ASG are not used
+			if calls := len(asgSvc.counter.filterByName("DescribeTags")) + len(asgSvc.counter.filterByName("CreateOrUpdateTags")); calls != 0 {
+				t.Errorf("expected no tag calls, had %d", calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+const asgTagNameOriginalMax = "aws-asg-roller/OriginalMax"
+
+// recordOriginalMax records the max size of an ASG before it is rolled, so that it can be restored once
+// the roll is done, even if the max size is raised to accommodate surging. As with the original desired
+// value, it is recorded as a tag on the ASG, to preserve it in the case of the process terminating.
+// If it already is known, from the state or the tag, it is left as it is. Nothing is recorded in a dry run.
+func recordOriginalMax(state *rollerState, asg *autoscaling.Group, asgSvc asgClient, dryRun, verbose bool) error {
+	asgName := *asg.AutoScalingGroupName
+	if asg.MaxSize == nil {
+		return nil
+	}
+	if dryRun {
+		log.Printf("dry run: would record max size of %d of ASG %s, unless already recorded", *asg.MaxSize, asgName)
+		return nil
+	}
+	if _, ok := state.getOriginalMax(asgName); ok {
+		return nil
+	}
+	tagOriginalMax, err := getOriginalMaxTag(asg)
+	if err != nil {
+		return err
+	}
+	if tagOriginalMax >= 0 {
+		state.setOriginalMax(asgName, tagOriginalMax)
+		return nil
+	}
+	_, err = asgSvc.CreateOrUpdateTags(&autoscaling.CreateOrUpdateTagsInput{
+		Tags: []*autoscaling.Tag{
+			{
+				Key:               aws.String(asgTagNameOriginalMax),
+				PropagateAtLaunch: aws.Bool(false),
+				ResourceId:        aws.String(asgName),
+				ResourceType:      aws.String("auto-scaling-group"),
+				Value:             aws.String(strconv.FormatInt(*asg.MaxSize, 10)),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to set tag '%s' for ASG %s: %v", asgTagNameOriginalMax, asgName, err)
+	}
+	if verbose {
+		log.Printf("recorded max size of %d in tag on ASG: %s", *asg.MaxSize, asgName)
+	}
+	state.setOriginalMax(asgName, *asg.MaxSize)
+	return nil
+}
+
+// restoreOriginalMax returns the max size of an ASG that is done rolling to its recorded original value, if
+// there is one, and then forgets it. The max size is never set below the desired count of the ASG. In a dry
+// run, the max size and the record of it are left as they are.
+func restoreOriginalMax(state *rollerState, asg *autoscaling.Group, asgSvc asgClient, dryRun, verbose bool) error {
+	asgName := *asg.AutoScalingGroupName
+	originalMax, ok := state.getOriginalMax(asgName)
+	if !ok {
+		tagOriginalMax, err := getOriginalMaxTag(asg)
+		if err != nil {
+			return err
+		}
+		if tagOriginalMax < 0 {
+			return nil
+		}
+		originalMax = tagOriginalMax
+	}
+	if originalMax < *asg.DesiredCapacity {
+		originalMax = *asg.DesiredCapacity
+	}
+	if dryRun {
+		log.Printf("dry run: would restore max size of ASG %s to %d, and remove tag '%s'", asgName, originalMax, asgTagNameOriginalMax)
+		return nil
+	}
+	if asg.MaxSize != nil && *asg.MaxSize != originalMax {
+		log.Printf("[%s] restoring max size from %d to %d\n", asgName, *asg.MaxSize, originalMax)
+		if err := setAsgMax(asgSvc, asg, originalMax, dryRun, verbose); err != nil {
+			return err
+		}
+		asg.MaxSize = aws.Int64(originalMax)
+	}
+	_, err := asgSvc.DeleteTags(&autoscaling.DeleteTagsInput{
+		Tags: []*autoscaling.Tag{
+			{
+				Key:          aws.String(asgTagNameOriginalMax),
+				ResourceId:   aws.String(asgName),
+				ResourceType: aws.String("auto-scaling-group"),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to delete tag '%s' for ASG %s: %v", asgTagNameOriginalMax, asgName, err)
+	}
+	state.clearOriginalMax(asgName)
+	return nil
+}
+
+// getOriginalMaxTag reads the original max size from the tags of the ASG. It returns -1 if there is no such tag.
+func getOriginalMaxTag(asg *autoscaling.Group) (int64, error) {
+	for _, tag := range asg.Tags {
+		if aws.StringValue(tag.Key) != asgTagNameOriginalMax {
+			continue
+		}
+		value, err := strconv.ParseInt(aws.StringValue(tag.Value), 10, 64)
+		if err != nil {
+			return -1, fmt.Errorf("unable to read tag '%s' for ASG %s: %v", asgTagNameOriginalMax, aws.StringValue(asg.AutoScalingGroupName), err)
+		}
+		return value, nil
+	}
+	return -1, nil
+}
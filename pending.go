@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// stuckPending returns the IDs of the instances that still are pending in EC2 more than timeout after they
+// were launched, in the same order. Instances that were not described, or have no known launch time, are
+// never taken to be stuck.
+func stuckPending(instances []*autoscaling.Instance, described map[string]*ec2.Instance, timeout time.Duration, now time.Time) []string {
+	stuck := make([]string, 0)
+	for _, i := range instances {
+		instance, ok := described[*i.InstanceId]
+		if !ok || instance.State == nil || instance.LaunchTime == nil {
+			continue
+		}
+		if aws.StringValue(instance.State.Name) == ec2.InstanceStateNamePending && now.Sub(*instance.LaunchTime) > timeout {
+			stuck = append(stuck, *i.InstanceId)
+		}
+	}
+	return stuck
+}
+
+// backOutStuckPending backs out the surge of an ASG whose new instances are stuck pending, rather than
+// waiting for them to become ready forever, by terminating them and lowering the desired count to match.
+// No more are backed out than the ASG surged by. It reports if any were, in which case the ASG should not
+// be rolled further in this loop.
+func backOutStuckPending(asgSvc asgClient, notifier rollNotifier, d *groupDescription, timeout time.Duration, dryRun bool) bool {
+	return backOutSurge(asgSvc, notifier, d, d.stuckPending, fmt.Sprintf("stuck pending for longer than %v", timeout), dryRun)
+}
+
+// backOutStuckUnhealthy backs out the surge of an ASG whose new instances have been unhealthy for too long,
+// as for backOutStuckPending
+func backOutStuckUnhealthy(asgSvc asgClient, notifier rollNotifier, d *groupDescription, timeout time.Duration, dryRun bool) bool {
+	return backOutSurge(asgSvc, notifier, d, d.stuckUnhealthy, fmt.Sprintf("unhealthy for longer than %v", timeout), dryRun)
+}
+
+// backOutSurge terminates the stuck new instances of an ASG, lowering the desired count to match, up to as
+// many as the ASG surged by. It reports if any were to be backed out.
+func backOutSurge(asgSvc asgClient, notifier rollNotifier, d *groupDescription, stuck []string, reason string, dryRun bool) bool {
+	name := *d.asg.AutoScalingGroupName
+	surge := int(*d.asg.DesiredCapacity - d.originalDesired)
+	if surge < 1 {
+		log.Printf("[%s] WARNING: new instances %v %s, but there is no surge to back out\n", name, stuck, reason)
+		return false
+	}
+	ids := stuck
+	if len(ids) > surge {
+		ids = ids[:surge]
+	}
+	log.Printf("[%s] WARNING: new instances %v %s, backing out the surge\n", name, ids, reason)
+	backedOut := make([]string, 0)
+	for _, id := range ids {
+		if err := awsBackOutInstance(asgSvc, id, dryRun); err != nil {
+			log.Printf("[%s] error backing out instance %s: %v\n", name, id, err)
+			break
+		}
+		backedOut = append(backedOut, id)
+	}
+	if len(backedOut) > 0 && !dryRun {
+		notifyRoll(notifier, rollEvent{kind: rollEventBackedOut, asg: name, oldInstances: len(d.oldInstances), newInstances: len(d.newInstances), terminated: backedOut})
+	}
+	return true
+}
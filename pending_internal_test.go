@@ -0,0 +1,250 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestStuckPending(t *testing.T) {
+	now := time.Now()
+	pending := &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNamePending)}
+	running := &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameRunning)}
+	// "4" was not described
+	described := map[string]*ec2.Instance{
+		"1": {InstanceId: aws.String("1"), State: pending, LaunchTime: aws.Time(now.Add(-20 * time.Minute))},
+		"2": {InstanceId: aws.String("2"), State: pending, LaunchTime: aws.Time(now.Add(-5 * time.Minute))},
+		"3": {InstanceId: aws.String("3"), State: running, LaunchTime: aws.Time(now.Add(-20 * time.Minute))},
+	}
+	instances := make([]*autoscaling.Instance, 0)
+	for _, id := range []string{"1", "2", "3", "4"} {
+		instances = append(instances, &autoscaling.Instance{InstanceId: aws.String(id)})
+	}
+	stuck := stuckPending(instances, described, 10*time.Minute, now)
+	if !testStringEq(stuck, []string{"1"}) {
+		t.Errorf("mismatched stuck instances, actual %v expected [1]", stuck)
+	}
+}
+
+func TestAdjustPendingTimeout(t *testing.T) {
+	tests := []struct {
+		desc      string
+		timeout   time.Duration
+		desired   int64
+		backedOut []string
+		notified  bool
+	}{
+		{"no timeout", 0, 3, []string{}, false},
+		{"backed out", 10 * time.Minute, 3, []string{"new1"}, true},
+		{"no surge to back out", 10 * time.Minute, 2, []string{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// part way through a roll, with the surged new instance pending ever since it was launched
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			instances := []*autoscaling.Instance{
+				{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+				{InstanceId: aws.String("2"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+				{InstanceId: aws.String("new1"), LaunchConfigurationName: &lcName, HealthStatus: aws.String("Unhealthy")},
+			}
+			ec2Instances := map[string]*ec2.Instance{
+				"new1": {
+					InstanceId:     aws.String("new1"),
+					PrivateDnsName: aws.String("hostnew1"),
+					State:          &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNamePending)},
+					LaunchTime:     aws.Time(time.Now().Add(-time.Hour)),
+				},
+			}
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(tt.desired),
+					MaxSize:                 aws.Int64(3),
+					LaunchConfigurationName: &lcName,
+					Instances:               instances,
+				},
+			}}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 2}
+			state.setRolling(name, true)
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				MaxTerminate:      1,
+				PendingTimeout:    tt.timeout,
+			}
+			notifier := &mockNotifier{}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true, instances: ec2Instances}, asgSvc, nil, nil, nil, nil, nil, notifier, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			backedOut := make([]string, 0)
+			for _, c := range asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup") {
+				in := c.params[0].(*autoscaling.TerminateInstanceInAutoScalingGroupInput)
+				if !*in.ShouldDecrementDesiredCapacity {
+					t.Errorf("unexpected termination of %s without decrementing desired", *in.InstanceId)
+					continue
+				}
+				backedOut = append(backedOut, *in.InstanceId)
+			}
+			if !testStringEq(backedOut, tt.backedOut) {
+				t.Errorf("mismatched backed out instances, actual %v expected %v", backedOut, tt.backedOut)
+			}
+			notified := false
+			for _, e := range notifier.events {
+				if e.kind == rollEventBackedOut {
+					notified = true
+				}
+			}
+			if notified != tt.notified {
+				t.Errorf("mismatched backed out notification, actual %v expected %v", notified, tt.notified)
+			}
+		})
+	}
+}
+
+func TestStuckUnhealthy(t *testing.T) {
+	state := newRollerState()
+	start := time.Now()
+	now := start
+	state.now = func() time.Time { return now }
+	instances := []*autoscaling.Instance{
+		{InstanceId: aws.String("1"), HealthStatus: aws.String("Unhealthy")},
+		{InstanceId: aws.String("2"), HealthStatus: aws.String(healthy)},
+	}
+	if stuck := state.stuckUnhealthy("myasg", instances, 10*time.Minute); len(stuck) != 0 {
+		t.Errorf("unexpected stuck instances when first seen: %v", stuck)
+	}
+	// another instance becomes unhealthy later
+	instances[1].HealthStatus = aws.String("Unhealthy")
+	now = start.Add(5 * time.Minute)
+	if stuck := state.stuckUnhealthy("myasg", instances, 10*time.Minute); len(stuck) != 0 {
+		t.Errorf("unexpected stuck instances within timeout: %v", stuck)
+	}
+	now = start.Add(11 * time.Minute)
+	if stuck := state.stuckUnhealthy("myasg", instances, 10*time.Minute); !testStringEq(stuck, []string{"1"}) {
+		t.Errorf("mismatched stuck instances, actual %v expected [1]", stuck)
+	}
+	// an instance that becomes healthy is forgotten, so starts over if it is unhealthy again
+	instances[0].HealthStatus = aws.String(healthy)
+	now = start.Add(12 * time.Minute)
+	state.stuckUnhealthy("myasg", instances, 10*time.Minute)
+	instances[0].HealthStatus = aws.String("Unhealthy")
+	now = start.Add(16 * time.Minute)
+	if stuck := state.stuckUnhealthy("myasg", instances, 10*time.Minute); !testStringEq(stuck, []string{"2"}) {
+		t.Errorf("mismatched stuck instances, actual %v expected [2]", stuck)
+	}
+}
+
+func TestHealthGraceRemaining(t *testing.T) {
+	state := newRollerState()
+	start := time.Now()
+	now := start
+	state.now = func() time.Time { return now }
+	instances := []*autoscaling.Instance{
+		{InstanceId: aws.String("1"), HealthStatus: aws.String(healthy)},
+		{InstanceId: aws.String("2"), HealthStatus: aws.String("Unhealthy")},
+	}
+	if remaining := state.healthGraceRemaining("myasg", instances, 10*time.Minute); remaining != 10*time.Minute {
+		t.Errorf("mismatched remaining when first seen healthy, actual %v expected %v", remaining, 10*time.Minute)
+	}
+	// the other instance becomes healthy later, and so is the last out of its grace period
+	now = start.Add(4 * time.Minute)
+	instances[1].HealthStatus = aws.String(healthy)
+	if remaining := state.healthGraceRemaining("myasg", instances, 10*time.Minute); remaining != 10*time.Minute {
+		t.Errorf("mismatched remaining, actual %v expected %v", remaining, 10*time.Minute)
+	}
+	now = start.Add(11 * time.Minute)
+	if remaining := state.healthGraceRemaining("myasg", instances, 10*time.Minute); remaining != 3*time.Minute {
+		t.Errorf("mismatched remaining, actual %v expected %v", remaining, 3*time.Minute)
+	}
+	now = start.Add(15 * time.Minute)
+	if remaining := state.healthGraceRemaining("myasg", instances, 10*time.Minute); remaining != 0 {
+		t.Errorf("mismatched remaining after grace period, actual %v expected 0", remaining)
+	}
+	// an instance that becomes unhealthy is forgotten, so starts over once healthy again
+	instances[0].HealthStatus = aws.String("Unhealthy")
+	state.healthGraceRemaining("myasg", instances, 10*time.Minute)
+	instances[0].HealthStatus = aws.String(healthy)
+	now = start.Add(16 * time.Minute)
+	if remaining := state.healthGraceRemaining("myasg", instances, 10*time.Minute); remaining != 10*time.Minute {
+		t.Errorf("mismatched remaining once healthy again, actual %v expected %v", remaining, 10*time.Minute)
+	}
+}
+
+func TestAdjustUnhealthyTimeout(t *testing.T) {
+	tests := []struct {
+		desc      string
+		timeout   time.Duration
+		since     time.Duration
+		backedOut []string
+		notified  bool
+	}{
+		{"no timeout", 0, time.Hour, []string{}, false},
+		{"within timeout", 10 * time.Minute, time.Minute, []string{}, false},
+		{"backed out", 10 * time.Minute, time.Hour, []string{"new1"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// part way through a roll, with the surged new instance running but never healthy
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			instances := []*autoscaling.Instance{
+				{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+				{InstanceId: aws.String("2"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+				{InstanceId: aws.String("new1"), LaunchConfigurationName: &lcName, HealthStatus: aws.String("Unhealthy")},
+			}
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(3),
+					MaxSize:                 aws.Int64(3),
+					LaunchConfigurationName: &lcName,
+					Instances:               instances,
+				},
+			}}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 2}
+			state.setRolling(name, true)
+			state.unhealthySince[name] = map[string]time.Time{"new1": time.Now().Add(-tt.since)}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				MaxTerminate:      1,
+				UnhealthyTimeout:  tt.timeout,
+			}
+			notifier := &mockNotifier{}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, notifier, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			backedOut := make([]string, 0)
+			for _, c := range asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup") {
+				in := c.params[0].(*autoscaling.TerminateInstanceInAutoScalingGroupInput)
+				if !*in.ShouldDecrementDesiredCapacity {
+					t.Errorf("unexpected termination of %s without decrementing desired", *in.InstanceId)
+					continue
+				}
+				backedOut = append(backedOut, *in.InstanceId)
+			}
+			if !testStringEq(backedOut, tt.backedOut) {
+				t.Errorf("mismatched backed out instances, actual %v expected %v", backedOut, tt.backedOut)
+			}
+			notified := false
+			for _, e := range notifier.events {
+				if e.kind == rollEventBackedOut {
+					notified = true
+				}
+			}
+			if notified != tt.notified {
+				t.Errorf("mismatched backed out notification, actual %v expected %v", notified, tt.notified)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// error code EC2 returns for a dry run of a call that would have succeeded
+const ec2ErrCodeDryRunOperation = "DryRunOperation"
+
+// validatePlan checks that all of the new desired counts and terminations planned in a loop can be
+// applied, so that the loop can be aborted before any of them is, rather than part way through. It
+// returns an error listing every problem found.
+func validatePlan(configs Configs, asgMap map[string]*autoscaling.Group, newDesired map[string]int64, newTerminate map[string][]string, ec2Svc ec2Client) error {
+	problems := make([]string, 0)
+	for name, desired := range newDesired {
+		asg := asgMap[name]
+		if asg.MaxSize != nil && desired > *asg.MaxSize && !groupConfigs(configs, name).IncreaseMax {
+			problems = append(problems, fmt.Sprintf("[%s] desired %d is greater than max size %d", name, desired, *asg.MaxSize))
+		}
+		if asg.MinSize != nil && desired < *asg.MinSize {
+			problems = append(problems, fmt.Sprintf("[%s] desired %d is less than min size %d", name, desired, *asg.MinSize))
+		}
+	}
+	ids := make([]string, 0)
+	for name, terminate := range newTerminate {
+		inService := map[string]bool{}
+		for _, i := range asgMap[name].Instances {
+			inService[aws.StringValue(i.InstanceId)] = !strings.HasPrefix(aws.StringValue(i.LifecycleState), autoscaling.LifecycleStateTerminating)
+		}
+		for _, id := range terminate {
+			if !inService[id] {
+				problems = append(problems, fmt.Sprintf("[%s] instance %s to terminate is not in service in the ASG", name, id))
+			}
+		}
+		ids = append(ids, terminate...)
+	}
+	// EC2 can check that the instances may be terminated without terminating them
+	if configs.TerminateViaEC2 && len(ids) > 0 {
+		_, err := ec2Svc.TerminateInstances(&ec2.TerminateInstancesInput{
+			InstanceIds: aws.StringSlice(ids),
+			DryRun:      aws.Bool(true),
+		})
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != ec2ErrCodeDryRunOperation {
+			problems = append(problems, fmt.Sprintf("unable to terminate instances %v: %v", ids, err))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	// groups are planned in no particular order, so report them in a stable one
+	sort.Strings(problems)
+	return fmt.Errorf("%s", strings.Join(problems, "; "))
+}
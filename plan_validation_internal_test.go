@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestValidatePlan(t *testing.T) {
+	asgMap := map[string]*autoscaling.Group{
+		"myasg": {
+			AutoScalingGroupName: aws.String("myasg"),
+			MinSize:              aws.Int64(2),
+			MaxSize:              aws.Int64(4),
+			Instances: []*autoscaling.Instance{
+				{InstanceId: aws.String("1"), LifecycleState: aws.String(autoscaling.LifecycleStateInService)},
+				{InstanceId: aws.String("2"), LifecycleState: aws.String(autoscaling.LifecycleStateTerminatingWait)},
+			},
+		},
+	}
+	tests := []struct {
+		desc         string
+		increaseMax  bool
+		newDesired   map[string]int64
+		newTerminate map[string][]string
+		err          string
+	}{
+		{"valid", false, map[string]int64{"myasg": 4}, map[string][]string{"myasg": {"1"}}, ""},
+		{"nothing to do", false, nil, nil, ""},
+		{"above max", false, map[string]int64{"myasg": 5}, nil, "[myasg] desired 5 is greater than max size 4"},
+		{"above max that can be increased", true, map[string]int64{"myasg": 5}, nil, ""},
+		{"below min", false, map[string]int64{"myasg": 1}, nil, "[myasg] desired 1 is less than min size 2"},
+		{"not in ASG", false, nil, map[string][]string{"myasg": {"3"}}, "[myasg] instance 3 to terminate is not in service in the ASG"},
+		{"already terminating", false, nil, map[string][]string{"myasg": {"2"}}, "[myasg] instance 2 to terminate is not in service in the ASG"},
+		{"every problem", false, map[string]int64{"myasg": 5}, map[string][]string{"myasg": {"3"}}, "[myasg] desired 5 is greater than max size 4; [myasg] instance 3 to terminate is not in service in the ASG"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			configs := Configs{IncreaseMax: tt.increaseMax}
+			err := validatePlan(configs, asgMap, tt.newDesired, tt.newTerminate, &mockEc2Svc{})
+			switch {
+			case err == nil && tt.err != "":
+				t.Errorf("no error, expected %s", tt.err)
+			case err != nil && err.Error() != tt.err:
+				t.Errorf("mismatched error, actual %v expected %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestAdjustValidatePlan(t *testing.T) {
+	tests := []struct {
+		desc            string
+		terminateViaEC2 bool
+		ec2Err          error
+		err             bool
+		setDesired      int
+		terminated      int
+	}{
+		{"valid", false, nil, false, 1, 1},
+		{"not permitted to terminate", true, awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil), true, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// one group is about to surge, and the other to terminate an old instance
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				"surging": {
+					AutoScalingGroupName:    aws.String("surging"),
+					DesiredCapacity:         aws.Int64(2),
+					MaxSize:                 aws.Int64(3),
+					LaunchConfigurationName: &lcName,
+					Instances: []*autoscaling.Instance{
+						{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+						{InstanceId: aws.String("2"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+					},
+				},
+				"terminating": {
+					AutoScalingGroupName:    aws.String("terminating"),
+					DesiredCapacity:         aws.Int64(3),
+					MaxSize:                 aws.Int64(3),
+					LaunchConfigurationName: &lcName,
+					Instances: []*autoscaling.Instance{
+						{InstanceId: aws.String("3"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+						{InstanceId: aws.String("4"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+						{InstanceId: aws.String("5"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+					},
+				},
+			}}
+			ec2Svc := &mockEc2Svc{autodescribe: true, err: tt.ec2Err}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{"surging": 2, "terminating": 2}
+			state.setRolling("terminating", true)
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{"surging", "terminating"},
+				InitialSurge:      1,
+				MaxTerminate:      1,
+				MaxSurge:          -1,
+				MaxUnavailable:    -1,
+				TerminateViaEC2:   tt.terminateViaEC2,
+				ValidatePlan:      true,
+			}
+			_, err := adjust(configs, ec2Svc, asgSvc, nil, nil, nil, nil, nil, nil, state)
+			switch {
+			case err != nil && !tt.err:
+				t.Fatalf("unexpected error: %v", err)
+			case err == nil && tt.err:
+				t.Fatalf("no error, expected one")
+			}
+			if calls := asgSvc.counter.filterByName("SetDesiredCapacity"); len(calls) != tt.setDesired {
+				t.Errorf("mismatched desired counts set, actual %d expected %d", len(calls), tt.setDesired)
+			}
+			terminated := len(asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup"))
+			for _, c := range ec2Svc.counter.filterByName("TerminateInstances") {
+				if in := c.params[0].(*ec2.TerminateInstancesInput); !aws.BoolValue(in.DryRun) {
+					terminated += len(in.InstanceIds)
+				}
+			}
+			if terminated != tt.terminated {
+				t.Errorf("mismatched terminations, actual %d expected %d", terminated, tt.terminated)
+			}
+		})
+	}
+}
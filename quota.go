@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/servicequotas"
+)
+
+const (
+	quotaServiceCodeEC2 = "ec2"
+	// Running On-Demand Standard (A, C, D, H, I, M, R, T, Z) instances, counted in vCPUs
+	quotaCodeOnDemandStandard = "L-1216C47A"
+	// instance families the quota for on-demand standard instances covers
+	onDemandStandardFamilies = "acdhimrtz"
+)
+
+// capacityQuota reports how much headroom the account has under its quota for running instances, so that
+// ASGs are not surged into it, leaving new instances that can never launch
+type capacityQuota interface {
+	// headroom returns how many more vCPUs of instances can be running, and the vCPUs of each instance
+	// that counts towards the quota now, by ID
+	headroom() (int64, map[string]int64, error)
+}
+
+// awsCapacityQuota looks up the quota for on-demand standard instances, and sums up the vCPUs of the
+// instances running in the region that count towards it
+type awsCapacityQuota struct {
+	quotasSvc quotasClient
+	ec2Svc    ec2Client
+}
+
+func (q *awsCapacityQuota) headroom() (int64, map[string]int64, error) {
+	out, err := q.quotasSvc.GetServiceQuota(&servicequotas.GetServiceQuotaInput{
+		ServiceCode: aws.String(quotaServiceCodeEC2),
+		QuotaCode:   aws.String(quotaCodeOnDemandStandard),
+	})
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to get quota %s: %v", quotaCodeOnDemandStandard, err)
+	}
+	if out.Quota == nil || out.Quota.Value == nil {
+		return 0, nil, fmt.Errorf("quota %s has no value", quotaCodeOnDemandStandard)
+	}
+	vcpus := map[string]int64{}
+	used := int64(0)
+	input := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("instance-state-name"), Values: aws.StringSlice([]string{ec2.InstanceStateNamePending, ec2.InstanceStateNameRunning})},
+		},
+	}
+	err = q.ec2Svc.DescribeInstancesPages(input, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, r := range page.Reservations {
+			for _, i := range r.Instances {
+				if count, ok := onDemandStandardVCPUs(i); ok {
+					vcpus[*i.InstanceId] = count
+					used += count
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to describe running instances: %v", err)
+	}
+	return int64(*out.Quota.Value) - used, vcpus, nil
+}
+
+// onDemandStandardVCPUs returns the vCPUs of an instance, and whether it counts towards the quota for
+// on-demand standard instances at all
+func onDemandStandardVCPUs(i *ec2.Instance) (int64, bool) {
+	if aws.StringValue(i.InstanceLifecycle) == ec2.InstanceLifecycleTypeSpot || i.CpuOptions == nil {
+		return 0, false
+	}
+	instanceType := aws.StringValue(i.InstanceType)
+	if instanceType == "" || !strings.ContainsRune(onDemandStandardFamilies, rune(instanceType[0])) {
+		return 0, false
+	}
+	return aws.Int64Value(i.CpuOptions.CoreCount) * aws.Int64Value(i.CpuOptions.ThreadsPerCore), true
+}
+
+// capacityCheck keeps track of the headroom under the quota in a single loop, so that ASGs surging in the
+// same loop share it
+type capacityCheck struct {
+	quota    capacityQuota
+	checked  bool
+	headroom int64
+	vcpus    map[string]int64
+}
+
+// reserve takes what surging the ASG by count instances needs from the headroom, and returns false,
+// leaving the headroom as it is, if there is not enough of it. New instances are taken to be as large as
+// the largest instance in the ASG that counts towards the quota, so an ASG without one needs none.
+func (c *capacityCheck) reserve(asg *autoscaling.Group, count int64, verbose bool) (bool, error) {
+	if !c.checked {
+		headroom, vcpus, err := c.quota.headroom()
+		if err != nil {
+			return false, err
+		}
+		c.checked, c.headroom, c.vcpus = true, headroom, vcpus
+	}
+	perInstance := int64(0)
+	for _, i := range asg.Instances {
+		if vcpus := c.vcpus[aws.StringValue(i.InstanceId)]; vcpus > perInstance {
+			perInstance = vcpus
+		}
+	}
+	needed := perInstance * count
+	if verbose {
+		log.Printf("[%v] surging by %d instances needs %d vCPUs, %d available under the quota", p2v(asg.AutoScalingGroupName), count, needed, c.headroom)
+	}
+	if needed > c.headroom {
+		return false, nil
+	}
+	c.headroom -= needed
+	return true, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+type mockCapacityQuota struct {
+	calls     int
+	available int64
+	vcpus     map[string]int64
+	err       error
+}
+
+func (m *mockCapacityQuota) headroom() (int64, map[string]int64, error) {
+	m.calls++
+	return m.available, m.vcpus, m.err
+}
+
+func TestOnDemandStandardVCPUs(t *testing.T) {
+	cpu := &ec2.CpuOptions{CoreCount: aws.Int64(2), ThreadsPerCore: aws.Int64(2)}
+	tests := []struct {
+		desc     string
+		instance *ec2.Instance
+		vcpus    int64
+		counts   bool
+	}{
+		{"standard", &ec2.Instance{InstanceType: aws.String("m5.xlarge"), CpuOptions: cpu}, 4, true},
+		{"spot", &ec2.Instance{InstanceType: aws.String("m5.xlarge"), CpuOptions: cpu, InstanceLifecycle: aws.String(ec2.InstanceLifecycleTypeSpot)}, 0, false},
+		{"other family", &ec2.Instance{InstanceType: aws.String("p3.2xlarge"), CpuOptions: cpu}, 0, false},
+		{"no cpu options", &ec2.Instance{InstanceType: aws.String("m5.xlarge")}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			vcpus, counts := onDemandStandardVCPUs(tt.instance)
+			if vcpus != tt.vcpus || counts != tt.counts {
+				t.Errorf("mismatched vCPUs, actual %d %v expected %d %v", vcpus, counts, tt.vcpus, tt.counts)
+			}
+		})
+	}
+}
+
+func TestCapacityCheckReserve(t *testing.T) {
+	quota := &mockCapacityQuota{available: 10, vcpus: map[string]int64{"1": 2, "2": 4, "3": 4}}
+	check := &capacityCheck{quota: quota}
+	asg := func(ids ...string) *autoscaling.Group {
+		instances := make([]*autoscaling.Instance, 0)
+		for _, id := range ids {
+			instances = append(instances, &autoscaling.Instance{InstanceId: aws.String(id)})
+		}
+		return &autoscaling.Group{AutoScalingGroupName: aws.String("myasg"), Instances: instances}
+	}
+	tests := []struct {
+		desc  string
+		asg   *autoscaling.Group
+		count int64
+		ok    bool
+	}{
+		{"largest instance counts", asg("1", "2"), 2, true},
+		{"not enough left", asg("3"), 1, false},
+		{"smaller instances fit", asg("1"), 1, true},
+		{"no instances under the quota", asg("4"), 5, true},
+		{"headroom used up", asg("1"), 1, false},
+	}
+	for _, tt := range tests {
+		ok, err := check.reserve(tt.asg, tt.count, false)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.desc, err)
+		}
+		if ok != tt.ok {
+			t.Errorf("%s: mismatched result, actual %v expected %v", tt.desc, ok, tt.ok)
+		}
+	}
+	if quota.calls != 1 {
+		t.Errorf("mismatched quota lookups, actual %d expected 1", quota.calls)
+	}
+}
+
+func TestAdjustCheckQuota(t *testing.T) {
+	tests := []struct {
+		desc       string
+		quota      *mockCapacityQuota
+		setDesired []int64
+		event      string
+	}{
+		{"no check", nil, []int64{3}, rollEventStarted},
+		{"enough headroom", &mockCapacityQuota{available: 4, vcpus: map[string]int64{"1": 4, "2": 4}}, []int64{3}, rollEventStarted},
+		{"insufficient headroom", &mockCapacityQuota{available: 2, vcpus: map[string]int64{"1": 4, "2": 4}}, []int64{}, rollEventDeferred},
+		{"quota error", &mockCapacityQuota{err: fmt.Errorf("throttled")}, []int64{}, rollEventFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(2),
+					MaxSize:                 aws.Int64(4),
+					LaunchConfigurationName: &lcName,
+					Instances: []*autoscaling.Instance{
+						{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+						{InstanceId: aws.String("2"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+					},
+				},
+			}}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 2}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				InitialSurge:      1,
+				MaxTerminate:      1,
+				MaxSurge:          -1,
+				MaxUnavailable:    -1,
+			}
+			var quota capacityQuota
+			if tt.quota != nil {
+				quota = tt.quota
+			}
+			notifier := &mockNotifier{}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, quota, notifier, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			setDesired := make([]int64, 0)
+			for _, c := range asgSvc.counter.filterByName("SetDesiredCapacity") {
+				setDesired = append(setDesired, *c.params[0].(*autoscaling.SetDesiredCapacityInput).DesiredCapacity)
+			}
+			if fmt.Sprint(setDesired) != fmt.Sprint(tt.setDesired) {
+				t.Errorf("mismatched desired counts, actual %v expected %v", setDesired, tt.setDesired)
+			}
+			if len(notifier.events) != 1 || notifier.events[0].kind != tt.event {
+				t.Errorf("mismatched events, actual %+v expected a single %s event", notifier.events, tt.event)
+			}
+		})
+	}
+}
@@ -3,4 +3,12 @@ package main
 type readiness interface {
 	getUnreadyCount(hostnames []string, ids []string) (int, error)
 	prepareTermination(hostnames []string, ids []string, drain, drainForce bool) error
+	// getPodCounts returns the number of pods, other than those of DaemonSets, on each instance, by ID
+	getPodCounts(hostnames []string, ids []string) (map[string]int, error)
+	// getNodeLabels returns the value of the label on the node of each instance, by ID
+	getNodeLabels(hostnames []string, ids []string, label string) (map[string]string, error)
+	// getNodeAnnotations returns the value of the annotation on the node of each instance, by ID
+	getNodeAnnotations(hostnames []string, ids []string, annotation string) (map[string]string, error)
+	// getScalingDownNodes returns the names of the nodes the cluster-autoscaler is removing
+	getScalingDownNodes() ([]string, error)
 }
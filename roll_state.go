@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+const asgTagNameRollState = "aws-asg-roller/RollState"
+
+// the most characters an ASG tag value can have
+const asgTagValueMaxLength = 256
+
+// phases of a roll of an ASG
+const (
+	// the desired count has been raised, and new instances are being waited for
+	rollPhaseSurging = "surging"
+	// old instances have been terminated, and are on their way out of the ASG
+	rollPhaseTerminating = "terminating"
+)
+
+// RollState is the in-progress state of a roll of an ASG, persisted so that a restarted roller resumes
+// the roll where it left off, rather than re-deriving it
+type RollState struct {
+	Phase   string    `json:"phase"`
+	Started time.Time `json:"started"`
+	// IDs of the instances terminated that still are in the ASG
+	Terminated []string `json:"terminated,omitempty"`
+}
+
+// equal reports if the roll state is the same as another
+func (r *RollState) equal(other *RollState) bool {
+	if r == nil || other == nil {
+		return r == other
+	}
+	if r.Phase != other.Phase || !r.Started.Equal(other.Started) || len(r.Terminated) != len(other.Terminated) {
+		return false
+	}
+	for i := range r.Terminated {
+		if r.Terminated[i] != other.Terminated[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// rollStateStore persists the roll state of ASGs
+type rollStateStore interface {
+	// loadRollState returns the roll state of the ASG, or nil if it has none
+	loadRollState(asg *autoscaling.Group) (*RollState, error)
+	saveRollState(asgName string, rollState *RollState) error
+	clearRollState(asgName string) error
+}
+
+// tagRollStateStore persists the roll state of each ASG as JSON in a tag on the ASG
+type tagRollStateStore struct {
+	asgSvc asgClient
+}
+
+func (t *tagRollStateStore) loadRollState(asg *autoscaling.Group) (*RollState, error) {
+	for _, tag := range asg.Tags {
+		if aws.StringValue(tag.Key) != asgTagNameRollState {
+			continue
+		}
+		var rollState RollState
+		if err := json.Unmarshal([]byte(aws.StringValue(tag.Value)), &rollState); err != nil {
+			return nil, fmt.Errorf("unable to read tag '%s' for ASG %s: %v", asgTagNameRollState, aws.StringValue(asg.AutoScalingGroupName), err)
+		}
+		return &rollState, nil
+	}
+	return nil, nil
+}
+
+func (t *tagRollStateStore) saveRollState(asgName string, rollState *RollState) error {
+	value, err := json.Marshal(rollState)
+	if err != nil {
+		return fmt.Errorf("unable to serialize roll state for ASG %s: %v", asgName, err)
+	}
+	if len(value) > asgTagValueMaxLength {
+		return fmt.Errorf("roll state for ASG %s of %d characters is too long for tag '%s'", asgName, len(value), asgTagNameRollState)
+	}
+	_, err = t.asgSvc.CreateOrUpdateTags(&autoscaling.CreateOrUpdateTagsInput{
+		Tags: []*autoscaling.Tag{
+			{
+				Key:               aws.String(asgTagNameRollState),
+				PropagateAtLaunch: aws.Bool(false),
+				ResourceId:        aws.String(asgName),
+				ResourceType:      aws.String("auto-scaling-group"),
+				Value:             aws.String(string(value)),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to set tag '%s' for ASG %s: %v", asgTagNameRollState, asgName, err)
+	}
+	return nil
+}
+
+func (t *tagRollStateStore) clearRollState(asgName string) error {
+	_, err := t.asgSvc.DeleteTags(&autoscaling.DeleteTagsInput{
+		Tags: []*autoscaling.Tag{
+			{
+				Key:          aws.String(asgTagNameRollState),
+				ResourceId:   aws.String(asgName),
+				ResourceType: aws.String("auto-scaling-group"),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to delete tag '%s' for ASG %s: %v", asgTagNameRollState, asgName, err)
+	}
+	return nil
+}
+
+// getRollStateStore returns the store to persist roll state in, if it is to be persisted
+func getRollStateStore(configs Configs, asgSvc asgClient) rollStateStore {
+	if !configs.PersistRollState {
+		return nil
+	}
+	return &tagRollStateStore{asgSvc: asgSvc}
+}
+
+// resumeRollStates resumes the rolls of the described ASGs that were in progress according to the store,
+// but are not known to be rolling, as when the roller has restarted part way through a roll
+func resumeRollStates(store rollStateStore, state *rollerState, descriptions []*groupDescription) {
+	for _, d := range descriptions {
+		asgName := *d.asg.AutoScalingGroupName
+		if state.isRolling(asgName) {
+			continue
+		}
+		rollState, err := store.loadRollState(d.asg)
+		if err != nil {
+			log.Printf("[%s] Unable to resume roll: %v\n", asgName, err)
+			continue
+		}
+		if rollState == nil {
+			continue
+		}
+		log.Printf("[%s] resuming roll started at %v, %s, with terminated instances %v\n", asgName, rollState.Started, rollState.Phase, rollState.Terminated)
+		state.resumeRoll(asgName, rollState)
+		state.pruneTerminated(asgName, d.asg.Instances)
+	}
+}
+
+// saveRollStates persists the roll state of each of the described ASGs when it has changed, and clears it
+// once the ASG is no longer rolling. Failing to persist it only affects how a restarted roller resumes, so
+// is logged rather than holding up the roll. In a dry run the store is left as it is.
+func saveRollStates(store rollStateStore, state *rollerState, descriptions []*groupDescription, dryRun bool) {
+	for _, d := range descriptions {
+		asgName := *d.asg.AutoScalingGroupName
+		rollState, saved := state.rollState(asgName), state.savedRollState(asgName)
+		if rollState == nil {
+			if saved == nil && !hasTag(d.asg, asgTagNameRollState) {
+				continue
+			}
+			if dryRun {
+				log.Printf("dry run: would clear roll state of ASG %s", asgName)
+				continue
+			}
+			if err := store.clearRollState(asgName); err != nil {
+				log.Printf("[%s] Unable to clear roll state: %v\n", asgName, err)
+				continue
+			}
+			state.setSavedRollState(asgName, nil)
+			continue
+		}
+		if rollState.equal(saved) {
+			continue
+		}
+		if dryRun {
+			log.Printf("dry run: would save roll state of ASG %s, %s", asgName, rollState.Phase)
+			continue
+		}
+		if err := store.saveRollState(asgName, rollState); err != nil {
+			log.Printf("[%s] Unable to save roll state: %v\n", asgName, err)
+			continue
+		}
+		state.setSavedRollState(asgName, rollState)
+	}
+}
+
+// hasTag reports if the ASG has a tag with the key
+func hasTag(asg *autoscaling.Group, key string) bool {
+	for _, tag := range asg.Tags {
+		if aws.StringValue(tag.Key) == key {
+			return true
+		}
+	}
+	return false
+}
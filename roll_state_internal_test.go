@@ -0,0 +1,175 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// rollStateTags returns the values of the roll state tags set
+func rollStateTags(asgSvc *mockAsgSvc) []string {
+	values := make([]string, 0)
+	for _, c := range asgSvc.counter.filterByName("CreateOrUpdateTags") {
+		for _, tag := range c.params[0].(*autoscaling.CreateOrUpdateTagsInput).Tags {
+			if *tag.Key == asgTagNameRollState {
+				values = append(values, *tag.Value)
+			}
+		}
+	}
+	return values
+}
+
+func TestTagRollStateStore(t *testing.T) {
+	started := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		desc      string
+		rollState *RollState
+		err       string
+	}{
+		{"surging", &RollState{Phase: rollPhaseSurging, Started: started}, ""},
+		{"terminating", &RollState{Phase: rollPhaseTerminating, Started: started, Terminated: []string{"i-0123456789abcdef0", "i-0123456789abcdef1"}}, ""},
+		{"too long", &RollState{Phase: rollPhaseTerminating, Started: started, Terminated: []string{
+			"i-0123456789abcdef0", "i-0123456789abcdef1", "i-0123456789abcdef2", "i-0123456789abcdef3", "i-0123456789abcdef4",
+			"i-0123456789abcdef5", "i-0123456789abcdef6", "i-0123456789abcdef7", "i-0123456789abcdef8", "i-0123456789abcdef9",
+		}}, "too long"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			asgSvc := &mockAsgSvc{}
+			store := &tagRollStateStore{asgSvc: asgSvc}
+			err := store.saveRollState("myasg", tt.rollState)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("mismatched error, actual %v expected %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			values := rollStateTags(asgSvc)
+			if len(values) != 1 {
+				t.Fatalf("expected 1 roll state tag set, had %d", len(values))
+			}
+			// the state read back from the tag is the state saved
+			asg := &autoscaling.Group{
+				AutoScalingGroupName: aws.String("myasg"),
+				Tags: []*autoscaling.TagDescription{
+					{Key: aws.String(asgTagNameRollState), Value: aws.String(values[0])},
+				},
+			}
+			loaded, err := store.loadRollState(asg)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !loaded.equal(tt.rollState) {
+				t.Errorf("mismatched roll state, actual %+v expected %+v", loaded, tt.rollState)
+			}
+		})
+	}
+
+	// an ASG without the tag has no roll state, and one with an invalid tag is an error
+	store := &tagRollStateStore{asgSvc: &mockAsgSvc{}}
+	if loaded, err := store.loadRollState(&autoscaling.Group{AutoScalingGroupName: aws.String("myasg")}); loaded != nil || err != nil {
+		t.Errorf("unexpected roll state %+v, error %v, without tag", loaded, err)
+	}
+	invalid := &autoscaling.Group{
+		AutoScalingGroupName: aws.String("myasg"),
+		Tags:                 []*autoscaling.TagDescription{{Key: aws.String(asgTagNameRollState), Value: aws.String("{")}},
+	}
+	if _, err := store.loadRollState(invalid); err == nil {
+		t.Errorf("expected error for invalid tag")
+	}
+}
+
+func TestAdjustPersistRollState(t *testing.T) {
+	started := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	name := "myasg"
+	lcName := "lconfig"
+	oldLcName := "oldlconfig"
+	myHealthy := healthy
+
+	// the first run terminates an old instance part way through a roll, and persists the state
+	group := &autoscaling.Group{
+		AutoScalingGroupName:    &name,
+		DesiredCapacity:         aws.Int64(3),
+		MaxSize:                 aws.Int64(3),
+		LaunchConfigurationName: &lcName,
+		Instances: []*autoscaling.Instance{
+			{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+			{InstanceId: aws.String("2"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+			{InstanceId: aws.String("new1"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+		},
+	}
+	asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{name: group}}
+	state := newRollerState()
+	state.originalDesired = map[string]int64{name: 2}
+	state.rolling[name] = started
+	configs := Configs{
+		KubernetesEnabled: kubernetesEnabled,
+		ASGS:              []string{name},
+		MaxTerminate:      1,
+		PersistRollState:  true,
+		VerifyReplacement: true,
+	}
+	if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	values := rollStateTags(asgSvc)
+	if len(values) != 1 {
+		t.Fatalf("expected 1 roll state tag set, had %d", len(values))
+	}
+	expected := `{"phase":"terminating","started":"2020-01-02T03:04:05Z","terminated":["1"]}`
+	if values[0] != expected {
+		t.Errorf("mismatched roll state, actual %s expected %s", values[0], expected)
+	}
+
+	// the roller restarts, with the terminated instance still on its way out, and resumes the roll
+	group.Tags = []*autoscaling.TagDescription{{Key: aws.String(asgTagNameRollState), Value: aws.String(values[0])}}
+	asgSvc = &mockAsgSvc{groups: map[string]*autoscaling.Group{name: group}}
+	state = newRollerState()
+	state.originalDesired = map[string]int64{name: 2}
+	if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rollState := state.rollState(name); rollState == nil || !rollState.Started.Equal(started) {
+		t.Errorf("roll not resumed from when it started, roll state %+v", rollState)
+	}
+	// the roll state is unchanged, so is not saved again
+	if values := rollStateTags(asgSvc); len(values) != 0 {
+		t.Errorf("unexpected roll state tags set %v", values)
+	}
+
+	// the terminated instance must not come back in service, even after the restart
+	group.Instances[0].LaunchConfigurationName = &lcName
+	group.Instances[0].LifecycleState = aws.String(autoscaling.LifecycleStateInService)
+	state = newRollerState()
+	state.originalDesired = map[string]int64{name: 2}
+	asgSvc = &mockAsgSvc{groups: map[string]*autoscaling.Group{name: group}}
+	if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls := asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup"); len(calls) != 0 {
+		t.Errorf("unexpected terminations of a group with a terminated instance back in service: %d", len(calls))
+	}
+
+	// once the roll is done, the roll state is cleared
+	group.DesiredCapacity = aws.Int64(2)
+	group.Instances = []*autoscaling.Instance{
+		{InstanceId: aws.String("new1"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+		{InstanceId: aws.String("new2"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+	}
+	asgSvc = &mockAsgSvc{groups: map[string]*autoscaling.Group{name: group}}
+	if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls := asgSvc.counter.filterByName("DeleteTags"); len(calls) != 1 || *calls[0].params[0].(*autoscaling.DeleteTagsInput).Tags[0].Key != asgTagNameRollState {
+		t.Errorf("expected roll state tag to be deleted")
+	}
+	if !state.takeRollCompleted() {
+		t.Errorf("expected resumed roll to complete")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RollStatus is how far along rolling an ASG is at the end of a single loop
+type RollStatus struct {
+	ASG          string `json:"asg"`
+	OldInstances int    `json:"oldInstances"`
+	NewInstances int    `json:"newInstances"`
+	// desired count of the ASG when the loop started
+	DesiredBefore int64 `json:"desiredBefore"`
+	// desired count of the ASG once the loop is done
+	Desired int64 `json:"desired"`
+	// IDs of the instances terminated in the loop
+	Terminated []string `json:"terminated"`
+	Done       bool     `json:"done"`
+	// status of the instance refresh rolling the ASG, if rolled by one
+	InstanceRefresh string `json:"instanceRefresh,omitempty"`
+	// old instances in the warm pool, if included, which are terminated in the loop
+	OldWarmPoolInstances int `json:"oldWarmPoolInstances,omitempty"`
+}
+
+// String returns a summary of the status, for logging
+func (s RollStatus) String() string {
+	progress := "rolling"
+	if s.Done {
+		progress = "done"
+	}
+	terminated := "none"
+	if len(s.Terminated) > 0 {
+		terminated = strings.Join(s.Terminated, ", ")
+	}
+	if s.InstanceRefresh != "" {
+		return fmt.Sprintf("[%s] %s: %d old instances, %d new instances, desired %d, instance refresh %s", s.ASG, progress, s.OldInstances, s.NewInstances, s.Desired, s.InstanceRefresh)
+	}
+	return fmt.Sprintf("[%s] %s: %d old instances, %d new instances, desired %d, terminated %s", s.ASG, progress, s.OldInstances, s.NewInstances, s.Desired, terminated)
+}
+
+// rollStatuses returns the status of each group described in the loop, in the same order, from the
+// desired counts set, the instances terminated and the status of the instance refreshes under way in it
+func rollStatuses(descriptions []*groupDescription, desired map[string]int64, terminated map[string][]string, refreshes map[string]string) []RollStatus {
+	statuses := make([]RollStatus, 0, len(descriptions))
+	for _, d := range descriptions {
+		name := *d.asg.AutoScalingGroupName
+		status := RollStatus{
+			ASG:           name,
+			OldInstances:  len(d.oldInstances),
+			NewInstances:  len(d.newInstances),
+			DesiredBefore: *d.asg.DesiredCapacity,
+			Desired:       *d.asg.DesiredCapacity,
+			Terminated:    []string{},
+			Done:          d.done(),
+		}
+		if count, ok := desired[name]; ok {
+			status.Desired = count
+		}
+		status.Terminated = append(status.Terminated, terminated[name]...)
+		status.InstanceRefresh = refreshes[name]
+		status.OldWarmPoolInstances = len(d.oldWarmPool)
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
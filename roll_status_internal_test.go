@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func TestRollStatuses(t *testing.T) {
+	instances := func(ids ...string) []*autoscaling.Instance {
+		list := make([]*autoscaling.Instance, 0)
+		for _, id := range ids {
+			list = append(list, &autoscaling.Instance{InstanceId: aws.String(id)})
+		}
+		return list
+	}
+	descriptions := []*groupDescription{
+		{asg: &autoscaling.Group{AutoScalingGroupName: aws.String("rolling"), DesiredCapacity: aws.Int64(3)}, oldInstances: instances("1", "2"), newInstances: instances("3"), originalDesired: 2},
+		{asg: &autoscaling.Group{AutoScalingGroupName: aws.String("done"), DesiredCapacity: aws.Int64(2)}, oldInstances: instances(), newInstances: instances("4", "5"), originalDesired: 2},
+		{asg: &autoscaling.Group{AutoScalingGroupName: aws.String("refreshing"), DesiredCapacity: aws.Int64(2)}, oldInstances: instances("6"), newInstances: instances("7"), originalDesired: 2},
+	}
+	statuses := rollStatuses(descriptions, map[string]int64{"rolling": 4}, map[string][]string{"rolling": {"1"}}, map[string]string{"refreshing": autoscaling.InstanceRefreshStatusInProgress})
+	expected := []RollStatus{
+		{ASG: "rolling", OldInstances: 2, NewInstances: 1, DesiredBefore: 3, Desired: 4, Terminated: []string{"1"}, Done: false},
+		{ASG: "done", OldInstances: 0, NewInstances: 2, DesiredBefore: 2, Desired: 2, Terminated: []string{}, Done: true},
+		{ASG: "refreshing", OldInstances: 1, NewInstances: 1, DesiredBefore: 2, Desired: 2, Terminated: []string{}, Done: false, InstanceRefresh: "InProgress"},
+	}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("mismatched statuses, actual %v expected %v", statuses, expected)
+	}
+	messages := []string{
+		"[rolling] rolling: 2 old instances, 1 new instances, desired 4, terminated 1",
+		"[done] done: 0 old instances, 2 new instances, desired 2, terminated none",
+		"[refreshing] rolling: 1 old instances, 1 new instances, desired 2, instance refresh InProgress",
+	}
+	for i, s := range statuses {
+		if s.String() != messages[i] {
+			t.Errorf("mismatched message, actual %q expected %q", s.String(), messages[i])
+		}
+	}
+}
+
+func TestAdjustStatusesPaused(t *testing.T) {
+	statuses, err := adjust(Configs{Paused: true}, &mockEc2Svc{}, &mockAsgSvc{}, nil, nil, nil, nil, nil, nil, newRollerState())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(statuses) != 0 {
+		t.Errorf("unexpected statuses while paused: %v", statuses)
+	}
+}
@@ -1,133 +1,834 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
-	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
-	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 )
 
 const (
 	healthy = "Healthy"
 )
 
-// adjust runs a single adjustment in the loop to update an ASG in a rolling fashion to latest launch config
-func adjust(kubernetesEnabled bool, asgList []string, ec2Svc ec2iface.EC2API, asgSvc autoscalingiface.AutoScalingAPI, readinessHandler readiness, originalDesired map[string]int64, storeOriginalDesiredOnTag, canIncreaseMax, verbose, drain, drainForce bool) error {
+// sleep is time.Sleep, replaced in tests
+var sleep = time.Sleep
+
+// groupDescription holds everything learned about a single ASG during the describe phase of adjust
+type groupDescription struct {
+	asg             *autoscaling.Group
+	oldInstances    []*autoscaling.Instance
+	newInstances    []*autoscaling.Instance
+	originalDesired int64
+	// IDs of new instances stuck pending for longer than the pending timeout
+	stuckPending []string
+	// IDs of new instances unhealthy for longer than the unhealthy timeout
+	stuckUnhealthy []string
+	// how long until the last of the new instances to become healthy is out of its health grace period
+	healthGrace time.Duration
+	// IDs of old instances in Standby, to be moved out of it before they are rolled
+	standby []string
+	// IDs of old instances in the warm pool, to be terminated
+	oldWarmPool []string
+}
+
+// done reports if the ASG has no outdated instances and is back at its original desired count
+func (g *groupDescription) done() bool {
+	return len(g.oldInstances) == 0 && *g.asg.DesiredCapacity == g.originalDesired
+}
+
+// groupAdjustment is the adjustment calculated for a single ASG during the act phase of adjust
+type groupAdjustment struct {
+	d            *groupDescription
+	asgConfigs   Configs
+	limits       rollLimits
+	oldInstances []*autoscaling.Instance
+	drain        bool
+	drainForce   bool
+	// how long to wait yet before terminating any more old instances
+	terminateWait time.Duration
+	// results of calculating the adjustment
+	desired   int64
+	terminate []string
+	err       error
+}
+
+// adjust runs a single adjustment in the loop to update an ASG in a rolling fashion to latest launch config.
+// It runs in two phases: a describe phase, which learns everything about all of the ASGs without changing
+// anything, and an act phase, which decides on and applies the changes. Because every ASG is described
+// before any action is taken, decisions can be made with full visibility across all of the groups.
+func adjust(configs Configs, ec2Svc ec2Client, asgSvc asgClient, ssmSvc ssmClient, store stateStore, readinessHandler readiness, lbHealth loadBalancerHealth, quota capacityQuota, notifier rollNotifier, state *rollerState) ([]RollStatus, error) {
+	return adjustContext(context.Background(), configs, ec2Svc, asgSvc, ssmSvc, store, readinessHandler, lbHealth, quota, notifier, state)
+}
+
+// adjustWithTimeout adjusts the groups, but gives up waiting once the timeout has passed, so that a loop
+// does not run far longer than the interval. Work still in flight is cancelled: it makes no further
+// changes to the groups once it notices, e.g. once a slow drain returns. Until then, later loops are
+// skipped rather than run alongside it, and the loop after it finishes starts afresh.
+func adjustWithTimeout(timeout time.Duration, configs Configs, ec2Svc ec2Client, asgSvc asgClient, ssmSvc ssmClient, store stateStore, readinessHandler readiness, lbHealth loadBalancerHealth, quota capacityQuota, notifier rollNotifier, state *rollerState) ([]RollStatus, error) {
+	if !state.startAdjust() {
+		return nil, fmt.Errorf("a cancelled adjustment of ASGs is still finishing, skipping")
+	}
+	if timeout <= 0 {
+		defer state.finishAdjust()
+		return adjust(configs, ec2Svc, asgSvc, ssmSvc, store, readinessHandler, lbHealth, quota, notifier, state)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	type result struct {
+		statuses []RollStatus
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		// the adjustment is over only once it returns, even if no longer waited for
+		defer state.finishAdjust()
+		statuses, err := adjustContext(ctx, configs, ec2Svc, asgSvc, ssmSvc, store, readinessHandler, lbHealth, quota, notifier, state)
+		done <- result{statuses, err}
+	}()
+	select {
+	case r := <-done:
+		return r.statuses, r.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("adjusting ASGs did not complete within %v, cancelled", timeout)
+	}
+}
+
+func adjustContext(ctx context.Context, configs Configs, ec2Svc ec2Client, asgSvc asgClient, ssmSvc ssmClient, store stateStore, readinessHandler readiness, lbHealth loadBalancerHealth, quota capacityQuota, notifier rollNotifier, state *rollerState) ([]RollStatus, error) {
+	start := time.Now()
+	defer func() {
+		metrics.setLoopDuration(time.Since(start))
+	}()
+	if configs.Paused {
+		log.Printf("rolling updates are paused, skipping")
+		return nil, nil
+	}
+	if configs.KubernetesEnabled && readinessHandler == nil {
+		log.Printf("WARNING: kubernetes is enabled, but there is no connection to it, so nodes are checked only for EC2 health, and are not drained")
+	}
+	wasRolling := state.anyRolling()
+	descriptions, hostnameMap, err := describeGroups(configs, ec2Svc, asgSvc, ssmSvc, store, state)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range descriptions {
+		metrics.setGroup(*d.asg.AutoScalingGroupName, len(d.oldInstances), len(d.newInstances), *d.asg.DesiredCapacity)
+	}
+	// pick up rolls left part way through by a previous run, and persist how far they get
+	if store := getRollStateStore(configs, asgSvc); store != nil {
+		resumeRollStates(store, state, descriptions)
+		wasRolling = wasRolling || state.anyRolling()
+		defer saveRollStates(store, state, descriptions, configs.DryRun)
+	}
+	statuses, err := actOnGroups(ctx, configs, descriptions, hostnameMap, ec2Svc, asgSvc, readinessHandler, lbHealth, quota, notifier, state)
+	if err != nil {
+		return statuses, err
+	}
+	// the roll is complete once no ASG is rolling any more
+	if wasRolling && !state.anyRolling() {
+		log.Printf("all ASGs are up to date, roll complete")
+		state.setRollCompleted()
+	}
+	return statuses, nil
+}
+
+// describeGroups is the describe phase of adjust. It gets information on all of the groups, their original
+// desired values, which of their instances are old and new, and the hostnames of the instances in groups
+// that need updates. Up to configs.DescribeConcurrency groups have their instances grouped at the same time.
+// returns:
+//   a description of each group, in the order returned by AWS
+//   map of instance ID to hostname for every instance in a group that needs updates
+//   error
+func describeGroups(configs Configs, ec2Svc ec2Client, asgSvc asgClient, ssmSvc ssmClient, store stateStore, state *rollerState) ([]*groupDescription, map[string]string, error) {
+	verbose := configs.Verbose
 	// get information on all of the groups
-	asgs, err := awsDescribeGroups(asgSvc, asgList)
+	asgs, err := describeConfiguredGroups(asgSvc, configs)
 	if err != nil {
-		return fmt.Errorf("Unexpected error describing ASGs, skipping: %v", err)
+		return nil, nil, fmt.Errorf("Unexpected error describing ASGs, skipping: %v", err)
+	}
+	// AWS silently leaves out any groups that do not exist
+	if missing := missingGroups(configs.ASGS, asgs); len(missing) > 0 {
+		for _, name := range missing {
+			log.Printf("[%s] WARNING: configured ASG was not found, it may have been deleted\n", name)
+		}
+		if configs.MissingASGError {
+			return nil, nil, fmt.Errorf("configured ASGs not found, skipping: %v", missing)
+		}
 	}
 
 	// look up and record original desired values
-	err = populateOriginalDesired(originalDesired, asgs, asgSvc, storeOriginalDesiredOnTag, verbose)
+	if store == nil {
+		store = &tagStateStore{asgSvc: asgSvc, batchSize: configs.TagBatchSize}
+	}
+	err = populateOriginalDesired(state, asgs, store, configs)
 	if err != nil {
-		return fmt.Errorf("unexpected error looking up original desired values for ASGs, skipping: %v", err)
+		return nil, nil, fmt.Errorf("unexpected error looking up original desired values for ASGs, skipping: %v", err)
 	}
 
-	asgMap := map[string]*autoscaling.Group{}
-	// get information on all of the ec2 instances
-	instances := make([]*autoscaling.Instance, 0)
-	for _, asg := range asgs {
-		oldInstances, newInstances, err := groupInstances(asg, ec2Svc, verbose)
+	// ASGs often share launch templates, so describe each only once
+	templates := newLaunchTemplateCache()
+	if configs.TemplateConcurrency > 0 {
+		templates.prefetch(ec2Svc, asgs, configs.TemplateConcurrency)
+	}
+	descriptions := make([]*groupDescription, len(asgs))
+	err = runConcurrently(len(asgs), configs.DescribeConcurrency, func(i int) error {
+		asg := asgs[i]
+		oldInstances, newInstances, err := groupInstances(asg, ec2Svc, asgSvc, templates, configs.CompareLaunchConfigs, configs.SkipWithoutLaunch, configs.MissingLTVersions, verbose)
+		if _, ok := err.(*missingTemplateVersionsError); ok {
+			// leave just this group alone, rather than all of them
+			log.Printf("[%v] WARNING: %v, skipping\n", p2v(asg.AutoScalingGroupName), err)
+			return nil
+		}
+		if _, ok := err.(*noLaunchSpecError); ok {
+			log.Printf("WARNING: %v, skipping\n", err)
+			return nil
+		}
 		if err != nil {
 			return fmt.Errorf("unable to group instances into new and old: %v", err)
 		}
-		// if there are no outdated instances skip updating
-		if len(oldInstances) == 0 && *asg.DesiredCapacity == originalDesired[*asg.AutoScalingGroupName] {
-			log.Printf("[%s] ok\n", *asg.AutoScalingGroupName)
-			err := ensureNoScaleDownDisabledAnnotation(kubernetesEnabled, ec2Svc, mapInstancesIds(asg.Instances))
+		if configs.RequireIMDSv2 {
+			if oldInstances, newInstances, err = requireIMDSv2(asg, oldInstances, newInstances, ec2Svc, verbose); err != nil {
+				return fmt.Errorf("unable to group instances into new and old: %v", err)
+			}
+		}
+		if configs.CompareAMI {
+			if oldInstances, newInstances, err = requireTemplateImage(asg, oldInstances, newInstances, ec2Svc, ssmSvc, verbose); err != nil {
+				return fmt.Errorf("unable to group instances into new and old: %v", err)
+			}
+		}
+		// instances in Standby are left alone by the ASG, and so by the roller, unless they are to be included
+		active, standby := splitStandby(oldInstances)
+		if !configs.IncludeStandby {
+			for _, i := range standby {
+				log.Printf("[%v] WARNING: skipping old instance %v because it is in standby\n", p2v(asg.AutoScalingGroupName), p2v(i.InstanceId))
+			}
+			oldInstances = active
+		}
+		original, _ := state.getOriginalDesired(*asg.AutoScalingGroupName)
+		descriptions[i] = &groupDescription{
+			asg:             asg,
+			oldInstances:    oldInstances,
+			newInstances:    newInstances,
+			originalDesired: original,
+		}
+		if configs.IncludeStandby {
+			descriptions[i].standby = mapInstancesIds(standby)
+		}
+		if configs.IncludeWarmPool {
+			oldWarmPool, err := groupWarmPool(asg, ec2Svc, asgSvc, templates, configs)
 			if err != nil {
-				log.Printf("[%s] Unable to update node annotations: %v\n", *asg.AutoScalingGroupName, err)
+				return err
 			}
-			continue
+			descriptions[i].oldWarmPool = mapInstancesIds(oldWarmPool)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	descriptions = skipUndescribed(descriptions)
 
-		log.Printf("[%s] need updates: %d\n", *asg.AutoScalingGroupName, len(oldInstances))
+	// keep track of which groups are steady, and pick up changes to desired made while they are. Without a
+	// stored value, the original desired of a steady group follows its current desired, as it would be
+	// guessed afresh, whereas a stored value is kept unless set to be refreshed.
+	for _, d := range descriptions {
+		name := *d.asg.AutoScalingGroupName
+		storeOriginalDesiredOnTag := storesOriginalDesired(groupConfigs(configs, name))
+		state.pruneTerminated(name, d.asg.Instances)
+		switch {
+		case len(d.oldInstances) > 0:
+			state.setSteady(name, false)
+		case *d.asg.DesiredCapacity == d.originalDesired:
+			state.setSteady(name, true)
+		case (configs.RefreshOriginalDesired || !storeOriginalDesiredOnTag) && state.isSteady(name):
+			err := updateOriginalDesired(state, d.asg, store, storeOriginalDesiredOnTag, configs.DryRun, verbose)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unexpected error updating original desired value for ASG %s, skipping: %v", name, err)
+			}
+			d.originalDesired = *d.asg.DesiredCapacity
+		}
+	}
 
-		asgMap[*asg.AutoScalingGroupName] = asg
-		instances = append(instances, oldInstances...)
-		instances = append(instances, newInstances...)
+	// get information on all of the ec2 instances in groups that need updates
+	instances := make([]*autoscaling.Instance, 0)
+	for _, d := range descriptions {
+		if d.done() {
+			continue
+		}
+		instances = append(instances, d.oldInstances...)
+		instances = append(instances, d.newInstances...)
 	}
+	hostnameMap := map[string]string{}
 	// no instances no work needed
 	if len(instances) == 0 {
-		return nil
+		return descriptions, hostnameMap, nil
 	}
 	ids := mapInstancesIds(instances)
-	hostnames, err := awsGetHostnames(ec2Svc, ids)
+	described, err := awsDescribeInstances(ec2Svc, ids, configs.LookupConcurrency)
 	if err != nil {
-		return fmt.Errorf("unable to get aws hostnames for ids %v: %v", ids, err)
+		return nil, nil, fmt.Errorf("unable to get aws hostnames for ids %v: %v", ids, err)
 	}
-	hostnameMap := map[string]string{}
-	for i, id := range ids {
-		hostnameMap[id] = hostnames[i]
+	// put the old instances in the order they are to be terminated, leaving out any pinned by tag
+	for _, d := range descriptions {
+		d.oldInstances = skipTagged(d.asg, d.oldInstances, described, configs.SkipTag)
+		d.oldInstances = orderForTermination(d.oldInstances, described, configs.TerminateOrder)
+		if configs.TerminateSpotFirst {
+			d.oldInstances = spotFirst(d.oldInstances, described)
+		}
+		if configs.PendingTimeout > 0 {
+			d.stuckPending = stuckPending(d.newInstances, described, configs.PendingTimeout, time.Now())
+		}
+		if configs.UnhealthyTimeout > 0 {
+			d.stuckUnhealthy = state.stuckUnhealthy(*d.asg.AutoScalingGroupName, d.newInstances, configs.UnhealthyTimeout)
+		}
+		if configs.HealthGracePeriod > 0 {
+			d.healthGrace = state.healthGraceRemaining(*d.asg.AutoScalingGroupName, d.newInstances, configs.HealthGracePeriod)
+		}
 	}
+	return descriptions, instanceHostnames(described, configs.NodeNameTag), nil
+}
+
+// actOnGroups is the act phase of adjust. It calculates the adjustment for each group from its description,
+// then applies the new desired counts and terminates nodes.
+func actOnGroups(ctx context.Context, configs Configs, descriptions []*groupDescription, hostnameMap map[string]string, ec2Svc ec2Client, asgSvc asgClient, readinessHandler readiness, lbHealth loadBalancerHealth, quota capacityQuota, notifier rollNotifier, state *rollerState) (statuses []RollStatus, err error) {
+	asgMap := map[string]*autoscaling.Group{}
+	descriptionMap := map[string]*groupDescription{}
 	newDesired := map[string]int64{}
-	newTerminate := map[string]string{}
+	newTerminate := map[string][]string{}
+	// whether any of the nodes to terminate are drained first
+	drained := false
+	// report how far each group got, however far the loop gets
+	setDesired := map[string]int64{}
+	terminated := map[string][]string{}
+	refreshes := map[string]string{}
+	defer func() {
+		statuses = rollStatuses(descriptions, setDesired, terminated, refreshes)
+	}()
+
+	// groups already part way through a roll hold a slot until they are done; other groups that need
+	// updates wait for a free slot
+	rolling := 0
+	adjustments := make([]*groupAdjustment, 0)
+	for _, d := range descriptions {
+		name := *d.asg.AutoScalingGroupName
+		descriptionMap[name] = d
+		wasRolling := state.isRolling(name)
+		switch {
+		case d.done():
+			state.setRolling(name, false)
+			if wasRolling {
+				notifyRoll(notifier, rollEvent{kind: rollEventFinished, asg: name, oldInstances: len(d.oldInstances), newInstances: len(d.newInstances)})
+			}
+			if wasRolling && configs.PostRollCooldown > 0 {
+				if err := recordRollFinished(state, d.asg, asgSvc, configs.DryRun, configs.Verbose); err != nil {
+					log.Printf("[%s] Unable to record roll finished: %v\n", name, err)
+				}
+			}
+		case wasRolling || *d.asg.DesiredCapacity != d.originalDesired:
+			state.setRolling(name, true)
+			rolling++
+			if !wasRolling {
+				notifyRoll(notifier, rollEvent{kind: rollEventStarted, asg: name, oldInstances: len(d.oldInstances), newInstances: len(d.newInstances)})
+			}
+		}
+	}
 
-	// keep keyed references to the ASGs
-	for _, asg := range asgMap {
-		newDesiredA, terminateID, err := calculateAdjustment(kubernetesEnabled, asg, ec2Svc, hostnameMap, readinessHandler, originalDesired[*asg.AutoScalingGroupName], verbose, drain, drainForce)
-		log.Printf("[%v] desired: %d original: %d", p2v(asg.AutoScalingGroupName), newDesiredA, originalDesired[*asg.AutoScalingGroupName])
+	// drains per node pool are capped across all of the groups
+	var pools *nodePoolDrains
+	if configs.NodePoolLabel != "" && configs.MaxDrainsPerPool > 0 {
+		pools = newNodePoolDrains(configs.NodePoolLabel, configs.MaxDrainsPerPool)
+	}
+	// so is the headroom under the quota for instances
+	var capacity *capacityCheck
+	if quota != nil {
+		capacity = &capacityCheck{quota: quota}
+	}
+
+	for _, d := range descriptions {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("cancelled before acting on all groups: %v", err)
+		}
+		asg := d.asg
+		// old instances in the warm pool are not in service, so are replaced straight away, whether or not
+		// those in service need updates
+		if len(d.oldWarmPool) > 0 {
+			if err := terminateWarmPool(ec2Svc, asg, d.oldWarmPool, configs.DryRun); err != nil {
+				log.Printf("[%s] error terminating old warm pool instances: %v\n", *asg.AutoScalingGroupName, err)
+				notifyFailed(notifier, d, err)
+			}
+		}
+		// if there are no outdated instances skip updating
+		if d.done() {
+			log.Printf("[%s] ok\n", *asg.AutoScalingGroupName)
+			err := ensureNoScaleDownDisabledAnnotation(configs.KubernetesEnabled, ec2Svc, mapInstancesIds(asg.Instances), configs.NodeNameTag, configs.DryRun)
+			if err != nil {
+				log.Printf("[%s] Unable to update node annotations: %v\n", *asg.AutoScalingGroupName, err)
+			}
+			if configs.RestoreMax {
+				if err := restoreOriginalMax(state, asg, asgSvc, configs.DryRun, configs.Verbose); err != nil {
+					log.Printf("[%s] Unable to restore max size: %v\n", *asg.AutoScalingGroupName, err)
+				}
+			}
+			if err := restoreTerminationPolicies(asgSvc, asg, configs.DryRun, configs.Verbose); err != nil {
+				log.Printf("[%s] Unable to restore termination policies: %v\n", *asg.AutoScalingGroupName, err)
+			}
+			continue
+		}
+
+		log.Printf("[%s] need updates: %d\n", *asg.AutoScalingGroupName, len(d.oldInstances))
+		asgMap[*asg.AutoScalingGroupName] = asg
+
+		// leave the roll to the ASG's own instance refresh instead, if so configured; the ASG is done, as with
+		// a roll of its own, once it has no old instances left
+		if configs.InstanceRefresh {
+			name := *asg.AutoScalingGroupName
+			if !state.isRolling(name) {
+				if configs.MaxRollingASGs > 0 && rolling >= configs.MaxRollingASGs {
+					log.Printf("[%s] waiting to start, %d ASGs already rolling\n", name, rolling)
+					continue
+				}
+				state.setRolling(name, true)
+				rolling++
+				notifyRoll(notifier, rollEvent{kind: rollEventStarted, asg: name, oldInstances: len(d.oldInstances), newInstances: len(d.newInstances)})
+			}
+			status, err := refreshInstances(asgSvc, asg, configs.RefreshMinHealthy, configs.DryRun)
+			if err != nil {
+				log.Printf("[%s] error refreshing instances: %v\n", name, err)
+				notifyFailed(notifier, d, err)
+			}
+			refreshes[name] = status
+			continue
+		}
+
+		// an instance we terminated should never come back in service, rather than being replaced by a new one.
+		// It keeps whatever launch configuration or template it had, so may be among the old instances.
+		if configs.VerifyReplacement {
+			if reused := state.reusedTerminated(*asg.AutoScalingGroupName, asg.Instances); len(reused) > 0 {
+				log.Printf("[%s] ERROR: terminated instances %v are in service again instead of being replaced by new instances - skipping\n", *asg.AutoScalingGroupName, reused)
+				notifyFailed(notifier, d, fmt.Errorf("terminated instances %v are in service again", reused))
+				continue
+			}
+		}
+
+		// every terminated instance should be replaced by a new instance in the same ASG, not elsewhere
+		if configs.ReplacementTimeout > 0 {
+			if missing, overdue := state.checkReplacements(*asg.AutoScalingGroupName, asg.Instances, configs.ReplacementTimeout); overdue {
+				log.Printf("[%s] ERROR: %d terminated instances were not replaced by new instances in the ASG within %v - skipping\n", *asg.AutoScalingGroupName, missing, configs.ReplacementTimeout)
+				notifyFailed(notifier, d, fmt.Errorf("%d terminated instances were not replaced within %v", missing, configs.ReplacementTimeout))
+				continue
+			}
+		}
+
+		// old instances in Standby are rolled once they are in service again
+		if len(d.standby) > 0 {
+			log.Printf("[%s] moving old instances %v out of standby - skipping until they are in service\n", *asg.AutoScalingGroupName, d.standby)
+			if err := awsExitStandby(asgSvc, asg, d.standby, configs.DryRun); err != nil {
+				log.Printf("[%s] error moving instances out of standby: %v\n", *asg.AutoScalingGroupName, err)
+				notifyFailed(notifier, d, err)
+			}
+			continue
+		}
+
+		// old instances held by a termination lifecycle hook are waited for until they leave the ASG, and
+		// optionally let go of
+		if configs.CompleteLifecycleHooks {
+			if waiting := waitingInstances(d.oldInstances); len(waiting) > 0 {
+				log.Printf("[%s] completing termination lifecycle hooks for instances %v\n", *asg.AutoScalingGroupName, waiting)
+				if err := awsCompleteLifecycleHooks(asgSvc, asg, waiting, configs.DryRun); err != nil {
+					log.Printf("[%s] error completing lifecycle hooks - skipping: %v\n", *asg.AutoScalingGroupName, err)
+					notifyFailed(notifier, d, err)
+					continue
+				}
+			}
+		}
+
+		// a new instance that never leaves pending would otherwise stall the roll forever
+		if len(d.stuckPending) > 0 && backOutStuckPending(asgSvc, notifier, d, configs.PendingTimeout, configs.DryRun) {
+			continue
+		}
+		// as would a new instance that never becomes healthy
+		if len(d.stuckUnhealthy) > 0 && backOutStuckUnhealthy(asgSvc, notifier, d, configs.UnhealthyTimeout, configs.DryRun) {
+			continue
+		}
+
+		// changing a group while a scaling activity is in progress contends with it, so wait for it to be quiet.
+		// This comes after the steps above, which only help activities finish.
+		if configs.SkipDuringActivities {
+			activities, err := awsInProgressActivities(asgSvc, *asg.AutoScalingGroupName)
+			if err != nil {
+				log.Printf("[%s] error checking scaling activities - skipping: %v\n", *asg.AutoScalingGroupName, err)
+				notifyFailed(notifier, d, err)
+				continue
+			}
+			if len(activities) > 0 {
+				log.Printf("[%s] waiting, %d scaling activities in progress: %s\n", *asg.AutoScalingGroupName, len(activities), strings.Join(activities, "; "))
+				continue
+			}
+		}
+
+		// a group scaled to zero may have old instances left that are on their way out anyway, and rolling
+		// them would surge it to an instance it is not meant to have
+		if d.originalDesired == 0 && configs.SkipZeroDesired && !state.isRolling(*asg.AutoScalingGroupName) {
+			log.Printf("[%s] original desired is 0, not rolling %d old instances\n", *asg.AutoScalingGroupName, len(d.oldInstances))
+			continue
+		}
+
+		if !state.isRolling(*asg.AutoScalingGroupName) {
+			// batch up changes that come in quick succession, rather than rolling again for each of them
+			remaining, err := cooldownRemaining(state, asg, configs.PostRollCooldown, time.Now())
+			if err != nil {
+				log.Printf("[%s] error checking post-roll cooldown - skipping: %v\n", *asg.AutoScalingGroupName, err)
+				notifyFailed(notifier, d, err)
+				continue
+			}
+			if remaining > 0 {
+				log.Printf("[%s] waiting to start, post-roll cooldown has %v remaining\n", *asg.AutoScalingGroupName, remaining.Round(time.Second))
+				continue
+			}
+		}
+
+		if !state.isRolling(*asg.AutoScalingGroupName) && configs.MaxRollingASGs > 0 && rolling >= configs.MaxRollingASGs {
+			log.Printf("[%s] waiting to start, %d ASGs already rolling\n", *asg.AutoScalingGroupName, rolling)
+			continue
+		}
+
+		if configs.RestoreMax {
+			if err := recordOriginalMax(state, asg, asgSvc, configs.DryRun, configs.Verbose); err != nil {
+				log.Printf("[%v] error recording original max size - skipping: %v\n", p2v(asg.AutoScalingGroupName), err)
+				notifyFailed(notifier, d, err)
+				continue
+			}
+		}
+		// settings that can be overridden for the group
+		asgConfigs := groupConfigs(configs, *asg.AutoScalingGroupName)
+		if len(asgConfigs.TerminationPolicies) > 0 {
+			if err := applyTerminationPolicies(asgSvc, asg, asgConfigs.TerminationPolicies, configs.DryRun, configs.Verbose); err != nil {
+				log.Printf("[%v] error setting termination policies - skipping: %v\n", p2v(asg.AutoScalingGroupName), err)
+				notifyFailed(notifier, d, err)
+				continue
+			}
+		}
+		if err := normalizeMaxSize(asgSvc, asg, d.originalDesired, asgConfigs.IncreaseMax, configs.DryRun, configs.Verbose); err != nil {
+			log.Printf("[%v] ERROR: unable to roll - skipping: %v\n", p2v(asg.AutoScalingGroupName), err)
+			notifyFailed(notifier, d, err)
+			continue
+		}
+		limits, err := getRollLimits(asg, asgConfigs, d.originalDesired)
+		if err != nil {
+			log.Printf("[%v] error getting roll limits - skipping: %v\n", p2v(asg.AutoScalingGroupName), err)
+			notifyFailed(notifier, d, err)
+			continue
+		}
+		if state.isMaxAtLimit(*asg.AutoScalingGroupName) {
+			limits = replaceInPlace(asg, limits)
+			asgConfigs.IncreaseMax = false
+		}
+		// nodes that repeatedly failed to drain may be escalated
+		oldInstances, drain, drainForce := d.oldInstances, asgConfigs.Drain, configs.DrainForce
+		if configs.DrainFailureLimit > 0 {
+			var ok bool
+			if oldInstances, drain, drainForce, ok = escalateDrainFailures(state, asg, oldInstances, drain, drainForce, configs.DrainFailureLimit, configs.DrainFailureAction); !ok {
+				continue
+			}
+		}
+		if !state.isRolling(*asg.AutoScalingGroupName) {
+			// the group holds a slot from now on, so that groups calculated at the same time do not
+			// start more rolls than allowed
+			rolling++
+		}
+		terminateWait := state.terminateCooldownRemaining(*asg.AutoScalingGroupName, configs.TerminateCooldown)
+		if d.healthGrace > terminateWait {
+			terminateWait = d.healthGrace
+		}
+		adjustments = append(adjustments, &groupAdjustment{d: d, asgConfigs: asgConfigs, limits: limits, oldInstances: oldInstances, drain: drain, drainForce: drainForce, terminateWait: terminateWait})
+	}
+
+	// the cluster-autoscaler removing nodes at the same time as the roller terminates others could shrink the
+	// cluster too far, so hold off until it is done
+	if configs.WaitForAutoscaler && readinessHandler != nil && len(adjustments) > 0 {
+		scalingDown, err := readinessHandler.getScalingDownNodes()
 		if err != nil {
+			return nil, fmt.Errorf("unable to check for nodes the cluster-autoscaler is removing: %v", err)
+		}
+		if len(scalingDown) > 0 {
+			log.Printf("cluster-autoscaler is removing nodes %v - deferring %d ASGs\n", scalingDown, len(adjustments))
+			for _, a := range adjustments {
+				notifyRoll(notifier, rollEvent{kind: rollEventDeferred, asg: *a.d.asg.AutoScalingGroupName, oldInstances: len(a.d.oldInstances), newInstances: len(a.d.newInstances), err: fmt.Errorf("cluster-autoscaler is removing nodes %v", scalingDown)})
+			}
+			return nil, nil
+		}
+	}
+
+	// calculate the adjustments of up to configs.Concurrency groups at the same time, as draining nodes
+	// can take a while. An error in one group does not stop the others.
+	_ = runConcurrently(len(adjustments), configs.Concurrency, func(i int) error {
+		a := adjustments[i]
+		if err := ctx.Err(); err != nil {
+			a.err = fmt.Errorf("cancelled before calculating adjustment: %v", err)
+			return nil
+		}
+		if a.asgConfigs.NodeWeightAnnotation != "" && readinessHandler != nil && len(a.oldInstances) > 0 {
+			// terminate the old nodes operators gave the lowest weight first
+			ids := mapInstancesIds(a.oldInstances)
+			hostnames := make([]string, 0)
+			for _, id := range ids {
+				hostnames = append(hostnames, hostnameMap[id])
+			}
+			weights, err := readinessHandler.getNodeAnnotations(hostnames, ids, a.asgConfigs.NodeWeightAnnotation)
+			if err != nil {
+				a.err = fmt.Errorf("error getting termination weights of old nodes: %v", err)
+				return nil
+			}
+			a.oldInstances = orderByNodeWeight(*a.d.asg.AutoScalingGroupName, a.oldInstances, weights)
+		}
+		a.desired, a.terminate, a.err = calculateAdjustment(configs.KubernetesEnabled, a.d.asg, a.oldInstances, a.d.newInstances, hostnameMap, readinessHandler, lbHealth, pools, a.d.originalDesired, a.asgConfigs.MaxTerminate, a.limits, a.terminateWait, a.asgConfigs.IncreaseMax, configs.OrderByPodCount, configs.DryRun, configs.Verbose, a.drain && !configs.DryRun, a.drainForce)
+		return nil
+	})
+
+	for _, a := range adjustments {
+		d, asg, newDesiredA, terminateIDs, err := a.d, a.d.asg, a.desired, a.terminate, a.err
+		log.Printf("[%v] desired: %d original: %d", p2v(asg.AutoScalingGroupName), newDesiredA, d.originalDesired)
+		if err != nil {
+			if id, ok := drainFailedInstance(err); ok {
+				// the node may be drained on a later loop, once whatever holds it up is resolved
+				failures := state.addDrainFailure(*asg.AutoScalingGroupName, id)
+				log.Printf("ERROR: %v - skipping, %d failures to drain %s\n", err, failures, id)
+				notifyFailed(notifier, d, err)
+				continue
+			}
 			log.Printf("[%v] error calculating adjustment - skipping: %v\n", p2v(asg.AutoScalingGroupName), err)
+			notifyFailed(notifier, d, err)
 			continue
 		}
+		// surging into the quota would leave new instances that can never launch, so wait for headroom
+		if capacity != nil && newDesiredA > *asg.DesiredCapacity {
+			ok, err := capacity.reserve(asg, newDesiredA-*asg.DesiredCapacity, configs.Verbose)
+			if err != nil {
+				log.Printf("[%v] error checking instance quota - skipping: %v\n", p2v(asg.AutoScalingGroupName), err)
+				notifyFailed(notifier, d, err)
+				continue
+			}
+			if !ok {
+				log.Printf("[%v] not enough headroom under the instance quota to surge to %d - deferring\n", p2v(asg.AutoScalingGroupName), newDesiredA)
+				notifyRoll(notifier, rollEvent{kind: rollEventDeferred, asg: *asg.AutoScalingGroupName, oldInstances: len(d.oldInstances), newInstances: len(d.newInstances), err: fmt.Errorf("not enough headroom under the instance quota to surge to %d", newDesiredA)})
+				continue
+			}
+		}
+		if !state.isRolling(*asg.AutoScalingGroupName) {
+			state.setRolling(*asg.AutoScalingGroupName, true)
+			notifyRoll(notifier, rollEvent{kind: rollEventStarted, asg: *asg.AutoScalingGroupName, oldInstances: len(d.oldInstances), newInstances: len(d.newInstances)})
+		}
 		if newDesiredA != *asg.DesiredCapacity {
 			newDesired[*asg.AutoScalingGroupName] = newDesiredA
 		}
-		if terminateID != "" {
-			log.Printf("[%v] scheduled termination: %s", asg.AutoScalingGroupName, terminateID)
-			newTerminate[*asg.AutoScalingGroupName] = terminateID
+		// an instance terminated on an earlier loop may still show up while on its way out
+		if configs.TerminateDedupWindow > 0 && len(terminateIDs) > 0 {
+			var recent []string
+			recent, terminateIDs = state.recentlyTerminated(terminateIDs, configs.TerminateDedupWindow)
+			if len(recent) > 0 {
+				log.Printf("[%v] not terminating instances %v again, terminated within the last %v", p2v(asg.AutoScalingGroupName), recent, configs.TerminateDedupWindow)
+			}
+		}
+		if len(terminateIDs) > 0 {
+			log.Printf("[%v] scheduled termination: %v", p2v(asg.AutoScalingGroupName), terminateIDs)
+			newTerminate[*asg.AutoScalingGroupName] = terminateIDs
+			drained = drained || a.drain
+		}
+	}
+	if configs.LogPlan {
+		for _, d := range descriptions {
+			name := *d.asg.AutoScalingGroupName
+			if _, ok := asgMap[name]; !ok {
+				continue
+			}
+			desired, ok := newDesired[name]
+			if !ok {
+				desired = *d.asg.DesiredCapacity
+			}
+			log.Printf("[%s] plan: %s\n", name, rollPlan(*d.asg.DesiredCapacity, desired, d.originalDesired, newTerminate[name]))
+		}
+	}
+	// apply none of the plan unless all of it can be applied
+	if configs.ValidatePlan && !configs.DryRun {
+		if err := validatePlan(configs, asgMap, newDesired, newTerminate, ec2Svc); err != nil {
+			return nil, fmt.Errorf("invalid plan, not acting on any ASG: %v", err)
 		}
 	}
 	// adjust current desired
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("cancelled before setting desired counts: %v", err)
+	}
 	for asg, desired := range newDesired {
 		log.Printf("[%s] set desired instances: %d\n", asg, desired)
-		err = setAsgDesired(asgSvc, asgMap[asg], desired, canIncreaseMax, verbose)
+		err := setAsgDesired(asgSvc, asgMap[asg], desired, groupConfigs(configs, asg).IncreaseMax, configs.DryRun, configs.Verbose)
+		if isMaxSizeLimit(err) && configs.MaxLimitAction == maxLimitActionReplace {
+			// roll the group without surging from the next loop on
+			log.Printf("[%s] WARNING: %v - replacing instances in place instead\n", asg, err)
+			state.setMaxAtLimit(asg)
+			continue
+		}
 		if err != nil {
-			return fmt.Errorf("[%s] error setting desired to %d: %v", asg, desired, err)
+			notifyFailed(notifier, descriptionMap[asg], err)
+			return nil, fmt.Errorf("[%s] error setting desired to %d: %v", asg, desired, err)
+		}
+		if !configs.DryRun {
+			setDesired[asg] = desired
 		}
 	}
 	// terminate nodes
-	for asg, id := range newTerminate {
-		log.Printf("[%s] terminating node: %s\n", asg, id)
-		// all new config instances are ready, terminate an old one
-		err = awsTerminateNode(asgSvc, id)
+	ids := make([]string, 0)
+	for _, d := range descriptions {
+		ids = append(ids, newTerminate[*d.asg.AutoScalingGroupName]...)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	if configs.DryRun && configs.TerminateViaEC2 {
+		log.Printf("dry run: would terminate instances %v\n", ids)
+		return nil, nil
+	}
+	// let things settle, e.g. connections drain at the load balancer, after pods have left the nodes
+	if configs.PostDrainSleep > 0 && readinessHandler != nil && drained && !configs.DryRun {
+		log.Printf("sleeping %v after draining nodes before terminating them\n", configs.PostDrainSleep)
+		sleep(configs.PostDrainSleep)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("cancelled before terminating nodes: %v", err)
+	}
+	if configs.TagTerminated && !configs.DryRun {
+		// the tag only helps trace the termination, so failing to set it should not hold up the roll
+		if err := awsTagTerminated(ec2Svc, ids, time.Now()); err != nil {
+			log.Printf("Unable to tag nodes %v before terminating: %v\n", ids, err)
+		}
+	}
+	if configs.TerminateViaEC2 {
+		// EC2 can terminate many instances in a single call
+		log.Printf("terminating nodes: %v\n", ids)
+		err := awsTerminateInstances(ec2Svc, ids)
 		if err != nil {
-			return fmt.Errorf("[%s] error terminating node %s: %v", asg, id, err)
+			return nil, fmt.Errorf("error terminating nodes %v: %v", ids, err)
+		}
+		metrics.addTerminations(len(ids))
+		for asg, ids := range newTerminate {
+			terminated[asg] = ids
+			state.addTerminated(asg, ids, configs.TerminateDedupWindow)
+			if configs.ReplacementTimeout > 0 {
+				state.expectReplacements(asg, asgMap[asg].Instances, len(ids))
+			}
+			notifyTerminated(notifier, descriptionMap[asg], ids)
 		}
+		return nil, nil
 	}
-	return nil
+	for asg, ids := range newTerminate {
+		for _, id := range ids {
+			if err := ctx.Err(); err != nil {
+				return nil, fmt.Errorf("cancelled before terminating node %s: %v", id, err)
+			}
+			log.Printf("[%s] terminating node: %s\n", asg, id)
+			// all new config instances are ready, terminate an old one
+			err := awsTerminateNode(asgSvc, id, configs.DryRun)
+			if err != nil {
+				notifyFailed(notifier, descriptionMap[asg], err)
+				return nil, fmt.Errorf("[%s] error terminating node %s: %v", asg, id, err)
+			}
+			if configs.DryRun {
+				continue
+			}
+			metrics.addTerminations(1)
+			terminated[asg] = append(terminated[asg], id)
+			state.addTerminated(asg, []string{id}, configs.TerminateDedupWindow)
+			if configs.ReplacementTimeout > 0 {
+				state.expectReplacements(asg, asgMap[asg].Instances, 1)
+			}
+		}
+		if !configs.DryRun {
+			notifyTerminated(notifier, descriptionMap[asg], ids)
+		}
+	}
+	return nil, nil
+}
+
+// notifyTerminated notifies of the termination of old instances of a group
+func notifyTerminated(notifier rollNotifier, d *groupDescription, ids []string) {
+	notifyRoll(notifier, rollEvent{kind: rollEventTerminated, asg: *d.asg.AutoScalingGroupName, oldInstances: len(d.oldInstances), newInstances: len(d.newInstances), terminated: ids})
+}
+
+// notifyFailed notifies of a failure to roll a group in this loop; other groups carry on
+func notifyFailed(notifier rollNotifier, d *groupDescription, err error) {
+	notifyRoll(notifier, rollEvent{kind: rollEventFailed, asg: *d.asg.AutoScalingGroupName, oldInstances: len(d.oldInstances), newInstances: len(d.newInstances), err: err})
 }
 
 // ensureNoScaleDownDisabledAnnotation remove any "cluster-autoscaler.kubernetes.io/scale-down-disabled"
 // annotations in the nodes as no update is required anymore.
-func ensureNoScaleDownDisabledAnnotation(kubernetesEnabled bool, ec2Svc ec2iface.EC2API, ids []string) error {
-	hostnames, err := awsGetHostnames(ec2Svc, ids)
+func ensureNoScaleDownDisabledAnnotation(kubernetesEnabled bool, ec2Svc ec2Client, ids []string, nameTag string, dryRun bool) error {
+	hostnameMap, err := awsGetHostnames(ec2Svc, ids, nameTag)
 	if err != nil {
 		return fmt.Errorf("unable to get aws hostnames for ids %v: %v", ids, err)
 	}
-	return removeScaleDownDisabledAnnotation(kubernetesEnabled, hostnames)
+	hostnames := make([]string, 0)
+	for _, id := range ids {
+		hostnames = append(hostnames, hostnameMap[id])
+	}
+	return removeScaleDownDisabledAnnotation(kubernetesEnabled, hostnames, dryRun)
+}
+
+// rollPlan summarizes the changes to be made to an ASG in a single loop
+func rollPlan(currentDesired, desired, originalDesired int64, terminate []string) string {
+	desiredPlan := fmt.Sprintf("desired %d unchanged", currentDesired)
+	if desired != currentDesired {
+		desiredPlan = fmt.Sprintf("desired %d -> %d", currentDesired, desired)
+	}
+	terminatePlan := "terminate none"
+	if len(terminate) > 0 {
+		terminatePlan = fmt.Sprintf("terminate %d %v", len(terminate), terminate)
+	}
+	return fmt.Sprintf("%s (original %d), %s", desiredPlan, originalDesired, terminatePlan)
+}
+
+// normalizeMaxSize makes sure that the desired and original desired counts of an ASG that is to be rolled
+// are within its max size, which they may not be if the ASG is misconfigured. If the max size can
+// be increased, it is raised to fit them; otherwise the ASG cannot be rolled, and an error is returned.
+func normalizeMaxSize(asgSvc asgClient, asg *autoscaling.Group, originalDesired int64, canIncreaseMax, dryRun, verbose bool) error {
+	if asg.MaxSize == nil {
+		return nil
+	}
+	needed := *asg.DesiredCapacity
+	if originalDesired > needed {
+		needed = originalDesired
+	}
+	if needed <= *asg.MaxSize {
+		return nil
+	}
+	log.Printf("[%v] WARNING: desired %d or original desired %d is above max size %d\n", p2v(asg.AutoScalingGroupName), *asg.DesiredCapacity, originalDesired, *asg.MaxSize)
+	if !canIncreaseMax {
+		return fmt.Errorf("desired count %d is above max size %d, which cannot be increased", needed, *asg.MaxSize)
+	}
+	if err := setAsgMax(asgSvc, asg, needed, dryRun, verbose); err != nil {
+		return err
+	}
+	asg.MaxSize = aws.Int64(needed)
+	return nil
 }
 
-// calculateAdjustment calculates the new settings for the desired number, and which node (if any) to terminate
-// this makes no actual adjustment, only calculates what new settings should be
+// calculateAdjustment calculates the new settings for the desired number, and which nodes (if any) to terminate
+// this makes no actual adjustment, only calculates what new settings should be, based on the old and new
+// instances found by groupInstances
+// At most maxTerminate old nodes are terminated at once, and never so many that fewer than originalDesired
+// healthy instances would remain.
 // returns:
 //   what the new desired number of instances should be
-//   ID of an instance to terminate, "" if none
+//   IDs of instances to terminate, empty if none
 //   error
-func calculateAdjustment(kubernetesEnabled bool, asg *autoscaling.Group, ec2Svc ec2iface.EC2API, hostnameMap map[string]string, readinessHandler readiness, originalDesired int64, verbose, drain, drainForce bool) (int64, string, error) {
+func calculateAdjustment(kubernetesEnabled bool, asg *autoscaling.Group, oldInstances, newInstances []*autoscaling.Instance, hostnameMap map[string]string, readinessHandler readiness, lbHealth loadBalancerHealth, pools *nodePoolDrains, originalDesired int64, maxTerminate int, limits rollLimits, terminateWait time.Duration, canIncreaseMax, orderByPodCount, dryRun, verbose, drain, drainForce bool) (int64, []string, error) {
 	desired := *asg.DesiredCapacity
-
-	// get instances with old launch config
-	oldInstances, newInstances, err := groupInstances(asg, ec2Svc, verbose)
-	if err != nil {
-		return originalDesired, "", fmt.Errorf("unable to group instances into new and old: %v", err)
+	if maxTerminate < 1 {
+		maxTerminate = 1
 	}
 
 	// Possibilities:
@@ -139,11 +840,33 @@ func calculateAdjustment(kubernetesEnabled bool, asg *autoscaling.Group, ec2Svc
 		if verbose && desired != originalDesired {
 			log.Printf("[%v] returning desired to original value %d", p2v(asg.AutoScalingGroupName), originalDesired)
 		}
-		return originalDesired, "", nil
+		return originalDesired, nil, nil
+	}
+	// surge above the original desired count by up to the max surge, but by no more than the number of old
+	// instances, nor beyond the max size if it cannot be increased
+	surge := limits.maxSurge
+	if surge > len(oldInstances) {
+		surge = len(oldInstances)
+	}
+	if !canIncreaseMax && asg.MaxSize != nil && originalDesired+int64(surge) > *asg.MaxSize {
+		surge = int(*asg.MaxSize - originalDesired)
+	}
+	if surge < 0 {
+		surge = 0
+	}
+	if surge == 0 && limits.maxUnavailable < 1 {
+		// nothing can be terminated without surging, so surge by one anyway
+		surge = 1
 	}
-	if originalDesired == desired {
+	if originalDesired == desired && surge > 0 {
 		// we have not started updates; raise the desired count
-		return originalDesired + 1, "", nil
+		return originalDesired + int64(surge), nil, nil
+	}
+	// wait for instances terminated before, including any held by a termination lifecycle hook, to leave the
+	// ASG, rather than counting them or terminating more alongside them
+	if terminating := terminatingInstances(asg.Instances); len(terminating) > 0 {
+		log.Printf("[%v] waiting for instances %v to finish terminating", p2v(asg.AutoScalingGroupName), mapInstancesIds(terminating))
+		return desired, nil, nil
 	}
 
 	// how we determine if we can terminate one
@@ -154,15 +877,31 @@ func calculateAdjustment(kubernetesEnabled bool, asg *autoscaling.Group, ec2Svc
 	// if yes, terminate one old one
 	// if not, loop around again - eventually it will be
 
-	// do we have at least one more more ready instances than the original desired? if not, loop again until we do
-	readyCount := 0
-	for _, i := range asg.Instances {
+	// do we have enough ready new instances to terminate more old ones? If not, loop again until we do.
+	// Only healthy new instances count against the target: the fewest allowed by max unavailable, less the
+	// healthy old instances that stay in service. Any other healthy instances in the ASG, e.g. ones left alone
+	// for having neither a launch configuration nor a launch template, cannot stand in for new ones.
+	minAvailable := int(originalDesired) - limits.maxUnavailable
+	readyNew := 0
+	for _, i := range newInstances {
+		if *i.HealthStatus == healthy {
+			readyNew++
+		}
+	}
+	healthyOld := 0
+	// an unhealthy old instance is not serving anyway, so terminating it costs nothing; otherwise, it would
+	// keep the ready count from ever getting above the fewest allowed, and stall the roll
+	unhealthyOld := 0
+	for _, i := range oldInstances {
 		if *i.HealthStatus == healthy {
-			readyCount++
+			healthyOld++
+		} else {
+			unhealthyOld++
 		}
 	}
-	if int64(readyCount) < originalDesired+1 {
-		return desired, "", nil
+	count := readyNew - (minAvailable - healthyOld)
+	if count <= 0 && unhealthyOld == 0 {
+		return desired, nil, nil
 	}
 	// are any of the updated config instances not ready?
 	unReadyCount := 0
@@ -173,7 +912,18 @@ func calculateAdjustment(kubernetesEnabled bool, asg *autoscaling.Group, ec2Svc
 		}
 	}
 	if unReadyCount > 0 {
-		return desired, "", nil
+		return desired, nil, nil
+	}
+	// are any of them not healthy according to the load balancers themselves?
+	if lbHealth != nil {
+		unhealthyCount, err := lbHealth.getUnhealthyCount(asg, mapInstancesIds(newInstances))
+		if err != nil {
+			return desired, nil, fmt.Errorf("error getting load balancer health of new instances: %v", err)
+		}
+		if unhealthyCount > 0 {
+			log.Printf("[%v] New instances not healthy in load balancers: %d", p2v(asg.AutoScalingGroupName), unhealthyCount)
+			return desired, nil, nil
+		}
 	}
 	// do we have additional requirements for readiness?
 	if readinessHandler != nil {
@@ -187,53 +937,136 @@ func calculateAdjustment(kubernetesEnabled bool, asg *autoscaling.Group, ec2Svc
 		for _, i := range ids {
 			hostnames = append(hostnames, hostnameMap[i])
 		}
-		_, err = setScaleDownDisabledAnnotation(kubernetesEnabled, hostnames)
+		_, err = setScaleDownDisabledAnnotation(kubernetesEnabled, hostnames, dryRun)
 		if err != nil {
 			log.Printf("Unable to set disabled scale down annotations: %v", err)
 		}
 		unReadyCount, err = readinessHandler.getUnreadyCount(hostnames, ids)
 		if err != nil {
-			return desired, "", fmt.Errorf("error getting readiness new node status: %v", err)
+			return desired, nil, fmt.Errorf("error getting readiness new node status: %v", err)
 		}
 		if unReadyCount > 0 {
 			log.Printf("[%v] Nodes not ready: %d", p2v(asg.AutoScalingGroupName), unReadyCount)
-			return desired, "", nil
+			return desired, nil, nil
 		}
 	}
-	candidate := *oldInstances[0].InstanceId
+	// ready, but give downstream systems time to settle after the last termination, and new instances time to
+	// warm up after becoming healthy
+	if terminateWait > 0 {
+		log.Printf("[%v] waiting %v before terminating more old instances", p2v(asg.AutoScalingGroupName), terminateWait.Round(time.Second))
+		return desired, nil, nil
+	}
+	// terminate as many as we are allowed, without going below the fewest ready instances allowed
+	if count < 0 {
+		count = 0
+	}
+	count += unhealthyOld
+	if count > maxTerminate {
+		count = maxTerminate
+	}
+	if count > len(oldInstances) {
+		count = len(oldInstances)
+	}
+	if orderByPodCount && readinessHandler != nil {
+		// drain the nodes with the fewest pods first, to disrupt as little as possible
+		ids := mapInstancesIds(oldInstances)
+		hostnames := make([]string, 0)
+		for _, id := range ids {
+			hostnames = append(hostnames, hostnameMap[id])
+		}
+		podCounts, err := readinessHandler.getPodCounts(hostnames, ids)
+		if err != nil {
+			return desired, nil, fmt.Errorf("error getting pod counts of old nodes: %v", err)
+		}
+		ordered := make([]*autoscaling.Instance, len(oldInstances))
+		copy(ordered, oldInstances)
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return podCounts[*ordered[i].InstanceId] < podCounts[*ordered[j].InstanceId]
+		})
+		oldInstances = ordered
+	}
+	if unhealthyOld > 0 {
+		// terminate unhealthy old instances first
+		ordered := make([]*autoscaling.Instance, len(oldInstances))
+		copy(ordered, oldInstances)
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return *ordered[i].HealthStatus != healthy && *ordered[j].HealthStatus == healthy
+		})
+		oldInstances = ordered
+	}
+	toTerminate := oldInstances[:count]
+	if pools != nil && readinessHandler != nil && drain {
+		// drain no more of any node pool at once than allowed
+		ids := mapInstancesIds(oldInstances)
+		hostnames := make([]string, 0)
+		for _, id := range ids {
+			hostnames = append(hostnames, hostnameMap[id])
+		}
+		nodePools, err := readinessHandler.getNodeLabels(hostnames, ids, pools.label)
+		if err != nil {
+			return desired, nil, fmt.Errorf("error getting node pools of old nodes: %v", err)
+		}
+		toTerminate = pools.take(oldInstances, nodePools, count)
+		if len(toTerminate) == 0 {
+			log.Printf("[%v] waiting, node pools of old nodes already draining as many nodes as allowed", p2v(asg.AutoScalingGroupName))
+			return desired, nil, nil
+		}
+	}
+	candidates := mapInstancesIds(toTerminate)
 
 	if readinessHandler != nil {
-		// get the node reference - first need the hostname
-		var (
-			hostname string
-			err      error
-		)
-		hostname = hostnameMap[candidate]
-		err = readinessHandler.prepareTermination([]string{hostname}, []string{candidate}, drain, drainForce)
+		// get the node references - first need the hostnames
+		hostnames := make([]string, 0)
+		for _, id := range candidates {
+			hostnames = append(hostnames, hostnameMap[id])
+		}
+		err := readinessHandler.prepareTermination(hostnames, candidates, drain, drainForce)
+		if timeoutErr, ok := err.(*drainTimeoutError); ok {
+			timeoutErr.asg = aws.StringValue(asg.AutoScalingGroupName)
+			return desired, nil, timeoutErr
+		}
+		if drainErr, ok := err.(*drainError); ok {
+			drainErr.asg = aws.StringValue(asg.AutoScalingGroupName)
+			return desired, nil, drainErr
+		}
 		if err != nil {
-			return desired, "", fmt.Errorf("unexpected error readiness handler terminating node %s: %v", hostname, err)
+			return desired, nil, fmt.Errorf("unexpected error readiness handler terminating nodes %v: %v", hostnames, err)
 		}
 	}
 
-	// all new config instances are ready, terminate an old one
-	return desired, candidate, nil
+	// all new config instances are ready, terminate old ones
+	return desired, candidates, nil
+}
+
+// targetLaunchTemplate returns the launch template of the ASG, or of its mixed instances policy, if any
+func targetLaunchTemplate(asg *autoscaling.Group) *autoscaling.LaunchTemplateSpecification {
+	if asg.LaunchTemplate == nil && asg.MixedInstancesPolicy != nil && asg.MixedInstancesPolicy.LaunchTemplate != nil {
+		return asg.MixedInstancesPolicy.LaunchTemplate.LaunchTemplateSpecification
+	}
+	return asg.LaunchTemplate
 }
 
 // groupInstances handles all of the logic for determining which nodes in the ASG have an old or outdated
 // config, and which are up to date. It should do nothing else.
 // The entire rest of the code should rely on this for making the determination
-func groupInstances(asg *autoscaling.Group, ec2Svc ec2iface.EC2API, verbose bool) ([]*autoscaling.Instance, []*autoscaling.Instance, error) {
+func groupInstances(asg *autoscaling.Group, ec2Svc ec2Client, asgSvc asgClient, templates *launchTemplateCache, compareLaunchConfigs, skipWithoutLaunchConfig bool, missingVersions string, verbose bool) ([]*autoscaling.Instance, []*autoscaling.Instance, error) {
 	oldInstances := make([]*autoscaling.Instance, 0)
 	newInstances := make([]*autoscaling.Instance, 0)
+	// instances attached to the ASG from elsewhere, e.g. imported, may have neither a launch configuration
+	// nor a launch template; these are old by default, or can be left alone
+	instances := make([]*autoscaling.Instance, 0)
+	for _, i := range asg.Instances {
+		if skipWithoutLaunchConfig && i.LaunchConfigurationName == nil && i.LaunchTemplate == nil {
+			log.Printf("[%v] WARNING: skipping %v because it has neither a launch configuration nor a launch template", p2v(asg.AutoScalingGroupName), p2v(i.InstanceId))
+			continue
+		}
+		instances = append(instances, i)
+	}
 	// we want to be able to handle LaunchTemplate as well
 	targetLc := asg.LaunchConfigurationName
-	targetLt := asg.LaunchTemplate
-	// check for mixed instance policy
-	if targetLt == nil && asg.MixedInstancesPolicy != nil && asg.MixedInstancesPolicy.LaunchTemplate != nil {
-		if verbose {
-			log.Printf("[%v] using mixed instances policy launch template", p2v(asg.AutoScalingGroupName))
-		}
-		targetLt = asg.MixedInstancesPolicy.LaunchTemplate.LaunchTemplateSpecification
+	targetLt := targetLaunchTemplate(asg)
+	if verbose && asg.LaunchTemplate == nil && targetLt != nil {
+		log.Printf("[%v] using mixed instances policy launch template", p2v(asg.AutoScalingGroupName))
 	}
 	// prioritize LaunchTemplate over LaunchConfiguration
 	if targetLt != nil {
@@ -247,11 +1080,11 @@ func groupInstances(asg *autoscaling.Group, ec2Svc ec2iface.EC2API, verbose bool
 		)
 		switch {
 		case targetLt.LaunchTemplateId != nil && *targetLt.LaunchTemplateId != "":
-			if targetTemplate, err = awsGetLaunchTemplateByID(ec2Svc, *targetLt.LaunchTemplateId); err != nil {
+			if targetTemplate, err = templates.byID(ec2Svc, *targetLt.LaunchTemplateId); err != nil {
 				return nil, nil, fmt.Errorf("[%v] error retrieving information about launch template ID %v: %v", p2v(asg.AutoScalingGroupName), p2v(targetLt.LaunchTemplateId), err)
 			}
 		case targetLt.LaunchTemplateName != nil && *targetLt.LaunchTemplateName != "":
-			if targetTemplate, err = awsGetLaunchTemplateByName(ec2Svc, *targetLt.LaunchTemplateName); err != nil {
+			if targetTemplate, err = templates.byName(ec2Svc, *targetLt.LaunchTemplateName); err != nil {
 				return nil, nil, fmt.Errorf("[%v] error retrieving information about launch template name %v: %v", p2v(asg.AutoScalingGroupName), p2v(targetLt.LaunchTemplateName), err)
 			}
 		default:
@@ -261,11 +1094,23 @@ func groupInstances(asg *autoscaling.Group, ec2Svc ec2iface.EC2API, verbose bool
 		if targetTemplate == nil {
 			return nil, nil, fmt.Errorf("no template found")
 		}
+		if targetTemplate.DefaultVersionNumber == nil || targetTemplate.LatestVersionNumber == nil {
+			switch missingVersions {
+			case missingTemplateVersionsSkip:
+				return nil, nil, &missingTemplateVersionsError{name: aws.StringValue(targetTemplate.LaunchTemplateName), id: aws.StringValue(targetTemplate.LaunchTemplateId)}
+			case missingTemplateVersionsResolve:
+				resolved, err := awsResolveTemplateVersions(ec2Svc, targetTemplate)
+				if err != nil {
+					return nil, nil, fmt.Errorf("[%v] error resolving versions of launch template name %v, id %v: %v", p2v(asg.AutoScalingGroupName), p2v(targetTemplate.LaunchTemplateName), p2v(targetTemplate.LaunchTemplateId), err)
+				}
+				targetTemplate = resolved
+			}
+		}
 		if verbose {
 			log.Printf("Grouping instances for ASG named %v with target template name %v, id %v, latest version %v and default version %v", p2v(asg.AutoScalingGroupName), p2v(targetTemplate.LaunchTemplateName), p2v(targetTemplate.LaunchTemplateId), p2v(targetTemplate.LatestVersionNumber), p2v(targetTemplate.DefaultVersionNumber))
 		}
 		// now we can loop through each node and compare
-		for _, i := range asg.Instances {
+		for _, i := range instances {
 			switch {
 			case i.LaunchTemplate == nil:
 				if verbose {
@@ -273,16 +1118,11 @@ func groupInstances(asg *autoscaling.Group, ec2Svc ec2iface.EC2API, verbose bool
 				}
 				// has no launch template at all
 				oldInstances = append(oldInstances, i)
-			case aws.StringValue(i.LaunchTemplate.LaunchTemplateName) != aws.StringValue(targetLt.LaunchTemplateName):
-				// mismatched name
-				if verbose {
-					log.Printf("[%v] adding %v to list of old instances because its name is %v and the target template's name is %v", p2v(asg.AutoScalingGroupName), p2v(i.InstanceId), p2v(i.LaunchTemplate.LaunchTemplateName), p2v(targetLt.LaunchTemplateName))
-				}
-				oldInstances = append(oldInstances, i)
-			case aws.StringValue(i.LaunchTemplate.LaunchTemplateId) != aws.StringValue(targetLt.LaunchTemplateId):
-				// mismatched ID
+			case !sameLaunchTemplate(targetTemplate, i.LaunchTemplate):
+				// mismatched name or ID; the ASG may refer to the template by name and the instance by ID, or
+				// the other way around, so compare both to those of the template itself
 				if verbose {
-					log.Printf("[%v] adding %v to list of old instances because its template id is %v and the target template's id is %v", p2v(asg.AutoScalingGroupName), p2v(i.InstanceId), p2v(i.LaunchTemplate.LaunchTemplateId), p2v(targetLt.LaunchTemplateId))
+					log.Printf("[%v] adding %v to list of old instances because its template name %v and id %v are not those of the target template, name %v and id %v", p2v(asg.AutoScalingGroupName), p2v(i.InstanceId), p2v(i.LaunchTemplate.LaunchTemplateName), p2v(i.LaunchTemplate.LaunchTemplateId), p2v(targetTemplate.LaunchTemplateName), p2v(targetTemplate.LaunchTemplateId))
 				}
 				oldInstances = append(oldInstances, i)
 			// name and id match, just need to check versions
@@ -299,23 +1139,79 @@ func groupInstances(asg *autoscaling.Group, ec2Svc ec2iface.EC2API, verbose bool
 			}
 		}
 	} else if targetLc != nil {
+		// launch configurations cannot be changed, but can be deleted and recreated with the same name and
+		// different contents, so optionally compare the contents of instances with matching names as well
+		var (
+			targetHash     string
+			instanceHashes map[string]string
+		)
+		if compareLaunchConfigs {
+			lc, err := awsGetLaunchConfiguration(asgSvc, *targetLc)
+			if err != nil {
+				return nil, nil, fmt.Errorf("[%v] error retrieving information about launch configuration %v: %v", p2v(asg.AutoScalingGroupName), p2v(targetLc), err)
+			}
+			if lc == nil {
+				return nil, nil, fmt.Errorf("[%v] launch configuration %v not found", p2v(asg.AutoScalingGroupName), p2v(targetLc))
+			}
+			targetHash = contentHash(aws.StringValue(lc.ImageId), aws.StringValue(lc.InstanceType), aws.StringValue(lc.UserData))
+			ids := make([]string, 0)
+			for _, i := range instances {
+				if aws.StringValue(i.LaunchConfigurationName) == *targetLc {
+					ids = append(ids, *i.InstanceId)
+				}
+			}
+			if instanceHashes, err = awsGetInstanceContentHashes(ec2Svc, ids); err != nil {
+				return nil, nil, fmt.Errorf("[%v] error retrieving contents of instances: %v", p2v(asg.AutoScalingGroupName), err)
+			}
+		}
 		// go through each instance and find those that are not with the target LC
-		for _, i := range asg.Instances {
-			if i.LaunchConfigurationName != nil && *i.LaunchConfigurationName == *targetLc {
-				newInstances = append(newInstances, i)
-			} else {
+		for _, i := range instances {
+			switch {
+			case i.LaunchConfigurationName == nil || *i.LaunchConfigurationName != *targetLc:
 				if verbose {
 					log.Printf("[%v] adding %v to list of old instances because the launch configuration names do not match (%v!=%v)", p2v(asg.AutoScalingGroupName), p2v(i.InstanceId), p2v(i.LaunchConfigurationName), p2v(targetLc))
 				}
 				oldInstances = append(oldInstances, i)
+			case compareLaunchConfigs && instanceHashes[*i.InstanceId] != targetHash:
+				if verbose {
+					log.Printf("[%v] adding %v to list of old instances because its contents do not match those of the launch configuration %v", p2v(asg.AutoScalingGroupName), p2v(i.InstanceId), p2v(targetLc))
+				}
+				oldInstances = append(oldInstances, i)
+			default:
+				newInstances = append(newInstances, i)
 			}
 		}
 	} else {
-		return nil, nil, fmt.Errorf("[%v] both target launch configuration and launch template are nil", p2v(asg.AutoScalingGroupName))
+		return nil, nil, &noLaunchSpecError{asg: aws.StringValue(asg.AutoScalingGroupName)}
 	}
 	return oldInstances, newInstances, nil
 }
 
+// noLaunchSpecError is returned when grouping the instances of an ASG that has neither a launch
+// configuration nor a launch template, e.g. while it is being changed, so that callers can skip just that ASG
+type noLaunchSpecError struct {
+	asg string
+}
+
+func (e *noLaunchSpecError) Error() string {
+	return fmt.Sprintf("[%s] both target launch configuration and launch template are nil", e.asg)
+}
+
+// missingGroups returns the names in the list that are not the name of any of the groups, in list order
+func missingGroups(names []string, asgs []*autoscaling.Group) []string {
+	found := map[string]bool{}
+	for _, asg := range asgs {
+		found[aws.StringValue(asg.AutoScalingGroupName)] = true
+	}
+	missing := make([]string, 0)
+	for _, name := range names {
+		if !found[name] {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
 func mapInstancesIds(instances []*autoscaling.Instance) []string {
 	ids := make([]string, 0)
 	for _, i := range instances {
@@ -324,6 +1220,22 @@ func mapInstancesIds(instances []*autoscaling.Instance) []string {
 	return ids
 }
 
+// sameLaunchTemplate checks if a launch template reference, whether by ID, by name or both, is to the
+// given template
+func sameLaunchTemplate(template *ec2.LaunchTemplate, lt *autoscaling.LaunchTemplateSpecification) bool {
+	id, name := aws.StringValue(lt.LaunchTemplateId), aws.StringValue(lt.LaunchTemplateName)
+	if id == "" && name == "" {
+		return false
+	}
+	if id != "" && id != aws.StringValue(template.LaunchTemplateId) {
+		return false
+	}
+	if name != "" && name != aws.StringValue(template.LaunchTemplateName) {
+		return false
+	}
+	return true
+}
+
 // compareLaunchTemplateVersions compare two launch template versions and see if they match
 // can handle `$Latest` and `$Default` by resolving to the actual version in use
 func compareLaunchTemplateVersions(targetTemplate *ec2.LaunchTemplate, lt1, lt2 *autoscaling.LaunchTemplateSpecification) bool {
@@ -340,23 +1252,33 @@ func compareLaunchTemplateVersions(targetTemplate *ec2.LaunchTemplate, lt1, lt2
 	if (lt1.Version == nil && lt2.Version != nil) || (lt1.Version != nil && lt2.Version == nil) {
 		return false
 	}
-	// if either version starts with `$`, then resolve to actual version from LaunchTemplate
-	var lt1version, lt2version string
-	switch *lt1.Version {
-	case "$Default":
-		lt1version = fmt.Sprintf("%d", *targetTemplate.DefaultVersionNumber)
-	case "$Latest":
-		lt1version = fmt.Sprintf("%d", *targetTemplate.LatestVersionNumber)
-	default:
-		lt1version = *lt1.Version
+	// if either version starts with `$`, then resolve to actual version from LaunchTemplate; a version
+	// that cannot be resolved, because the template has no such version number, matches nothing
+	lt1version, ok := resolveLaunchTemplateVersion(targetTemplate, *lt1.Version)
+	if !ok {
+		return false
+	}
+	lt2version, ok := resolveLaunchTemplateVersion(targetTemplate, *lt2.Version)
+	if !ok {
+		return false
 	}
-	switch *lt2.Version {
+	return lt1version == lt2version
+}
+
+// resolveLaunchTemplateVersion returns the actual version number for `$Default` and `$Latest`, and any
+// other version as it is. It returns false if the template does not have the version number.
+func resolveLaunchTemplateVersion(targetTemplate *ec2.LaunchTemplate, version string) (string, bool) {
+	var number *int64
+	switch version {
 	case "$Default":
-		lt2version = fmt.Sprintf("%d", *targetTemplate.DefaultVersionNumber)
+		number = targetTemplate.DefaultVersionNumber
 	case "$Latest":
-		lt2version = fmt.Sprintf("%d", *targetTemplate.LatestVersionNumber)
+		number = targetTemplate.LatestVersionNumber
 	default:
-		lt2version = *lt2.Version
+		return version, true
 	}
-	return lt1version == lt2version
+	if number == nil {
+		return "", false
+	}
+	return fmt.Sprintf("%d", *number), true
 }
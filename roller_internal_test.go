@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/ec2"
 )
@@ -18,14 +25,38 @@ type testReadyHandler struct {
 	unreadyCount   int
 	unreadyError   error
 	terminateError error
+	podCounts      map[string]int
+	podCountsError error
+	nodeLabels     map[string]string
+	// nodeAnnotations are the values of the annotation asked for, by instance ID
+	nodeAnnotations map[string]string
+	// nodes the cluster-autoscaler is removing
+	scalingDown []string
+	// drainDelay is how long prepareTermination takes, as for a slow drain
+	drainDelay time.Duration
+	counter    funcCounter
 }
 
 func (t *testReadyHandler) getUnreadyCount(hostnames []string, ids []string) (int, error) {
 	return t.unreadyCount, t.unreadyError
 }
 func (t *testReadyHandler) prepareTermination(hostnames []string, ids []string, drain, drainForce bool) error {
+	t.counter.add("prepareTermination", hostnames, ids, drain, drainForce)
+	time.Sleep(t.drainDelay)
 	return t.terminateError
 }
+func (t *testReadyHandler) getPodCounts(hostnames []string, ids []string) (map[string]int, error) {
+	return t.podCounts, t.podCountsError
+}
+func (t *testReadyHandler) getNodeLabels(hostnames []string, ids []string, label string) (map[string]string, error) {
+	return t.nodeLabels, nil
+}
+func (t *testReadyHandler) getNodeAnnotations(hostnames []string, ids []string, annotation string) (map[string]string, error) {
+	return t.nodeAnnotations, nil
+}
+func (t *testReadyHandler) getScalingDownNodes() ([]string, error) {
+	return t.scalingDown, nil
+}
 
 func TestCalculateAdjustment(t *testing.T) {
 	/*
@@ -59,6 +90,12 @@ func TestCalculateAdjustment(t *testing.T) {
 	terminateErrorHandler := &testReadyHandler{
 		terminateError: fmt.Errorf("Error"),
 	}
+	podCountHandler := &testReadyHandler{
+		podCounts: map[string]int{"1": 5, "2": 10, "3": 1},
+	}
+	podCountErrorHandler := &testReadyHandler{
+		podCountsError: fmt.Errorf("Error"),
+	}
 
 	tests := []struct {
 		oldInstances          []string
@@ -68,35 +105,79 @@ func TestCalculateAdjustment(t *testing.T) {
 		originalDesired       int64
 		readiness             readiness
 		targetDesired         int64
-		targetTerminate       string
+		targetTerminate       []string
 		err                   error
 		verbose               bool
 		drain                 bool
 		drainForce            bool
+		maxTerminate          int
+		initialSurge          int
+		maxSize               int64
+		increaseMax           bool
+		orderByPodCount       bool
 	}{
 		// 1 old, 2 new healthy, 0 new unhealthy, should terminate old
-		{[]string{"1"}, []string{"2", "3"}, []string{}, 3, 2, nil, 3, "1", nil, false, true, true},
+		{[]string{"1"}, []string{"2", "3"}, []string{}, 3, 2, nil, 3, []string{"1"}, nil, false, true, true, 1, 1, 0, false, false},
 		// 0 old, 2 new healthy, 0 new unhealthy, should indicate end of process
-		{[]string{}, []string{"2", "3"}, []string{}, 2, 2, nil, 2, "", nil, false, true, true},
+		{[]string{}, []string{"2", "3"}, []string{}, 2, 2, nil, 2, nil, nil, false, true, true, 1, 1, 0, false, false},
 		// 2 old, 0 new healthy, 0 new unhealthy, should indicate start of process
-		{[]string{"1", "2"}, []string{}, []string{}, 2, 2, nil, 3, "", nil, false, true, true},
+		{[]string{"1", "2"}, []string{}, []string{}, 2, 2, nil, 3, nil, nil, false, true, true, 1, 1, 0, false, false},
 		// 2 old, 0 new healthy, 0 new unhealthy, started, should not do anything until new healthy one
-		{[]string{"1", "2"}, []string{}, []string{}, 3, 2, nil, 3, "", nil, false, true, true},
+		{[]string{"1", "2"}, []string{}, []string{}, 3, 2, nil, 3, nil, nil, false, true, true, 1, 1, 0, false, false},
 		// 2 old, 1 new healthy, 0 new unhealthy, remove an old one
-		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, nil, 3, "1", nil, false, true, true},
+		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, nil, 3, []string{"1"}, nil, false, true, true, 1, 1, 0, false, false},
 		// 2 old, 0 new healthy, 1 new unhealthy, started, should not do anything until new one is healthy
-		{[]string{"1", "2"}, []string{}, []string{"3"}, 3, 2, nil, 3, "", nil, false, true, true},
+		{[]string{"1", "2"}, []string{}, []string{"3"}, 3, 2, nil, 3, nil, nil, false, true, true, 1, 1, 0, false, false},
 
 		// 2 old, 1 new healthy, 0 new unhealthy, 1 new unready, should not change anything
-		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, unreadyCountHandler, 3, "", nil, false, true, true},
+		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, unreadyCountHandler, 3, nil, nil, false, true, true, 1, 1, 0, false, false},
 		// 2 old, 1 new healthy, 0 new unhealthy, 0 new unready, 1 error: should not change anything
-		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, unreadyErrorHandler, 3, "", fmt.Errorf("error"), false, true, true},
+		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, unreadyErrorHandler, 3, nil, fmt.Errorf("error"), false, true, true, 1, 1, 0, false, false},
 		// 2 old, 1 new healthy, 0 new unhealthy, 0 unready, remove an old one
-		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, readyHandler, 3, "1", nil, false, true, true},
+		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, readyHandler, 3, []string{"1"}, nil, false, true, true, 1, 1, 0, false, false},
 		// 2 old, 1 new healthy, 0 new unhealthy, 0 new unready, 1 error: should not change anything
-		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, terminateErrorHandler, 3, "", fmt.Errorf("unexpected error"), false, true, true},
+		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, terminateErrorHandler, 3, nil, fmt.Errorf("unexpected error"), false, true, true, 1, 1, 0, false, false},
 		// 2 old, 1 new healthy, 0 new unhealthy, 0 unready, successful terminate: remove an old one
-		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, terminateHandler, 3, "1", nil, false, true, true},
+		{[]string{"1", "2"}, []string{"3"}, []string{}, 3, 2, terminateHandler, 3, []string{"1"}, nil, false, true, true, 1, 1, 0, false, false},
+
+		// 3 old, 2 new healthy, 0 new unhealthy, allowed to terminate 2: remove two old ones
+		{[]string{"1", "2", "3"}, []string{"4", "5"}, []string{}, 4, 2, nil, 4, []string{"1", "2"}, nil, false, true, true, 2, 1, 0, false, false},
+		// 3 old, 2 new healthy, 0 new unhealthy, allowed to terminate 5: remove only as many as keeps original desired healthy
+		{[]string{"1", "2", "3"}, []string{"4", "5"}, []string{}, 4, 2, nil, 4, []string{"1", "2", "3"}, nil, false, true, true, 5, 1, 0, false, false},
+		// 3 old, 1 new healthy, 0 new unhealthy, allowed to terminate 3: remove only as many as keeps original desired healthy
+		{[]string{"1", "2", "3"}, []string{"4"}, []string{}, 4, 3, nil, 4, []string{"1"}, nil, false, true, true, 3, 1, 0, false, false},
+		// 1 old, 3 new healthy, 0 new unhealthy, allowed to terminate 3: remove the only old one
+		{[]string{"1"}, []string{"2", "3", "4"}, []string{}, 4, 3, nil, 4, []string{"1"}, nil, false, true, true, 3, 1, 0, false, false},
+
+		// 4 old, 0 new, surge by 3 at the start of the process
+		{[]string{"1", "2", "3", "4"}, []string{}, []string{}, 4, 4, nil, 7, nil, nil, false, true, true, 3, 3, 0, false, false},
+		// 4 old, 0 new, surge by no more than can be terminated at once
+		{[]string{"1", "2", "3", "4"}, []string{}, []string{}, 4, 4, nil, 6, nil, nil, false, true, true, 2, 3, 0, false, false},
+		// 2 old, 0 new, surge by no more than the number of old instances
+		{[]string{"1", "2"}, []string{}, []string{}, 2, 2, nil, 4, nil, nil, false, true, true, 5, 5, 0, false, false},
+		// 4 old, 0 new, surge by no more than the max size
+		{[]string{"1", "2", "3", "4"}, []string{}, []string{}, 4, 4, nil, 6, nil, nil, false, true, true, 3, 3, 6, false, false},
+		// 4 old, 0 new, surge beyond the max size when it can be increased
+		{[]string{"1", "2", "3", "4"}, []string{}, []string{}, 4, 4, nil, 7, nil, nil, false, true, true, 3, 3, 6, true, false},
+		// 4 old, 0 new, already at max size, surge by one anyway
+		{[]string{"1", "2", "3", "4"}, []string{}, []string{}, 4, 4, nil, 5, nil, nil, false, true, true, 3, 3, 4, false, false},
+		// 4 old, 1 new healthy, surged by 3 and started: terminate only one at a time
+		{[]string{"1", "2", "3", "4"}, []string{"5"}, []string{}, 7, 4, nil, 7, []string{"1"}, nil, false, true, true, 1, 3, 0, false, false},
+		// batch of 10, 3 old, 0 new, start: surge by only as many as old instances remain
+		{[]string{"1", "2", "3"}, []string{}, []string{}, 3, 3, nil, 6, nil, nil, false, true, true, 10, 10, 0, false, false},
+		// batch of 10, 3 old, 3 new healthy, started: terminate only as many as old instances remain
+		{[]string{"1", "2", "3"}, []string{"4", "5", "6"}, []string{}, 6, 3, nil, 6, []string{"1", "2", "3"}, nil, false, true, true, 10, 10, 0, false, false},
+		// batch of 5, 1 old left, 4 new healthy, part way through: terminate the last old one
+		{[]string{"1"}, []string{"2", "3", "4", "5"}, []string{}, 5, 4, nil, 5, []string{"1"}, nil, false, true, true, 5, 5, 0, false, false},
+
+		// 3 old, 2 new healthy, ordered by pod count: remove the two with the fewest pods
+		{[]string{"1", "2", "3"}, []string{"4", "5"}, []string{}, 4, 2, podCountHandler, 4, []string{"3", "1"}, nil, false, true, true, 2, 1, 0, false, true},
+		// 3 old, 2 new healthy, not ordered by pod count: remove the first two
+		{[]string{"1", "2", "3"}, []string{"4", "5"}, []string{}, 4, 2, podCountHandler, 4, []string{"1", "2"}, nil, false, true, true, 2, 1, 0, false, false},
+		// 3 old, 2 new healthy, ordered by pod count with no readiness handler: remove the first two
+		{[]string{"1", "2", "3"}, []string{"4", "5"}, []string{}, 4, 2, nil, 4, []string{"1", "2"}, nil, false, true, true, 2, 1, 0, false, true},
+		// 3 old, 2 new healthy, error getting pod counts: should not change anything
+		{[]string{"1", "2", "3"}, []string{"4", "5"}, []string{}, 4, 2, podCountErrorHandler, 4, nil, fmt.Errorf("error getting pod counts"), false, true, true, 2, 1, 0, false, true},
 	}
 	hostnameMap := map[string]string{}
 	for i := 0; i < 20; i++ {
@@ -141,10 +222,21 @@ func TestCalculateAdjustment(t *testing.T) {
 			Instances:               instances,
 			AutoScalingGroupName:    aws.String("myasg"),
 		}
+		if tt.maxSize > 0 {
+			asg.MaxSize = &tt.maxSize
+		}
 		ec2Svc := &mockEc2Svc{
 			autodescribe: true,
 		}
-		desired, terminate, err := calculateAdjustment(kubernetesEnabled, asg, ec2Svc, hostnameMap, tt.readiness, tt.originalDesired, tt.verbose, tt.drain, tt.drainForce)
+		oldInstances, newInstances, err := groupInstances(asg, ec2Svc, nil, nil, false, false, missingTemplateVersionsOld, tt.verbose)
+		if err != nil {
+			t.Fatalf("%d: unexpected error grouping instances: %v", i, err)
+		}
+		limits, err := getRollLimits(asg, Configs{MaxTerminate: tt.maxTerminate, InitialSurge: tt.initialSurge, MaxSurge: -1, MaxUnavailable: -1}, tt.originalDesired)
+		if err != nil {
+			t.Fatalf("%d: unexpected error getting roll limits: %v", i, err)
+		}
+		desired, terminate, err := calculateAdjustment(kubernetesEnabled, asg, oldInstances, newInstances, hostnameMap, tt.readiness, nil, nil, tt.originalDesired, tt.maxTerminate, limits, 0, tt.increaseMax, tt.orderByPodCount, false, tt.verbose, tt.drain, tt.drainForce)
 		switch {
 		case (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
 			t.Errorf("%d: mismatched errors, actual then expected", i)
@@ -152,8 +244,234 @@ func TestCalculateAdjustment(t *testing.T) {
 			t.Logf("%v", tt.err)
 		case desired != tt.targetDesired:
 			t.Errorf("%d: Mismatched desired, actual %d expected %d", i, desired, tt.targetDesired)
-		case terminate != tt.targetTerminate:
-			t.Errorf("%d: Mismatched terminate ID, actual %s expected %s", i, terminate, tt.targetTerminate)
+		case !testStringEq(terminate, tt.targetTerminate):
+			t.Errorf("%d: Mismatched terminate IDs, actual %v expected %v", i, terminate, tt.targetTerminate)
+		}
+	}
+}
+
+func TestCalculateAdjustmentRollLimits(t *testing.T) {
+	tests := []struct {
+		desc                  string
+		oldInstances          []string
+		newInstancesHealthy   []string
+		newInstancesUnhealthy []string
+		desired               int64
+		maxSize               int64
+		limits                rollLimits
+		maxTerminate          int
+		targetDesired         int64
+		targetTerminate       []string
+	}{
+		{"surge 2 unavailable 0: start", []string{"1", "2", "3", "4"}, nil, nil, 4, 0, rollLimits{2, 0}, 2, 6, nil},
+		{"surge 2 unavailable 0: new unhealthy", []string{"1", "2", "3", "4"}, []string{"5"}, []string{"6"}, 6, 0, rollLimits{2, 0}, 2, 6, nil},
+		{"surge 2 unavailable 0: new healthy", []string{"1", "2", "3", "4"}, []string{"5", "6"}, nil, 6, 0, rollLimits{2, 0}, 2, 6, []string{"1", "2"}},
+		{"surge 2 unavailable 0: by max terminate", []string{"1", "2", "3", "4"}, []string{"5", "6"}, nil, 6, 0, rollLimits{2, 0}, 1, 6, []string{"1"}},
+		{"surge 2 unavailable 0: by max size", []string{"1", "2", "3", "4"}, nil, nil, 4, 5, rollLimits{2, 0}, 2, 5, nil},
+		{"surge 0 unavailable 1: start", []string{"1", "2", "3", "4"}, nil, nil, 4, 0, rollLimits{0, 1}, 2, 4, []string{"1"}},
+		{"surge 0 unavailable 1: new unhealthy", []string{"2", "3", "4"}, nil, []string{"5"}, 4, 0, rollLimits{0, 1}, 2, 4, nil},
+		{"surge 0 unavailable 1: new healthy", []string{"2", "3", "4"}, []string{"5"}, nil, 4, 0, rollLimits{0, 1}, 2, 4, []string{"2"}},
+		{"surge 0 unavailable 2: by max terminate", []string{"1", "2", "3", "4"}, nil, nil, 4, 0, rollLimits{0, 2}, 1, 4, []string{"1"}},
+		{"surge 1 unavailable 1: start", []string{"1", "2", "3", "4"}, nil, nil, 4, 0, rollLimits{1, 1}, 2, 5, nil},
+		{"surge 1 unavailable 1: new healthy", []string{"1", "2", "3", "4"}, []string{"5"}, nil, 5, 0, rollLimits{1, 1}, 2, 5, []string{"1", "2"}},
+		{"surge 2 unavailable 1: at max size", []string{"1", "2", "3", "4"}, nil, nil, 4, 4, rollLimits{2, 1}, 2, 4, []string{"1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			instances := make([]*autoscaling.Instance, 0)
+			oldInstances := make([]*autoscaling.Instance, 0)
+			newInstances := make([]*autoscaling.Instance, 0)
+			for _, id := range tt.oldInstances {
+				instance := &autoscaling.Instance{InstanceId: aws.String(id), HealthStatus: aws.String(healthy)}
+				instances = append(instances, instance)
+				oldInstances = append(oldInstances, instance)
+			}
+			for _, id := range tt.newInstancesHealthy {
+				instance := &autoscaling.Instance{InstanceId: aws.String(id), HealthStatus: aws.String(healthy)}
+				instances = append(instances, instance)
+				newInstances = append(newInstances, instance)
+			}
+			for _, id := range tt.newInstancesUnhealthy {
+				instance := &autoscaling.Instance{InstanceId: aws.String(id), HealthStatus: aws.String("Down")}
+				instances = append(instances, instance)
+				newInstances = append(newInstances, instance)
+			}
+			asg := &autoscaling.Group{
+				AutoScalingGroupName: aws.String("myasg"),
+				DesiredCapacity:      aws.Int64(tt.desired),
+				Instances:            instances,
+			}
+			if tt.maxSize > 0 {
+				asg.MaxSize = aws.Int64(tt.maxSize)
+			}
+			desired, terminate, err := calculateAdjustment(false, asg, oldInstances, newInstances, map[string]string{}, nil, nil, nil, 4, tt.maxTerminate, tt.limits, 0, false, false, false, false, true, true)
+			switch {
+			case err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case desired != tt.targetDesired:
+				t.Errorf("mismatched desired, actual %d expected %d", desired, tt.targetDesired)
+			case !testStringEq(terminate, tt.targetTerminate):
+				t.Errorf("mismatched terminate IDs, actual %v expected %v", terminate, tt.targetTerminate)
+			}
+		})
+	}
+}
+
+func TestCalculateAdjustmentUnhealthyOld(t *testing.T) {
+	// original desired is 4
+	tests := []struct {
+		desc            string
+		oldHealthy      []string
+		oldUnhealthy    []string
+		newHealthy      []string
+		newUnhealthy    []string
+		other           []string
+		desired         int64
+		limits          rollLimits
+		maxTerminate    int
+		targetTerminate []string
+	}{
+		{"unhealthy old instance terminated", []string{"1", "3", "4"}, []string{"2"}, []string{"5"}, nil, nil, 5, rollLimits{1, 0}, 1, []string{"2"}},
+		{"new instance not ready", []string{"1", "3", "4"}, []string{"2"}, nil, []string{"5"}, nil, 5, rollLimits{1, 0}, 1, nil},
+		{"unhealthy old instance first", []string{"1", "2", "4"}, []string{"3"}, []string{"5", "6"}, nil, nil, 6, rollLimits{2, 0}, 2, []string{"3", "1"}},
+		{"by max terminate", []string{"1", "2", "4"}, []string{"3"}, []string{"5", "6"}, nil, nil, 6, rollLimits{2, 0}, 1, []string{"3"}},
+		{"healthy old and other instances without ready new ones", []string{"1", "2", "3", "4"}, nil, nil, nil, []string{"9"}, 5, rollLimits{1, 0}, 1, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			instances := make([]*autoscaling.Instance, 0)
+			oldInstances := make([]*autoscaling.Instance, 0)
+			newInstances := make([]*autoscaling.Instance, 0)
+			add := func(ids []string, status string, old bool) {
+				for _, id := range ids {
+					instance := &autoscaling.Instance{InstanceId: aws.String(id), HealthStatus: aws.String(status)}
+					instances = append(instances, instance)
+					if old {
+						oldInstances = append(oldInstances, instance)
+					} else {
+						newInstances = append(newInstances, instance)
+					}
+				}
+			}
+			add(tt.oldHealthy, healthy, true)
+			add(tt.oldUnhealthy, "Unhealthy", true)
+			add(tt.newHealthy, healthy, false)
+			add(tt.newUnhealthy, "Unhealthy", false)
+			// neither old nor new, e.g. left alone for having no launch configuration or template
+			for _, id := range tt.other {
+				instances = append(instances, &autoscaling.Instance{InstanceId: aws.String(id), HealthStatus: aws.String(healthy)})
+			}
+			// keep the old instances in ID order, as AWS lists them
+			sort.Slice(oldInstances, func(i, j int) bool { return *oldInstances[i].InstanceId < *oldInstances[j].InstanceId })
+			asg := &autoscaling.Group{
+				AutoScalingGroupName: aws.String("myasg"),
+				DesiredCapacity:      aws.Int64(tt.desired),
+				Instances:            instances,
+			}
+			desired, terminate, err := calculateAdjustment(false, asg, oldInstances, newInstances, map[string]string{}, nil, nil, nil, 4, tt.maxTerminate, tt.limits, 0, false, false, false, false, true, true)
+			switch {
+			case err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case desired != tt.desired:
+				t.Errorf("mismatched desired, actual %d expected %d", desired, tt.desired)
+			case !testStringEq(terminate, tt.targetTerminate):
+				t.Errorf("mismatched terminate IDs, actual %v expected %v", terminate, tt.targetTerminate)
+			}
+		})
+	}
+}
+
+func TestGetRollLimits(t *testing.T) {
+	tests := []struct {
+		desc    string
+		configs Configs
+		tags    map[string]string
+		limits  rollLimits
+		err     bool
+	}{
+		{"unset", Configs{InitialSurge: 3, MaxTerminate: 5, MaxSurge: -1, MaxUnavailable: -1}, nil, rollLimits{3, 0}, false},
+		{"unset bounded by max terminate", Configs{InitialSurge: 3, MaxTerminate: 2, MaxSurge: -1, MaxUnavailable: -1}, nil, rollLimits{2, 0}, false},
+		{"configured", Configs{InitialSurge: 1, MaxTerminate: 1, MaxSurge: 4, MaxUnavailable: 2}, nil, rollLimits{4, 2}, false},
+		{"configured unavailable only", Configs{InitialSurge: 1, MaxTerminate: 1, MaxSurge: -1, MaxUnavailable: 2}, nil, rollLimits{1, 2}, false},
+		{"tags override", Configs{InitialSurge: 1, MaxTerminate: 1, MaxSurge: 4, MaxUnavailable: 2}, map[string]string{asgTagNameMaxSurge: "0", asgTagNameMaxUnavailable: "1"}, rollLimits{0, 1}, false},
+		{"other tags ignored", Configs{InitialSurge: 1, MaxTerminate: 1, MaxSurge: 2, MaxUnavailable: 0}, map[string]string{"Name": "abc"}, rollLimits{2, 0}, false},
+		{"both zero", Configs{InitialSurge: 1, MaxTerminate: 1, MaxSurge: 0, MaxUnavailable: 0}, nil, rollLimits{1, 0}, false},
+		{"max unavailable strategy", Configs{Strategy: strategyMaxUnavailable, InitialSurge: 3, MaxTerminate: 2, MaxSurge: -1, MaxUnavailable: -1}, nil, rollLimits{0, 2}, false},
+		{"max unavailable strategy at least one", Configs{Strategy: strategyMaxUnavailable, InitialSurge: 1, MaxTerminate: 0, MaxSurge: -1, MaxUnavailable: -1}, nil, rollLimits{0, 1}, false},
+		{"max unavailable strategy configured", Configs{Strategy: strategyMaxUnavailable, InitialSurge: 1, MaxTerminate: 1, MaxSurge: 1, MaxUnavailable: 3}, nil, rollLimits{1, 3}, false},
+		{"max unavailable strategy tags override", Configs{Strategy: strategyMaxUnavailable, InitialSurge: 1, MaxTerminate: 1, MaxSurge: -1, MaxUnavailable: -1}, map[string]string{asgTagNameMaxSurge: "2"}, rollLimits{2, 1}, false},
+		{"percentage of original desired", Configs{InitialSurge: 1, MaxTerminate: 1, MaxSurge: -1, MaxSurgePercent: 25, MaxUnavailable: -1}, nil, rollLimits{3, 0}, false},
+		{"percentage of original desired exact", Configs{InitialSurge: 1, MaxTerminate: 1, MaxSurge: -1, MaxSurgePercent: 50, MaxUnavailable: -1}, nil, rollLimits{5, 0}, false},
+		{"percentage tag", Configs{InitialSurge: 1, MaxTerminate: 1, MaxSurge: 4, MaxUnavailable: -1}, map[string]string{asgTagNameMaxSurge: "10%"}, rollLimits{1, 0}, false},
+		{"percentage tag overrides percentage", Configs{InitialSurge: 1, MaxTerminate: 1, MaxSurge: -1, MaxSurgePercent: 100, MaxUnavailable: -1}, map[string]string{asgTagNameMaxSurge: "20%"}, rollLimits{2, 0}, false},
+		{"invalid percentage tag", Configs{MaxSurge: -1, MaxUnavailable: -1}, map[string]string{asgTagNameMaxSurge: "-5%"}, rollLimits{}, true},
+		{"invalid tag", Configs{MaxSurge: -1, MaxUnavailable: -1}, map[string]string{asgTagNameMaxSurge: "abc"}, rollLimits{}, true},
+		{"negative tag", Configs{MaxSurge: -1, MaxUnavailable: -1}, map[string]string{asgTagNameMaxUnavailable: "-1"}, rollLimits{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			asg := &autoscaling.Group{AutoScalingGroupName: aws.String("myasg")}
+			for k, v := range tt.tags {
+				asg.Tags = append(asg.Tags, &autoscaling.TagDescription{Key: aws.String(k), Value: aws.String(v)})
+			}
+			limits, err := getRollLimits(asg, tt.configs, 10)
+			switch {
+			case tt.err && err == nil:
+				t.Errorf("expected error, found limits %+v", limits)
+			case !tt.err && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case limits != tt.limits:
+				t.Errorf("mismatched limits, actual %+v expected %+v", limits, tt.limits)
+			}
+		})
+	}
+}
+
+func TestParseMaxSurge(t *testing.T) {
+	tests := []struct {
+		value   string
+		count   int
+		percent int
+		err     bool
+	}{
+		{"-1", -1, 0, false},
+		{"0", 0, 0, false},
+		{"3", 3, 0, false},
+		{"25%", -1, 25, false},
+		{"0%", 0, 0, false},
+		{"150%", -1, 150, false},
+		{"-5%", 0, 0, true},
+		{"%", 0, 0, true},
+		{"abc", 0, 0, true},
+	}
+	for _, tt := range tests {
+		count, percent, err := parseMaxSurge(tt.value)
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("%s: expected error, had none", tt.value)
+		case !tt.err && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.value, err)
+		case count != tt.count || percent != tt.percent:
+			t.Errorf("%s: mismatched max surge, actual %d and %d%% expected %d and %d%%", tt.value, count, percent, tt.count, tt.percent)
+		}
+	}
+}
+
+func TestPercentOfDesired(t *testing.T) {
+	tests := []struct {
+		percent  int
+		desired  int64
+		expected int
+	}{
+		{25, 10, 3},
+		{25, 4, 1},
+		{25, 1, 1},
+		{100, 6, 6},
+		{10, 0, 0},
+	}
+	for _, tt := range tests {
+		if actual := percentOfDesired(tt.percent, tt.desired); actual != tt.expected {
+			t.Errorf("%d%% of %d: actual %d expected %d", tt.percent, tt.desired, actual, tt.expected)
 		}
 	}
 }
@@ -323,291 +641,3262 @@ func TestAdjust(t *testing.T) {
 		},
 	}
 
+	// the results are the same whether the groups are calculated one at a time or concurrently
 	for i, tt := range tests {
-		t.Run(tt.desc, func(t *testing.T) {
-			validGroups := map[string]*autoscaling.Group{}
-			for _, n := range tt.asgs {
-				name := n
-				lcName := "lconfig"
-				oldLcName := fmt.Sprintf("old%s", lcName)
-				myHealthy := healthy
-				desired := tt.asgCurrentDesired[name]
-				max := tt.max[name]
-				instances := make([]*autoscaling.Instance, 0)
-				for _, id := range tt.oldIds[name] {
-					idd := id
-					instances = append(instances, &autoscaling.Instance{
-						InstanceId:              &idd,
-						LaunchConfigurationName: &oldLcName,
-						HealthStatus:            &myHealthy,
-					})
-				}
-				for _, id := range tt.newIds[name] {
-					idd := id
-					instances = append(instances, &autoscaling.Instance{
-						InstanceId:              &idd,
+		for _, concurrency := range []int{1, 4} {
+			t.Run(fmt.Sprintf("%s, concurrency %d", tt.desc, concurrency), func(t *testing.T) {
+				validGroups := map[string]*autoscaling.Group{}
+				for _, n := range tt.asgs {
+					name := n
+					lcName := "lconfig"
+					oldLcName := fmt.Sprintf("old%s", lcName)
+					myHealthy := healthy
+					desired := tt.asgCurrentDesired[name]
+					max := tt.max[name]
+					instances := make([]*autoscaling.Instance, 0)
+					for _, id := range tt.oldIds[name] {
+						idd := id
+						instances = append(instances, &autoscaling.Instance{
+							InstanceId:              &idd,
+							LaunchConfigurationName: &oldLcName,
+							HealthStatus:            &myHealthy,
+						})
+					}
+					for _, id := range tt.newIds[name] {
+						idd := id
+						instances = append(instances, &autoscaling.Instance{
+							InstanceId:              &idd,
+							LaunchConfigurationName: &lcName,
+							HealthStatus:            &myHealthy,
+						})
+					}
+					// construct the Group we will pass
+					validGroup := &autoscaling.Group{
+						AutoScalingGroupName:    &name,
+						DesiredCapacity:         &desired,
+						Instances:               instances,
 						LaunchConfigurationName: &lcName,
-						HealthStatus:            &myHealthy,
-					})
+						MaxSize:                 &max,
+					}
+
+					if tt.persistOriginalDesiredOnTag {
+						if originalDesired, ok := tt.originalDesired[name]; ok {
+							validGroup.Tags = []*autoscaling.TagDescription{
+								{
+									Key:               aws.String(asgTagNameOriginalDesired),
+									PropagateAtLaunch: aws.Bool(false),
+									ResourceId:        &name,
+									ResourceType:      aws.String("auto-scaling-group"),
+									Value:             aws.String(strconv.FormatInt(originalDesired, 10)),
+								},
+							}
+						}
+					}
+					validGroups[n] = validGroup
 				}
-				// construct the Group we will pass
-				validGroup := &autoscaling.Group{
-					AutoScalingGroupName:    &name,
-					DesiredCapacity:         &desired,
-					Instances:               instances,
-					LaunchConfigurationName: &lcName,
-					MaxSize:                 &max,
+				asgSvc := &mockAsgSvc{
+					groups: validGroups,
+				}
+				ec2Svc := &mockEc2Svc{
+					autodescribe: true,
+				}
+				// convert maps from map[string] to map[*string]
+				originalDesiredPtr := map[*string]int64{}
+				for k, v := range tt.originalDesired {
+					ks := k
+					originalDesiredPtr[&ks] = v
+				}
+				newDesiredPtr := map[*string]int64{}
+				for k, v := range tt.newDesired {
+					ks := k
+					newDesiredPtr[&ks] = v
+				}
+				configs := Configs{
+					KubernetesEnabled:    kubernetesEnabled,
+					ASGS:                 tt.asgs,
+					OriginalDesiredOnTag: tt.persistOriginalDesiredOnTag,
+					IncreaseMax:          tt.canIncreaseMax,
+					Verbose:              tt.verbose,
+					Drain:                tt.drain,
+					DrainForce:           tt.drainForce,
+					Concurrency:          concurrency,
+				}
+				state := newRollerState()
+				for k, v := range tt.originalDesired {
+					state.originalDesired[k] = v
+				}
+				statuses, err := adjust(configs, ec2Svc, asgSvc, nil, nil, tt.handler, nil, nil, nil, state)
+				// what were our last calls to each?
+				switch {
+				case (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
+					t.Errorf("%d: mismatched errors, actual then expected", i)
+					t.Logf("%v", err)
+					t.Logf("%v", tt.err)
 				}
 
-				if tt.persistOriginalDesiredOnTag {
-					if originalDesired, ok := tt.originalDesired[name]; ok {
-						validGroup.Tags = []*autoscaling.TagDescription{
-							{
-								Key:               aws.String(asgTagNameOriginalDesired),
-								PropagateAtLaunch: aws.Bool(false),
-								ResourceId:        &name,
-								ResourceType:      aws.String("auto-scaling-group"),
-								Value:             aws.String(strconv.FormatInt(originalDesired, 10)),
-							},
+				// check each svc with its correct calls
+				desiredCalls := asgSvc.counter.filterByName("SetDesiredCapacity")
+				if len(desiredCalls) != len(tt.newDesired) {
+					t.Errorf("%d: Expected %d SetDesiredCapacity calls but had %d", i, len(tt.newDesired), len(desiredCalls))
+				}
+				// sort through by the relevant inputs
+				for _, d := range desiredCalls {
+					asg := d.params[0].(*autoscaling.SetDesiredCapacityInput)
+					name := asg.AutoScalingGroupName
+					if *asg.DesiredCapacity != tt.newDesired[*name] {
+						t.Errorf("%d: Mismatched call to set capacity for ASG '%s': actual %d, expected %d", i, *name, *asg.DesiredCapacity, tt.newDesired[*name])
+					}
+				}
+				// convert list of terminations into map
+				ids := map[string]bool{}
+				for _, id := range tt.terminate {
+					ids[id] = true
+				}
+				terminateCalls := asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup")
+				if len(terminateCalls) != len(tt.terminate) {
+					t.Errorf("%d: Expected %d Terminate calls but had %d", i, len(tt.terminate), len(terminateCalls))
+				}
+				for _, d := range terminateCalls {
+					in := d.params[0].(*autoscaling.TerminateInstanceInAutoScalingGroupInput)
+					id := in.InstanceId
+					if _, ok := ids[*id]; !ok {
+						t.Errorf("%d: Requested call to terminate instance %s, unexpected", i, *id)
+					}
+				}
+				// the statuses reflect what was done to each group
+				if err == nil {
+					if len(statuses) != len(tt.asgs) {
+						t.Errorf("%d: Expected %d statuses but had %d", i, len(tt.asgs), len(statuses))
+					}
+					terminatedCount := 0
+					for _, s := range statuses {
+						desired, ok := tt.newDesired[s.ASG]
+						if !ok {
+							desired = tt.asgCurrentDesired[s.ASG]
+						}
+						original, ok := tt.originalDesired[s.ASG]
+						if !ok {
+							original = tt.asgCurrentDesired[s.ASG]
 						}
+						done := len(tt.oldIds[s.ASG]) == 0 && tt.asgCurrentDesired[s.ASG] == original
+						expected := RollStatus{ASG: s.ASG, OldInstances: len(tt.oldIds[s.ASG]), NewInstances: len(tt.newIds[s.ASG]), DesiredBefore: tt.asgCurrentDesired[s.ASG], Desired: desired, Terminated: s.Terminated, Done: done}
+						if !reflect.DeepEqual(s, expected) {
+							t.Errorf("%d: Mismatched status, actual %v expected %v", i, s, expected)
+						}
+						for _, id := range s.Terminated {
+							if _, ok := ids[id]; !ok {
+								t.Errorf("%d: Status of ASG '%s' has unexpected terminated instance %s", i, s.ASG, id)
+							}
+						}
+						terminatedCount += len(s.Terminated)
+					}
+					if terminatedCount != len(tt.terminate) {
+						t.Errorf("%d: Expected %d terminated instances in statuses but had %d", i, len(tt.terminate), terminatedCount)
 					}
 				}
-				validGroups[n] = validGroup
-			}
+				// check for calls to update the group (e.g. to raise max)
+				updateGroupCalls := asgSvc.counter.filterByName("UpdateAutoScalingGroup")
+				for k, desired := range tt.newDesired {
+					if desired > tt.max[k] && len(updateGroupCalls) == 0 {
+						t.Errorf("%d: Expected call to UpdateAutoScalingGroup to set max but there was none", i)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestAdjustDescribeBeforeAct(t *testing.T) {
+	// every group is part way through a roll and ready to have an old node terminated
+	names := []string{"asg1", "asg2", "asg3", "asg4"}
+	groups := map[string]*autoscaling.Group{}
+	for i, n := range names {
+		name := n
+		lcName := "lconfig"
+		oldLcName := fmt.Sprintf("old%s", lcName)
+		myHealthy := healthy
+		oldID := fmt.Sprintf("%d-old", i)
+		newID1 := fmt.Sprintf("%d-new1", i)
+		newID2 := fmt.Sprintf("%d-new2", i)
+		groups[name] = &autoscaling.Group{
+			AutoScalingGroupName:    &name,
+			DesiredCapacity:         aws.Int64(3),
+			MaxSize:                 aws.Int64(3),
+			LaunchConfigurationName: &lcName,
+			Instances: []*autoscaling.Instance{
+				{InstanceId: &oldID, LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+				{InstanceId: &newID1, LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+				{InstanceId: &newID2, LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+			},
+			Tags: []*autoscaling.TagDescription{
+				{
+					Key:          aws.String(asgTagNameOriginalDesired),
+					ResourceId:   &name,
+					ResourceType: aws.String("auto-scaling-group"),
+					Value:        aws.String("2"),
+				},
+			},
+		}
+	}
+	for _, concurrency := range []int{1, 2, 10} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
 			asgSvc := &mockAsgSvc{
-				groups: validGroups,
+				groups: groups,
 			}
 			ec2Svc := &mockEc2Svc{
 				autodescribe: true,
 			}
-			// convert maps from map[string] to map[*string]
-			originalDesiredPtr := map[*string]int64{}
-			for k, v := range tt.originalDesired {
-				ks := k
-				originalDesiredPtr[&ks] = v
-			}
-			newDesiredPtr := map[*string]int64{}
-			for k, v := range tt.newDesired {
-				ks := k
-				newDesiredPtr[&ks] = v
-			}
-			err := adjust(kubernetesEnabled, tt.asgs, ec2Svc, asgSvc, tt.handler, tt.originalDesired, tt.persistOriginalDesiredOnTag, tt.canIncreaseMax, tt.verbose, tt.drain, tt.drainForce)
-			// what were our last calls to each?
-			switch {
-			case (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
-				t.Errorf("%d: mismatched errors, actual then expected", i)
-				t.Logf("%v", err)
-				t.Logf("%v", tt.err)
-			}
-
-			// check each svc with its correct calls
-			desiredCalls := asgSvc.counter.filterByName("SetDesiredCapacity")
-			if len(desiredCalls) != len(tt.newDesired) {
-				t.Errorf("%d: Expected %d SetDesiredCapacity calls but had %d", i, len(tt.newDesired), len(desiredCalls))
-			}
-			// sort through by the relevant inputs
-			for _, d := range desiredCalls {
-				asg := d.params[0].(*autoscaling.SetDesiredCapacityInput)
-				name := asg.AutoScalingGroupName
-				if *asg.DesiredCapacity != tt.newDesired[*name] {
-					t.Errorf("%d: Mismatched call to set capacity for ASG '%s': actual %d, expected %d", i, *name, *asg.DesiredCapacity, tt.newDesired[*name])
-				}
+			configs := Configs{
+				KubernetesEnabled:    kubernetesEnabled,
+				ASGS:                 names,
+				OriginalDesiredOnTag: true,
+				DescribeConcurrency:  concurrency,
 			}
-			// convert list of terminations into map
-			ids := map[string]bool{}
-			for _, id := range tt.terminate {
-				ids[id] = true
+			if _, err := adjust(configs, ec2Svc, asgSvc, nil, nil, nil, nil, nil, nil, newRollerState()); err != nil {
+				t.Fatalf("unexpected error: %v", err)
 			}
 			terminateCalls := asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup")
-			if len(terminateCalls) != len(tt.terminate) {
-				t.Errorf("%d: Expected %d Terminate calls but had %d", i, len(tt.terminate), len(terminateCalls))
+			if len(terminateCalls) != len(names) {
+				t.Fatalf("expected %d terminate calls, had %d", len(names), len(terminateCalls))
 			}
-			for _, d := range terminateCalls {
-				in := d.params[0].(*autoscaling.TerminateInstanceInAutoScalingGroupInput)
-				id := in.InstanceId
-				if _, ok := ids[*id]; !ok {
-					t.Errorf("%d: Requested call to terminate instance %s, unexpected", i, *id)
+			firstTerminate := terminateCalls[0].seq
+			for _, call := range terminateCalls {
+				if call.seq < firstTerminate {
+					firstTerminate = call.seq
 				}
 			}
-			// check for calls to update the group (e.g. to raise max)
-			updateGroupCalls := asgSvc.counter.filterByName("UpdateAutoScalingGroup")
-			for k, desired := range tt.newDesired {
-				if desired > tt.max[k] && len(updateGroupCalls) == 0 {
-					t.Errorf("%d: Expected call to UpdateAutoScalingGroup to set max but there was none", i)
+			for _, call := range append(asgSvc.counter.count, ec2Svc.counter.count...) {
+				if strings.HasPrefix(call.name, "Describe") && call.seq > firstTerminate {
+					t.Errorf("%s was called after the first terminate", call.name)
 				}
 			}
 		})
 	}
 }
 
-func TestGroupInstances(t *testing.T) {
-	runTest := func(t *testing.T, asg *autoscaling.Group, i int, oldIds, newIds []string) {
-		ec2Svc := &mockEc2Svc{
-			autodescribe: true,
-		}
-		oldInstances, newInstances, err := groupInstances(asg, ec2Svc, false)
-		if err != nil {
-			t.Errorf("unexpected error grouping instances: %v", err)
-			return
-		}
-		oldList := make([]string, 0)
-		newList := make([]string, 0)
-		for _, i := range oldInstances {
-			oldList = append(oldList, *i.InstanceId)
-		}
-		for _, i := range newInstances {
-			newList = append(newList, *i.InstanceId)
-		}
-		if !testStringEq(oldList, oldIds) {
-			t.Errorf("%d: mismatched old Ids. Actual %v, expected %v", i, oldList, oldIds)
-		}
-		if !testStringEq(newList, newIds) {
-			t.Errorf("%d: mismatched new Ids. Actual %v, expected %v", i, newList, newIds)
+func TestAdjustConcurrentDrains(t *testing.T) {
+	// every group is part way through a roll and ready to have an old node drained and terminated
+	names := []string{"asg1", "asg2", "asg3", "asg4"}
+	groups := map[string]*autoscaling.Group{}
+	for i, n := range names {
+		name := n
+		lcName := "lconfig"
+		oldLcName := fmt.Sprintf("old%s", lcName)
+		myHealthy := healthy
+		groups[name] = &autoscaling.Group{
+			AutoScalingGroupName:    &name,
+			DesiredCapacity:         aws.Int64(3),
+			MaxSize:                 aws.Int64(3),
+			LaunchConfigurationName: &lcName,
+			Instances: []*autoscaling.Instance{
+				{InstanceId: aws.String(fmt.Sprintf("%d-old", i)), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+				{InstanceId: aws.String(fmt.Sprintf("%d-new1", i)), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+				{InstanceId: aws.String(fmt.Sprintf("%d-new2", i)), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+			},
 		}
 	}
+	drainDelay := 200 * time.Millisecond
+	for _, concurrency := range []int{1, 4} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			asgSvc := &mockAsgSvc{groups: groups}
+			handler := &testReadyHandler{drainDelay: drainDelay}
+			state := newRollerState()
+			for _, name := range names {
+				state.setOriginalDesired(name, 2)
+			}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              names,
+				Drain:             true,
+				Concurrency:       concurrency,
+			}
+			start := time.Now()
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, handler, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			elapsed := time.Since(start)
+			terminated := make([]string, 0)
+			for _, c := range asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup") {
+				terminated = append(terminated, *c.params[0].(*autoscaling.TerminateInstanceInAutoScalingGroupInput).InstanceId)
+			}
+			sort.Strings(terminated)
+			if !testStringEq(terminated, []string{"0-old", "1-old", "2-old", "3-old"}) {
+				t.Errorf("mismatched terminated instances, actual %v", terminated)
+			}
+			// the drains of the groups overlap only when calculated concurrently
+			serial := time.Duration(len(names)) * drainDelay
+			switch {
+			case concurrency == 1 && elapsed < serial:
+				t.Errorf("drains took %v, expected at least %v one at a time", elapsed, serial)
+			case concurrency > 1 && elapsed >= serial:
+				t.Errorf("drains took %v, expected less than %v concurrently", elapsed, serial)
+			}
+		})
+	}
+}
+func TestAdjustRefreshOriginalDesired(t *testing.T) {
 	tests := []struct {
-		oldIds []string
-		newIds []string
+		desc             string
+		refresh          bool
+		steady           bool
+		expectTag        bool
+		expectSetDesired bool
 	}{
-		{[]string{"1", "2"}, []string{"3"}},
-		{[]string{"1", "2", "3"}, []string{}},
-		{[]string{}, []string{"1", "2", "3"}},
-		{[]string{}, []string{"1", "2", "$D"}},
+		{"refresh steady group", true, true, true, false},
+		{"refresh not enabled", false, true, false, true},
+		{"group not known to be steady", true, false, false, true},
 	}
-	t.Run("launchconfiguration", func(t *testing.T) {
-		for i, tt := range tests {
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			name := "myasg"
+			lcName := "lconfig"
+			myHealthy := healthy
 			instances := make([]*autoscaling.Instance, 0)
-			lcName := "lcname"
-			lcNameNew := lcName
-			lcNameOld := fmt.Sprintf("old-%s", lcName)
-			for _, instance := range tt.oldIds {
-				id := instance
+			for _, id := range []string{"1", "2", "3", "4", "5"} {
+				idd := id
 				instances = append(instances, &autoscaling.Instance{
-					InstanceId:              &id,
-					LaunchConfigurationName: &lcNameOld,
+					InstanceId:              &idd,
+					LaunchConfigurationName: &lcName,
+					HealthStatus:            &myHealthy,
 				})
 			}
-			for _, instance := range tt.newIds {
-				id := instance
-				instances = append(instances, &autoscaling.Instance{
-					InstanceId:              &id,
-					LaunchConfigurationName: &lcNameNew,
-				})
+			// the tag says 3, but desired has been raised to 5 with no outdated instances
+			asgSvc := &mockAsgSvc{
+				groups: map[string]*autoscaling.Group{
+					name: {
+						AutoScalingGroupName:    &name,
+						DesiredCapacity:         aws.Int64(5),
+						MaxSize:                 aws.Int64(10),
+						LaunchConfigurationName: &lcName,
+						Instances:               instances,
+						Tags: []*autoscaling.TagDescription{
+							{
+								Key:          aws.String(asgTagNameOriginalDesired),
+								ResourceId:   &name,
+								ResourceType: aws.String("auto-scaling-group"),
+								Value:        aws.String("3"),
+							},
+						},
+					},
+				},
 			}
-			// construct the Group we will pass
-			asg := &autoscaling.Group{
-				LaunchConfigurationName: &lcName,
-				Instances:               instances,
+			state := newRollerState()
+			state.steady[name] = tt.steady
+			configs := Configs{
+				KubernetesEnabled:      kubernetesEnabled,
+				ASGS:                   []string{name},
+				OriginalDesiredOnTag:   true,
+				RefreshOriginalDesired: tt.refresh,
 			}
-			runTest(t, asg, i, tt.oldIds, tt.newIds)
-		}
-	})
-	t.Run("launchtemplate", func(t *testing.T) {
-		for i, tt := range tests {
-			instances := make([]*autoscaling.Instance, 0)
-			ltName := "lt1"
-			ltNameNew := ltName
-			ltNameOld := fmt.Sprintf("old-%s", ltName)
-			for _, instance := range tt.oldIds {
-				id := instance
-				instances = append(instances, &autoscaling.Instance{
-					InstanceId:     &id,
-					LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: &ltNameOld},
-				})
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
 			}
-			for _, instance := range tt.newIds {
-				id := instance
-				instances = append(instances, &autoscaling.Instance{
-					InstanceId:     &id,
-					LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: &ltNameNew},
-				})
+			tagCalls := asgSvc.counter.filterByName("CreateOrUpdateTags")
+			switch {
+			case tt.expectTag && len(tagCalls) != 1:
+				t.Errorf("expected 1 CreateOrUpdateTags call, had %d", len(tagCalls))
+			case tt.expectTag && *tagCalls[0].params[0].(*autoscaling.CreateOrUpdateTagsInput).Tags[0].Value != "5":
+				t.Errorf("expected tag to be updated to 5, was %s", *tagCalls[0].params[0].(*autoscaling.CreateOrUpdateTagsInput).Tags[0].Value)
+			case !tt.expectTag && len(tagCalls) != 0:
+				t.Errorf("expected no CreateOrUpdateTags calls, had %d", len(tagCalls))
 			}
-			// construct the Group we will pass
-			asg := &autoscaling.Group{
-				LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: &ltName},
-				Instances:      instances,
+			desiredCalls := asgSvc.counter.filterByName("SetDesiredCapacity")
+			switch {
+			case tt.expectSetDesired && len(desiredCalls) != 1:
+				t.Errorf("expected 1 SetDesiredCapacity call, had %d", len(desiredCalls))
+			case tt.expectSetDesired && *desiredCalls[0].params[0].(*autoscaling.SetDesiredCapacityInput).DesiredCapacity != 3:
+				t.Errorf("expected desired to be returned to 3")
+			case !tt.expectSetDesired && len(desiredCalls) != 0:
+				t.Errorf("expected no SetDesiredCapacity calls, had %d", len(desiredCalls))
 			}
-			runTest(t, asg, i, tt.oldIds, tt.newIds)
-		}
-	})
-	t.Run("launchtemplatemixedinstances", func(t *testing.T) {
-		for i, tt := range tests {
-			instances := make([]*autoscaling.Instance, 0)
-			ltName := "lt1"
-			ltNameNew := ltName
-			ltNameOld := fmt.Sprintf("old-%s", ltName)
-			for _, instance := range tt.oldIds {
-				id := instance
-				instances = append(instances, &autoscaling.Instance{
-					InstanceId:     &id,
-					LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: &ltNameOld},
-				})
+			expectedOriginal := int64(3)
+			if tt.expectTag {
+				expectedOriginal = 5
 			}
-			for _, instance := range tt.newIds {
-				id := instance
-				instances = append(instances, &autoscaling.Instance{
-					InstanceId:     &id,
-					LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: &ltNameNew},
-				})
+			if state.originalDesired[name] != expectedOriginal {
+				t.Errorf("mismatched original desired, actual %d expected %d", state.originalDesired[name], expectedOriginal)
 			}
-			// construct the Group we will pass
-			asg := &autoscaling.Group{
-				MixedInstancesPolicy: &autoscaling.MixedInstancesPolicy{
+		})
+	}
+}
+
+func TestAdjustDesiredChangedBetweenLoops(t *testing.T) {
+	tests := []struct {
+		desc             string
+		tag              bool
+		oldInstances     bool
+		originalDesired  int64
+		expectSetDesired []int64
+	}{
+		// without a stored value, a change made while steady is taken up, as when guessing afresh each time
+		{"steady", false, false, 5, []int64{}},
+		// a stored value is kept, and the group returned to it
+		{"steady on tag", true, false, 2, []int64{2}},
+		// part way through a roll, the change is not taken for the original, any more than the surge is
+		{"rolling", false, true, 2, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			instanceLc := &lcName
+			if tt.oldInstances {
+				instanceLc = &oldLcName
+			}
+			tags := make([]*autoscaling.TagDescription, 0)
+			if tt.tag {
+				tags = append(tags, &autoscaling.TagDescription{Key: aws.String(asgTagNameOriginalDesired), ResourceId: &name, ResourceType: aws.String("auto-scaling-group"), Value: aws.String("2")})
+			}
+			group := &autoscaling.Group{
+				AutoScalingGroupName:    &name,
+				DesiredCapacity:         aws.Int64(2),
+				MaxSize:                 aws.Int64(10),
+				LaunchConfigurationName: &lcName,
+				Instances: []*autoscaling.Instance{
+					{InstanceId: aws.String("1"), LaunchConfigurationName: instanceLc, HealthStatus: &myHealthy},
+					{InstanceId: aws.String("2"), LaunchConfigurationName: instanceLc, HealthStatus: &myHealthy},
+				},
+				Tags: tags,
+			}
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{name: group}}
+			state := newRollerState()
+			configs := Configs{
+				KubernetesEnabled:    kubernetesEnabled,
+				ASGS:                 []string{name},
+				OriginalDesiredOnTag: tt.tag,
+				InitialSurge:         1,
+				MaxTerminate:         1,
+				MaxSurge:             -1,
+				MaxUnavailable:       -1,
+			}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error on first loop: %v", err)
+			}
+			// between loops, someone changes desired by hand
+			group.DesiredCapacity = aws.Int64(5)
+			asgSvc.counter = funcCounter{}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error on second loop: %v", err)
+			}
+			if original, _ := state.getOriginalDesired(name); original != tt.originalDesired {
+				t.Errorf("mismatched original desired, actual %d expected %d", original, tt.originalDesired)
+			}
+			if tt.expectSetDesired == nil {
+				return
+			}
+			setDesired := make([]int64, 0)
+			for _, c := range asgSvc.counter.filterByName("SetDesiredCapacity") {
+				setDesired = append(setDesired, *c.params[0].(*autoscaling.SetDesiredCapacityInput).DesiredCapacity)
+			}
+			if fmt.Sprint(setDesired) != fmt.Sprint(tt.expectSetDesired) {
+				t.Errorf("mismatched desired counts, actual %v expected %v", setDesired, tt.expectSetDesired)
+			}
+		})
+	}
+}
+
+func TestPopulateOriginalDesiredConcurrent(t *testing.T) {
+	// run with -race to catch unsafe access to the state
+	groups := map[string]*autoscaling.Group{}
+	asgs := make([]*autoscaling.Group, 0)
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("asg%d", i)
+		group := &autoscaling.Group{
+			AutoScalingGroupName: aws.String(name),
+			DesiredCapacity:      aws.Int64(int64(i)),
+		}
+		// every other group already has the tag, with a different value from its current desired
+		if i%2 == 0 {
+			group.Tags = []*autoscaling.TagDescription{
+				{
+					Key:          aws.String(asgTagNameOriginalDesired),
+					ResourceId:   aws.String(name),
+					ResourceType: aws.String("auto-scaling-group"),
+					Value:        aws.String(fmt.Sprintf("%d", i+100)),
+				},
+			}
+		}
+		groups[name] = group
+		asgs = append(asgs, group)
+	}
+	asgSvc := &mockAsgSvc{groups: groups}
+	state := newRollerState()
+	if err := populateOriginalDesired(state, asgs, &tagStateStore{asgSvc: asgSvc, batchSize: 10}, Configs{OriginalDesiredOnTag: true, DuplicateDesiredTags: duplicateDesiredTagsMax, DescribeConcurrency: 8, TagBatchSize: 10}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		expected := int64(i)
+		if i%2 == 0 {
+			expected = int64(i + 100)
+		}
+		actual, ok := state.getOriginalDesired(fmt.Sprintf("asg%d", i))
+		if !ok || actual != expected {
+			t.Errorf("asg%d: mismatched original desired, actual %d (known %v) expected %d", i, actual, ok, expected)
+		}
+	}
+	// the 25 groups without the tag are tagged in batches of 10
+	if tagCalls := asgSvc.counter.filterByName("CreateOrUpdateTags"); len(tagCalls) != 3 {
+		t.Errorf("expected 3 CreateOrUpdateTags calls, had %d", len(tagCalls))
+	}
+}
+
+func TestPopulateOriginalDesiredBatched(t *testing.T) {
+	tests := []struct {
+		desc      string
+		batchSize int
+		tagErrs   []error
+		batches   [][]string
+		err       bool
+		sleeps    []time.Duration
+	}{
+		{"single batch", 20, nil, [][]string{{"asg0", "asg1", "asg2", "asg3", "asg4"}}, false, nil},
+		{"several batches", 2, nil, [][]string{{"asg0", "asg1"}, {"asg2", "asg3"}, {"asg4"}}, false, nil},
+		{"unset batch size", 0, nil, [][]string{{"asg0"}, {"asg1"}, {"asg2"}, {"asg3"}, {"asg4"}}, false, nil},
+		{"retry on contention", 20,
+			[]error{awserr.New(autoscaling.ErrCodeResourceContentionFault, "contention", nil), awserr.New(autoscaling.ErrCodeResourceContentionFault, "contention", nil)},
+			[][]string{{"asg0", "asg1", "asg2", "asg3", "asg4"}, {"asg0", "asg1", "asg2", "asg3", "asg4"}, {"asg0", "asg1", "asg2", "asg3", "asg4"}}, false,
+			[]time.Duration{time.Second, 2 * time.Second}},
+		{"no retry on other errors", 20,
+			[]error{awserr.New(autoscaling.ErrCodeLimitExceededFault, "limit", nil)},
+			[][]string{{"asg0", "asg1", "asg2", "asg3", "asg4"}}, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// back off without actually waiting
+			sleeps := make([]time.Duration, 0)
+			sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+			defer func() { sleep = time.Sleep }()
+			groups := map[string]*autoscaling.Group{}
+			asgs := make([]*autoscaling.Group, 0)
+			for i := 0; i < 5; i++ {
+				name := fmt.Sprintf("asg%d", i)
+				group := &autoscaling.Group{
+					AutoScalingGroupName: aws.String(name),
+					DesiredCapacity:      aws.Int64(int64(i)),
+				}
+				groups[name] = group
+				asgs = append(asgs, group)
+			}
+			asgSvc := &mockAsgSvc{groups: groups, tagErrs: tt.tagErrs}
+			err := populateOriginalDesired(newRollerState(), asgs, &tagStateStore{asgSvc: asgSvc, batchSize: tt.batchSize}, Configs{OriginalDesiredOnTag: true, DuplicateDesiredTags: duplicateDesiredTagsMax, DescribeConcurrency: 4, TagBatchSize: tt.batchSize})
+			switch {
+			case tt.err && err == nil:
+				t.Errorf("expected error, had none")
+			case !tt.err && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			}
+			batches := make([][]string, 0)
+			for _, c := range asgSvc.counter.filterByName("CreateOrUpdateTags") {
+				batch := make([]string, 0)
+				for _, tag := range c.params[0].(*autoscaling.CreateOrUpdateTagsInput).Tags {
+					batch = append(batch, *tag.ResourceId)
+				}
+				batches = append(batches, batch)
+			}
+			if !reflect.DeepEqual(batches, tt.batches) {
+				t.Errorf("mismatched batches of tags, actual %v expected %v", batches, tt.batches)
+			}
+			if fmt.Sprint(sleeps) != fmt.Sprint(tt.sleeps) {
+				t.Errorf("mismatched backoff, actual %v expected %v", sleeps, tt.sleeps)
+			}
+		})
+	}
+}
+
+func TestPopulateOriginalDesiredDuplicateTags(t *testing.T) {
+	tests := []struct {
+		desc       string
+		values     []string
+		duplicates string
+		original   int64
+		retagged   []string
+		err        bool
+	}{
+		{"no tag", []string{}, duplicateDesiredTagsMax, 5, []string{"5"}, false},
+		{"single tag", []string{"3"}, duplicateDesiredTagsMax, 3, []string{}, false},
+		{"duplicates use max", []string{"3", "4"}, duplicateDesiredTagsMax, 4, []string{"4"}, false},
+		{"duplicates use min", []string{"4", "3"}, duplicateDesiredTagsMin, 3, []string{"3"}, false},
+		{"duplicates error", []string{"3", "4"}, duplicateDesiredTagsError, 0, []string{}, true},
+		{"same duplicates", []string{"3", "3"}, duplicateDesiredTagsMax, 3, []string{"3"}, false},
+		{"invalid duplicate", []string{"3", "x"}, duplicateDesiredTagsMax, 0, []string{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			name := "myasg"
+			tags := make([]*autoscaling.TagDescription, 0)
+			for _, v := range tt.values {
+				tags = append(tags, &autoscaling.TagDescription{
+					Key:          aws.String(asgTagNameOriginalDesired),
+					ResourceId:   aws.String(name),
+					ResourceType: aws.String("auto-scaling-group"),
+					Value:        aws.String(v),
+				})
+			}
+			group := &autoscaling.Group{
+				AutoScalingGroupName: aws.String(name),
+				DesiredCapacity:      aws.Int64(5),
+				Tags:                 tags,
+			}
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{name: group}}
+			state := newRollerState()
+			err := populateOriginalDesired(state, []*autoscaling.Group{group}, &tagStateStore{asgSvc: asgSvc}, Configs{OriginalDesiredOnTag: true, DuplicateDesiredTags: tt.duplicates})
+			original, _ := state.getOriginalDesired(name)
+			retagged := make([]string, 0)
+			for _, c := range asgSvc.counter.filterByName("CreateOrUpdateTags") {
+				retagged = append(retagged, *c.params[0].(*autoscaling.CreateOrUpdateTagsInput).Tags[0].Value)
+			}
+			switch {
+			case tt.err && err == nil:
+				t.Errorf("expected error, had original desired %d", original)
+			case !tt.err && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case original != tt.original:
+				t.Errorf("mismatched original desired, actual %d expected %d", original, tt.original)
+			case !testStringEq(retagged, tt.retagged):
+				t.Errorf("mismatched tag values set, actual %v expected %v", retagged, tt.retagged)
+			}
+		})
+	}
+}
+
+func TestAdjustTerminateViaEC2(t *testing.T) {
+	// each group is part way through a roll, with enough new healthy instances to terminate two old ones
+	names := []string{"myasg", "anotherasg"}
+	groups := map[string]*autoscaling.Group{}
+	for _, n := range names {
+		name := n
+		lcName := "lconfig"
+		oldLcName := fmt.Sprintf("old%s", lcName)
+		myHealthy := healthy
+		instances := make([]*autoscaling.Instance, 0)
+		for i := 0; i < 3; i++ {
+			id := fmt.Sprintf("%s-old%d", name, i)
+			instances = append(instances, &autoscaling.Instance{InstanceId: &id, LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy})
+		}
+		for i := 0; i < 2; i++ {
+			id := fmt.Sprintf("%s-new%d", name, i)
+			instances = append(instances, &autoscaling.Instance{InstanceId: &id, LaunchConfigurationName: &lcName, HealthStatus: &myHealthy})
+		}
+		groups[name] = &autoscaling.Group{
+			AutoScalingGroupName:    &name,
+			DesiredCapacity:         aws.Int64(4),
+			MaxSize:                 aws.Int64(4),
+			LaunchConfigurationName: &lcName,
+			Instances:               instances,
+		}
+	}
+	tests := []struct {
+		desc            string
+		viaEC2          bool
+		maxTerminate    int
+		ec2Calls        int
+		asgCalls        int
+		terminatedCount int
+	}{
+		{"via ASG one at a time", false, 1, 0, 2, 2},
+		{"via ASG two at a time", false, 2, 0, 4, 4},
+		{"via EC2 one at a time", true, 1, 1, 0, 2},
+		{"via EC2 two at a time", true, 2, 1, 0, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			asgSvc := &mockAsgSvc{
+				groups: groups,
+			}
+			ec2Svc := &mockEc2Svc{
+				autodescribe: true,
+			}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{"myasg": 2, "anotherasg": 2}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              names,
+				MaxTerminate:      tt.maxTerminate,
+				TerminateViaEC2:   tt.viaEC2,
+			}
+			if _, err := adjust(configs, ec2Svc, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			asgCalls := asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup")
+			if len(asgCalls) != tt.asgCalls {
+				t.Errorf("expected %d TerminateInstanceInAutoScalingGroup calls, had %d", tt.asgCalls, len(asgCalls))
+			}
+			ec2Calls := ec2Svc.counter.filterByName("TerminateInstances")
+			if len(ec2Calls) != tt.ec2Calls {
+				t.Fatalf("expected %d TerminateInstances calls, had %d", tt.ec2Calls, len(ec2Calls))
+			}
+			if tt.viaEC2 {
+				ids := ec2Calls[0].params[0].(*ec2.TerminateInstancesInput).InstanceIds
+				if len(ids) != tt.terminatedCount {
+					t.Errorf("expected %d instances in TerminateInstances call, had %v", tt.terminatedCount, aws.StringValueSlice(ids))
+				}
+				for _, id := range ids {
+					if !strings.Contains(*id, "-old") {
+						t.Errorf("requested termination of instance %s, unexpected", *id)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAdjustPaused(t *testing.T) {
+	asgSvc := &mockAsgSvc{}
+	ec2Svc := &mockEc2Svc{}
+	configs := Configs{ASGS: []string{"myasg"}, Paused: true}
+	if _, err := adjust(configs, ec2Svc, asgSvc, nil, nil, nil, nil, nil, nil, newRollerState()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(asgSvc.counter.count) != 0 || len(ec2Svc.counter.count) != 0 {
+		t.Errorf("expected no AWS calls while paused, had %d ASG and %d EC2", len(asgSvc.counter.count), len(ec2Svc.counter.count))
+	}
+}
+
+func TestAdjustMaxRollingASGs(t *testing.T) {
+	names := []string{"asg1", "asg2", "asg3"}
+	tests := []struct {
+		desc        string
+		maxRolling  int
+		asg3Rolling bool
+		setDesired  []string
+		terminated  []string
+	}{
+		{"no limit", 0, false, []string{"asg1", "asg2", "asg3"}, []string{}},
+		{"more eligible than limit", 2, false, []string{"asg1", "asg2"}, []string{}},
+		{"limit above eligible", 5, false, []string{"asg1", "asg2", "asg3"}, []string{}},
+		{"rolling group holds the slot", 1, true, []string{}, []string{"asg3-old0"}},
+		{"rolling group counts towards limit", 2, true, []string{"asg1"}, []string{"asg3-old0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			groups := map[string]*autoscaling.Group{}
+			for _, n := range names {
+				name := n
+				lcName := "lconfig"
+				oldLcName := fmt.Sprintf("old%s", lcName)
+				myHealthy := healthy
+				instances := make([]*autoscaling.Instance, 0)
+				for i := 0; i < 2; i++ {
+					id := fmt.Sprintf("%s-old%d", name, i)
+					instances = append(instances, &autoscaling.Instance{InstanceId: &id, LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy})
+				}
+				desired := int64(2)
+				// part way through a roll, with a new instance ready to replace an old one
+				if name == "asg3" && tt.asg3Rolling {
+					id := fmt.Sprintf("%s-new0", name)
+					instances = append(instances, &autoscaling.Instance{InstanceId: &id, LaunchConfigurationName: &lcName, HealthStatus: &myHealthy})
+					desired = 3
+				}
+				groups[name] = &autoscaling.Group{
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         &desired,
+					MaxSize:                 aws.Int64(10),
+					LaunchConfigurationName: &lcName,
+					Instances:               instances,
+				}
+			}
+			asgSvc := &mockAsgSvc{groups: groups}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{"asg1": 2, "asg2": 2, "asg3": 2}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              names,
+				MaxRollingASGs:    tt.maxRolling,
+			}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			setDesired := make([]string, 0)
+			for _, c := range asgSvc.counter.filterByName("SetDesiredCapacity") {
+				setDesired = append(setDesired, *c.params[0].(*autoscaling.SetDesiredCapacityInput).AutoScalingGroupName)
+			}
+			sort.Strings(setDesired)
+			if !testStringEq(setDesired, tt.setDesired) {
+				t.Errorf("mismatched SetDesiredCapacity groups, actual %v expected %v", setDesired, tt.setDesired)
+			}
+			terminated := make([]string, 0)
+			for _, c := range asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup") {
+				terminated = append(terminated, *c.params[0].(*autoscaling.TerminateInstanceInAutoScalingGroupInput).InstanceId)
+			}
+			if !testStringEq(terminated, tt.terminated) {
+				t.Errorf("mismatched terminated instances, actual %v expected %v", terminated, tt.terminated)
+			}
+			rolling := 0
+			for _, n := range names {
+				if state.isRolling(n) {
+					rolling++
+				}
+			}
+			if tt.maxRolling > 0 && rolling > tt.maxRolling {
+				t.Errorf("%d ASGs rolling, more than the limit of %d", rolling, tt.maxRolling)
+			}
+		})
+	}
+}
+
+func TestAdjustTagTerminated(t *testing.T) {
+	tests := []struct {
+		desc   string
+		tag    bool
+		viaEC2 bool
+		tagErr error
+	}{
+		{"no tag", false, false, nil},
+		{"tag then terminate via ASG", true, false, nil},
+		{"tag then terminate via EC2", true, true, nil},
+		{"tag failure does not block termination", true, false, fmt.Errorf("failed")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// part way through a roll, with a new instance ready to replace an old one
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			asgSvc := &mockAsgSvc{
+				groups: map[string]*autoscaling.Group{
+					name: {
+						AutoScalingGroupName:    &name,
+						DesiredCapacity:         aws.Int64(2),
+						MaxSize:                 aws.Int64(2),
+						LaunchConfigurationName: &lcName,
+						Instances: []*autoscaling.Instance{
+							{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+							{InstanceId: aws.String("2"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+						},
+					},
+				},
+			}
+			ec2Svc := &mockEc2Svc{autodescribe: true, err: tt.tagErr}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 1}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				TagTerminated:     tt.tag,
+				TerminateViaEC2:   tt.viaEC2,
+			}
+			if _, err := adjust(configs, ec2Svc, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			terminateCalls := asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup")
+			if tt.viaEC2 {
+				terminateCalls = ec2Svc.counter.filterByName("TerminateInstances")
+			}
+			if len(terminateCalls) != 1 {
+				t.Fatalf("expected 1 terminate call, had %d", len(terminateCalls))
+			}
+			tagCalls := ec2Svc.counter.filterByName("CreateTags")
+			switch {
+			case !tt.tag && len(tagCalls) != 0:
+				t.Errorf("expected no CreateTags calls, had %d", len(tagCalls))
+			case tt.tag && len(tagCalls) != 1:
+				t.Errorf("expected 1 CreateTags call, had %d", len(tagCalls))
+			case tt.tag && !testStringEq(aws.StringValueSlice(tagCalls[0].params[0].(*ec2.CreateTagsInput).Resources), []string{"1"}):
+				t.Errorf("mismatched tagged instances %v", aws.StringValueSlice(tagCalls[0].params[0].(*ec2.CreateTagsInput).Resources))
+			case tt.tag && tagCalls[0].seq > terminateCalls[0].seq:
+				t.Errorf("instance was tagged after it was terminated")
+			}
+		})
+	}
+}
+
+func TestAdjustRollCompleted(t *testing.T) {
+	tests := []struct {
+		desc       string
+		wasRolling bool
+		desired    int64
+		completed  bool
+	}{
+		{"last step of roll", true, 2, true},
+		{"still rolling", true, 3, false},
+		{"nothing was rolling", false, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// all instances are new, so the group is done once desired is back to its original value
+			name := "myasg"
+			lcName := "lconfig"
+			myHealthy := healthy
+			asgSvc := &mockAsgSvc{
+				groups: map[string]*autoscaling.Group{
+					name: {
+						AutoScalingGroupName:    &name,
+						DesiredCapacity:         aws.Int64(tt.desired),
+						MaxSize:                 aws.Int64(3),
+						LaunchConfigurationName: &lcName,
+						Instances: []*autoscaling.Instance{
+							{InstanceId: aws.String("1"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+							{InstanceId: aws.String("2"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+						},
+					},
+				},
+			}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 2}
+			state.setRolling(name, tt.wasRolling)
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+			}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if completed := state.takeRollCompleted(); completed != tt.completed {
+				t.Errorf("mismatched roll completed, actual %v expected %v", completed, tt.completed)
+			}
+		})
+	}
+}
+
+func TestAdjustPostDrainSleep(t *testing.T) {
+	tests := []struct {
+		desc      string
+		sleep     time.Duration
+		readiness bool
+		drain     bool
+		slept     bool
+	}{
+		{"no sleep", 0, true, true, false},
+		{"sleep after drain", time.Minute, true, true, true},
+		{"no drain", time.Minute, true, false, false},
+		{"no kubernetes", time.Minute, false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// part way through a roll, with a new instance ready to replace an old one
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			asgSvc := &mockAsgSvc{
+				groups: map[string]*autoscaling.Group{
+					name: {
+						AutoScalingGroupName:    &name,
+						DesiredCapacity:         aws.Int64(2),
+						MaxSize:                 aws.Int64(2),
+						LaunchConfigurationName: &lcName,
+						Instances: []*autoscaling.Instance{
+							{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+							{InstanceId: aws.String("2"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+						},
+					},
+				},
+			}
+			var sleepCounter funcCounter
+			sleep = func(d time.Duration) {
+				sleepCounter.add("sleep", d)
+			}
+			defer func() { sleep = time.Sleep }()
+			handler := &testReadyHandler{}
+			var readinessHandler readiness
+			if tt.readiness {
+				readinessHandler = handler
+			}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 1}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				Drain:             tt.drain,
+				PostDrainSleep:    tt.sleep,
+			}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, readinessHandler, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			terminateCalls := asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup")
+			if len(terminateCalls) != 1 {
+				t.Fatalf("expected 1 terminate call, had %d", len(terminateCalls))
+			}
+			sleeps := sleepCounter.filterByName("sleep")
+			switch {
+			case !tt.slept && len(sleeps) != 0:
+				t.Errorf("expected no sleep, had %d", len(sleeps))
+			case tt.slept && len(sleeps) != 1:
+				t.Errorf("expected 1 sleep, had %d", len(sleeps))
+			case tt.slept && sleeps[0].params[0].(time.Duration) != tt.sleep:
+				t.Errorf("mismatched sleep, actual %v expected %v", sleeps[0].params[0], tt.sleep)
+			case tt.slept && sleeps[0].seq < handler.counter.filterByName("prepareTermination")[0].seq:
+				t.Errorf("slept before draining")
+			case tt.slept && sleeps[0].seq > terminateCalls[0].seq:
+				t.Errorf("slept after terminating")
+			}
+		})
+	}
+}
+
+func TestGroupInstances(t *testing.T) {
+	runTest := func(t *testing.T, asg *autoscaling.Group, i int, oldIds, newIds []string) {
+		ec2Svc := &mockEc2Svc{
+			autodescribe: true,
+		}
+		oldInstances, newInstances, err := groupInstances(asg, ec2Svc, nil, nil, false, false, missingTemplateVersionsOld, false)
+		if err != nil {
+			t.Errorf("unexpected error grouping instances: %v", err)
+			return
+		}
+		oldList := make([]string, 0)
+		newList := make([]string, 0)
+		for _, i := range oldInstances {
+			oldList = append(oldList, *i.InstanceId)
+		}
+		for _, i := range newInstances {
+			newList = append(newList, *i.InstanceId)
+		}
+		if !testStringEq(oldList, oldIds) {
+			t.Errorf("%d: mismatched old Ids. Actual %v, expected %v", i, oldList, oldIds)
+		}
+		if !testStringEq(newList, newIds) {
+			t.Errorf("%d: mismatched new Ids. Actual %v, expected %v", i, newList, newIds)
+		}
+	}
+	tests := []struct {
+		oldIds []string
+		newIds []string
+	}{
+		{[]string{"1", "2"}, []string{"3"}},
+		{[]string{"1", "2", "3"}, []string{}},
+		{[]string{}, []string{"1", "2", "3"}},
+		{[]string{}, []string{"1", "2", "$D"}},
+	}
+	t.Run("launchconfiguration", func(t *testing.T) {
+		for i, tt := range tests {
+			instances := make([]*autoscaling.Instance, 0)
+			lcName := "lcname"
+			lcNameNew := lcName
+			lcNameOld := fmt.Sprintf("old-%s", lcName)
+			for _, instance := range tt.oldIds {
+				id := instance
+				instances = append(instances, &autoscaling.Instance{
+					InstanceId:              &id,
+					LaunchConfigurationName: &lcNameOld,
+				})
+			}
+			for _, instance := range tt.newIds {
+				id := instance
+				instances = append(instances, &autoscaling.Instance{
+					InstanceId:              &id,
+					LaunchConfigurationName: &lcNameNew,
+				})
+			}
+			// construct the Group we will pass
+			asg := &autoscaling.Group{
+				LaunchConfigurationName: &lcName,
+				Instances:               instances,
+			}
+			runTest(t, asg, i, tt.oldIds, tt.newIds)
+		}
+	})
+	t.Run("launchtemplate", func(t *testing.T) {
+		for i, tt := range tests {
+			instances := make([]*autoscaling.Instance, 0)
+			ltName := "lt1"
+			ltNameNew := ltName
+			ltNameOld := fmt.Sprintf("old-%s", ltName)
+			for _, instance := range tt.oldIds {
+				id := instance
+				instances = append(instances, &autoscaling.Instance{
+					InstanceId:     &id,
+					LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: &ltNameOld},
+				})
+			}
+			for _, instance := range tt.newIds {
+				id := instance
+				instances = append(instances, &autoscaling.Instance{
+					InstanceId:     &id,
+					LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: &ltNameNew},
+				})
+			}
+			// construct the Group we will pass
+			asg := &autoscaling.Group{
+				LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: &ltName},
+				Instances:      instances,
+			}
+			runTest(t, asg, i, tt.oldIds, tt.newIds)
+		}
+	})
+	t.Run("launchtemplatemixedinstances", func(t *testing.T) {
+		for i, tt := range tests {
+			instances := make([]*autoscaling.Instance, 0)
+			ltName := "lt1"
+			ltNameNew := ltName
+			ltNameOld := fmt.Sprintf("old-%s", ltName)
+			for _, instance := range tt.oldIds {
+				id := instance
+				instances = append(instances, &autoscaling.Instance{
+					InstanceId:     &id,
+					LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: &ltNameOld},
+				})
+			}
+			for _, instance := range tt.newIds {
+				id := instance
+				instances = append(instances, &autoscaling.Instance{
+					InstanceId:     &id,
+					LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: &ltNameNew},
+				})
+			}
+			// construct the Group we will pass
+			asg := &autoscaling.Group{
+				MixedInstancesPolicy: &autoscaling.MixedInstancesPolicy{
 					LaunchTemplate: &autoscaling.LaunchTemplate{
 						LaunchTemplateSpecification: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: &ltName},
 					},
 				},
-				Instances: instances,
+				Instances: instances,
+			}
+			runTest(t, asg, i, tt.oldIds, tt.newIds)
+		}
+	})
+
+}
+
+func TestGroupInstancesLaunchTemplateNameOrID(t *testing.T) {
+	// the same template, lt3 with ID lt-0003, can be referred to by name, by ID or both
+	byName := &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: aws.String("lt3"), Version: aws.String("5")}
+	byID := &autoscaling.LaunchTemplateSpecification{LaunchTemplateId: aws.String("lt-0003"), Version: aws.String("5")}
+	instances := []*autoscaling.Instance{
+		{InstanceId: aws.String("1"), LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: aws.String("lt3"), Version: aws.String("5")}},
+		{InstanceId: aws.String("2"), LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateId: aws.String("lt-0003"), Version: aws.String("5")}},
+		{InstanceId: aws.String("3"), LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateId: aws.String("lt-0003"), LaunchTemplateName: aws.String("lt3"), Version: aws.String("5")}},
+		// an older version of the same template
+		{InstanceId: aws.String("4"), LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: aws.String("lt3"), Version: aws.String("4")}},
+		// a different template
+		{InstanceId: aws.String("5"), LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: aws.String("lt1"), Version: aws.String("5")}},
+		// the name of the template, but the ID of another
+		{InstanceId: aws.String("6"), LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateId: aws.String("lt-0009"), LaunchTemplateName: aws.String("lt3"), Version: aws.String("5")}},
+	}
+	tests := []struct {
+		desc   string
+		target *autoscaling.LaunchTemplateSpecification
+	}{
+		{"ASG refers to template by name", byName},
+		{"ASG refers to template by ID", byID},
+	}
+	for _, tt := range tests {
+		asg := &autoscaling.Group{
+			AutoScalingGroupName: aws.String("myasg"),
+			LaunchTemplate:       tt.target,
+			Instances:            instances,
+		}
+		oldInstances, newInstances, err := groupInstances(asg, &mockEc2Svc{autodescribe: true}, nil, nil, false, false, missingTemplateVersionsOld, false)
+		if err != nil {
+			t.Fatalf("%s: unexpected error grouping instances: %v", tt.desc, err)
+		}
+		if oldIds := mapInstancesIds(oldInstances); !testStringEq(oldIds, []string{"4", "5", "6"}) {
+			t.Errorf("%s: mismatched old Ids. Actual %v", tt.desc, oldIds)
+		}
+		if newIds := mapInstancesIds(newInstances); !testStringEq(newIds, []string{"1", "2", "3"}) {
+			t.Errorf("%s: mismatched new Ids. Actual %v", tt.desc, newIds)
+		}
+	}
+}
+
+func TestGroupInstancesWithoutLaunchConfig(t *testing.T) {
+	lcName := "lcname"
+	oldLcName := "old-lcname"
+	ltName := "lt1"
+	// instance 3 was attached to the ASG, so has neither a launch configuration nor a launch template
+	groups := map[string]*autoscaling.Group{
+		"launchconfiguration": {
+			AutoScalingGroupName:    aws.String("myasg"),
+			LaunchConfigurationName: &lcName,
+			Instances: []*autoscaling.Instance{
+				{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName},
+				{InstanceId: aws.String("2"), LaunchConfigurationName: &lcName},
+				{InstanceId: aws.String("3")},
+			},
+		},
+		"launchtemplate": {
+			AutoScalingGroupName: aws.String("myasg"),
+			LaunchTemplate:       &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: &ltName},
+			Instances: []*autoscaling.Instance{
+				{InstanceId: aws.String("1"), LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: aws.String("old-lt1")}},
+				{InstanceId: aws.String("2"), LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: &ltName}},
+				{InstanceId: aws.String("3")},
+			},
+		},
+	}
+	tests := []struct {
+		skip   bool
+		oldIds []string
+		newIds []string
+	}{
+		{false, []string{"1", "3"}, []string{"2"}},
+		{true, []string{"1"}, []string{"2"}},
+	}
+	for desc, asg := range groups {
+		for _, tt := range tests {
+			oldInstances, newInstances, err := groupInstances(asg, &mockEc2Svc{autodescribe: true}, nil, nil, false, tt.skip, missingTemplateVersionsOld, false)
+			if err != nil {
+				t.Fatalf("%s skip %v: unexpected error grouping instances: %v", desc, tt.skip, err)
+			}
+			if oldIds := mapInstancesIds(oldInstances); !testStringEq(oldIds, tt.oldIds) {
+				t.Errorf("%s skip %v: mismatched old Ids. Actual %v, expected %v", desc, tt.skip, oldIds, tt.oldIds)
+			}
+			if newIds := mapInstancesIds(newInstances); !testStringEq(newIds, tt.newIds) {
+				t.Errorf("%s skip %v: mismatched new Ids. Actual %v, expected %v", desc, tt.skip, newIds, tt.newIds)
+			}
+		}
+	}
+}
+
+func TestGroupInstancesLaunchConfigContents(t *testing.T) {
+	// the launch configuration was recreated with the same name, with a new AMI
+	lcName := "lcname"
+	oldLcName := "old-lcname"
+	lc := &autoscaling.LaunchConfiguration{
+		LaunchConfigurationName: &lcName,
+		ImageId:                 aws.String("ami-new"),
+		InstanceType:            aws.String("m5.large"),
+		UserData:                aws.String("dXNlcmRhdGE="),
+	}
+	asg := &autoscaling.Group{
+		AutoScalingGroupName:    aws.String("myasg"),
+		LaunchConfigurationName: &lcName,
+		Instances: []*autoscaling.Instance{
+			{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName},
+			{InstanceId: aws.String("2"), LaunchConfigurationName: &lcName},
+			{InstanceId: aws.String("3"), LaunchConfigurationName: &lcName},
+			{InstanceId: aws.String("4"), LaunchConfigurationName: &lcName},
+		},
+	}
+	ec2Svc := &mockEc2Svc{
+		instances: map[string]*ec2.Instance{
+			// launched with the previous incarnation of the launch configuration
+			"2": {InstanceId: aws.String("2"), ImageId: aws.String("ami-old"), InstanceType: aws.String("m5.large")},
+			"3": {InstanceId: aws.String("3"), ImageId: aws.String("ami-new"), InstanceType: aws.String("m5.large")},
+			// same AMI, different user data
+			"4": {InstanceId: aws.String("4"), ImageId: aws.String("ami-new"), InstanceType: aws.String("m5.large")},
+		},
+		userData: map[string]string{"2": "dXNlcmRhdGE=", "3": "dXNlcmRhdGE=", "4": "b3RoZXI="},
+	}
+	asgSvc := &mockAsgSvc{
+		launchConfigurations: map[string]*autoscaling.LaunchConfiguration{lcName: lc},
+	}
+	tests := []struct {
+		compare bool
+		oldIds  []string
+		newIds  []string
+	}{
+		{false, []string{"1"}, []string{"2", "3", "4"}},
+		{true, []string{"1", "2", "4"}, []string{"3"}},
+	}
+	for _, tt := range tests {
+		oldInstances, newInstances, err := groupInstances(asg, ec2Svc, asgSvc, nil, tt.compare, false, missingTemplateVersionsOld, false)
+		if err != nil {
+			t.Fatalf("compare %v: unexpected error grouping instances: %v", tt.compare, err)
+		}
+		if oldList := mapInstancesIds(oldInstances); !testStringEq(oldList, tt.oldIds) {
+			t.Errorf("compare %v: mismatched old Ids. Actual %v, expected %v", tt.compare, oldList, tt.oldIds)
+		}
+		if newList := mapInstancesIds(newInstances); !testStringEq(newList, tt.newIds) {
+			t.Errorf("compare %v: mismatched new Ids. Actual %v, expected %v", tt.compare, newList, tt.newIds)
+		}
+	}
+	// a missing launch configuration cannot be compared
+	if _, _, err := groupInstances(asg, ec2Svc, &mockAsgSvc{}, nil, true, false, missingTemplateVersionsOld, false); err == nil {
+		t.Errorf("expected error for missing launch configuration")
+	}
+}
+
+func TestAdjustVerifyReplacement(t *testing.T) {
+	name := "myasg"
+	lcName := "lconfig"
+	oldLcName := "oldlconfig"
+	myHealthy := healthy
+	inService := autoscaling.LifecycleStateInService
+	// instance 2 may have been terminated in a previous run, with the old launch configuration that it keeps
+	// if it is back in service
+	newGroup := func(lifecycleState string) *autoscaling.Group {
+		return &autoscaling.Group{
+			AutoScalingGroupName:    &name,
+			DesiredCapacity:         aws.Int64(3),
+			MaxSize:                 aws.Int64(3),
+			LaunchConfigurationName: &lcName,
+			Instances: []*autoscaling.Instance{
+				{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy, LifecycleState: &inService},
+				{InstanceId: aws.String("2"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy, LifecycleState: &lifecycleState},
+				{InstanceId: aws.String("3"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy, LifecycleState: &inService},
+			},
+		}
+	}
+	tests := []struct {
+		desc           string
+		verify         bool
+		terminated     []string
+		lifecycleState string
+		failed         bool
+	}{
+		{"no verification", false, []string{"2"}, autoscaling.LifecycleStateInService, false},
+		{"verification with reused instance", true, []string{"2"}, autoscaling.LifecycleStateInService, true},
+		{"verification with terminated instance on its way out", true, []string{"2"}, autoscaling.LifecycleStateTerminating, false},
+		{"verification with terminated instance gone", true, []string{"4"}, autoscaling.LifecycleStateInService, false},
+		{"verification with nothing terminated", true, nil, autoscaling.LifecycleStateInService, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			asgSvc := &mockAsgSvc{
+				groups: map[string]*autoscaling.Group{name: newGroup(tt.lifecycleState)},
+			}
+			state := newRollerState()
+			state.originalDesired[name] = 2
+			state.addTerminated(name, tt.terminated, 0)
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				VerifyReplacement: tt.verify,
+			}
+			notifier := &mockNotifier{}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, notifier, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			failed := false
+			for _, e := range notifier.events {
+				if e.kind == rollEventFailed {
+					failed = true
+				}
+			}
+			if failed != tt.failed {
+				t.Errorf("mismatched failed notification, actual %v expected %v", failed, tt.failed)
+			}
+			terminated := make([]string, 0)
+			for _, call := range asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup") {
+				terminated = append(terminated, *call.params[0].(*autoscaling.TerminateInstanceInAutoScalingGroupInput).InstanceId)
+			}
+			if tt.failed && len(terminated) > 0 {
+				t.Errorf("unexpected terminations %v of an ASG with a reused instance", terminated)
+			}
+			// whatever was terminated now should be tracked
+			for _, id := range terminated {
+				if !state.terminated[name][id] {
+					t.Errorf("terminated instance %s not recorded", id)
+				}
+			}
+		})
+	}
+}
+
+func TestAdjustReplacementTimeout(t *testing.T) {
+	// old instance "0" was terminated in the last run, when "1", "2" and "3" were in the ASG
+	tests := []struct {
+		desc       string
+		instances  []string
+		timeout    time.Duration
+		elapsed    time.Duration
+		terminated []string
+		pending    int
+	}{
+		{"replacement joined", []string{"1", "2", "3", "4"}, 10 * time.Minute, time.Hour, []string{"1"}, 1},
+		{"replacement not joined yet", []string{"1", "2", "3"}, 10 * time.Minute, 5 * time.Minute, []string{"1"}, 2},
+		{"replacement overdue", []string{"1", "2", "3"}, 10 * time.Minute, time.Hour, []string{}, 1},
+		{"not verified", []string{"1", "2", "3"}, 0, time.Hour, []string{"1"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			instances := make([]*autoscaling.Instance, 0)
+			for _, id := range tt.instances {
+				lc := &lcName
+				if id == "1" {
+					lc = &oldLcName
+				}
+				instances = append(instances, &autoscaling.Instance{InstanceId: aws.String(id), LaunchConfigurationName: lc, HealthStatus: &myHealthy})
+			}
+			asgSvc := &mockAsgSvc{
+				groups: map[string]*autoscaling.Group{
+					name: {
+						AutoScalingGroupName:    &name,
+						DesiredCapacity:         aws.Int64(3),
+						MaxSize:                 aws.Int64(3),
+						LaunchConfigurationName: &lcName,
+						Instances:               instances,
+					},
+				},
+			}
+			start := time.Now()
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 1}
+			state.now = func() time.Time { return start }
+			state.expectReplacements(name, []*autoscaling.Instance{
+				{InstanceId: aws.String("1")},
+				{InstanceId: aws.String("2")},
+				{InstanceId: aws.String("3")},
+			}, 1)
+			state.now = func() time.Time { return start.Add(tt.elapsed) }
+			configs := Configs{
+				KubernetesEnabled:  kubernetesEnabled,
+				ASGS:               []string{name},
+				ReplacementTimeout: tt.timeout,
+			}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			terminated := make([]string, 0)
+			for _, c := range asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup") {
+				terminated = append(terminated, *c.params[0].(*autoscaling.TerminateInstanceInAutoScalingGroupInput).InstanceId)
+			}
+			if !testStringEq(terminated, tt.terminated) {
+				t.Errorf("mismatched terminated instances, actual %v expected %v", terminated, tt.terminated)
+			}
+			// any termination in this run expects a replacement of its own, if verified
+			if pending := state.replacements[name]; pending == nil || pending.count != tt.pending {
+				t.Errorf("mismatched pending replacements, actual %+v expected %d", pending, tt.pending)
+			}
+		})
+	}
+}
+
+func TestRollerStateReplacements(t *testing.T) {
+	start := time.Now()
+	now := start
+	state := newRollerState()
+	state.now = func() time.Time { return now }
+	instances := func(ids ...string) []*autoscaling.Instance {
+		ret := make([]*autoscaling.Instance, 0)
+		for _, id := range ids {
+			ret = append(ret, &autoscaling.Instance{InstanceId: aws.String(id)})
+		}
+		return ret
+	}
+	if missing, overdue := state.checkReplacements("myasg", instances("1"), time.Hour); missing != 0 || overdue {
+		t.Errorf("expected nothing missing with no terminations, had %d overdue %v", missing, overdue)
+	}
+	// terminate 2 out of 4 instances, in two steps
+	state.expectReplacements("myasg", instances("1", "2", "3", "4"), 1)
+	state.expectReplacements("myasg", instances("2", "3", "4"), 1)
+	if missing, overdue := state.checkReplacements("myasg", instances("3", "4"), time.Hour); missing != 2 || overdue {
+		t.Errorf("expected 2 missing, not overdue, had %d overdue %v", missing, overdue)
+	}
+	now = start.Add(2 * time.Hour)
+	if missing, overdue := state.checkReplacements("myasg", instances("3", "4", "5"), time.Hour); missing != 1 || !overdue {
+		t.Errorf("expected 1 missing, overdue, had %d overdue %v", missing, overdue)
+	}
+	if missing, overdue := state.checkReplacements("myasg", instances("3", "4", "5", "6"), time.Hour); missing != 0 || overdue {
+		t.Errorf("expected nothing missing once replaced, had %d overdue %v", missing, overdue)
+	}
+	if _, ok := state.replacements["myasg"]; ok {
+		t.Errorf("expected replacements to be forgotten once replaced")
+	}
+}
+
+func TestMissingGroups(t *testing.T) {
+	tests := []struct {
+		names    []string
+		existing []string
+		missing  []string
+	}{
+		{[]string{"a", "b"}, []string{"a", "b"}, []string{}},
+		{[]string{"a", "b"}, []string{"b", "a"}, []string{}},
+		{[]string{"a", "b", "c"}, []string{"b"}, []string{"a", "c"}},
+		{[]string{"a"}, []string{}, []string{"a"}},
+		{[]string{}, []string{"a"}, []string{}},
+	}
+	for i, tt := range tests {
+		asgs := make([]*autoscaling.Group, 0)
+		for _, n := range tt.existing {
+			asgs = append(asgs, &autoscaling.Group{AutoScalingGroupName: aws.String(n)})
+		}
+		missing := missingGroups(tt.names, asgs)
+		if !testStringEq(missing, tt.missing) {
+			t.Errorf("%d: mismatched missing groups, actual %v expected %v", i, missing, tt.missing)
+		}
+	}
+}
+
+func TestAdjustMissingGroup(t *testing.T) {
+	name := "myasg"
+	lcName := "lconfig"
+	oldLcName := "oldlconfig"
+	myHealthy := healthy
+	id := "1"
+	tests := []struct {
+		desc        string
+		errOnMiss   bool
+		err         error
+		desiredSets int
+	}{
+		{"warning only", false, nil, 1},
+		{"error", true, fmt.Errorf("configured ASGs not found, skipping: [deletedasg]"), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			asgSvc := &mockAsgSvc{
+				groups: map[string]*autoscaling.Group{
+					name: {
+						AutoScalingGroupName:    &name,
+						DesiredCapacity:         aws.Int64(1),
+						MaxSize:                 aws.Int64(2),
+						LaunchConfigurationName: &lcName,
+						Instances: []*autoscaling.Instance{
+							{InstanceId: &id, LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+						},
+					},
+				},
+			}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name, "deletedasg"},
+				MissingASGError:   tt.errOnMiss,
+			}
+			_, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, newRollerState())
+			if (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && err.Error() != tt.err.Error()) {
+				t.Errorf("mismatched errors, actual %v expected %v", err, tt.err)
+			}
+			if desiredCalls := asgSvc.counter.filterByName("SetDesiredCapacity"); len(desiredCalls) != tt.desiredSets {
+				t.Errorf("expected %d SetDesiredCapacity calls, had %d", tt.desiredSets, len(desiredCalls))
+			}
+		})
+	}
+}
+
+func TestMapInstanceIds(t *testing.T) {
+	ids := []string{"1", "2", "10"}
+	instances := make([]*autoscaling.Instance, 0)
+	for _, i := range ids {
+		id := i
+		instances = append(instances, &autoscaling.Instance{
+			InstanceId: &id,
+		})
+	}
+	m := mapInstancesIds(instances)
+	if !testStringEq(m, ids) {
+		t.Errorf("mismatched ids. Actual %v, expected %v", m, ids)
+	}
+}
+
+func TestCompareLaunchTemplateVersions(t *testing.T) {
+	template := &ec2.LaunchTemplate{
+		DefaultVersionNumber: aws.Int64(25),
+		LatestVersionNumber:  aws.Int64(64),
+	}
+	tests := []struct {
+		lt1      *autoscaling.LaunchTemplateSpecification
+		lt2      *autoscaling.LaunchTemplateSpecification
+		expected bool
+	}{
+		{nil, nil, true},
+		{nil, &autoscaling.LaunchTemplateSpecification{}, false},
+		{&autoscaling.LaunchTemplateSpecification{}, nil, false},
+		{&autoscaling.LaunchTemplateSpecification{}, &autoscaling.LaunchTemplateSpecification{}, true},
+		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("25")}, &autoscaling.LaunchTemplateSpecification{}, false},
+		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("25")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("26")}, false},
+		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("25")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("25")}, true},
+		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("25")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("25")}, true},
+		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("64")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("$Latest")}, true},
+		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("25")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("$Default")}, true},
+		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("$Default")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("$Default")}, true},
+		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("$Latest")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("$Latest")}, true},
+		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("$Default")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("$Latest")}, false},
+		// pinned to a version number, an instance on a dynamic version matches only if it resolves to that number
+		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("25")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("$Latest")}, false},
+		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("64")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("$Default")}, false},
+		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("$Latest")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("63")}, false},
+		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("$Latest")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("64")}, true},
+		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("$Default")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("25")}, true},
+	}
+	for i, tt := range tests {
+		result := compareLaunchTemplateVersions(template, tt.lt1, tt.lt2)
+		if result != tt.expected {
+			t.Errorf("%d: mismatched results, received %v expected %v", i, result, tt.expected)
+		}
+	}
+	// a template without version numbers cannot resolve `$Default` or `$Latest`, so those match nothing
+	noVersions := &ec2.LaunchTemplate{}
+	noVersionsTests := []struct {
+		lt1      *autoscaling.LaunchTemplateSpecification
+		lt2      *autoscaling.LaunchTemplateSpecification
+		expected bool
+	}{
+		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("25")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("25")}, true},
+		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("25")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("$Default")}, false},
+		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("$Latest")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("25")}, false},
+		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("$Latest")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("$Latest")}, false},
+	}
+	for i, tt := range noVersionsTests {
+		result := compareLaunchTemplateVersions(noVersions, tt.lt1, tt.lt2)
+		if result != tt.expected {
+			t.Errorf("no versions %d: mismatched results, received %v expected %v", i, result, tt.expected)
+		}
+	}
+}
+
+func TestGroupInstancesMissingTemplateVersions(t *testing.T) {
+	ltName := "lt4"
+	asg := &autoscaling.Group{
+		AutoScalingGroupName: aws.String("myasg"),
+		LaunchTemplate:       &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: &ltName, Version: aws.String("$Latest")},
+		Instances: []*autoscaling.Instance{
+			{InstanceId: aws.String("1"), LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: &ltName, Version: aws.String("$Latest")}},
+			{InstanceId: aws.String("2"), LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: &ltName, Version: aws.String("3")}},
+		},
+	}
+	oldInstances, newInstances, err := groupInstances(asg, &mockEc2Svc{autodescribe: true}, nil, nil, false, false, missingTemplateVersionsOld, false)
+	if err != nil {
+		t.Fatalf("unexpected error grouping instances: %v", err)
+	}
+	if oldIds := mapInstancesIds(oldInstances); !testStringEq(oldIds, []string{"1", "2"}) {
+		t.Errorf("mismatched old Ids. Actual %v, expected [1 2]", oldIds)
+	}
+	if newIds := mapInstancesIds(newInstances); len(newIds) != 0 {
+		t.Errorf("mismatched new Ids. Actual %v, expected []", newIds)
+	}
+	_, _, err = groupInstances(asg, &mockEc2Svc{autodescribe: true}, nil, nil, false, false, missingTemplateVersionsSkip, false)
+	if _, ok := err.(*missingTemplateVersionsError); !ok {
+		t.Errorf("mismatched error, actual %v expected missing template versions", err)
+	}
+}
+
+func TestGroupInstancesResolveTemplateVersions(t *testing.T) {
+	ltName := "lt4"
+	tests := []struct {
+		desc     string
+		target   string
+		versions map[string]int64
+		old      []string
+		new      []string
+		err      bool
+	}{
+		{"latest", "$Latest", map[string]int64{"$Default": 2, "$Latest": 3}, []string{"2", "3"}, []string{"1", "4"}, false},
+		{"default", "$Default", map[string]int64{"$Default": 2, "$Latest": 3}, []string{"1", "4"}, []string{"2", "3"}, false},
+		{"default is latest", "$Latest", map[string]int64{"$Default": 3}, []string{"2"}, []string{"1", "3", "4"}, false},
+		{"concrete", "2", map[string]int64{"$Default": 2, "$Latest": 3}, []string{"1", "4"}, []string{"2", "3"}, false},
+		// pinned to an older version than the default and latest, so no dynamic version is new
+		{"concrete older", "2", map[string]int64{"$Default": 3, "$Latest": 3}, []string{"1", "3", "4"}, []string{"2"}, false},
+		// pinned to the latest version, with the default older
+		{"concrete latest", "3", map[string]int64{"$Default": 2, "$Latest": 3}, []string{"2", "3"}, []string{"1", "4"}, false},
+		{"not found", "$Latest", map[string]int64{}, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// the template is described without version numbers, so the aliases are resolved by describing them
+			asg := &autoscaling.Group{
+				AutoScalingGroupName: aws.String("myasg"),
+				LaunchTemplate:       &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: &ltName, Version: aws.String(tt.target)},
+				Instances: []*autoscaling.Instance{
+					{InstanceId: aws.String("1"), LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: &ltName, Version: aws.String("3")}},
+					{InstanceId: aws.String("2"), LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: &ltName, Version: aws.String("2")}},
+					{InstanceId: aws.String("3"), LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: &ltName, Version: aws.String("$Default")}},
+					{InstanceId: aws.String("4"), LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: &ltName, Version: aws.String("$Latest")}},
+				},
+			}
+			ec2Svc := &mockEc2Svc{autodescribe: true, templateVersions: tt.versions}
+			oldInstances, newInstances, err := groupInstances(asg, ec2Svc, nil, nil, false, false, missingTemplateVersionsResolve, false)
+			switch {
+			case err != nil && !tt.err:
+				t.Fatalf("unexpected error grouping instances: %v", err)
+			case err == nil && tt.err:
+				t.Fatalf("no error, expected one")
+			case err != nil:
+				return
+			}
+			if oldIds := mapInstancesIds(oldInstances); !testStringEq(oldIds, tt.old) {
+				t.Errorf("mismatched old Ids. Actual %v, expected %v", oldIds, tt.old)
+			}
+			if newIds := mapInstancesIds(newInstances); !testStringEq(newIds, tt.new) {
+				t.Errorf("mismatched new Ids. Actual %v, expected %v", newIds, tt.new)
+			}
+			// the shared template is left without version numbers
+			if validLaunchTemplates["lt4"].LatestVersionNumber != nil || validLaunchTemplates["lt4"].DefaultVersionNumber != nil {
+				t.Errorf("resolving versions changed the described template")
+			}
+		})
+	}
+}
+
+func TestAdjustMissingTemplateVersions(t *testing.T) {
+	tests := []struct {
+		action     string
+		setDesired []int64
+	}{
+		{missingTemplateVersionsOld, []int64{3, 3}},
+		{missingTemplateVersionsSkip, []int64{3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			myHealthy := healthy
+			missing := &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: aws.String("lt4"), Version: aws.String("$Latest")}
+			lc, oldLc := "lconfig", "oldlconfig"
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				"missing": {
+					AutoScalingGroupName: aws.String("missing"),
+					DesiredCapacity:      aws.Int64(2),
+					MaxSize:              aws.Int64(4),
+					LaunchTemplate:       missing,
+					Instances: []*autoscaling.Instance{
+						{InstanceId: aws.String("1"), LaunchTemplate: missing, HealthStatus: &myHealthy},
+						{InstanceId: aws.String("2"), LaunchTemplate: missing, HealthStatus: &myHealthy},
+					},
+				},
+				"other": {
+					AutoScalingGroupName:    aws.String("other"),
+					DesiredCapacity:         aws.Int64(2),
+					MaxSize:                 aws.Int64(4),
+					LaunchConfigurationName: &lc,
+					Instances: []*autoscaling.Instance{
+						{InstanceId: aws.String("3"), LaunchConfigurationName: &oldLc, HealthStatus: &myHealthy},
+						{InstanceId: aws.String("4"), LaunchConfigurationName: &oldLc, HealthStatus: &myHealthy},
+					},
+				},
+			}}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{"missing": 2, "other": 2}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{"missing", "other"},
+				InitialSurge:      1,
+				MaxTerminate:      1,
+				MaxSurge:          -1,
+				MaxUnavailable:    -1,
+				MissingLTVersions: tt.action,
+			}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			setDesired := make([]int64, 0)
+			for _, c := range asgSvc.counter.filterByName("SetDesiredCapacity") {
+				setDesired = append(setDesired, *c.params[0].(*autoscaling.SetDesiredCapacityInput).DesiredCapacity)
+			}
+			if fmt.Sprint(setDesired) != fmt.Sprint(tt.setDesired) {
+				t.Errorf("mismatched desired counts, actual %v expected %v", setDesired, tt.setDesired)
+			}
+		})
+	}
+}
+
+func TestAdjustNoLaunchSpec(t *testing.T) {
+	myHealthy := healthy
+	lc, oldLc := "lconfig", "oldlconfig"
+	asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+		// neither a launch configuration nor a launch template, e.g. misconfigured
+		"nolaunch": {
+			AutoScalingGroupName: aws.String("nolaunch"),
+			DesiredCapacity:      aws.Int64(2),
+			MaxSize:              aws.Int64(4),
+			Instances: []*autoscaling.Instance{
+				{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLc, HealthStatus: &myHealthy},
+				{InstanceId: aws.String("2"), LaunchConfigurationName: &oldLc, HealthStatus: &myHealthy},
+			},
+		},
+		"other": {
+			AutoScalingGroupName:    aws.String("other"),
+			DesiredCapacity:         aws.Int64(2),
+			MaxSize:                 aws.Int64(4),
+			LaunchConfigurationName: &lc,
+			Instances: []*autoscaling.Instance{
+				{InstanceId: aws.String("3"), LaunchConfigurationName: &oldLc, HealthStatus: &myHealthy},
+				{InstanceId: aws.String("4"), LaunchConfigurationName: &oldLc, HealthStatus: &myHealthy},
+			},
+		},
+	}}
+	state := newRollerState()
+	state.originalDesired = map[string]int64{"nolaunch": 2, "other": 2}
+	configs := Configs{
+		KubernetesEnabled: kubernetesEnabled,
+		ASGS:              []string{"nolaunch", "other"},
+		InitialSurge:      1,
+		MaxTerminate:      1,
+		MaxSurge:          -1,
+		MaxUnavailable:    -1,
+	}
+	statuses, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// only the other group is rolled
+	calls := asgSvc.counter.filterByName("SetDesiredCapacity")
+	if len(calls) != 1 || *calls[0].params[0].(*autoscaling.SetDesiredCapacityInput).AutoScalingGroupName != "other" {
+		t.Errorf("expected desired set only for ASG other, had %v", calls)
+	}
+	if len(statuses) != 1 || statuses[0].ASG != "other" {
+		t.Errorf("expected status only for ASG other, had %v", statuses)
+	}
+}
+
+func TestAdjustDesiredAboveMax(t *testing.T) {
+	tests := []struct {
+		desc            string
+		desired         int64
+		originalDesired int64
+		increaseMax     bool
+		updatedMax      []int64
+		setDesired      []int64
+	}{
+		{"within max", 2, 2, false, []int64{}, []int64{3}},
+		{"desired above max", 5, 5, false, []int64{}, []int64{}},
+		{"original desired above max", 4, 5, false, []int64{}, []int64{}},
+		{"desired above max, max increased", 5, 5, true, []int64{5, 6}, []int64{6}},
+		{"original desired above max, max increased", 4, 5, true, []int64{5}, []int64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := fmt.Sprintf("old%s", lcName)
+			myHealthy := healthy
+			instances := make([]*autoscaling.Instance, 0)
+			for i := int64(0); i < tt.desired; i++ {
+				id := fmt.Sprintf("old%d", i)
+				instances = append(instances, &autoscaling.Instance{InstanceId: &id, LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy})
+			}
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(tt.desired),
+					MaxSize:                 aws.Int64(4),
+					LaunchConfigurationName: &lcName,
+					Instances:               instances,
+				},
+			}}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: tt.originalDesired}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				IncreaseMax:       tt.increaseMax,
+			}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			updatedMax := make([]int64, 0)
+			for _, c := range asgSvc.counter.filterByName("UpdateAutoScalingGroup") {
+				updatedMax = append(updatedMax, *c.params[0].(*autoscaling.UpdateAutoScalingGroupInput).MaxSize)
+			}
+			setDesired := make([]int64, 0)
+			for _, c := range asgSvc.counter.filterByName("SetDesiredCapacity") {
+				setDesired = append(setDesired, *c.params[0].(*autoscaling.SetDesiredCapacityInput).DesiredCapacity)
+			}
+			if fmt.Sprint(updatedMax) != fmt.Sprint(tt.updatedMax) {
+				t.Errorf("mismatched max sizes, actual %v expected %v", updatedMax, tt.updatedMax)
+			}
+			if fmt.Sprint(setDesired) != fmt.Sprint(tt.setDesired) {
+				t.Errorf("mismatched desired counts, actual %v expected %v", setDesired, tt.setDesired)
+			}
+		})
+	}
+}
+
+func TestAdjustRestoreMax(t *testing.T) {
+	tests := []struct {
+		desc        string
+		old         int64
+		desired     int64
+		max         int64
+		restoreMax  bool
+		dryRun      bool
+		stateMax    int64
+		tagMax      string
+		updatedMax  []int64
+		taggedMax   []string
+		deletedTags int
+	}{
+		{"start of roll raises max", 2, 2, 2, false, false, -1, "", []int64{3}, []string{}, 0},
+		{"start of roll records max", 2, 2, 2, true, false, -1, "", []int64{3}, []string{"2"}, 0},
+		{"start of roll keeps recorded max", 2, 2, 2, true, false, 1, "", []int64{3}, []string{}, 0},
+		{"start of roll reads max from tag", 2, 2, 2, true, false, -1, "1", []int64{3}, []string{}, 0},
+		{"done leaves max", 0, 2, 3, false, false, 2, "", []int64{}, []string{}, 0},
+		{"done restores max", 0, 2, 3, true, false, 2, "", []int64{2}, []string{}, 1},
+		{"done restores max from tag", 0, 2, 3, true, false, -1, "2", []int64{2}, []string{}, 1},
+		{"done restores max no lower than desired", 0, 2, 3, true, false, 1, "", []int64{2}, []string{}, 1},
+		{"done with max unchanged", 0, 2, 2, true, false, 2, "", []int64{}, []string{}, 1},
+		{"done without recorded max", 0, 2, 3, true, false, -1, "", []int64{}, []string{}, 0},
+		{"start of roll dry run records nothing", 2, 2, 2, true, true, -1, "", []int64{}, []string{}, 0},
+		{"done dry run keeps recorded max", 0, 2, 3, true, true, 2, "", []int64{}, []string{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := fmt.Sprintf("old%s", lcName)
+			myHealthy := healthy
+			instances := make([]*autoscaling.Instance, 0)
+			for i := int64(0); i < tt.desired; i++ {
+				id, instanceLc := fmt.Sprintf("new%d", i), lcName
+				if i < tt.old {
+					id, instanceLc = fmt.Sprintf("old%d", i), oldLcName
+				}
+				instances = append(instances, &autoscaling.Instance{InstanceId: aws.String(id), LaunchConfigurationName: aws.String(instanceLc), HealthStatus: &myHealthy})
+			}
+			tags := make([]*autoscaling.TagDescription, 0)
+			if tt.tagMax != "" {
+				tags = append(tags, &autoscaling.TagDescription{Key: aws.String(asgTagNameOriginalMax), Value: aws.String(tt.tagMax)})
+			}
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(tt.desired),
+					MaxSize:                 aws.Int64(tt.max),
+					LaunchConfigurationName: &lcName,
+					Instances:               instances,
+					Tags:                    tags,
+				},
+			}}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: tt.desired}
+			if tt.stateMax >= 0 {
+				state.originalMax = map[string]int64{name: tt.stateMax}
+			}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				IncreaseMax:       true,
+				RestoreMax:        tt.restoreMax,
+				DryRun:            tt.dryRun,
+				InitialSurge:      1,
+				MaxTerminate:      1,
+				MaxSurge:          -1,
+				MaxUnavailable:    -1,
+			}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			updatedMax := make([]int64, 0)
+			for _, c := range asgSvc.counter.filterByName("UpdateAutoScalingGroup") {
+				updatedMax = append(updatedMax, *c.params[0].(*autoscaling.UpdateAutoScalingGroupInput).MaxSize)
+			}
+			taggedMax := make([]string, 0)
+			for _, c := range asgSvc.counter.filterByName("CreateOrUpdateTags") {
+				for _, tag := range c.params[0].(*autoscaling.CreateOrUpdateTagsInput).Tags {
+					if *tag.Key == asgTagNameOriginalMax {
+						taggedMax = append(taggedMax, *tag.Value)
+					}
+				}
+			}
+			if fmt.Sprint(updatedMax) != fmt.Sprint(tt.updatedMax) {
+				t.Errorf("mismatched max sizes, actual %v expected %v", updatedMax, tt.updatedMax)
+			}
+			if fmt.Sprint(taggedMax) != fmt.Sprint(tt.taggedMax) {
+				t.Errorf("mismatched original max tags, actual %v expected %v", taggedMax, tt.taggedMax)
+			}
+			if deleted := len(asgSvc.counter.filterByName("DeleteTags")); deleted != tt.deletedTags {
+				t.Errorf("mismatched tag deletions, actual %d expected %d", deleted, tt.deletedTags)
+			}
+			if _, ok := state.getOriginalMax(name); ok && tt.deletedTags > 0 {
+				t.Errorf("expected original max to be cleared once restored")
+			}
+			// a dry run leaves the state as it was
+			if _, ok := state.getOriginalMax(name); tt.dryRun && ok != (tt.stateMax >= 0) {
+				t.Errorf("mismatched original max in state after dry run, recorded %v", ok)
+			}
+		})
+	}
+}
+
+func TestAdjustLogPlan(t *testing.T) {
+	tests := []struct {
+		desc    string
+		logPlan bool
+		desired int64
+		plan    string
+	}{
+		{"disabled", false, 2, ""},
+		{"start of roll", true, 2, "[myasg] plan: desired 2 -> 3 (original 2), terminate none"},
+		{"terminate", true, 3, "[myasg] plan: desired 3 unchanged (original 2), terminate 1 [1]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			instances := []*autoscaling.Instance{
+				{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+				{InstanceId: aws.String("2"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+			}
+			if tt.desired > 2 {
+				instances = append(instances, &autoscaling.Instance{InstanceId: aws.String("3"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy})
+			}
+			asgSvc := &mockAsgSvc{
+				groups: map[string]*autoscaling.Group{
+					name: {
+						AutoScalingGroupName:    &name,
+						DesiredCapacity:         aws.Int64(tt.desired),
+						MaxSize:                 aws.Int64(4),
+						LaunchConfigurationName: &lcName,
+						Instances:               instances,
+					},
+				},
+			}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 2}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				LogPlan:           tt.logPlan,
+			}
+			var buf bytes.Buffer
+			log.SetOutput(&buf)
+			_, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state)
+			log.SetOutput(os.Stderr)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			plans := make([]string, 0)
+			for _, line := range strings.Split(buf.String(), "\n") {
+				if i := strings.Index(line, "["+name+"] plan:"); i >= 0 {
+					plans = append(plans, line[i:])
+				}
+			}
+			switch {
+			case tt.plan == "" && len(plans) != 0:
+				t.Errorf("expected no plan, logged %v", plans)
+			case tt.plan != "" && !testStringEq(plans, []string{tt.plan}):
+				t.Errorf("mismatched plan, actual %v expected %s", plans, tt.plan)
+			}
+		})
+	}
+}
+
+func TestAdjustMaxDrainsPerPool(t *testing.T) {
+	tests := []struct {
+		desc       string
+		label      string
+		maxDrains  int
+		terminated []string
+	}{
+		{"no cap", "", 0, []string{"1", "2", "3", "4"}},
+		{"label without cap", "pool", 0, []string{"1", "2", "3", "4"}},
+		{"one per pool", "pool", 1, []string{"1", "4"}},
+		{"two per pool", "pool", 2, []string{"1", "2", "4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// both groups part way through a roll, with new instances ready to replace both old ones
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			groups := map[string]*autoscaling.Group{}
+			for n, old := range map[string][]string{"asg1": {"1", "2"}, "asg2": {"3", "4"}} {
+				name := n
+				instances := make([]*autoscaling.Instance, 0)
+				for _, id := range old {
+					instances = append(instances, &autoscaling.Instance{InstanceId: aws.String(id), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy})
+					instances = append(instances, &autoscaling.Instance{InstanceId: aws.String("new" + id), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy})
+				}
+				groups[name] = &autoscaling.Group{
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(4),
+					MaxSize:                 aws.Int64(4),
+					LaunchConfigurationName: &lcName,
+					Instances:               instances,
+				}
+			}
+			asgSvc := &mockAsgSvc{groups: groups}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{"asg1": 2, "asg2": 2}
+			// node 4 is in a pool of its own; the rest are in the same pool
+			handler := &testReadyHandler{nodeLabels: map[string]string{"1": "a", "2": "a", "3": "a", "4": "b"}}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{"asg1", "asg2"},
+				MaxTerminate:      2,
+				Drain:             true,
+				NodePoolLabel:     tt.label,
+				MaxDrainsPerPool:  tt.maxDrains,
+			}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, handler, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			terminated := make([]string, 0)
+			for _, c := range asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup") {
+				terminated = append(terminated, *c.params[0].(*autoscaling.TerminateInstanceInAutoScalingGroupInput).InstanceId)
+			}
+			sort.Strings(terminated)
+			if !testStringEq(terminated, tt.terminated) {
+				t.Errorf("mismatched terminated instances, actual %v expected %v", terminated, tt.terminated)
+			}
+			drained := make([]string, 0)
+			for _, c := range handler.counter.filterByName("prepareTermination") {
+				drained = append(drained, c.params[1].([]string)...)
+			}
+			sort.Strings(drained)
+			if !testStringEq(drained, tt.terminated) {
+				t.Errorf("mismatched drained instances, actual %v expected %v", drained, tt.terminated)
+			}
+		})
+	}
+}
+
+func TestAdjustTerminateSpotFirst(t *testing.T) {
+	tests := []struct {
+		desc       string
+		spotFirst  bool
+		spot       []string
+		terminated []string
+	}{
+		{"in ASG order", false, []string{"3", "4"}, []string{"1", "2"}},
+		{"spot first", true, []string{"3", "4"}, []string{"3", "4"}},
+		{"spot first, then on-demand", true, []string{"2"}, []string{"2", "1"}},
+		{"no spot", true, []string{}, []string{"1", "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// part way through a roll, with new instances ready to replace two of the old ones
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			instances := make([]*autoscaling.Instance, 0)
+			ec2Instances := map[string]*ec2.Instance{}
+			for _, id := range []string{"1", "2", "3", "4"} {
+				instances = append(instances, &autoscaling.Instance{InstanceId: aws.String(id), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy})
+				ec2Instances[id] = &ec2.Instance{InstanceId: aws.String(id), PrivateDnsName: aws.String("host" + id)}
+			}
+			for _, id := range tt.spot {
+				ec2Instances[id].InstanceLifecycle = aws.String(ec2.InstanceLifecycleTypeSpot)
+			}
+			for _, id := range []string{"new1", "new2"} {
+				instances = append(instances, &autoscaling.Instance{InstanceId: aws.String(id), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy})
+			}
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(6),
+					MaxSize:                 aws.Int64(6),
+					LaunchConfigurationName: &lcName,
+					Instances:               instances,
+				},
+			}}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 4}
+			configs := Configs{
+				KubernetesEnabled:  kubernetesEnabled,
+				ASGS:               []string{name},
+				MaxTerminate:       2,
+				TerminateSpotFirst: tt.spotFirst,
+			}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true, instances: ec2Instances}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			terminated := make([]string, 0)
+			for _, c := range asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup") {
+				terminated = append(terminated, *c.params[0].(*autoscaling.TerminateInstanceInAutoScalingGroupInput).InstanceId)
+			}
+			if !testStringEq(terminated, tt.terminated) {
+				t.Errorf("mismatched terminated instances, actual %v expected %v", terminated, tt.terminated)
+			}
+		})
+	}
+}
+
+func TestAdjustNodeWeightAnnotation(t *testing.T) {
+	tests := []struct {
+		desc       string
+		annotation string
+		overrides  map[string]asgConfigOverride
+		weights    map[string]string
+		terminated []string
+	}{
+		{"no annotation", "", nil, map[string]string{"1": "3", "2": "2", "3": "1"}, []string{"1", "2"}},
+		{"lowest weight first", "example.com/weight", nil, map[string]string{"1": "3", "2": "2", "3": "1"}, []string{"3", "2"}},
+		{"unweighted last", "example.com/weight", nil, map[string]string{"4": "5"}, []string{"4", "1"}},
+		{"per-ASG annotation", "", map[string]asgConfigOverride{"myasg": {NodeWeightAnnotation: aws.String("example.com/weight")}}, map[string]string{"1": "3", "2": "2", "3": "1"}, []string{"3", "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// part way through a roll, with new instances ready to replace two of the old ones
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			instances := make([]*autoscaling.Instance, 0)
+			for _, id := range []string{"1", "2", "3", "4"} {
+				instances = append(instances, &autoscaling.Instance{InstanceId: aws.String(id), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy})
+			}
+			for _, id := range []string{"new1", "new2"} {
+				instances = append(instances, &autoscaling.Instance{InstanceId: aws.String(id), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy})
+			}
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(6),
+					MaxSize:                 aws.Int64(6),
+					LaunchConfigurationName: &lcName,
+					Instances:               instances,
+				},
+			}}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 4}
+			configs := Configs{
+				KubernetesEnabled:    kubernetesEnabled,
+				ASGS:                 []string{name},
+				MaxTerminate:         2,
+				NodeWeightAnnotation: tt.annotation,
+				ASGOverrides:         tt.overrides,
+			}
+			handler := &testReadyHandler{nodeAnnotations: tt.weights}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, handler, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			terminated := make([]string, 0)
+			for _, c := range asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup") {
+				terminated = append(terminated, *c.params[0].(*autoscaling.TerminateInstanceInAutoScalingGroupInput).InstanceId)
+			}
+			if !testStringEq(terminated, tt.terminated) {
+				t.Errorf("mismatched terminated instances, actual %v expected %v", terminated, tt.terminated)
+			}
+		})
+	}
+}
+
+func TestAdjustPostRollCooldown(t *testing.T) {
+	tests := []struct {
+		desc       string
+		cooldown   time.Duration
+		stateSince time.Duration
+		tagSince   time.Duration
+		setDesired []int64
+	}{
+		{"no cooldown", 0, time.Minute, 0, []int64{3}},
+		{"never rolled", time.Hour, 0, 0, []int64{3}},
+		{"new version mid-cooldown", time.Hour, time.Minute, 0, []int64{}},
+		{"new version mid-cooldown from tag", time.Hour, 0, time.Minute, []int64{}},
+		{"new version after cooldown", time.Hour, 2 * time.Hour, 0, []int64{3}},
+		{"new version after cooldown from tag", time.Hour, 0, 2 * time.Hour, []int64{3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// a new version came in after the group finished rolling
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			tags := make([]*autoscaling.TagDescription, 0)
+			if tt.tagSince > 0 {
+				tags = append(tags, &autoscaling.TagDescription{Key: aws.String(asgTagNameLastRollFinished), Value: aws.String(time.Now().Add(-tt.tagSince).UTC().Format(time.RFC3339))})
+			}
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(2),
+					MaxSize:                 aws.Int64(4),
+					LaunchConfigurationName: &lcName,
+					Instances: []*autoscaling.Instance{
+						{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+						{InstanceId: aws.String("2"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+					},
+					Tags: tags,
+				},
+			}}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 2}
+			if tt.stateSince > 0 {
+				state.lastFinished[name] = time.Now().Add(-tt.stateSince)
+			}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				InitialSurge:      1,
+				MaxTerminate:      1,
+				MaxSurge:          -1,
+				MaxUnavailable:    -1,
+				PostRollCooldown:  tt.cooldown,
+			}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			setDesired := make([]int64, 0)
+			for _, c := range asgSvc.counter.filterByName("SetDesiredCapacity") {
+				setDesired = append(setDesired, *c.params[0].(*autoscaling.SetDesiredCapacityInput).DesiredCapacity)
+			}
+			if fmt.Sprint(setDesired) != fmt.Sprint(tt.setDesired) {
+				t.Errorf("mismatched desired counts, actual %v expected %v", setDesired, tt.setDesired)
+			}
+		})
+	}
+}
+
+func TestAdjustTerminateCooldown(t *testing.T) {
+	tests := []struct {
+		desc       string
+		cooldown   time.Duration
+		lastAsg    string
+		since      time.Duration
+		terminated []string
+	}{
+		{"no cooldown", 0, "myasg", time.Minute, []string{"1"}},
+		{"never terminated", time.Hour, "", 0, []string{"1"}},
+		{"within cooldown", time.Hour, "myasg", time.Minute, []string{}},
+		{"after cooldown", time.Hour, "myasg", 2 * time.Hour, []string{"1"}},
+		{"other group terminated", time.Hour, "otherasg", time.Minute, []string{"1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// the group has surged, and its new instance is ready to replace an old one
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(3),
+					MaxSize:                 aws.Int64(4),
+					LaunchConfigurationName: &lcName,
+					Instances: []*autoscaling.Instance{
+						{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+						{InstanceId: aws.String("2"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+						{InstanceId: aws.String("3"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+					},
+				},
+			}}
+			now := time.Now()
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 2}
+			if tt.lastAsg != "" {
+				state.now = func() time.Time { return now.Add(-tt.since) }
+				state.addTerminated(tt.lastAsg, []string{"0"}, 0)
+			}
+			state.now = func() time.Time { return now }
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				InitialSurge:      1,
+				MaxTerminate:      1,
+				MaxSurge:          -1,
+				MaxUnavailable:    -1,
+				TerminateCooldown: tt.cooldown,
+			}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			terminated := make([]string, 0)
+			for _, c := range asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup") {
+				terminated = append(terminated, *c.params[0].(*autoscaling.TerminateInstanceInAutoScalingGroupInput).InstanceId)
+			}
+			if !testStringEq(terminated, tt.terminated) {
+				t.Errorf("mismatched terminated, actual %v expected %v", terminated, tt.terminated)
+			}
+			// a termination starts the cooldown again
+			if len(tt.terminated) > 0 && !state.lastTerminated[name].Equal(now) {
+				t.Errorf("cooldown not restarted, last terminated at %v expected %v", state.lastTerminated[name], now)
+			}
+		})
+	}
+}
+
+func TestAdjustHealthGracePeriod(t *testing.T) {
+	tests := []struct {
+		desc       string
+		grace      time.Duration
+		after      time.Duration
+		terminated []string
+	}{
+		{"no grace period", 0, 0, []string{"1"}},
+		{"just healthy", 10 * time.Minute, 0, []string{}},
+		{"within grace period", 10 * time.Minute, 5 * time.Minute, []string{}},
+		{"after grace period", 10 * time.Minute, 11 * time.Minute, []string{"1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// the group has surged, and its new instance has just become healthy
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(3),
+					MaxSize:                 aws.Int64(4),
+					LaunchConfigurationName: &lcName,
+					Instances: []*autoscaling.Instance{
+						{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+						{InstanceId: aws.String("2"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+						{InstanceId: aws.String("3"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+					},
+				},
+			}}
+			start := time.Now()
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 2}
+			state.now = func() time.Time { return start }
+			if tt.grace > 0 {
+				// the roller first sees the new instance healthy
+				state.healthGraceRemaining(name, asgSvc.groups[name].Instances[2:], tt.grace)
+			}
+			state.now = func() time.Time { return start.Add(tt.after) }
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				InitialSurge:      1,
+				MaxTerminate:      1,
+				MaxSurge:          -1,
+				MaxUnavailable:    -1,
+				HealthGracePeriod: tt.grace,
+			}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			terminated := make([]string, 0)
+			for _, c := range asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup") {
+				terminated = append(terminated, *c.params[0].(*autoscaling.TerminateInstanceInAutoScalingGroupInput).InstanceId)
+			}
+			if !testStringEq(terminated, tt.terminated) {
+				t.Errorf("mismatched terminated, actual %v expected %v", terminated, tt.terminated)
+			}
+		})
+	}
+}
+
+func TestAdjustRecordRollFinished(t *testing.T) {
+	tests := []struct {
+		desc     string
+		cooldown time.Duration
+		rolling  bool
+		dryRun   bool
+		tagged   bool
+	}{
+		{"finished with cooldown", time.Hour, true, false, true},
+		{"finished without cooldown", 0, true, false, false},
+		{"not rolling", time.Hour, false, false, false},
+		{"finished with cooldown dry run", time.Hour, true, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// the group has no old instances left, and is back at its original desired count
+			name := "myasg"
+			lcName := "lconfig"
+			myHealthy := healthy
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(1),
+					MaxSize:                 aws.Int64(2),
+					LaunchConfigurationName: &lcName,
+					Instances: []*autoscaling.Instance{
+						{InstanceId: aws.String("1"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+					},
+				},
+			}}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 1}
+			if tt.rolling {
+				state.setRolling(name, true)
+			}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				PostRollCooldown:  tt.cooldown,
+				DryRun:            tt.dryRun,
+			}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			tagged := false
+			for _, c := range asgSvc.counter.filterByName("CreateOrUpdateTags") {
+				for _, tag := range c.params[0].(*autoscaling.CreateOrUpdateTagsInput).Tags {
+					if *tag.Key == asgTagNameLastRollFinished {
+						tagged = true
+					}
+				}
+			}
+			if tagged != tt.tagged {
+				t.Errorf("mismatched roll finished tag, actual %v expected %v", tagged, tt.tagged)
+			}
+		})
+	}
+}
+
+func TestRequireIMDSv2(t *testing.T) {
+	v2 := &ec2.InstanceMetadataOptionsResponse{HttpTokens: aws.String(ec2.HttpTokensStateRequired), HttpEndpoint: aws.String(ec2.InstanceMetadataEndpointStateEnabled)}
+	v1 := &ec2.InstanceMetadataOptionsResponse{HttpTokens: aws.String(ec2.HttpTokensStateOptional), HttpEndpoint: aws.String(ec2.InstanceMetadataEndpointStateEnabled)}
+	disabled := &ec2.InstanceMetadataOptionsResponse{HttpTokens: aws.String(ec2.HttpTokensStateOptional), HttpEndpoint: aws.String(ec2.InstanceMetadataEndpointStateDisabled)}
+	tests := []struct {
+		desc    string
+		options map[string]*ec2.InstanceMetadataOptionsResponse
+		old     []string
+		new     []string
+	}{
+		{"all enforced", map[string]*ec2.InstanceMetadataOptionsResponse{"1": v2, "2": v2}, []string{"old1"}, []string{"1", "2"}},
+		{"drifted to IMDSv1", map[string]*ec2.InstanceMetadataOptionsResponse{"1": v2, "2": v1}, []string{"old1", "2"}, []string{"1"}},
+		{"endpoint disabled", map[string]*ec2.InstanceMetadataOptionsResponse{"1": disabled, "2": v2}, []string{"old1"}, []string{"1", "2"}},
+		{"no metadata options", map[string]*ec2.InstanceMetadataOptionsResponse{"1": nil, "2": v2}, []string{"old1", "1"}, []string{"2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			instances := map[string]*ec2.Instance{}
+			for id, options := range tt.options {
+				instances[id] = &ec2.Instance{InstanceId: aws.String(id), MetadataOptions: options}
+			}
+			asg := &autoscaling.Group{AutoScalingGroupName: aws.String("myasg")}
+			oldInstances := []*autoscaling.Instance{{InstanceId: aws.String("old1")}}
+			newInstances := []*autoscaling.Instance{{InstanceId: aws.String("1")}, {InstanceId: aws.String("2")}}
+			oldInstances, newInstances, err := requireIMDSv2(asg, oldInstances, newInstances, &mockEc2Svc{instances: instances}, false)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if old := mapInstancesIds(oldInstances); !testStringEq(old, tt.old) {
+				t.Errorf("mismatched old instances, actual %v expected %v", old, tt.old)
+			}
+			if newIDs := mapInstancesIds(newInstances); !testStringEq(newIDs, tt.new) {
+				t.Errorf("mismatched new instances, actual %v expected %v", newIDs, tt.new)
+			}
+		})
+	}
+}
+
+func TestAdjustRequireIMDSv2(t *testing.T) {
+	tests := []struct {
+		desc       string
+		require    bool
+		tokens     string
+		setDesired []int64
+	}{
+		{"not required", false, ec2.HttpTokensStateOptional, []int64{}},
+		{"required and enforced", true, ec2.HttpTokensStateRequired, []int64{}},
+		{"required and drifted", true, ec2.HttpTokensStateOptional, []int64{3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// every instance is on the target launch configuration, but one allows IMDSv1
+			name := "myasg"
+			lcName := "lconfig"
+			myHealthy := healthy
+			ec2Instances := map[string]*ec2.Instance{
+				"1": {InstanceId: aws.String("1"), PrivateDnsName: aws.String("host1"), MetadataOptions: &ec2.InstanceMetadataOptionsResponse{HttpTokens: aws.String(ec2.HttpTokensStateRequired)}},
+				"2": {InstanceId: aws.String("2"), PrivateDnsName: aws.String("host2"), MetadataOptions: &ec2.InstanceMetadataOptionsResponse{HttpTokens: aws.String(tt.tokens)}},
+			}
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(2),
+					MaxSize:                 aws.Int64(4),
+					LaunchConfigurationName: &lcName,
+					Instances: []*autoscaling.Instance{
+						{InstanceId: aws.String("1"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+						{InstanceId: aws.String("2"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+					},
+				},
+			}}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 2}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				InitialSurge:      1,
+				MaxTerminate:      1,
+				MaxSurge:          -1,
+				MaxUnavailable:    -1,
+				RequireIMDSv2:     tt.require,
+			}
+			if _, err := adjust(configs, &mockEc2Svc{instances: ec2Instances}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			setDesired := make([]int64, 0)
+			for _, c := range asgSvc.counter.filterByName("SetDesiredCapacity") {
+				setDesired = append(setDesired, *c.params[0].(*autoscaling.SetDesiredCapacityInput).DesiredCapacity)
+			}
+			if fmt.Sprint(setDesired) != fmt.Sprint(tt.setDesired) {
+				t.Errorf("mismatched desired counts, actual %v expected %v", setDesired, tt.setDesired)
+			}
+		})
+	}
+}
+
+func TestAdjustDryRun(t *testing.T) {
+	tests := []struct {
+		desc    string
+		desired int64
+		viaEC2  bool
+	}{
+		{"start of roll", 2, false},
+		{"terminate via ASG", 3, false},
+		{"terminate via EC2", 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			instances := []*autoscaling.Instance{
+				{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+				{InstanceId: aws.String("2"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+			}
+			if tt.desired > 2 {
+				instances = append(instances, &autoscaling.Instance{InstanceId: aws.String("3"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy})
+			}
+			asgSvc := &mockAsgSvc{
+				groups: map[string]*autoscaling.Group{
+					name: {
+						AutoScalingGroupName:    &name,
+						DesiredCapacity:         aws.Int64(tt.desired),
+						MaxSize:                 aws.Int64(2),
+						LaunchConfigurationName: &lcName,
+						Instances:               instances,
+					},
+				},
+			}
+			ec2Svc := &mockEc2Svc{autodescribe: true}
+			handler := &testReadyHandler{}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 2}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				DryRun:            true,
+				Drain:             true,
+				IncreaseMax:       true,
+				TagTerminated:     true,
+				TerminateViaEC2:   tt.viaEC2,
+			}
+			if _, err := adjust(configs, ec2Svc, asgSvc, nil, nil, handler, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, call := range []string{"SetDesiredCapacity", "UpdateAutoScalingGroup", "TerminateInstanceInAutoScalingGroup"} {
+				if calls := asgSvc.counter.filterByName(call); len(calls) != 0 {
+					t.Errorf("expected no %s calls in dry run, had %d", call, len(calls))
+				}
+			}
+			for _, call := range []string{"TerminateInstances", "CreateTags"} {
+				if calls := ec2Svc.counter.filterByName(call); len(calls) != 0 {
+					t.Errorf("expected no %s calls in dry run, had %d", call, len(calls))
+				}
+			}
+			for _, c := range handler.counter.filterByName("prepareTermination") {
+				if drain := c.params[2].(bool); drain {
+					t.Errorf("expected no drain in dry run")
+				}
+			}
+		})
+	}
+}
+
+func TestAdjustDryRunNoWrites(t *testing.T) {
+	tests := []struct {
+		desc string
+		// how many of the 2 instances in the ASG are old
+		old     int64
+		desired int64
+		// the original desired value already known, or -1 if none is
+		original int64
+		rolling  bool
+		steady   bool
+		tags     map[string]string
+		// whether the original desired value is written to the store when not a dry run
+		stored bool
+	}{
+		{"start of roll", 2, 2, -1, false, false, nil, true},
+		{"done rolling", 0, 2, 2, true, false, map[string]string{asgTagNameOriginalMax: "2", asgTagNameOriginalTerminationPolicies: "Default"}, false},
+		{"desired changed while steady", 0, 3, 2, false, true, nil, true},
+	}
+	backends := []string{stateBackendTag, stateBackendSSM, stateBackendDynamoDB}
+	asgWrites := []string{"SetDesiredCapacity", "UpdateAutoScalingGroup", "TerminateInstanceInAutoScalingGroup", "CreateOrUpdateTags", "DeleteTags", "StartInstanceRefresh", "CompleteLifecycleAction", "ExitStandby"}
+	for _, tt := range tests {
+		for _, backend := range backends {
+			for _, dryRun := range []bool{false, true} {
+				t.Run(fmt.Sprintf("%s %s dry run %v", tt.desc, backend, dryRun), func(t *testing.T) {
+					name := "myasg"
+					lcName := "lconfig"
+					oldLcName := "oldlconfig"
+					myHealthy := healthy
+					instances := make([]*autoscaling.Instance, 0)
+					for i := int64(0); i < tt.desired; i++ {
+						instanceLc := lcName
+						if i < tt.old {
+							instanceLc = oldLcName
+						}
+						instances = append(instances, &autoscaling.Instance{InstanceId: aws.String(fmt.Sprint(i)), LaunchConfigurationName: aws.String(instanceLc), HealthStatus: &myHealthy})
+					}
+					tags := make([]*autoscaling.TagDescription, 0)
+					for key, value := range tt.tags {
+						tags = append(tags, &autoscaling.TagDescription{Key: aws.String(key), Value: aws.String(value)})
+					}
+					asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+						name: {
+							AutoScalingGroupName:    &name,
+							DesiredCapacity:         aws.Int64(tt.desired),
+							MaxSize:                 aws.Int64(3),
+							LaunchConfigurationName: &lcName,
+							Instances:               instances,
+							Tags:                    tags,
+							TerminationPolicies:     aws.StringSlice([]string{"OldestInstance"}),
+						},
+					}}
+					ec2Svc := &mockEc2Svc{autodescribe: true}
+					ssmSvc := &mockSsmSvc{}
+					dynamoSvc := &mockDynamoSvc{}
+					stores := map[string]stateStore{
+						stateBackendTag:      &tagStateStore{asgSvc: asgSvc, batchSize: 1},
+						stateBackendSSM:      &ssmStateStore{ssmSvc: ssmSvc, prefix: "/roller"},
+						stateBackendDynamoDB: &dynamoStateStore{svc: dynamoSvc, table: "roller"},
+					}
+					state := newRollerState()
+					if tt.original >= 0 {
+						state.setOriginalDesired(name, tt.original)
+					}
+					state.setRolling(name, tt.rolling)
+					state.setSteady(name, tt.steady)
+					configs := Configs{
+						KubernetesEnabled:      kubernetesEnabled,
+						ASGS:                   []string{name},
+						DryRun:                 dryRun,
+						IncreaseMax:            true,
+						RestoreMax:             true,
+						OriginalDesiredOnTag:   true,
+						RefreshOriginalDesired: true,
+						StateBackend:           backend,
+						TerminationPolicies:    []string{"NewestInstance"},
+						PostRollCooldown:       time.Hour,
+						MaxTerminate:           1,
+						MaxSurge:               -1,
+						MaxUnavailable:         -1,
+						PersistRollState:       true,
+					}
+					if _, err := adjust(configs, ec2Svc, asgSvc, nil, stores[backend], nil, nil, nil, nil, state); err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					writes := map[string]int{
+						"PutParameter": len(ssmSvc.counter.filterByName("PutParameter")),
+						"PutItem":      len(dynamoSvc.counter.filterByName("PutItem")),
+					}
+					for _, call := range asgWrites {
+						writes[call] = len(asgSvc.counter.filterByName(call))
+					}
+					for _, call := range []string{"TerminateInstances", "CreateTags"} {
+						writes[call] = len(ec2Svc.counter.filterByName(call))
+					}
+					for call, count := range writes {
+						if dryRun && count != 0 {
+							t.Errorf("expected no %s calls in dry run, had %d", call, count)
+						}
+					}
+					// the same adjustment does write to the store when not a dry run
+					stored := writes["PutParameter"] + writes["PutItem"]
+					for _, c := range asgSvc.counter.filterByName("CreateOrUpdateTags") {
+						for _, tag := range c.params[0].(*autoscaling.CreateOrUpdateTagsInput).Tags {
+							if *tag.Key == asgTagNameOriginalDesired {
+								stored++
+							}
+						}
+					}
+					if expected := tt.stored && !dryRun; (stored > 0) != expected {
+						t.Errorf("mismatched writes to the store, actual %d expected any %v", stored, expected)
+					}
+				})
 			}
-			runTest(t, asg, i, tt.oldIds, tt.newIds)
 		}
-	})
+	}
+}
+
+func TestAdjustWithTimeout(t *testing.T) {
+	tests := []struct {
+		desc       string
+		timeout    time.Duration
+		drainDelay time.Duration
+		err        bool
+		terminated int
+	}{
+		{"no timeout", 0, 50 * time.Millisecond, false, 2},
+		{"completes within timeout", time.Second, 0, false, 2},
+		{"slow drain times out", 50 * time.Millisecond, 300 * time.Millisecond, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// both groups part way through a roll, with a new instance ready to replace an old one
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			groups := map[string]*autoscaling.Group{}
+			for _, n := range []string{"asg1", "asg2"} {
+				name := n
+				groups[name] = &autoscaling.Group{
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(2),
+					MaxSize:                 aws.Int64(2),
+					LaunchConfigurationName: &lcName,
+					Instances: []*autoscaling.Instance{
+						{InstanceId: aws.String(name + "-old"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+						{InstanceId: aws.String(name + "-new"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+					},
+				}
+			}
+			asgSvc := &mockAsgSvc{groups: groups}
+			handler := &testReadyHandler{drainDelay: tt.drainDelay}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{"asg1": 1, "asg2": 1}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{"asg1", "asg2"},
+				Drain:             true,
+			}
+			start := time.Now()
+			_, err := adjustWithTimeout(tt.timeout, configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, handler, nil, nil, nil, state)
+			elapsed := time.Since(start)
+			switch {
+			case tt.err && err == nil:
+				t.Errorf("expected timeout error")
+			case !tt.err && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.err && elapsed >= tt.drainDelay:
+				t.Errorf("returned after %v, not when the timeout of %v passed", elapsed, tt.timeout)
+			}
+			// let any cancelled work finish, to check it made no further changes
+			time.Sleep(2 * tt.drainDelay)
+			if terminated := len(asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup")); terminated != tt.terminated {
+				t.Errorf("mismatched terminated instances, actual %d expected %d", terminated, tt.terminated)
+			}
+		})
+	}
+}
+
+func TestAdjustWithTimeoutNoOverlap(t *testing.T) {
+	// part way through a roll, with a new instance ready to replace an old one, but a slow drain
+	name := "myasg"
+	lcName := "lconfig"
+	oldLcName := "oldlconfig"
+	myHealthy := healthy
+	asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+		name: {
+			AutoScalingGroupName:    &name,
+			DesiredCapacity:         aws.Int64(2),
+			MaxSize:                 aws.Int64(2),
+			LaunchConfigurationName: &lcName,
+			Instances: []*autoscaling.Instance{
+				{InstanceId: aws.String("old"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+				{InstanceId: aws.String("new"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+			},
+		},
+	}}
+	drainDelay := 300 * time.Millisecond
+	handler := &testReadyHandler{drainDelay: drainDelay}
+	state := newRollerState()
+	state.originalDesired = map[string]int64{name: 1}
+	configs := Configs{
+		KubernetesEnabled: kubernetesEnabled,
+		ASGS:              []string{name},
+		Drain:             true,
+	}
+	if _, err := adjustWithTimeout(50*time.Millisecond, configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, handler, nil, nil, nil, state); err == nil {
+		t.Fatalf("expected timeout error")
+	}
+	// the next loop comes around while the drain still is in flight, and leaves the groups alone
+	described := len(asgSvc.counter.filterByName("DescribeAutoScalingGroups"))
+	if _, err := adjustWithTimeout(50*time.Millisecond, configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, handler, nil, nil, nil, state); err == nil {
+		t.Errorf("expected error for overlapping adjustment")
+	}
+	if calls := len(asgSvc.counter.filterByName("DescribeAutoScalingGroups")); calls != described {
+		t.Errorf("overlapping adjustment described groups")
+	}
+	if drains := len(handler.counter.filterByName("prepareTermination")); drains != 1 {
+		t.Errorf("mismatched drains while the first is in flight, actual %d expected 1", drains)
+	}
+	// once the cancelled adjustment is over, loops run again
+	time.Sleep(2 * drainDelay)
+	if _, err := adjustWithTimeout(0, configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, handler, nil, nil, nil, state); err != nil {
+		t.Errorf("unexpected error once the cancelled adjustment is over: %v", err)
+	}
+	if calls := len(asgSvc.counter.filterByName("DescribeAutoScalingGroups")); calls == described {
+		t.Errorf("expected groups to be described once the cancelled adjustment is over")
+	}
+}
 
+func TestCalculateAdjustmentDrainTimeout(t *testing.T) {
+	handler := &testReadyHandler{terminateError: &drainTimeoutError{hostname: "host1", timeout: time.Minute}}
+	old := &autoscaling.Instance{InstanceId: aws.String("1"), HealthStatus: aws.String(healthy)}
+	asg := &autoscaling.Group{
+		AutoScalingGroupName: aws.String("myasg"),
+		DesiredCapacity:      aws.Int64(2),
+		Instances:            []*autoscaling.Instance{old, {InstanceId: aws.String("2"), HealthStatus: aws.String(healthy)}},
+	}
+	_, _, err := calculateAdjustment(false, asg, []*autoscaling.Instance{old}, asg.Instances[1:], map[string]string{"1": "host1", "2": "host2"}, handler, nil, nil, 1, 1, rollLimits{maxSurge: 1}, 0, false, false, false, false, true, true)
+	if err == nil || err.Error() != "[myasg] draining kubernetes node host1 did not complete within 1m0s" {
+		t.Errorf("mismatched error %v", err)
+	}
 }
 
-func TestMapInstanceIds(t *testing.T) {
-	ids := []string{"1", "2", "10"}
-	instances := make([]*autoscaling.Instance, 0)
-	for _, i := range ids {
-		id := i
-		instances = append(instances, &autoscaling.Instance{
-			InstanceId: &id,
+func TestAdjustNodeNameTag(t *testing.T) {
+	tests := []struct {
+		desc     string
+		nameTag  string
+		hostname string
+	}{
+		{"private DNS name", "", "ip-10-0-0-1.ec2.internal"},
+		{"name from tag", "KubernetesNodeName", "worker-old"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// part way through a roll, with a new instance ready to replace the old one
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(2),
+					MaxSize:                 aws.Int64(2),
+					LaunchConfigurationName: &lcName,
+					Instances: []*autoscaling.Instance{
+						{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+						{InstanceId: aws.String("2"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+					},
+				},
+			}}
+			ec2Svc := &mockEc2Svc{instances: map[string]*ec2.Instance{
+				"1": {
+					InstanceId:     aws.String("1"),
+					PrivateDnsName: aws.String("ip-10-0-0-1.ec2.internal"),
+					Tags:           []*ec2.Tag{{Key: aws.String("KubernetesNodeName"), Value: aws.String("worker-old")}},
+				},
+				"2": {
+					InstanceId:     aws.String("2"),
+					PrivateDnsName: aws.String("ip-10-0-0-2.ec2.internal"),
+					Tags:           []*ec2.Tag{{Key: aws.String("KubernetesNodeName"), Value: aws.String("worker-new")}},
+				},
+			}}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 1}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				Drain:             true,
+				NodeNameTag:       tt.nameTag,
+			}
+			handler := &testReadyHandler{}
+			if _, err := adjust(configs, ec2Svc, asgSvc, nil, nil, handler, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			calls := handler.counter.filterByName("prepareTermination")
+			if len(calls) != 1 {
+				t.Fatalf("expected 1 prepareTermination call, had %d", len(calls))
+			}
+			if hostnames := calls[0].params[0].([]string); !testStringEq(hostnames, []string{tt.hostname}) {
+				t.Errorf("mismatched hostnames drained, actual %v expected [%s]", hostnames, tt.hostname)
+			}
 		})
 	}
-	m := mapInstancesIds(instances)
-	if !testStringEq(m, ids) {
-		t.Errorf("mismatched ids. Actual %v, expected %v", m, ids)
+}
+
+func TestAdjustZeroDesired(t *testing.T) {
+	tests := []struct {
+		desc       string
+		skip       bool
+		setDesired []int64
+	}{
+		{"rolled", false, []int64{1}},
+		{"skipped", true, []int64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// scaled to zero, with old instances still on their way out
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(0),
+					MaxSize:                 aws.Int64(2),
+					LaunchConfigurationName: &lcName,
+					Instances: []*autoscaling.Instance{
+						{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+						{InstanceId: aws.String("2"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+					},
+				},
+			}}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 0}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				InitialSurge:      1,
+				MaxTerminate:      1,
+				MaxSurge:          -1,
+				MaxUnavailable:    -1,
+				SkipZeroDesired:   tt.skip,
+			}
+			statuses, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			setDesired := make([]int64, 0)
+			for _, c := range asgSvc.counter.filterByName("SetDesiredCapacity") {
+				setDesired = append(setDesired, *c.params[0].(*autoscaling.SetDesiredCapacityInput).DesiredCapacity)
+			}
+			if fmt.Sprint(setDesired) != fmt.Sprint(tt.setDesired) {
+				t.Errorf("mismatched desired counts, actual %v expected %v", setDesired, tt.setDesired)
+			}
+			if terminated := asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup"); tt.skip && len(terminated) > 0 {
+				t.Errorf("unexpected terminations of skipped ASG: %d", len(terminated))
+			}
+			if len(statuses) != 1 || statuses[0].Done {
+				t.Errorf("mismatched statuses, actual %v expected a single ASG not done", statuses)
+			}
+		})
 	}
 }
 
-func TestCompareLaunchTemplateVersions(t *testing.T) {
-	template := &ec2.LaunchTemplate{
-		DefaultVersionNumber: aws.Int64(25),
-		LatestVersionNumber:  aws.Int64(64),
+func TestAdjustWaitForAutoscaler(t *testing.T) {
+	tests := []struct {
+		desc        string
+		wait        bool
+		scalingDown []string
+		terminated  int
+		deferred    int
+	}{
+		{"not waiting", false, []string{"ip-10-0-0-9.ec2.internal"}, 1, 0},
+		{"nothing scaling down", true, []string{}, 1, 0},
+		{"scaling down", true, []string{"ip-10-0-0-9.ec2.internal"}, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// part way through a roll, with an old instance ready to terminate
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(2),
+					MaxSize:                 aws.Int64(2),
+					LaunchConfigurationName: &lcName,
+					Instances: []*autoscaling.Instance{
+						{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+						{InstanceId: aws.String("2"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+					},
+				},
+			}}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 1}
+			state.setRolling(name, true)
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				InitialSurge:      1,
+				MaxTerminate:      1,
+				MaxSurge:          -1,
+				MaxUnavailable:    -1,
+				WaitForAutoscaler: tt.wait,
+			}
+			handler := &testReadyHandler{scalingDown: tt.scalingDown}
+			notifier := &mockNotifier{}
+			_, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, handler, nil, nil, notifier, state)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if terminated := asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup"); len(terminated) != tt.terminated {
+				t.Errorf("mismatched terminations, actual %d expected %d", len(terminated), tt.terminated)
+			}
+			deferred := 0
+			for _, e := range notifier.events {
+				if e.kind == rollEventDeferred {
+					deferred++
+				}
+			}
+			if deferred != tt.deferred {
+				t.Errorf("mismatched deferred events, actual %d expected %d", deferred, tt.deferred)
+			}
+		})
 	}
+}
+
+func TestAdjustTerminateDedupWindow(t *testing.T) {
 	tests := []struct {
-		lt1      *autoscaling.LaunchTemplateSpecification
-		lt2      *autoscaling.LaunchTemplateSpecification
-		expected bool
+		desc       string
+		window     time.Duration
+		ago        time.Duration
+		terminated []string
+		// the instances whose termination time is still kept afterwards
+		terminatedAt []string
 	}{
-		{nil, nil, true},
-		{nil, &autoscaling.LaunchTemplateSpecification{}, false},
-		{&autoscaling.LaunchTemplateSpecification{}, nil, false},
-		{&autoscaling.LaunchTemplateSpecification{}, &autoscaling.LaunchTemplateSpecification{}, true},
-		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("25")}, &autoscaling.LaunchTemplateSpecification{}, false},
-		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("25")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("26")}, false},
-		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("25")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("25")}, true},
-		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("25")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("25")}, true},
-		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("64")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("$Latest")}, true},
-		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("25")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("$Default")}, true},
-		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("$Default")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("$Default")}, true},
-		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("$Latest")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("$Latest")}, true},
-		{&autoscaling.LaunchTemplateSpecification{Version: aws.String("$Default")}, &autoscaling.LaunchTemplateSpecification{Version: aws.String("$Latest")}, false},
+		{"no window", 0, time.Minute, []string{"1"}, []string{}},
+		{"terminated within window", 5 * time.Minute, time.Minute, []string{}, []string{"1"}},
+		{"terminated before window", 5 * time.Minute, 10 * time.Minute, []string{"1"}, []string{"1"}},
 	}
-	for i, tt := range tests {
-		result := compareLaunchTemplateVersions(template, tt.lt1, tt.lt2)
-		if result != tt.expected {
-			t.Errorf("%d: mismatched results, received %v expected %v", i, result, tt.expected)
-		}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// part way through a roll, with the old instance terminated on an earlier loop still in the ASG
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(3),
+					MaxSize:                 aws.Int64(4),
+					LaunchConfigurationName: &lcName,
+					Instances: []*autoscaling.Instance{
+						{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy, LifecycleState: aws.String(autoscaling.LifecycleStateInService)},
+						{InstanceId: aws.String("2"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy, LifecycleState: aws.String(autoscaling.LifecycleStateInService)},
+						{InstanceId: aws.String("3"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy, LifecycleState: aws.String(autoscaling.LifecycleStateInService)},
+					},
+				},
+			}}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 2}
+			now := time.Now()
+			state.now = func() time.Time { return now }
+			state.setRolling(name, true)
+			state.terminatedAt["1"] = now.Add(-tt.ago)
+			configs := Configs{
+				KubernetesEnabled:    kubernetesEnabled,
+				ASGS:                 []string{name},
+				InitialSurge:         1,
+				MaxTerminate:         1,
+				MaxSurge:             -1,
+				MaxUnavailable:       -1,
+				TerminateDedupWindow: tt.window,
+			}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			terminated := make([]string, 0)
+			for _, c := range asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup") {
+				terminated = append(terminated, *c.params[0].(*autoscaling.TerminateInstanceInAutoScalingGroupInput).InstanceId)
+			}
+			if !testStringEq(terminated, tt.terminated) {
+				t.Errorf("mismatched terminated instances, actual %v expected %v", terminated, tt.terminated)
+			}
+			terminatedAt := make([]string, 0)
+			for id := range state.terminatedAt {
+				terminatedAt = append(terminatedAt, id)
+			}
+			if !testStringEq(terminatedAt, tt.terminatedAt) {
+				t.Errorf("mismatched instances kept with when they were terminated, actual %v expected %v", terminatedAt, tt.terminatedAt)
+			}
+		})
+	}
+}
+
+func TestAdjustStrategy(t *testing.T) {
+	tests := []struct {
+		desc       string
+		strategy   string
+		desired    []int64
+		terminated []string
+	}{
+		{"surge", strategySurge, []int64{3}, []string{}},
+		{"max unavailable", strategyMaxUnavailable, []int64{}, []string{"1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// about to start rolling, with no headroom to surge unless the max can be increased
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(2),
+					MaxSize:                 aws.Int64(2),
+					LaunchConfigurationName: &lcName,
+					Instances: []*autoscaling.Instance{
+						{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy, LifecycleState: aws.String(autoscaling.LifecycleStateInService)},
+						{InstanceId: aws.String("2"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy, LifecycleState: aws.String(autoscaling.LifecycleStateInService)},
+					},
+				},
+			}}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 2}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				IncreaseMax:       true,
+				Strategy:          tt.strategy,
+				InitialSurge:      1,
+				MaxTerminate:      1,
+				MaxSurge:          -1,
+				MaxUnavailable:    -1,
+			}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			desired := make([]int64, 0)
+			for _, c := range asgSvc.counter.filterByName("SetDesiredCapacity") {
+				desired = append(desired, *c.params[0].(*autoscaling.SetDesiredCapacityInput).DesiredCapacity)
+			}
+			if !reflect.DeepEqual(desired, tt.desired) {
+				t.Errorf("mismatched desired counts set, actual %v expected %v", desired, tt.desired)
+			}
+			terminated := make([]string, 0)
+			for _, c := range asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup") {
+				terminated = append(terminated, *c.params[0].(*autoscaling.TerminateInstanceInAutoScalingGroupInput).InstanceId)
+			}
+			if !testStringEq(terminated, tt.terminated) {
+				t.Errorf("mismatched terminated instances, actual %v expected %v", terminated, tt.terminated)
+			}
+		})
+	}
+}
+
+func TestAdjustMaxSurgePercent(t *testing.T) {
+	tests := []struct {
+		desc       string
+		desired    int64
+		newCount   int
+		setDesired []int64
+		setMax     []int64
+	}{
+		{"surge up to the cap", 4, 0, []int64{6}, []int64{6}},
+		{"at the cap until terminations", 6, 2, []int64{}, []int64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			instances := make([]*autoscaling.Instance, 0)
+			for i := 0; i < 4; i++ {
+				instances = append(instances, &autoscaling.Instance{InstanceId: aws.String(fmt.Sprintf("old%d", i)), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy, LifecycleState: aws.String(autoscaling.LifecycleStateInService)})
+			}
+			// the new instances are not ready yet
+			for i := 0; i < tt.newCount; i++ {
+				instances = append(instances, &autoscaling.Instance{InstanceId: aws.String(fmt.Sprintf("new%d", i)), LaunchConfigurationName: &lcName, HealthStatus: aws.String("Unhealthy"), LifecycleState: aws.String(autoscaling.LifecycleStatePending)})
+			}
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(tt.desired),
+					MaxSize:                 aws.Int64(tt.desired),
+					LaunchConfigurationName: &lcName,
+					Instances:               instances,
+				},
+			}}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 4}
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				IncreaseMax:       true,
+				InitialSurge:      1,
+				MaxTerminate:      4,
+				MaxSurge:          -1,
+				MaxSurgePercent:   50,
+				MaxUnavailable:    -1,
+			}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			setDesired := make([]int64, 0)
+			for _, c := range asgSvc.counter.filterByName("SetDesiredCapacity") {
+				setDesired = append(setDesired, *c.params[0].(*autoscaling.SetDesiredCapacityInput).DesiredCapacity)
+			}
+			if !reflect.DeepEqual(setDesired, tt.setDesired) {
+				t.Errorf("mismatched desired counts set, actual %v expected %v", setDesired, tt.setDesired)
+			}
+			setMax := make([]int64, 0)
+			for _, c := range asgSvc.counter.filterByName("UpdateAutoScalingGroup") {
+				if in := c.params[0].(*autoscaling.UpdateAutoScalingGroupInput); in.MaxSize != nil {
+					setMax = append(setMax, *in.MaxSize)
+				}
+			}
+			if !reflect.DeepEqual(setMax, tt.setMax) {
+				t.Errorf("mismatched max sizes set, actual %v expected %v", setMax, tt.setMax)
+			}
+			if terminated := asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup"); len(terminated) != 0 {
+				t.Errorf("expected no terminations, had %d", len(terminated))
+			}
+		})
 	}
 }
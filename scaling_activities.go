@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// how many of the most recent scaling activities of an ASG to check for any still in progress; activities
+// are listed newest first, so those in progress are among them
+const scalingActivitiesChecked = 20
+
+// awsInProgressActivities returns the descriptions of the scaling activities of the ASG that are still in
+// progress, e.g. a scaling triggered by a user, with which the roller changing the ASG would contend
+func awsInProgressActivities(svc asgClient, asgName string) ([]string, error) {
+	out, err := svc.DescribeScalingActivities(&autoscaling.DescribeScalingActivitiesInput{
+		AutoScalingGroupName: aws.String(asgName),
+		MaxRecords:           aws.Int64(scalingActivitiesChecked),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to describe scaling activities of ASG %s: %v", asgName, err)
+	}
+	inProgress := make([]string, 0)
+	for _, activity := range out.Activities {
+		switch aws.StringValue(activity.StatusCode) {
+		case autoscaling.ScalingActivityStatusCodeSuccessful, autoscaling.ScalingActivityStatusCodeFailed, autoscaling.ScalingActivityStatusCodeCancelled:
+			continue
+		}
+		inProgress = append(inProgress, aws.StringValue(activity.Description))
+	}
+	return inProgress, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func TestAdjustSkipDuringActivities(t *testing.T) {
+	tests := []struct {
+		desc       string
+		skip       bool
+		statuses   []string
+		err        error
+		setDesired bool
+		failed     bool
+	}{
+		{"not checked", false, []string{autoscaling.ScalingActivityStatusCodeInProgress}, nil, true, false},
+		{"no activities", true, nil, nil, true, false},
+		{"finished activities", true, []string{autoscaling.ScalingActivityStatusCodeSuccessful, autoscaling.ScalingActivityStatusCodeFailed, autoscaling.ScalingActivityStatusCodeCancelled}, nil, true, false},
+		{"in progress", true, []string{autoscaling.ScalingActivityStatusCodeInProgress, autoscaling.ScalingActivityStatusCodeSuccessful}, nil, false, false},
+		{"waiting for spot", true, []string{autoscaling.ScalingActivityStatusCodeWaitingForSpotInstanceId}, nil, false, false},
+		{"error", true, nil, fmt.Errorf("throttled"), false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			activities := make([]*autoscaling.Activity, 0)
+			for i, status := range tt.statuses {
+				activities = append(activities, &autoscaling.Activity{
+					ActivityId:  aws.String(fmt.Sprintf("activity%d", i)),
+					Description: aws.String("Launching a new EC2 instance"),
+					StatusCode:  aws.String(status),
+				})
+			}
+			asgSvc := &mockAsgSvc{
+				groups: map[string]*autoscaling.Group{
+					name: {
+						AutoScalingGroupName:    &name,
+						DesiredCapacity:         aws.Int64(2),
+						MaxSize:                 aws.Int64(3),
+						LaunchConfigurationName: &lcName,
+						Instances: []*autoscaling.Instance{
+							{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+							{InstanceId: aws.String("2"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+						},
+					},
+				},
+				activities: map[string][]*autoscaling.Activity{name: activities},
+			}
+			ec2Svc := &mockEc2Svc{autodescribe: true}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 2}
+			configs := Configs{
+				KubernetesEnabled:    kubernetesEnabled,
+				ASGS:                 []string{name},
+				MaxTerminate:         1,
+				MaxSurge:             1,
+				SkipDuringActivities: tt.skip,
+			}
+			notifier := &mockNotifier{}
+			// only describing the activities fails
+			svc := &activitiesErrAsgSvc{mockAsgSvc: asgSvc, err: tt.err}
+			if _, err := adjust(configs, ec2Svc, svc, nil, nil, nil, nil, nil, notifier, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if setDesired := len(asgSvc.counter.filterByName("SetDesiredCapacity")) > 0; setDesired != tt.setDesired {
+				t.Errorf("mismatched setting desired, actual %v expected %v", setDesired, tt.setDesired)
+			}
+			failed := false
+			for _, e := range notifier.events {
+				if e.kind == rollEventFailed {
+					failed = true
+				}
+			}
+			if failed != tt.failed {
+				t.Errorf("mismatched failure notification, actual %v expected %v", failed, tt.failed)
+			}
+		})
+	}
+}
+
+// activitiesErrAsgSvc fails only to describe scaling activities
+type activitiesErrAsgSvc struct {
+	*mockAsgSvc
+	err error
+}
+
+func (m *activitiesErrAsgSvc) DescribeScalingActivities(in *autoscaling.DescribeScalingActivitiesInput) (*autoscaling.DescribeScalingActivitiesOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return m.mockAsgSvc.DescribeScalingActivities(in)
+}
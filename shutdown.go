@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// shutdownSummary describes the rolling updates that are in progress, so that operators, or the next start
+// of the roller, know which ASGs were left mid-roll
+func shutdownSummary(state *rollerState, now time.Time) string {
+	progress := state.rollProgress()
+	if len(progress) == 0 {
+		return "no ASGs were left mid-roll"
+	}
+	lines := []string{fmt.Sprintf("%d ASGs were left mid-roll:", len(progress))}
+	for _, p := range progress {
+		desired := "unknown"
+		if p.originalDesired >= 0 {
+			desired = fmt.Sprintf("%d", p.originalDesired)
+		}
+		lines = append(lines, fmt.Sprintf("[%s] rolling for %v, original desired %s, %d terminated instances still in the ASG", p.name, now.Sub(p.started).Round(time.Second), desired, p.terminated))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// handleShutdown waits for a signal to shut down, then logs the summary of the rolling updates in progress
+// and exits
+func handleShutdown(signals <-chan os.Signal, state *rollerState, exit func(code int)) {
+	sig := <-signals
+	log.Printf("Received %v, shutting down: %s\n", sig, shutdownSummary(state, time.Now()))
+	exit(0)
+}
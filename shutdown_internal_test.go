@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShutdownSummary(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		desc            string
+		rolling         map[string]time.Time
+		originalDesired map[string]int64
+		terminated      map[string][]string
+		summary         string
+	}{
+		{"nothing rolling", nil, map[string]int64{"myasg": 2}, nil, "no ASGs were left mid-roll"},
+		{"one rolling",
+			map[string]time.Time{"myasg": now.Add(-5 * time.Minute)},
+			map[string]int64{"myasg": 2},
+			map[string][]string{"myasg": {"1"}},
+			"1 ASGs were left mid-roll:\n[myasg] rolling for 5m0s, original desired 2, 1 terminated instances still in the ASG",
+		},
+		{"several rolling, one done",
+			map[string]time.Time{"b": now.Add(-time.Hour), "a": now.Add(-90 * time.Second)},
+			map[string]int64{"a": 3, "c": 1},
+			map[string][]string{"a": {"1", "2"}, "c": {"3"}},
+			"2 ASGs were left mid-roll:\n[a] rolling for 1m30s, original desired 3, 2 terminated instances still in the ASG\n[b] rolling for 1h0m0s, original desired unknown, 0 terminated instances still in the ASG",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			state := newRollerState()
+			for asg, started := range tt.rolling {
+				state.rolling[asg] = started
+			}
+			for asg, desired := range tt.originalDesired {
+				state.setOriginalDesired(asg, desired)
+			}
+			for asg, ids := range tt.terminated {
+				state.addTerminated(asg, ids, 0)
+			}
+			summary := shutdownSummary(state, now)
+			if summary != tt.summary {
+				t.Errorf("mismatched summary, actual %q expected %q", summary, tt.summary)
+			}
+		})
+	}
+}
+
+func TestHandleShutdown(t *testing.T) {
+	state := newRollerState()
+	state.setRolling("myasg", true)
+	signals := make(chan os.Signal, 1)
+	exited := make(chan int, 1)
+	go handleShutdown(signals, state, func(code int) { exited <- code })
+	signals <- syscall.SIGTERM
+	select {
+	case code := <-exited:
+		if code != 0 {
+			t.Errorf("mismatched exit code, actual %d expected 0", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("did not exit on signal")
+	}
+}
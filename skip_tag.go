@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// skipTagged returns the instances without the tag, whatever its value, logging each one with it as
+// skipped, so that instances pinned by hand are never terminated. Instances that were not described are
+// kept.
+func skipTagged(asg *autoscaling.Group, instances []*autoscaling.Instance, described map[string]*ec2.Instance, tagKey string) []*autoscaling.Instance {
+	if tagKey == "" {
+		return instances
+	}
+	kept := make([]*autoscaling.Instance, 0, len(instances))
+	for _, i := range instances {
+		if instanceHasTag(described[*i.InstanceId], tagKey) {
+			log.Printf("[%v] skipping old instance %v because it has tag %s\n", p2v(asg.AutoScalingGroupName), p2v(i.InstanceId), tagKey)
+			continue
+		}
+		kept = append(kept, i)
+	}
+	return kept
+}
+
+// instanceHasTag reports if the described instance has the tag
+func instanceHasTag(instance *ec2.Instance, tagKey string) bool {
+	if instance == nil {
+		return false
+	}
+	for _, tag := range instance.Tags {
+		if aws.StringValue(tag.Key) == tagKey {
+			return true
+		}
+	}
+	return false
+}
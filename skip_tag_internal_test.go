@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestSkipTagged(t *testing.T) {
+	described := map[string]*ec2.Instance{
+		"1": {InstanceId: aws.String("1"), Tags: []*ec2.Tag{{Key: aws.String("aws-asg-roller/skip"), Value: aws.String("")}}},
+		"2": {InstanceId: aws.String("2"), Tags: []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String("node")}}},
+		"3": {InstanceId: aws.String("3"), Tags: []*ec2.Tag{{Key: aws.String("aws-asg-roller/skip"), Value: aws.String("false")}}},
+	}
+	tests := []struct {
+		desc   string
+		tagKey string
+		kept   []string
+	}{
+		{"default tag", "aws-asg-roller/skip", []string{"2", "4"}},
+		{"other tag", "Name", []string{"1", "3", "4"}},
+		{"disabled", "", []string{"1", "2", "3", "4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			instances := []*autoscaling.Instance{
+				{InstanceId: aws.String("1")},
+				{InstanceId: aws.String("2")},
+				{InstanceId: aws.String("3")},
+				// not described
+				{InstanceId: aws.String("4")},
+			}
+			kept := skipTagged(&autoscaling.Group{AutoScalingGroupName: aws.String("myasg")}, instances, described, tt.tagKey)
+			if ids := mapInstancesIds(kept); !testStringEq(ids, tt.kept) {
+				t.Errorf("mismatched instances kept, actual %v expected %v", ids, tt.kept)
+			}
+		})
+	}
+}
+
+func TestAdjustSkipTag(t *testing.T) {
+	// part way through a roll, with the first old instance pinned by tag
+	name := "myasg"
+	lcName := "lconfig"
+	oldLcName := "oldlconfig"
+	myHealthy := healthy
+	asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+		name: {
+			AutoScalingGroupName:    &name,
+			DesiredCapacity:         aws.Int64(3),
+			MaxSize:                 aws.Int64(3),
+			LaunchConfigurationName: &lcName,
+			Instances: []*autoscaling.Instance{
+				{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+				{InstanceId: aws.String("2"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy},
+				{InstanceId: aws.String("3"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+			},
+		},
+	}}
+	ec2Svc := &mockEc2Svc{
+		autodescribe: true,
+		instances: map[string]*ec2.Instance{
+			"1": {InstanceId: aws.String("1"), PrivateDnsName: aws.String("host1"), Tags: []*ec2.Tag{{Key: aws.String("aws-asg-roller/skip"), Value: aws.String("true")}}},
+		},
+	}
+	state := newRollerState()
+	state.originalDesired = map[string]int64{name: 2}
+	state.setRolling(name, true)
+	configs := Configs{
+		KubernetesEnabled: kubernetesEnabled,
+		ASGS:              []string{name},
+		InitialSurge:      1,
+		MaxTerminate:      2,
+		MaxSurge:          -1,
+		MaxUnavailable:    1,
+		SkipTag:           "aws-asg-roller/skip",
+	}
+	// the pinned instance is never chosen, however many loops run
+	terminated := make([]string, 0)
+	for loop := 0; loop < 2; loop++ {
+		if _, err := adjust(configs, ec2Svc, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	for _, c := range asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup") {
+		terminated = append(terminated, *c.params[0].(*autoscaling.TerminateInstanceInAutoScalingGroupInput).InstanceId)
+	}
+	for _, id := range terminated {
+		if id == "1" {
+			t.Errorf("terminated instance 1 pinned by tag")
+		}
+	}
+	if len(terminated) == 0 {
+		t.Errorf("terminated no instances, expected the old instance without the tag")
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// splitStandby splits out the instances that are in Standby, which are left alone by the ASG, and so are
+// never replaced unless they are moved out of Standby first
+func splitStandby(instances []*autoscaling.Instance) ([]*autoscaling.Instance, []*autoscaling.Instance) {
+	active := make([]*autoscaling.Instance, 0)
+	standby := make([]*autoscaling.Instance, 0)
+	for _, i := range instances {
+		if aws.StringValue(i.LifecycleState) == autoscaling.LifecycleStateStandby {
+			standby = append(standby, i)
+			continue
+		}
+		active = append(active, i)
+	}
+	return active, standby
+}
+
+// awsExitStandby moves the instances of the ASG out of Standby, so that they can be rolled once they are
+// in service again. The ASG raises its desired count by one for each of them.
+func awsExitStandby(svc asgClient, asg *autoscaling.Group, ids []string, dryRun bool) error {
+	if dryRun {
+		log.Printf("dry run: would move instances %v of ASG %s out of standby", ids, *asg.AutoScalingGroupName)
+		return nil
+	}
+	_, err := svc.ExitStandby(&autoscaling.ExitStandbyInput{
+		AutoScalingGroupName: asg.AutoScalingGroupName,
+		InstanceIds:          aws.StringSlice(ids),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to move instances %v of ASG %s out of standby: %v", ids, *asg.AutoScalingGroupName, err)
+	}
+	return nil
+}
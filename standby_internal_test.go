@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func TestAdjustStandby(t *testing.T) {
+	tests := []struct {
+		desc         string
+		include      bool
+		oldInstances int
+		exited       []string
+		terminated   []string
+	}{
+		{"standby skipped", false, 1, []string{}, []string{"1"}},
+		{"standby included", true, 2, []string{"2"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// part way through a roll, with an old instance in standby
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(3),
+					MaxSize:                 aws.Int64(4),
+					LaunchConfigurationName: &lcName,
+					Instances: []*autoscaling.Instance{
+						{InstanceId: aws.String("1"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy, LifecycleState: aws.String(autoscaling.LifecycleStateInService)},
+						{InstanceId: aws.String("2"), LaunchConfigurationName: &oldLcName, HealthStatus: &myHealthy, LifecycleState: aws.String(autoscaling.LifecycleStateStandby)},
+						{InstanceId: aws.String("3"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy, LifecycleState: aws.String(autoscaling.LifecycleStateInService)},
+						{InstanceId: aws.String("4"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy, LifecycleState: aws.String(autoscaling.LifecycleStateInService)},
+					},
+				},
+			}}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 2}
+			state.setRolling(name, true)
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				InitialSurge:      1,
+				MaxTerminate:      1,
+				MaxSurge:          -1,
+				MaxUnavailable:    -1,
+				IncludeStandby:    tt.include,
+			}
+			statuses, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(statuses) != 1 || statuses[0].OldInstances != tt.oldInstances {
+				t.Errorf("mismatched statuses, actual %v expected %d old instances", statuses, tt.oldInstances)
+			}
+			exited := make([]string, 0)
+			for _, c := range asgSvc.counter.filterByName("ExitStandby") {
+				exited = append(exited, aws.StringValueSlice(c.params[0].(*autoscaling.ExitStandbyInput).InstanceIds)...)
+			}
+			if !testStringEq(exited, tt.exited) {
+				t.Errorf("mismatched instances moved out of standby, actual %v expected %v", exited, tt.exited)
+			}
+			terminated := make([]string, 0)
+			for _, c := range asgSvc.counter.filterByName("TerminateInstanceInAutoScalingGroup") {
+				terminated = append(terminated, *c.params[0].(*autoscaling.TerminateInstanceInAutoScalingGroupInput).InstanceId)
+			}
+			if !testStringEq(terminated, tt.terminated) {
+				t.Errorf("mismatched terminated instances, actual %v expected %v", terminated, tt.terminated)
+			}
+		})
+	}
+}
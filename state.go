@@ -0,0 +1,536 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// rollerState is the state the roller keeps in memory between runs of adjust. It is safe for concurrent use,
+// as long as it is accessed only via its methods.
+type rollerState struct {
+	mu sync.Mutex
+	// original desired value of each ASG, before any rolling update started
+	originalDesired map[string]int64
+	// max size of each ASG before it was rolled, if it is to be restored once the roll is done
+	originalMax map[string]int64
+	// ASGs that have been seen with no outdated instances at their original desired value, and have not
+	// been seen part way through a rolling update since
+	steady map[string]bool
+	// ASGs that are part way through a rolling update, and when they started
+	rolling map[string]time.Time
+	// ASGs that finished rolling since the last roll completed
+	finished []asgRollResult
+	// when each ASG last finished rolling
+	lastFinished map[string]time.Time
+	// set when a roll of all of the ASGs has completed, until the completion is handled
+	completed bool
+	// IDs of the instances terminated in each ASG, for as long as they still are in the ASG
+	terminated map[string]map[string]bool
+	// when each instance was last terminated, by ID, so that it is not terminated again while on its way out
+	terminatedAt map[string]time.Time
+	// when instances of each ASG were last terminated
+	lastTerminated map[string]time.Time
+	// replacements expected for terminated instances in each ASG, until they join it
+	replacements map[string]*pendingReplacements
+	// when each new instance in each ASG was first seen unhealthy, for as long as it still is
+	unhealthySince map[string]map[string]time.Time
+	// when each new instance in each ASG was first seen healthy, for as long as it still is
+	healthySince map[string]map[string]time.Time
+	// number of times draining each instance in each ASG failed, for as long as it still is in the ASG
+	drainFailures map[string]map[string]int
+	// roll state of each ASG as last persisted
+	savedRollStates map[string]*RollState
+	// ASGs whose max size could not be raised due to a limit, and so are replaced in place, until done rolling
+	maxAtLimit map[string]bool
+	// used in place of time.Now, for tests
+	now func() time.Time
+	// holds the adjustment in progress, so that one left running after a timeout does not overlap the next
+	adjusting chan struct{}
+}
+
+// pendingReplacements are new instances expected to join an ASG to replace terminated instances
+type pendingReplacements struct {
+	// IDs of the instances in the ASG when the instances were terminated, so not replacements
+	known map[string]bool
+	count int
+	since time.Time
+}
+
+func newRollerState() *rollerState {
+	return &rollerState{
+		originalDesired: map[string]int64{},
+		originalMax:     map[string]int64{},
+		steady:          map[string]bool{},
+		rolling:         map[string]time.Time{},
+		lastFinished:    map[string]time.Time{},
+		terminated:      map[string]map[string]bool{},
+		terminatedAt:    map[string]time.Time{},
+		lastTerminated:  map[string]time.Time{},
+		replacements:    map[string]*pendingReplacements{},
+		unhealthySince:  map[string]map[string]time.Time{},
+		healthySince:    map[string]map[string]time.Time{},
+		drainFailures:   map[string]map[string]int{},
+		savedRollStates: map[string]*RollState{},
+		maxAtLimit:      map[string]bool{},
+		now:             time.Now,
+		adjusting:       make(chan struct{}, 1),
+	}
+}
+
+// startAdjust starts an adjustment, unless one already is in progress, and reports if it did. An adjustment
+// started must be finished with finishAdjust.
+func (s *rollerState) startAdjust() bool {
+	select {
+	case s.adjusting <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// finishAdjust finishes the adjustment in progress
+func (s *rollerState) finishAdjust() {
+	<-s.adjusting
+}
+
+// getOriginalDesired returns the original desired value of an ASG, and whether it is known
+func (s *rollerState) getOriginalDesired(asg string) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	desired, ok := s.originalDesired[asg]
+	return desired, ok
+}
+
+// setOriginalDesired records the original desired value of an ASG
+func (s *rollerState) setOriginalDesired(asg string, desired int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.originalDesired[asg] = desired
+}
+
+// getOriginalMax returns the original max size of an ASG, and whether it is known
+func (s *rollerState) getOriginalMax(asg string) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	max, ok := s.originalMax[asg]
+	return max, ok
+}
+
+// setOriginalMax records the original max size of an ASG
+func (s *rollerState) setOriginalMax(asg string, max int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.originalMax[asg] = max
+}
+
+// clearOriginalMax forgets the original max size of an ASG, once it has been restored
+func (s *rollerState) clearOriginalMax(asg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.originalMax, asg)
+}
+
+// isSteady reports if an ASG is known to be steady, i.e. not part way through a rolling update
+func (s *rollerState) isSteady(asg string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.steady[asg]
+}
+
+// setSteady records whether or not an ASG is known to be steady
+func (s *rollerState) setSteady(asg string, steady bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if steady {
+		s.steady[asg] = true
+	} else {
+		delete(s.steady, asg)
+	}
+}
+
+// isRolling reports if an ASG is known to be part way through a rolling update
+func (s *rollerState) isRolling(asg string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.rolling[asg]
+	return ok
+}
+
+// setRolling records whether or not an ASG is part way through a rolling update, and so when it started
+// and finished rolling
+func (s *rollerState) setRolling(asg string, rolling bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	started, ok := s.rolling[asg]
+	switch {
+	case rolling && !ok:
+		s.rolling[asg] = s.now()
+	case !rolling && ok:
+		finished := s.now()
+		delete(s.rolling, asg)
+		delete(s.maxAtLimit, asg)
+		s.finished = append(s.finished, asgRollResult{Name: asg, Started: started, Finished: finished})
+		s.lastFinished[asg] = finished
+	}
+}
+
+// getLastFinished returns when an ASG last finished rolling, and whether it is known
+func (s *rollerState) getLastFinished(asg string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	finished, ok := s.lastFinished[asg]
+	return finished, ok
+}
+
+// setLastFinished records when an ASG last finished rolling
+func (s *rollerState) setLastFinished(asg string, finished time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastFinished[asg] = finished
+}
+
+// asgRollProgress is how far a rolling update of an ASG has got
+type asgRollProgress struct {
+	name    string
+	started time.Time
+	// original desired value of the ASG, or -1 if it is not known
+	originalDesired int64
+	// number of instances terminated that still are in the ASG
+	terminated int
+}
+
+// rollProgress returns the progress of each ASG that is part way through a rolling update, by name
+func (s *rollerState) rollProgress() []asgRollProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	progress := make([]asgRollProgress, 0, len(s.rolling))
+	for asg, started := range s.rolling {
+		originalDesired, ok := s.originalDesired[asg]
+		if !ok {
+			originalDesired = -1
+		}
+		progress = append(progress, asgRollProgress{name: asg, started: started, originalDesired: originalDesired, terminated: len(s.terminated[asg])})
+	}
+	sort.Slice(progress, func(i, j int) bool { return progress[i].name < progress[j].name })
+	return progress
+}
+
+// anyRolling reports if any ASG is part way through a rolling update
+func (s *rollerState) anyRolling() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.rolling) > 0
+}
+
+// setRollCompleted records that every ASG that was rolling is now done
+func (s *rollerState) setRollCompleted() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.completed = true
+}
+
+// takeRollCompleted reports if a roll has completed since it was last called
+func (s *rollerState) takeRollCompleted() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	completed := s.completed
+	s.completed = false
+	return completed
+}
+
+// takeFinished returns the ASGs that finished rolling since it was last called
+func (s *rollerState) takeFinished() []asgRollResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	finished := s.finished
+	s.finished = nil
+	return finished
+}
+
+// addTerminated records that instances in an ASG were terminated. When they were terminated is only kept
+// for as long as the dedup window, if there is one.
+func (s *rollerState) addTerminated(asg string, ids []string, dedupWindow time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.terminated[asg] == nil {
+		s.terminated[asg] = map[string]bool{}
+	}
+	s.forgetTerminatedAt(dedupWindow)
+	now := s.now()
+	for _, id := range ids {
+		s.terminated[asg][id] = true
+		if dedupWindow > 0 {
+			s.terminatedAt[id] = now
+		}
+	}
+	s.lastTerminated[asg] = now
+}
+
+// terminateCooldownRemaining returns how long until the cooldown after instances of the ASG were last
+// terminated is over, 0 if it is over or there is no cooldown
+func (s *rollerState) terminateCooldownRemaining(asg string, cooldown time.Duration) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last, ok := s.lastTerminated[asg]
+	if cooldown <= 0 || !ok {
+		return 0
+	}
+	if remaining := cooldown - s.now().Sub(last); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// recentlyTerminated splits the IDs of instances into those terminated within the window, and the rest,
+// forgetting terminations from before the window
+func (s *rollerState) recentlyTerminated(ids []string, window time.Duration) ([]string, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forgetTerminatedAt(window)
+	recent, rest := make([]string, 0), make([]string, 0)
+	for _, id := range ids {
+		if _, ok := s.terminatedAt[id]; ok {
+			recent = append(recent, id)
+		} else {
+			rest = append(rest, id)
+		}
+	}
+	return recent, rest
+}
+
+// forgetTerminatedAt forgets when instances were terminated, if it was before the window. The caller holds
+// the lock.
+func (s *rollerState) forgetTerminatedAt(window time.Duration) {
+	for id, at := range s.terminatedAt {
+		if s.now().Sub(at) > window {
+			delete(s.terminatedAt, id)
+		}
+	}
+}
+
+// pruneTerminated forgets terminated instances that have left the ASG
+func (s *rollerState) pruneTerminated(asg string, instances []*autoscaling.Instance) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := map[string]bool{}
+	for _, i := range instances {
+		current[aws.StringValue(i.InstanceId)] = true
+	}
+	for id := range s.terminated[asg] {
+		if !current[id] {
+			delete(s.terminated[asg], id)
+		}
+	}
+}
+
+// reusedTerminated returns the IDs of any of the instances of an ASG, old or new, that were terminated, and so
+// should be on their way out of the ASG, but are in service again
+func (s *rollerState) reusedTerminated(asg string, instances []*autoscaling.Instance) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reused := make([]string, 0)
+	for _, i := range instances {
+		if aws.StringValue(i.LifecycleState) != autoscaling.LifecycleStateInService {
+			continue
+		}
+		if id := aws.StringValue(i.InstanceId); s.terminated[asg][id] {
+			reused = append(reused, id)
+		}
+	}
+	return reused
+}
+
+// expectReplacements records that count instances were terminated in an ASG that had the given instances,
+// and so that as many new instances are expected to join it
+func (s *rollerState) expectReplacements(asg string, instances []*autoscaling.Instance, count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending, ok := s.replacements[asg]
+	if !ok {
+		pending = &pendingReplacements{known: map[string]bool{}, since: s.now()}
+		s.replacements[asg] = pending
+	}
+	for _, i := range instances {
+		pending.known[aws.StringValue(i.InstanceId)] = true
+	}
+	pending.count += count
+}
+
+// checkReplacements returns how many of the expected replacements have not yet joined an ASG with the given
+// instances, and whether they are overdue, i.e. have been expected for longer than timeout
+func (s *rollerState) checkReplacements(asg string, instances []*autoscaling.Instance, timeout time.Duration) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending, ok := s.replacements[asg]
+	if !ok {
+		return 0, false
+	}
+	joined := 0
+	for _, i := range instances {
+		if !pending.known[aws.StringValue(i.InstanceId)] {
+			joined++
+		}
+	}
+	if joined >= pending.count {
+		delete(s.replacements, asg)
+		return 0, false
+	}
+	return pending.count - joined, s.now().Sub(pending.since) > timeout
+}
+
+// stuckUnhealthy records which of the new instances of an ASG are unhealthy, and returns the IDs of those
+// that have been unhealthy for more than timeout, in the same order. Instances are forgotten once healthy or
+// out of the ASG.
+func (s *rollerState) stuckUnhealthy(asg string, instances []*autoscaling.Instance, timeout time.Duration) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	previous := s.unhealthySince[asg]
+	current := map[string]time.Time{}
+	stuck := make([]string, 0)
+	for _, i := range instances {
+		if aws.StringValue(i.HealthStatus) == healthy {
+			continue
+		}
+		id := aws.StringValue(i.InstanceId)
+		since, ok := previous[id]
+		if !ok {
+			since = now
+		}
+		current[id] = since
+		if now.Sub(since) > timeout {
+			stuck = append(stuck, id)
+		}
+	}
+	s.unhealthySince[asg] = current
+	return stuck
+}
+
+// healthGraceRemaining records which of the new instances of an ASG are healthy, and returns how long until
+// the last of them to become healthy has been so for the grace period, 0 if all of them have. Instances are
+// forgotten once unhealthy or out of the ASG.
+func (s *rollerState) healthGraceRemaining(asg string, instances []*autoscaling.Instance, grace time.Duration) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	previous := s.healthySince[asg]
+	current := map[string]time.Time{}
+	var remaining time.Duration
+	for _, i := range instances {
+		if aws.StringValue(i.HealthStatus) != healthy {
+			continue
+		}
+		id := aws.StringValue(i.InstanceId)
+		since, ok := previous[id]
+		if !ok {
+			since = now
+		}
+		current[id] = since
+		if r := grace - now.Sub(since); r > remaining {
+			remaining = r
+		}
+	}
+	s.healthySince[asg] = current
+	return remaining
+}
+
+// addDrainFailure records that draining an instance in an ASG failed, and returns how many times it has
+func (s *rollerState) addDrainFailure(asg, id string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.drainFailures[asg] == nil {
+		s.drainFailures[asg] = map[string]int{}
+	}
+	s.drainFailures[asg][id]++
+	return s.drainFailures[asg][id]
+}
+
+// failedToDrain returns the IDs of the instances in an ASG that failed to drain at least limit times,
+// forgetting those that have left the ASG
+func (s *rollerState) failedToDrain(asg string, instances []*autoscaling.Instance, limit int) map[string]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := map[string]bool{}
+	for _, i := range instances {
+		current[aws.StringValue(i.InstanceId)] = true
+	}
+	failed := map[string]bool{}
+	for id, failures := range s.drainFailures[asg] {
+		switch {
+		case !current[id]:
+			delete(s.drainFailures[asg], id)
+		case failures >= limit:
+			failed[id] = true
+		}
+	}
+	return failed
+}
+
+// setMaxAtLimit records that the max size of an ASG could not be raised due to a limit
+func (s *rollerState) setMaxAtLimit(asg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxAtLimit[asg] = true
+}
+
+// isMaxAtLimit returns whether the max size of an ASG could not be raised due to a limit during its roll
+func (s *rollerState) isMaxAtLimit(asg string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxAtLimit[asg]
+}
+
+// rollState returns the state of the roll of an ASG, or nil if it is not rolling
+func (s *rollerState) rollState(asg string) *RollState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	started, ok := s.rolling[asg]
+	if !ok {
+		return nil
+	}
+	rollState := &RollState{Phase: rollPhaseSurging, Started: started}
+	for id := range s.terminated[asg] {
+		rollState.Terminated = append(rollState.Terminated, id)
+	}
+	if len(rollState.Terminated) > 0 {
+		rollState.Phase = rollPhaseTerminating
+		sort.Strings(rollState.Terminated)
+	}
+	return rollState
+}
+
+// resumeRoll records that an ASG is part way through a roll, as persisted in its roll state
+func (s *rollerState) resumeRoll(asg string, rollState *RollState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rolling[asg] = rollState.Started
+	if len(rollState.Terminated) > 0 {
+		s.terminated[asg] = map[string]bool{}
+		for _, id := range rollState.Terminated {
+			s.terminated[asg][id] = true
+		}
+	}
+	s.savedRollStates[asg] = rollState
+}
+
+// savedRollState returns the roll state of an ASG as last persisted, or nil if none is
+func (s *rollerState) savedRollState(asg string) *RollState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.savedRollStates[asg]
+}
+
+// setSavedRollState records the roll state of an ASG as persisted, or that none is if nil
+func (s *rollerState) setSavedRollState(asg string, rollState *RollState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rollState == nil {
+		delete(s.savedRollStates, asg)
+		return
+	}
+	s.savedRollStates[asg] = rollState
+}
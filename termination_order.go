@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const (
+	terminateOrderOldest = "oldest"
+	terminateOrderNewest = "newest"
+	terminateOrderRandom = "random"
+)
+
+// used only to shuffle instances for a random termination order
+var terminateRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// validTerminateOrder reports if the order is one that instances can be terminated in. The empty order
+// means the order the ASG lists them.
+func validTerminateOrder(order string) bool {
+	switch order {
+	case "", terminateOrderOldest, terminateOrderNewest, terminateOrderRandom:
+		return true
+	}
+	return false
+}
+
+// orderForTermination returns the instances in the order they are to be terminated: the oldest or the
+// newest first, by launch time, or in random order. Instances that were not described, and so have no
+// known launch time, are kept in the same order, after those that were.
+func orderForTermination(instances []*autoscaling.Instance, described map[string]*ec2.Instance, order string) []*autoscaling.Instance {
+	ordered := make([]*autoscaling.Instance, len(instances))
+	copy(ordered, instances)
+	launched := func(i int) (time.Time, bool) {
+		instance, ok := described[*ordered[i].InstanceId]
+		if !ok || instance.LaunchTime == nil {
+			return time.Time{}, false
+		}
+		return *instance.LaunchTime, true
+	}
+	switch order {
+	case terminateOrderOldest, terminateOrderNewest:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			ti, iok := launched(i)
+			tj, jok := launched(j)
+			switch {
+			case !iok || !jok:
+				return iok && !jok
+			case order == terminateOrderOldest:
+				return ti.Before(tj)
+			default:
+				return ti.After(tj)
+			}
+		})
+	case terminateOrderRandom:
+		terminateRand.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+	}
+	return ordered
+}
+
+// spotFirst returns the instances with the spot instances, which are cheaper to lose, ahead of the on-demand
+// instances, otherwise in the same order. Instances that were not described are taken to be on-demand.
+func spotFirst(instances []*autoscaling.Instance, described map[string]*ec2.Instance) []*autoscaling.Instance {
+	ordered := make([]*autoscaling.Instance, len(instances))
+	copy(ordered, instances)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return isSpot(described[*ordered[i].InstanceId]) && !isSpot(described[*ordered[j].InstanceId])
+	})
+	return ordered
+}
+
+// isSpot reports if the described instance is a spot instance
+func isSpot(instance *ec2.Instance) bool {
+	return instance != nil && aws.StringValue(instance.InstanceLifecycle) == ec2.InstanceLifecycleTypeSpot
+}
+
+// orderByNodeWeight returns the instances with those whose nodes have the lowest weight first, otherwise in
+// the same order. The weights are the values of the weight annotation on the nodes, by instance ID.
+// Instances whose nodes have no weight, or one that is not a number, are kept after those that have one.
+func orderByNodeWeight(asgName string, instances []*autoscaling.Instance, weights map[string]string) []*autoscaling.Instance {
+	parsed := map[string]float64{}
+	for _, instance := range instances {
+		value := weights[*instance.InstanceId]
+		if value == "" {
+			continue
+		}
+		weight, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			log.Printf("[%s] ignoring invalid termination weight '%s' of node of instance %s", asgName, value, *instance.InstanceId)
+			continue
+		}
+		parsed[*instance.InstanceId] = weight
+	}
+	ordered := make([]*autoscaling.Instance, len(instances))
+	copy(ordered, instances)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		wi, iok := parsed[*ordered[i].InstanceId]
+		wj, jok := parsed[*ordered[j].InstanceId]
+		if !iok || !jok {
+			return iok && !jok
+		}
+		return wi < wj
+	})
+	return ordered
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestOrderForTermination(t *testing.T) {
+	now := time.Now()
+	// listed by the ASG in neither launch order; "4" was not described
+	described := map[string]*ec2.Instance{
+		"1": {InstanceId: aws.String("1"), LaunchTime: aws.Time(now.Add(-2 * time.Hour))},
+		"2": {InstanceId: aws.String("2"), LaunchTime: aws.Time(now.Add(-3 * time.Hour))},
+		"3": {InstanceId: aws.String("3"), LaunchTime: aws.Time(now.Add(-1 * time.Hour))},
+	}
+	tests := []struct {
+		order   string
+		ordered []string
+	}{
+		{"", []string{"1", "2", "3", "4"}},
+		{terminateOrderOldest, []string{"2", "1", "3", "4"}},
+		{terminateOrderNewest, []string{"3", "1", "2", "4"}},
+	}
+	for _, tt := range tests {
+		instances := make([]*autoscaling.Instance, 0)
+		for _, id := range []string{"1", "2", "3", "4"} {
+			instances = append(instances, &autoscaling.Instance{InstanceId: aws.String(id)})
+		}
+		ordered := mapInstancesIds(orderForTermination(instances, described, tt.order))
+		if !testStringEq(ordered, tt.ordered) {
+			t.Errorf("order '%s': mismatched order, actual %v expected %v", tt.order, ordered, tt.ordered)
+		}
+		// the instances passed in are left as they are
+		if ids := mapInstancesIds(instances); !testStringEq(ids, []string{"1", "2", "3", "4"}) {
+			t.Errorf("order '%s': instances changed to %v", tt.order, ids)
+		}
+	}
+
+	// random order is some order of all of the same instances
+	instances := make([]*autoscaling.Instance, 0)
+	for _, id := range []string{"1", "2", "3", "4"} {
+		instances = append(instances, &autoscaling.Instance{InstanceId: aws.String(id)})
+	}
+	ordered := mapInstancesIds(orderForTermination(instances, described, terminateOrderRandom))
+	sort.Strings(ordered)
+	if !testStringEq(ordered, []string{"1", "2", "3", "4"}) {
+		t.Errorf("random order: mismatched instances %v", ordered)
+	}
+}
+
+func TestValidTerminateOrder(t *testing.T) {
+	tests := []struct {
+		order string
+		valid bool
+	}{
+		{"", true},
+		{"oldest", true},
+		{"newest", true},
+		{"random", true},
+		{"Oldest", false},
+		{"first", false},
+	}
+	for _, tt := range tests {
+		if valid := validTerminateOrder(tt.order); valid != tt.valid {
+			t.Errorf("order '%s': mismatched validity, actual %v expected %v", tt.order, valid, tt.valid)
+		}
+	}
+}
+
+func TestOrderByNodeWeight(t *testing.T) {
+	tests := []struct {
+		desc    string
+		weights map[string]string
+		ordered []string
+	}{
+		{"no weights", map[string]string{}, []string{"1", "2", "3", "4"}},
+		{"lowest first", map[string]string{"1": "30", "2": "10", "3": "20", "4": "-5"}, []string{"4", "2", "3", "1"}},
+		{"equal weights keep order", map[string]string{"1": "1", "2": "0.5", "3": "1", "4": "0.5"}, []string{"2", "4", "1", "3"}},
+		{"unweighted last", map[string]string{"3": "100", "4": "7"}, []string{"4", "3", "1", "2"}},
+		{"invalid weight ignored", map[string]string{"1": "heavy", "2": "2", "4": "1"}, []string{"4", "2", "1", "3"}},
+	}
+	for _, tt := range tests {
+		instances := make([]*autoscaling.Instance, 0)
+		for _, id := range []string{"1", "2", "3", "4"} {
+			instances = append(instances, &autoscaling.Instance{InstanceId: aws.String(id)})
+		}
+		ordered := mapInstancesIds(orderByNodeWeight("myasg", instances, tt.weights))
+		if !testStringEq(ordered, tt.ordered) {
+			t.Errorf("%s: mismatched order, actual %v expected %v", tt.desc, ordered, tt.ordered)
+		}
+		if ids := mapInstancesIds(instances); !testStringEq(ids, []string{"1", "2", "3", "4"}) {
+			t.Errorf("%s: instances changed to %v", tt.desc, ids)
+		}
+	}
+}
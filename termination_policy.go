@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+const asgTagNameOriginalTerminationPolicies = "aws-asg-roller/OriginalTerminationPolicies"
+
+// applyTerminationPolicies sets the termination policies of an ASG that is to be rolled, so that the ASG
+// picks the instances to remove as preferred while it is rolled, e.g. when the desired count is returned to
+// its original value at the end of the roll. The policies the ASG had are recorded as a tag on the ASG, as
+// with the original max size, so that they can be restored once the roll is done, even if the process
+// terminates in between. If they already are recorded, or in a dry run, the tag is left as it is.
+func applyTerminationPolicies(asgSvc asgClient, asg *autoscaling.Group, policies []string, dryRun, verbose bool) error {
+	asgName := *asg.AutoScalingGroupName
+	current := aws.StringValueSlice(asg.TerminationPolicies)
+	if strings.Join(current, ",") == strings.Join(policies, ",") {
+		return nil
+	}
+	if _, ok := getOriginalTerminationPoliciesTag(asg); !ok {
+		if err := setOriginalTerminationPoliciesTag(asgSvc, asgName, current, dryRun, verbose); err != nil {
+			return err
+		}
+	}
+	log.Printf("[%s] setting termination policies from %v to %v while rolling\n", asgName, current, policies)
+	if err := setAsgTerminationPolicies(asgSvc, asg, policies, dryRun); err != nil {
+		return err
+	}
+	asg.TerminationPolicies = aws.StringSlice(policies)
+	return nil
+}
+
+// restoreTerminationPolicies returns the termination policies of an ASG that is done rolling to those
+// recorded before it was rolled, if any are, and then removes the record of them, unless in a dry run
+func restoreTerminationPolicies(asgSvc asgClient, asg *autoscaling.Group, dryRun, verbose bool) error {
+	asgName := *asg.AutoScalingGroupName
+	original, ok := getOriginalTerminationPoliciesTag(asg)
+	if !ok {
+		return nil
+	}
+	current := aws.StringValueSlice(asg.TerminationPolicies)
+	if strings.Join(current, ",") != strings.Join(original, ",") {
+		log.Printf("[%s] restoring termination policies from %v to %v\n", asgName, current, original)
+		if err := setAsgTerminationPolicies(asgSvc, asg, original, dryRun); err != nil {
+			return err
+		}
+		asg.TerminationPolicies = aws.StringSlice(original)
+	}
+	if dryRun {
+		log.Printf("dry run: would remove tag '%s' from ASG: %s", asgTagNameOriginalTerminationPolicies, asgName)
+		return nil
+	}
+	_, err := asgSvc.DeleteTags(&autoscaling.DeleteTagsInput{
+		Tags: []*autoscaling.Tag{
+			{
+				Key:          aws.String(asgTagNameOriginalTerminationPolicies),
+				ResourceId:   aws.String(asgName),
+				ResourceType: aws.String("auto-scaling-group"),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to delete tag '%s' for ASG %s: %v", asgTagNameOriginalTerminationPolicies, asgName, err)
+	}
+	if verbose {
+		log.Printf("removed recorded termination policies from tag on ASG: %s", asgName)
+	}
+	return nil
+}
+
+// setOriginalTerminationPoliciesTag records the termination policies an ASG had before it was rolled as a
+// tag on the ASG
+func setOriginalTerminationPoliciesTag(asgSvc asgClient, asgName string, policies []string, dryRun, verbose bool) error {
+	if dryRun {
+		log.Printf("dry run: would record termination policies %v in tag '%s' on ASG: %s", policies, asgTagNameOriginalTerminationPolicies, asgName)
+		return nil
+	}
+	_, err := asgSvc.CreateOrUpdateTags(&autoscaling.CreateOrUpdateTagsInput{
+		Tags: []*autoscaling.Tag{
+			{
+				Key:               aws.String(asgTagNameOriginalTerminationPolicies),
+				PropagateAtLaunch: aws.Bool(false),
+				ResourceId:        aws.String(asgName),
+				ResourceType:      aws.String("auto-scaling-group"),
+				Value:             aws.String(strings.Join(policies, ",")),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to set tag '%s' for ASG %s: %v", asgTagNameOriginalTerminationPolicies, asgName, err)
+	}
+	if verbose {
+		log.Printf("recorded termination policies %v in tag on ASG: %s", policies, asgName)
+	}
+	return nil
+}
+
+// getOriginalTerminationPoliciesTag reads the original termination policies from the tags of the ASG, and
+// whether there is such a tag. If the ASG had no policies, it has the default policy.
+func getOriginalTerminationPoliciesTag(asg *autoscaling.Group) ([]string, bool) {
+	for _, tag := range asg.Tags {
+		if aws.StringValue(tag.Key) != asgTagNameOriginalTerminationPolicies {
+			continue
+		}
+		if aws.StringValue(tag.Value) == "" {
+			return []string{"Default"}, true
+		}
+		return strings.Split(aws.StringValue(tag.Value), ","), true
+	}
+	return nil, false
+}
+
+func setAsgTerminationPolicies(svc asgClient, asg *autoscaling.Group, policies []string, dryRun bool) error {
+	if dryRun {
+		log.Printf("dry run: would set ASG %s termination policies to %v", *asg.AutoScalingGroupName, policies)
+		return nil
+	}
+	_, err := svc.UpdateAutoScalingGroup(&autoscaling.UpdateAutoScalingGroupInput{
+		AutoScalingGroupName: asg.AutoScalingGroupName,
+		TerminationPolicies:  aws.StringSlice(policies),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to set ASG %s termination policies to %v: %v", *asg.AutoScalingGroupName, policies, err)
+	}
+	return nil
+}
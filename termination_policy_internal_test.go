@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func TestAdjustTerminationPolicies(t *testing.T) {
+	tests := []struct {
+		desc        string
+		old         int64
+		policies    []string
+		current     []string
+		tag         string
+		dryRun      bool
+		updated     []string
+		tagged      []string
+		deletedTags int
+	}{
+		{"start of roll without policies", 2, nil, []string{"Default"}, "", false, []string{}, []string{}, 0},
+		{"start of roll sets policies", 2, []string{"OldestInstance"}, []string{"Default"}, "", false, []string{"[OldestInstance]"}, []string{"Default"}, 0},
+		{"start of roll with policies already set", 2, []string{"OldestInstance"}, []string{"OldestInstance"}, "", false, []string{}, []string{}, 0},
+		{"start of roll keeps recorded policies", 2, []string{"OldestInstance", "Default"}, []string{"NewestInstance"}, "Default", false, []string{"[OldestInstance Default]"}, []string{}, 0},
+		{"done restores policies", 0, []string{"OldestInstance"}, []string{"OldestInstance"}, "NewestInstance,Default", false, []string{"[NewestInstance Default]"}, []string{}, 1},
+		{"done with policies unchanged", 0, nil, []string{"Default"}, "Default", false, []string{}, []string{}, 1},
+		{"done without recorded policies", 0, []string{"OldestInstance"}, []string{"Default"}, "", false, []string{}, []string{}, 0},
+		{"start of roll dry run", 2, []string{"OldestInstance"}, []string{"Default"}, "", true, []string{}, []string{}, 0},
+		{"done dry run", 0, []string{"OldestInstance"}, []string{"OldestInstance"}, "NewestInstance,Default", true, []string{}, []string{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := fmt.Sprintf("old%s", lcName)
+			myHealthy := healthy
+			instances := make([]*autoscaling.Instance, 0)
+			for i := int64(0); i < 2; i++ {
+				id, instanceLc := fmt.Sprintf("new%d", i), lcName
+				if i < tt.old {
+					id, instanceLc = fmt.Sprintf("old%d", i), oldLcName
+				}
+				instances = append(instances, &autoscaling.Instance{InstanceId: aws.String(id), LaunchConfigurationName: aws.String(instanceLc), HealthStatus: &myHealthy})
+			}
+			tags := make([]*autoscaling.TagDescription, 0)
+			if tt.tag != "" {
+				tags = append(tags, &autoscaling.TagDescription{Key: aws.String(asgTagNameOriginalTerminationPolicies), Value: aws.String(tt.tag)})
+			}
+			asgSvc := &mockAsgSvc{groups: map[string]*autoscaling.Group{
+				name: {
+					AutoScalingGroupName:    &name,
+					DesiredCapacity:         aws.Int64(2),
+					MaxSize:                 aws.Int64(3),
+					LaunchConfigurationName: &lcName,
+					Instances:               instances,
+					Tags:                    tags,
+					TerminationPolicies:     aws.StringSlice(tt.current),
+				},
+			}}
+			state := newRollerState()
+			state.originalDesired = map[string]int64{name: 2}
+			configs := Configs{
+				KubernetesEnabled:   kubernetesEnabled,
+				ASGS:                []string{name},
+				InitialSurge:        1,
+				MaxTerminate:        1,
+				MaxSurge:            -1,
+				MaxUnavailable:      -1,
+				TerminationPolicies: tt.policies,
+				DryRun:              tt.dryRun,
+			}
+			if _, err := adjust(configs, &mockEc2Svc{autodescribe: true}, asgSvc, nil, nil, nil, nil, nil, nil, state); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			updated := make([]string, 0)
+			for _, c := range asgSvc.counter.filterByName("UpdateAutoScalingGroup") {
+				if policies := c.params[0].(*autoscaling.UpdateAutoScalingGroupInput).TerminationPolicies; policies != nil {
+					updated = append(updated, fmt.Sprint(aws.StringValueSlice(policies)))
+				}
+			}
+			tagged := make([]string, 0)
+			for _, c := range asgSvc.counter.filterByName("CreateOrUpdateTags") {
+				for _, tag := range c.params[0].(*autoscaling.CreateOrUpdateTagsInput).Tags {
+					if *tag.Key == asgTagNameOriginalTerminationPolicies {
+						tagged = append(tagged, *tag.Value)
+					}
+				}
+			}
+			if !testStringEq(updated, tt.updated) {
+				t.Errorf("mismatched termination policies, actual %v expected %v", updated, tt.updated)
+			}
+			if !testStringEq(tagged, tt.tagged) {
+				t.Errorf("mismatched original termination policies tags, actual %v expected %v", tagged, tt.tagged)
+			}
+			if deleted := len(asgSvc.counter.filterByName("DeleteTags")); deleted != tt.deletedTags {
+				t.Errorf("mismatched tag deletions, actual %d expected %d", deleted, tt.deletedTags)
+			}
+		})
+	}
+}
@@ -1,5 +1,12 @@
 package main
 
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+)
+
 // p2v is the equivalent of referencing a pointer, but safely (no panic).
 // Should be used for printing purposes (i.e. fmt.Printf(...))
 func p2v(p interface{}) interface{} {
@@ -18,3 +25,38 @@ func p2v(p interface{}) interface{} {
 		return value
 	}
 }
+
+// runConcurrently calls f for each index from 0 to n-1, with up to concurrency calls running at the same
+// time, and waits for all of them to complete. It returns the error for the lowest index that had one.
+func runConcurrently(n, concurrency int, f func(i int) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	errs := make([]error, n)
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = f(i)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contentHash returns a hash of the contents that an instance is launched with. User data is expected
+// base64-encoded, as both launch configurations and instance attributes return it.
+func contentHash(imageID, instanceType, userData string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join([]string{imageID, instanceType, userData}, "\n"))))
+}
@@ -1,5 +1,10 @@
 package main
 
+import (
+	"sync"
+	"sync/atomic"
+)
+
 func testStringEq(a, b []string) bool {
 
 	// If one is nil, the other must also be nil.
@@ -19,18 +24,26 @@ func testStringEq(a, b []string) bool {
 	return true
 }
 
+// callSequence orders calls across all funcCounters, so tests can check the order of calls to different mocks
+var callSequence int64
+
 type funcCounter struct {
+	sync.Mutex
 	count []funcCounterImpl
 }
 type funcCounterImpl struct {
 	name   string
 	params []interface{}
+	seq    int64
 }
 
 func (f *funcCounter) add(name string, params ...interface{}) {
+	f.Lock()
+	defer f.Unlock()
 	f.count = append(f.count, funcCounterImpl{
 		name:   name,
 		params: params,
+		seq:    atomic.AddInt64(&callSequence, 1),
 	})
 }
 func (f *funcCounter) last() (string, []interface{}) { //nolint:unused
@@ -50,6 +63,8 @@ func (f *funcCounter) lastByName(name string) []interface{} { //nolint:unused
 	return params
 }
 func (f *funcCounter) filterByName(name string) []funcCounterImpl {
+	f.Lock()
+	defer f.Unlock()
 	ret := make([]funcCounterImpl, 0)
 	for _, call := range f.count {
 		if call.name == name {
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// postRollValidator validates, e.g. by running smoke tests, that everything works once all of the ASGs
+// have been rolled
+type postRollValidator interface {
+	validate(asgs []string) error
+}
+
+// webhookValidator validates a roll by posting to a webhook, which must respond with a 2xx status
+type webhookValidator struct {
+	url    string
+	client *http.Client
+}
+
+func (w *webhookValidator) validate(asgs []string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"event": "roll-complete",
+		"asgs":  asgs,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create webhook request body: %v", err)
+	}
+	res, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error calling webhook %s: %v", w.url, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook %s returned status %s", w.url, res.Status)
+	}
+	return nil
+}
+
+// commandValidator validates a roll by running a command, which must exit with status 0. The command is
+// split on whitespace and run directly, not via a shell.
+type commandValidator struct {
+	command string
+	timeout time.Duration
+}
+
+func (c *commandValidator) validate(asgs []string) error {
+	args := strings.Fields(c.command)
+	if len(args) == 0 {
+		return fmt.Errorf("empty validation command")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("ROLLER_ASG=%s", strings.Join(asgs, ",")))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("command '%s' failed: %v: %s", c.command, err, out)
+	}
+	return nil
+}
+
+// getPostRollValidator returns the validator configured, if any
+func getPostRollValidator(configs Configs) postRollValidator {
+	switch {
+	case configs.PostRollWebhook != "":
+		return &webhookValidator{url: configs.PostRollWebhook, client: &http.Client{Timeout: configs.PostRollTimeout}}
+	case configs.PostRollCommand != "":
+		return &commandValidator{command: configs.PostRollCommand, timeout: configs.PostRollTimeout}
+	}
+	return nil
+}
+
+// validateRoll runs the post-roll validation, if there is one
+func validateRoll(configs Configs, validator postRollValidator) error {
+	if validator == nil {
+		return nil
+	}
+	log.Printf("running post-roll validation")
+	if err := validator.validate(configs.ASGS); err != nil {
+		log.Printf("ERROR: ***** POST-ROLL VALIDATION FAILED ***** all ASGs were rolled, but validation failed: %v", err)
+		return fmt.Errorf("post-roll validation failed: %v", err)
+	}
+	log.Printf("post-roll validation passed")
+	return nil
+}
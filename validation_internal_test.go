@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testValidator struct {
+	err   error
+	calls [][]string
+}
+
+func (v *testValidator) validate(asgs []string) error {
+	v.calls = append(v.calls, asgs)
+	return v.err
+}
+
+func TestWebhookValidator(t *testing.T) {
+	tests := []struct {
+		status int
+		err    error
+	}{
+		{http.StatusOK, nil},
+		{http.StatusNoContent, nil},
+		{http.StatusInternalServerError, fmt.Errorf("webhook")},
+	}
+	for _, tt := range tests {
+		var body map[string]interface{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Errorf("unable to decode webhook body: %v", err)
+			}
+			w.WriteHeader(tt.status)
+		}))
+		v := &webhookValidator{url: server.URL, client: server.Client()}
+		err := v.validate([]string{"asg1", "asg2"})
+		server.Close()
+		if (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())) {
+			t.Errorf("status %d: mismatched errors, actual %v expected %v", tt.status, err, tt.err)
+		}
+		if body["event"] != "roll-complete" || fmt.Sprintf("%v", body["asgs"]) != "[asg1 asg2]" {
+			t.Errorf("status %d: unexpected webhook body %v", tt.status, body)
+		}
+	}
+}
+
+func TestCommandValidator(t *testing.T) {
+	// the test binary is a command that is always available, even with no PATH, and that runs no tests
+	// successfully and fails on an unknown flag
+	tests := []struct {
+		command string
+		err     error
+	}{
+		{fmt.Sprintf("%s -test.run=^$", os.Args[0]), nil},
+		{fmt.Sprintf("%s -test.unknown", os.Args[0]), fmt.Errorf("command '%s -test.unknown' failed", os.Args[0])},
+		{"", fmt.Errorf("empty validation command")},
+	}
+	for _, tt := range tests {
+		v := &commandValidator{command: tt.command, timeout: time.Minute}
+		err := v.validate([]string{"asg1"})
+		if (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())) {
+			t.Errorf("command '%s': mismatched errors, actual %v expected %v", tt.command, err, tt.err)
+		}
+	}
+}
+
+func TestValidateRoll(t *testing.T) {
+	tests := []struct {
+		desc      string
+		validator *testValidator
+		err       error
+	}{
+		{"no validation", nil, nil},
+		{"validation passes", &testValidator{}, nil},
+		{"validation fails", &testValidator{err: fmt.Errorf("smoke tests failed")}, fmt.Errorf("post-roll validation failed: smoke tests failed")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			configs := Configs{ASGS: []string{"asg1", "asg2"}}
+			var validator postRollValidator
+			if tt.validator != nil {
+				validator = tt.validator
+			}
+			err := validateRoll(configs, validator)
+			if (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && err.Error() != tt.err.Error()) {
+				t.Errorf("mismatched errors, actual %v expected %v", err, tt.err)
+			}
+			if tt.validator == nil {
+				return
+			}
+			if len(tt.validator.calls) != 1 || !testStringEq(tt.validator.calls[0], configs.ASGS) {
+				t.Errorf("expected a single validation of %v, had %v", configs.ASGS, tt.validator.calls)
+			}
+		})
+	}
+}
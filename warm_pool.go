@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// awsDescribeWarmPool returns the instances in the warm pool of the ASG, none if it has no warm pool
+func awsDescribeWarmPool(svc asgClient, asg *autoscaling.Group) ([]*autoscaling.Instance, error) {
+	instances := make([]*autoscaling.Instance, 0)
+	input := &autoscaling.DescribeWarmPoolInput{AutoScalingGroupName: asg.AutoScalingGroupName}
+	for {
+		out, err := svc.DescribeWarmPool(input)
+		if err != nil {
+			return nil, fmt.Errorf("unable to describe warm pool of ASG %s: %v", *asg.AutoScalingGroupName, err)
+		}
+		instances = append(instances, out.Instances...)
+		if aws.StringValue(out.NextToken) == "" {
+			return instances, nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
+// groupWarmPool returns the instances in the warm pool of the ASG that are old, as determined by
+// groupInstances for the instances in service. Warm pool instances are stopped, hibernated or running, and
+// are put in service as they are when the ASG scales out, so an old one brings back the old config.
+// Instances already on their way out of the warm pool are left out.
+func groupWarmPool(asg *autoscaling.Group, ec2Svc ec2Client, asgSvc asgClient, templates *launchTemplateCache, configs Configs) ([]*autoscaling.Instance, error) {
+	described, err := awsDescribeWarmPool(asgSvc, asg)
+	if err != nil {
+		return nil, err
+	}
+	instances := make([]*autoscaling.Instance, 0)
+	for _, i := range described {
+		switch aws.StringValue(i.LifecycleState) {
+		case autoscaling.LifecycleStateWarmedTerminating, autoscaling.LifecycleStateWarmedTerminatingWait, autoscaling.LifecycleStateWarmedTerminatingProceed, autoscaling.LifecycleStateWarmedTerminated:
+			continue
+		}
+		instances = append(instances, i)
+	}
+	if len(instances) == 0 {
+		return nil, nil
+	}
+	pool := *asg
+	pool.Instances = instances
+	oldInstances, _, err := groupInstances(&pool, ec2Svc, asgSvc, templates, configs.CompareLaunchConfigs, configs.SkipWithoutLaunch, configs.MissingLTVersions, configs.Verbose)
+	if err != nil {
+		return nil, fmt.Errorf("unable to group warm pool instances into new and old: %v", err)
+	}
+	return oldInstances, nil
+}
+
+// terminateWarmPool terminates the old instances in the warm pool of the ASG, all at once, as they are not in
+// service, so nothing runs on them. The ASG replaces them in the warm pool with instances of its current
+// config.
+func terminateWarmPool(ec2Svc ec2Client, asg *autoscaling.Group, ids []string, dryRun bool) error {
+	if dryRun {
+		log.Printf("dry run: would terminate old warm pool instances %v of ASG %s", ids, *asg.AutoScalingGroupName)
+		return nil
+	}
+	log.Printf("[%s] terminating old warm pool instances %v\n", *asg.AutoScalingGroupName, ids)
+	return awsTerminateInstances(ec2Svc, ids)
+}
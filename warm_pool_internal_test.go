@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestAwsDescribeWarmPool(t *testing.T) {
+	name := "myasg"
+	asgSvc := &mockAsgSvc{warmPools: map[string][]*autoscaling.Instance{
+		name: {{InstanceId: aws.String("1")}, {InstanceId: aws.String("2")}, {InstanceId: aws.String("3")}},
+	}, warmPoolPageSize: 2}
+	instances, err := awsDescribeWarmPool(asgSvc, &autoscaling.Group{AutoScalingGroupName: &name})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ids := mapInstancesIds(instances); !testStringEq(ids, []string{"1", "2", "3"}) {
+		t.Errorf("mismatched warm pool instances, actual %v expected %v", ids, []string{"1", "2", "3"})
+	}
+	if calls := asgSvc.counter.filterByName("DescribeWarmPool"); len(calls) != 2 {
+		t.Errorf("mismatched calls for the pages of the warm pool, actual %d expected 2", len(calls))
+	}
+
+	asgSvc = &mockAsgSvc{err: fmt.Errorf("unavailable")}
+	if _, err := awsDescribeWarmPool(asgSvc, &autoscaling.Group{AutoScalingGroupName: &name}); err == nil {
+		t.Errorf("expected error, had none")
+	}
+}
+
+func TestGroupWarmPoolLaunchTemplate(t *testing.T) {
+	name := "myasg"
+	ltID := "67890"
+	asg := &autoscaling.Group{
+		AutoScalingGroupName: &name,
+		LaunchTemplate:       &autoscaling.LaunchTemplateSpecification{LaunchTemplateId: &ltID, Version: aws.String("$Latest")},
+	}
+	asgSvc := &mockAsgSvc{warmPools: map[string][]*autoscaling.Instance{
+		name: {
+			{InstanceId: aws.String("old"), LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateId: &ltID, Version: aws.String("9")}, LifecycleState: aws.String(autoscaling.LifecycleStateWarmedStopped)},
+			{InstanceId: aws.String("other"), LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateId: aws.String("12345"), Version: aws.String("10")}, LifecycleState: aws.String(autoscaling.LifecycleStateWarmedStopped)},
+			{InstanceId: aws.String("new"), LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateId: &ltID, Version: aws.String("10")}, LifecycleState: aws.String(autoscaling.LifecycleStateWarmedStopped)},
+			// already on its way out, so left alone
+			{InstanceId: aws.String("going"), LaunchTemplate: &autoscaling.LaunchTemplateSpecification{LaunchTemplateId: &ltID, Version: aws.String("9")}, LifecycleState: aws.String(autoscaling.LifecycleStateWarmedTerminating)},
+		},
+	}}
+	oldInstances, err := groupWarmPool(asg, &mockEc2Svc{autodescribe: true}, asgSvc, nil, Configs{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ids := mapInstancesIds(oldInstances); !testStringEq(ids, []string{"old", "other"}) {
+		t.Errorf("mismatched old warm pool instances, actual %v expected %v", ids, []string{"old", "other"})
+	}
+}
+
+func TestAdjustWarmPool(t *testing.T) {
+	tests := []struct {
+		desc       string
+		include    bool
+		dryRun     bool
+		described  int
+		terminated []string
+	}{
+		{"warm pool left alone", false, false, 0, []string{}},
+		{"warm pool included", true, false, 1, []string{"w1"}},
+		{"warm pool included dry run", true, true, 1, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// the instances in service are all new, but the warm pool still has an old instance
+			name := "myasg"
+			lcName := "lconfig"
+			oldLcName := "oldlconfig"
+			myHealthy := healthy
+			asgSvc := &mockAsgSvc{
+				groups: map[string]*autoscaling.Group{
+					name: {
+						AutoScalingGroupName:    &name,
+						DesiredCapacity:         aws.Int64(2),
+						MaxSize:                 aws.Int64(3),
+						LaunchConfigurationName: &lcName,
+						Instances: []*autoscaling.Instance{
+							{InstanceId: aws.String("1"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+							{InstanceId: aws.String("2"), LaunchConfigurationName: &lcName, HealthStatus: &myHealthy},
+						},
+					},
+				},
+				warmPools: map[string][]*autoscaling.Instance{
+					name: {
+						{InstanceId: aws.String("w1"), LaunchConfigurationName: &oldLcName, LifecycleState: aws.String(autoscaling.LifecycleStateWarmedStopped)},
+						{InstanceId: aws.String("w2"), LaunchConfigurationName: &lcName, LifecycleState: aws.String(autoscaling.LifecycleStateWarmedStopped)},
+					},
+				},
+			}
+			ec2Svc := &mockEc2Svc{autodescribe: true}
+			state := newRollerState()
+			configs := Configs{
+				KubernetesEnabled: kubernetesEnabled,
+				ASGS:              []string{name},
+				InitialSurge:      1,
+				MaxTerminate:      1,
+				MaxSurge:          -1,
+				MaxUnavailable:    -1,
+				IncludeWarmPool:   tt.include,
+				DryRun:            tt.dryRun,
+			}
+			statuses, err := adjust(configs, ec2Svc, asgSvc, nil, nil, nil, nil, nil, nil, state)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			old := 0
+			if tt.include {
+				old = 1
+			}
+			if len(statuses) != 1 || statuses[0].OldWarmPoolInstances != old {
+				t.Errorf("mismatched statuses, actual %v expected %d old warm pool instances", statuses, old)
+			}
+			if calls := asgSvc.counter.filterByName("DescribeWarmPool"); len(calls) != tt.described {
+				t.Errorf("mismatched warm pool descriptions, actual %d expected %d", len(calls), tt.described)
+			}
+			terminated := make([]string, 0)
+			for _, c := range ec2Svc.counter.filterByName("TerminateInstances") {
+				terminated = append(terminated, aws.StringValueSlice(c.params[0].(*ec2.TerminateInstancesInput).InstanceIds)...)
+			}
+			if !testStringEq(terminated, tt.terminated) {
+				t.Errorf("mismatched terminated warm pool instances, actual %v expected %v", terminated, tt.terminated)
+			}
+			// the instances in service are left alone
+			for _, call := range []string{"SetDesiredCapacity", "TerminateInstanceInAutoScalingGroup"} {
+				if calls := asgSvc.counter.filterByName(call); len(calls) != 0 {
+					t.Errorf("unexpected %s calls %d", call, len(calls))
+				}
+			}
+		})
+	}
+}